@@ -7,18 +7,31 @@ import (
 	"fmt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"io"
 	"kv/pkg/client"
+	"kv/pkg/dump"
 	"kv/pkg/watch"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
 var (
-	op        = flag.String("op", "", "[get|put|del|watch]")
-	key       = flag.String("k", "", "key name")
-	val       = flag.String("v", "", "value")
-	watchType = flag.String("t", "", "watch type")
+	op        = flag.String("op", "", "[get|entry|put|create|cas|del|range|prefix|compact|watch|grant|revoke|lease|export|import|incr|decr|append|pushfront|pushback|popfront|popback|counter|sadd|srem|lww|members|add-member|remove-member|transfer|shards]")
+	key       = flag.String("k", "", "key name, the start of a range, the prefix to export, or a cluster member's id")
+	end       = flag.String("e", "", "end of a range")
+	val       = flag.String("v", "", "value, the delta of incr, decr and counter, comma separated elements of sadd and srem, or the gRPC address of a member to add")
+	prev      = flag.String("p", "", "previous value for cas")
+	watchType = flag.String("t", "", "watch type [put|delete|expire|all]")
+	ttl       = flag.Duration("ttl", 0, "time to live for put or grant")
+	leaseID   = flag.Int64("l", 0, "lease to attach a put to, revoke or describe")
+	prefix    = flag.Bool("prefix", false, "watch every key beginning with -k, instead of a single key")
+	revision  = flag.Int64("r", 0, "revision to read at, watch from, compact to, or required by put and del")
+	file      = flag.String("f", "", "file to export to, or import from")
+	readMode  = flag.String("c", "", "consistency of get, entry, range and prefix [linearizable|sequential|stale]")
 )
 
 func main() {
@@ -31,27 +44,202 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
+	consistency, err := client.ConsistencyFromString(*readMode)
+	checkError(err)
+	var staleness client.Staleness
+	readOpts := []client.ReadOption{client.WithConsistency(consistency), client.WithStaleness(&staleness)}
+	reportStaleness := func() {
+		if consistency != client.Linearizable {
+			fmt.Fprintf(os.Stderr, "read may be %d entries and %v behind\n", staleness.Entries, staleness.Since)
+		}
+	}
+
 	switch *op {
 	case "get":
-		value, err := kv.Get(ctx, *key)
+		entry, err := kv.GetEntry(ctx, *key, *revision, readOpts...)
+		checkError(err)
+		reportStaleness()
+		fmt.Printf("%+v\n", entry.Value)
+	case "entry":
+		entry, err := kv.GetEntry(ctx, *key, *revision, readOpts...)
 		checkError(err)
-		fmt.Printf("%+v\n", value)
+		reportStaleness()
+		fmt.Printf("%+v\n", entry)
 	case "put":
-		err := kv.Put(ctx, *key, *val)
+		if *revision > 0 {
+			err = kv.PutIfRevisionEquals(ctx, *key, *val, *revision)
+		} else {
+			err = kv.Put(ctx, *key, *val, client.WithTTL(*ttl), client.WithLease(*leaseID))
+		}
+		checkError(err)
+	case "create":
+		err := kv.PutIfAbsent(ctx, *key, *val)
+		checkError(err)
+	case "cas":
+		err := kv.PutIfValueEquals(ctx, *key, *val, *prev)
 		checkError(err)
 	case "del":
-		err := kv.Delete(ctx, *key)
+		if *revision > 0 {
+			err = kv.DeleteIfRevisionEquals(ctx, *key, *revision)
+		} else {
+			err = kv.Delete(ctx, *key)
+		}
 		checkError(err)
+	case "compact":
+		err := kv.Compact(ctx, *revision)
+		checkError(err)
+	case "range", "prefix":
+		var kvs []client.KeyValue
+		token := ""
+		for {
+			if *op == "range" {
+				kvs, token, err = kv.Range(ctx, *key, *end, 0, token, readOpts...)
+			} else {
+				kvs, token, err = kv.Prefix(ctx, *key, 0, token, readOpts...)
+			}
+			checkError(err)
+			reportStaleness()
+			for _, kv := range kvs {
+				fmt.Printf("%s: %+v\n", kv.Key, kv.Value)
+			}
+			if len(token) == 0 {
+				break
+			}
+		}
 	case "watch":
 		watchType, err := watch.OperationFromString(*watchType)
 		checkError(err)
 
-		ch, err := kv.Watch(context.Background(), *key, watchType)
+		var opts []client.WatchOption
+		if *prefix {
+			opts = append(opts, client.WithPrefix())
+		} else if len(*end) != 0 {
+			opts = append(opts, client.WithRange(*end))
+		}
+		if *revision > 0 {
+			opts = append(opts, client.FromRevision(*revision))
+		}
+		ch, err := kv.Watch(context.Background(), *key, watchType, opts...)
 		checkError(err)
 
 		for update := range ch {
+			checkError(update.Err)
 			log.Printf("%+v", update)
 		}
+	case "grant":
+		id, err := leases(kv).LeaseGrant(ctx, *ttl)
+		checkError(err)
+		fmt.Println(id)
+	case "revoke":
+		err := leases(kv).LeaseRevoke(ctx, *leaseID)
+		checkError(err)
+	case "lease":
+		info, err := leases(kv).LeaseTimeToLive(ctx, *leaseID)
+		checkError(err)
+		fmt.Printf("%+v\n", info)
+	case "export":
+		t := transfers(kv)
+		f, err := os.Create(*file)
+		checkError(err)
+		w, err := dump.NewWriter(f)
+		checkError(err)
+
+		rev, err := t.Export(context.Background(), *key, func(kv client.KeyValue) error {
+			return w.Write(kv.Key, kv.Value)
+		})
+		checkError(err)
+		checkError(w.Finish(rev))
+		checkError(f.Close())
+		fmt.Printf("exported %d keys at revision %d\n", w.Count(), rev)
+	case "import":
+		t := transfers(kv)
+		f, err := os.Open(*file)
+		checkError(err)
+		defer f.Close()
+
+		// check the whole file before storing any of it
+		_, _, err = dump.Verify(f)
+		checkError(err)
+		_, err = f.Seek(0, io.SeekStart)
+		checkError(err)
+		r, err := dump.NewReader(f)
+		checkError(err)
+
+		count, err := t.Import(context.Background(), func() (client.KeyValue, error) {
+			key, value, err := r.Next()
+			return client.KeyValue{Key: key, Value: value}, err
+		})
+		checkError(err)
+		fmt.Printf("imported %d keys\n", count)
+	case "incr", "decr":
+		f := kv.Increment
+		if *op == "decr" {
+			f = kv.Decrement
+		}
+		v, err := f(ctx, *key, number(*val))
+		checkError(err)
+		fmt.Printf("%+v\n", v)
+	case "append", "pushfront", "pushback":
+		f := map[string]func(context.Context, string, interface{}) (interface{}, error){
+			"append":    kv.Append,
+			"pushfront": kv.PushFront,
+			"pushback":  kv.PushBack,
+		}[*op]
+		v, err := f(ctx, *key, *val)
+		checkError(err)
+		fmt.Printf("%+v\n", v)
+	case "popfront", "popback":
+		v, err := kv.Pop(ctx, *key, *op == "popfront")
+		checkError(err)
+		fmt.Printf("%+v\n", v)
+	case "counter":
+		delta, err := strconv.ParseInt(*val, 10, 64)
+		checkError(err)
+		n, err := crdts(kv).IncrementCounter(ctx, *key, delta)
+		checkError(err)
+		fmt.Println(n)
+	case "sadd", "srem":
+		f := crdts(kv).SetAdd
+		if *op == "srem" {
+			f = crdts(kv).SetRemove
+		}
+		elements, err := f(ctx, *key, strings.Split(*val, ",")...)
+		checkError(err)
+		fmt.Println(strings.Join(elements, ","))
+	case "lww":
+		v, err := crdts(kv).SetRegister(ctx, *key, *val)
+		checkError(err)
+		fmt.Printf("%+v\n", v)
+	case "members":
+		info, err := cluster(kv).Members(ctx)
+		checkError(err)
+		fmt.Printf("node %s, leader %s, term %d, commit %d, applied %d\n", info.ID, info.Leader, info.Term, info.Commit,
+			info.Applied)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tADDRESS\tROLE\tMATCH\tLAG")
+		for _, m := range info.Members {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", m.ID, m.Address, m.Role, m.Match, m.Lag)
+		}
+		checkError(w.Flush())
+	case "add-member":
+		err := cluster(kv).AddMember(ctx, *key, *val)
+		checkError(err)
+	case "remove-member":
+		err := cluster(kv).RemoveMember(ctx, *key)
+		checkError(err)
+	case "transfer":
+		err := cluster(kv).TransferLeadership(ctx, *key)
+		checkError(err)
+	case "shards":
+		m, err := kv.(client.Shards).ShardMap(ctx)
+		checkError(err)
+		fmt.Printf("version %d, %d slots\n", m.Version, m.Slots)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tADDRESS\tHTTP ADDRESS\tSLOTS")
+		for _, s := range m.Shards {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d-%d\n", s.ID, s.Address, s.HTTPAddress, s.Start, s.End-1)
+		}
+		checkError(w.Flush())
 	default:
 		fmt.Fprintf(os.Stderr, "error parsing command line\n")
 		os.Exit(1)
@@ -60,6 +248,18 @@ func main() {
 	os.Exit(0)
 }
 
+// number parses the delta of incr and decr, which is 1 when it's empty.
+func number(s string) interface{} {
+	if s == "" {
+		return nil
+	} else if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	checkError(err)
+	return f
+}
+
 func checkError(err error) {
 	if err == nil {
 		return
@@ -68,26 +268,78 @@ func checkError(err error) {
 	os.Exit(1)
 }
 
+func leases(kv client.KV) client.Leases {
+	l, ok := kv.(client.Leases)
+	if !ok {
+		checkError(errors.New("leases need the grpc transport"))
+	}
+	return l
+}
+
+func transfers(kv client.KV) client.Transfers {
+	t, ok := kv.(client.Transfers)
+	if !ok {
+		checkError(errors.New("export and import need the grpc transport"))
+	}
+	return t
+}
+
+func crdts(kv client.KV) client.CRDTs {
+	c, ok := kv.(client.CRDTs)
+	if !ok {
+		checkError(errors.New("this transport doesn't support CRDTs"))
+	}
+	return c
+}
+
+func cluster(kv client.KV) client.Cluster {
+	c, ok := kv.(client.Cluster)
+	if !ok {
+		checkError(errors.New("cluster commands need the grpc transport"))
+	}
+	return c
+}
+
+// configureTransport connects with KV_TRANSPORT, which is grpc or rest, to the server at KV_GRPC_ADDR or KV_HTTP_ADDR.
+// With KV_SHARDED=true that server is one shard of a sharded store, and requests are sent to each key's shard.
 func configureTransport() (client.KV, func(), error) {
 	name := os.Getenv("KV_TRANSPORT")
-	var kv client.KV
-	cancel := func() {}
-	var err error
-
-	if name == "rest" {
-		kv = client.NewRest("127.0.0.1:2500")
-	} else if len(name) == 0 || name == "grpc" {
-		conn, err := grpc.NewClient("127.0.0.1:2000", grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			log.Fatalf("did not connect: %v", err)
-		}
-		cancel = func() {
+	var conns []*grpc.ClientConn
+	cancel := func() {
+		for _, conn := range conns {
 			conn.Close()
 		}
-		kv = client.NewGRPC(conn)
-	} else {
-		err = errors.New("unknown transport: " + name)
 	}
+	dial := func(grpcAddress, httpAddress string) (client.KV, error) {
+		if name == "rest" {
+			return client.NewRest(httpAddress), nil
+		} else if len(name) == 0 || name == "grpc" {
+			conn, err := grpc.NewClient(grpcAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				return nil, err
+			}
+			conns = append(conns, conn)
+			return client.NewGRPC(conn), nil
+		}
+		return nil, errors.New("unknown transport: " + name)
+	}
+
+	kv, err := dial(envOrDefault("KV_GRPC_ADDR", "127.0.0.1:2000"), envOrDefault("KV_HTTP_ADDR", "127.0.0.1:2500"))
+	if err != nil || os.Getenv("KV_SHARDED") != "true" {
+		return kv, cancel, err
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	kv, err = client.NewSharded(ctx, kv.(client.Shards), func(s client.ShardInfo) (client.KV, error) {
+		return dial(s.Address, s.HTTPAddress)
+	})
 	return kv, cancel, err
+}
 
+func envOrDefault(name, value string) string {
+	if env, exists := os.LookupEnv(name); exists {
+		return env
+	}
+	return value
 }
@@ -2,21 +2,48 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 	"kv/cmd/server/rest"
 	"kv/cmd/server/rpc"
+	"kv/internal/antientropy"
 	"kv/internal/gen"
+	"kv/internal/raft"
+	"kv/internal/shard"
 	"kv/internal/store"
+	"kv/internal/store/follower"
+	"kv/internal/store/lease"
 	"kv/internal/store/multilock"
+	"kv/internal/store/replicated"
 	"kv/internal/store/singlelock"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/snapshot"
+	"kv/internal/store/syncmap"
+	"kv/internal/store/wal"
 	"kv/internal/store/watch"
+	"kv/pkg/crdt"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSnapshotInterval = 10 * time.Minute
+	snapshotsRetained       = 3
+	reapInterval            = time.Second
+	defaultBuckets          = 10
+	defaultSyncInterval     = 10 * time.Second
 )
 
 func main() {
@@ -25,31 +52,115 @@ func main() {
 	signal.Notify(sigChan, os.Interrupt)
 
 	configureLogging()
-	kvService := multilock.New(10, watchingKV, multilock.SimpleHashFunc)
-	go runGrpc(kvService, done, "127.0.0.1:2000")
-	go runHttp(kvService, done, "127.0.0.1:2500")
+	grpcAddress := envOrDefault("KV_GRPC_ADDR", "127.0.0.1:2000")
+	httpAddress := envOrDefault("KV_HTTP_ADDR", "127.0.0.1:2500")
+
+	// the node names this server in the CRDT changes it merges, so it must be unique to it
+	nodeID := envOrDefault("KV_NODE_ID", crdt.NewNode())
+
+	var kvService store.WatchableKVStore
+	var snapshots *snapshot.Manager
+	var node *raft.Node
+	var closeStore func()
+	var replica *antientropy.Store
+	var follow *follower.Store
+	var buckets atomic.Pointer[multilock.MultiKVStore]
+	newBuckets := configureBuckets(&buckets)
+	local := func() store.KVStore { return kvService }
+	if id, exists := os.LookupEnv("KV_RAFT_ID"); exists {
+		var replicatedKV *replicated.Store
+		replicatedKV, closeStore = configureRaft(id, newBuckets)
+		kvService, node = replicatedKV, replicatedKV.Node()
+		local = func() store.KVStore { return replicatedKV.Local() }
+	} else if leader, exists := os.LookupEnv("KV_LEADER"); exists {
+		var watched store.WatchableKVStore
+		follow, watched = configureFollower(leader, newBuckets, done)
+		kvService, closeStore = follow, func() {}
+		local = func() store.KVStore { return watched }
+		expvar.Publish("follower", expvar.Func(func() any { return follow.Status() }))
+	} else {
+		revision := store.NewRevision()
+		kv := newBuckets(revision)
+		var durableKV store.KVStore
+		durableKV, snapshots, closeStore = configureStore(kv, revision, done)
+
+		// watchers sit above the buckets so they can see a transaction's updates as a group
+		kvService = watch.Wrap(durableKV, configureWatch()...)
+		replica = configureAntiEntropy(kvService, done)
+		if replica != nil {
+			kvService = replica
+		}
+	}
+	sharded := configureShards(kvService)
+	if sharded != nil {
+		kvService = sharded
+	}
+	if _, ok := local().(*watch.KVStoreWatcher); ok {
+		expvar.Publish("watch", expvar.Func(func() any { return local().(*watch.KVStoreWatcher).Metrics() }))
+	}
+	if replica != nil {
+		expvar.Publish("antientropy", expvar.Func(func() any { return replica.Metrics() }))
+	}
+	// a follower can't write, its keys expire and its leases are revoked when the leader's updates arrive
+	if follow == nil {
+		go store.RunReaper(kvService, reapInterval, done)
+	}
+
+	// leases aren't durable, so the ones keys were attached to before a restart are recreated to be kept alive again.
+	// They aren't replicated either, so a raft cluster refuses them rather than losing them when the leader changes.
+	leases := lease.Disabled(lease.ErrReplicated)
+	if follow != nil {
+		leases = lease.Disabled(&follower.ReadOnlyError{Leader: follow.Leader()})
+	} else if node == nil {
+		leases = lease.New(kvService)
+		leases.Recover()
+		go leases.Run(reapInterval, done)
+	}
+
+	go runGrpc(kvService, leases, snapshots, node, sharded, replica, follow, done, grpcAddress, nodeID)
+	go runHttp(kvService, leases, snapshots, node, sharded, follow, buckets.Load, done, httpAddress, nodeID)
 
 	select {
 	case <-sigChan:
 		close(done)
+		closeStore()
 		os.Exit(1)
 	}
 }
 
-func watchingKV() store.KVStore {
-	return watch.New(singlelock.New())
-}
-
-func runGrpc(kv store.KVStore, done chan struct{}, address string) {
+func runGrpc(kv store.KVStore, leases *lease.Lessor, snapshots *snapshot.Manager, node *raft.Node,
+	sharded *shard.Store, replica *antientropy.Store, follow *follower.Store, done chan struct{}, address, nodeID string) {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer listener.Close()
 
-	handlers := rpc.New(kv)
-	grpcServer := grpc.NewServer()
+	handlers := rpc.New(kv, leases, rpc.WithNode(nodeID))
+	var opts []grpc.ServerOption
+	if node != nil {
+		// raft snapshots are sent in one message
+		opts = append(opts, grpc.MaxRecvMsgSize(math.MaxInt32))
+	}
+	grpcServer := grpc.NewServer(opts...)
 	gen.RegisterKVServer(grpcServer, handlers)
+	if follow == nil {
+		// a follower's keys aren't attached to leases, the leader's are
+		gen.RegisterLeaseServer(grpcServer, rpc.NewLease(leases))
+	}
+	if snapshots != nil {
+		gen.RegisterAdminServer(grpcServer, rpc.NewAdmin(snapshots))
+	}
+	if node != nil {
+		gen.RegisterRaftServer(grpcServer, rpc.NewRaft(node))
+		gen.RegisterClusterServer(grpcServer, rpc.NewCluster(node))
+	}
+	if sharded != nil {
+		gen.RegisterShardsServer(grpcServer, rpc.NewShards(sharded.Map()))
+	}
+	if replica != nil {
+		gen.RegisterAntiEntropyServer(grpcServer, rpc.NewAntiEntropy(replica))
+	}
 
 	errChan := make(chan error)
 	go func() {
@@ -64,7 +175,9 @@ func runGrpc(kv store.KVStore, done chan struct{}, address string) {
 	}
 }
 
-func runHttp(kv store.KVStore, done chan struct{}, address string) {
+func runHttp(kv store.KVStore, leases *lease.Lessor, snapshots *snapshot.Manager, node *raft.Node,
+	sharded *shard.Store, follow *follower.Store, buckets func() *multilock.MultiKVStore, done chan struct{},
+	address, nodeID string) {
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatal(err)
@@ -72,12 +185,50 @@ func runHttp(kv store.KVStore, done chan struct{}, address string) {
 	}
 	defer listener.Close()
 
-	h := rest.New(kv)
-	http.HandleFunc("POST /kv/", h.Put)
+	// a follower sends writes, and anything to do with leases, to its leader
+	write := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if follow != nil && follow.Leader().HTTPAddress != "" {
+		redirect := rest.Redirect(follow.Leader().HTTPAddress)
+		write = func(http.HandlerFunc) http.HandlerFunc { return redirect }
+	}
+
+	h := rest.New(kv, leases, rest.WithNode(nodeID))
+	http.HandleFunc("POST /kv/", write(h.Put))
+	http.HandleFunc("POST /kv/_bulk", write(h.Bulk))
+	http.HandleFunc("GET /kv", h.Range)
 	http.HandleFunc("GET /kv/{key}", h.Get)
-	http.HandleFunc("DELETE /kv/{key}", h.Delete)
+	http.HandleFunc("DELETE /kv/{key}", write(h.Delete))
+	http.HandleFunc("POST /compact", write(h.Compact))
+	http.HandleFunc("POST /txn", write(h.Txn))
+	http.HandleFunc("POST /merge", write(h.Merge))
+	http.HandleFunc("POST /mutate", write(h.Mutate))
 	http.HandleFunc("POST /watch", h.Watch)
 
+	l := rest.NewLease(leases)
+	http.HandleFunc("POST /lease", write(l.Grant))
+	http.HandleFunc("GET /lease/{id}", write(l.TimeToLive))
+	http.HandleFunc("DELETE /lease/{id}", write(l.Revoke))
+	http.HandleFunc("POST /lease/{id}/keepalive", write(l.KeepAlive))
+
+	b := rest.NewBuckets(buckets)
+	http.HandleFunc("GET /admin/buckets", b.Stats)
+	http.HandleFunc("POST /admin/buckets", b.Resize)
+	if snapshots != nil {
+		admin := rest.NewAdmin(snapshots)
+		http.HandleFunc("POST /admin/snapshots", admin.Snapshot)
+		http.HandleFunc("GET /admin/snapshots", admin.ListSnapshots)
+	}
+	if node != nil {
+		cluster := rest.NewCluster(node)
+		http.HandleFunc("GET /admin/cluster", cluster.Members)
+		http.HandleFunc("POST /admin/cluster/members", cluster.AddMember)
+		http.HandleFunc("DELETE /admin/cluster/members/{id}", cluster.RemoveMember)
+		http.HandleFunc("POST /admin/cluster/leader", cluster.TransferLeadership)
+	}
+	if sharded != nil {
+		http.HandleFunc("GET /admin/shards", rest.NewShards(sharded.Map()).ShardMap)
+	}
+
 	errChan := make(chan error)
 	s := &http.Server{}
 	go func() {
@@ -92,6 +243,325 @@ func runHttp(kv store.KVStore, done chan struct{}, address string) {
 	}
 }
 
+// configureStore makes kv durable when KV_DATADIR is set.  The newest snapshot in the directory is restored, then the
+// write ahead log is replayed on top of it.  KV_WALSYNC selects the log's sync mode, and KV_SNAPSHOT_INTERVAL how often
+// snapshots are taken, with 0 disabling periodic snapshots.
+func configureStore(kv store.KVStore, revision *store.Revision, done chan struct{}) (store.KVStore, *snapshot.Manager, func()) {
+	dir, exists := os.LookupEnv("KV_DATADIR")
+	if !exists {
+		return kv, nil, func() {}
+	}
+
+	options := wal.Options{Sync: wal.SyncBatch}
+	if name, exists := os.LookupEnv("KV_WALSYNC"); exists {
+		mode, err := wal.SyncModeFromString(name)
+		if err != nil {
+			log.Fatal("unable to parse KV_WALSYNC", err)
+		}
+		options.Sync = mode
+	}
+
+	interval := defaultSnapshotInterval
+	if env, exists := os.LookupEnv("KV_SNAPSHOT_INTERVAL"); exists {
+		var err error
+		interval, err = time.ParseDuration(env)
+		if err != nil {
+			log.Fatal("unable to parse KV_SNAPSHOT_INTERVAL", err)
+		}
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		log.Fatal("unable to create data directory", err)
+	}
+
+	restored, err := snapshot.Restore(dir, kv)
+	if err != nil {
+		log.Fatal("unable to restore snapshot", err)
+	}
+	revision.Restore(restored.Revision)
+	options.Applied = restored.Index
+
+	logStore, err := wal.New(dir, kv, options)
+	if err != nil {
+		log.Fatal("unable to open write ahead log", err)
+	}
+
+	snapshots := snapshot.New(dir, logStore, snapshotsRetained)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if interval > 0 {
+			snapshots.Run(interval, done)
+		}
+	}()
+
+	closeFunc := func() {
+		<-stopped
+		if err := logStore.Close(); err != nil {
+			slog.Error("closing write ahead log failed", "err", err)
+		}
+	}
+	return logStore, snapshots, closeFunc
+}
+
+// configureRaft replicates the store with raft, as the node KV_RAFT_ID of the cluster in KV_RAFT_PEERS.  The peers are
+// a comma separated list of id=address, where the address is the node's gRPC address.  A node started with
+// KV_RAFT_JOIN=true waits to be added to a running cluster instead of creating one, and reaches the cluster's current
+// members through KV_RAFT_PEERS.  The raft log and snapshots are kept under KV_DATADIR when it's set, and in memory
+// otherwise.  KV_RAFT_LEASE_READS=true lets the leader serve linearizable reads from its lease, rather than confirming
+// it's still the leader for each one.
+func configureRaft(id string, newBuckets func(*store.Revision) *multilock.MultiKVStore) (*replicated.Store, func()) {
+	peers, err := parsePeers(os.Getenv("KV_RAFT_PEERS"))
+	if err != nil {
+		log.Fatal("unable to parse KV_RAFT_PEERS", err)
+	}
+	join := envBool("KV_RAFT_JOIN")
+	leaseReads := envBool("KV_RAFT_LEASE_READS")
+
+	var storage raft.Storage = raft.NewMemoryStorage()
+	closeStorage := func() {}
+	if dir, exists := os.LookupEnv("KV_DATADIR"); exists {
+		fileStorage, err := raft.NewFileStorage(filepath.Join(dir, "raft"))
+		if err != nil {
+			log.Fatal("unable to open raft storage", err)
+		}
+		storage, closeStorage = fileStorage, func() { fileStorage.Close() }
+	}
+
+	newStore := func(revision *store.Revision) store.WatchableKVStore {
+		return watch.Wrap(newBuckets(revision), configureWatch()...)
+	}
+	transport := raft.NewGRPCTransport()
+	kv, err := replicated.New(newStore, raft.Options{
+		ID:         id,
+		Peers:      peers,
+		Join:       join,
+		Storage:    storage,
+		Transport:  transport,
+		LeaseReads: leaseReads,
+	})
+	if err != nil {
+		log.Fatal("unable to start raft", err)
+	}
+
+	closeFunc := func() {
+		kv.Close()
+		transport.Close()
+		closeStorage()
+	}
+	return kv, closeFunc
+}
+
+func parsePeers(env string) ([]raft.Member, error) {
+	var peers []raft.Member
+	for _, peer := range strings.Split(env, ",") {
+		id, address, found := strings.Cut(strings.TrimSpace(peer), "=")
+		if !found || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid peer [%s], expected id=address", peer)
+		}
+		peers = append(peers, raft.Member{ID: id, Address: address})
+	}
+	return peers, nil
+}
+
+// configureShards makes the server the shard KV_SHARD_ID of a sharded store, returning nil when KV_SHARD_ID isn't set.
+// KV_SHARDS lists every shard as a comma separated list of id=grpcAddress|httpAddress, and the hash slots are divided
+// evenly between them in that order, so every server must be given the same list.
+func configureShards(kv store.WatchableKVStore) *shard.Store {
+	id, exists := os.LookupEnv("KV_SHARD_ID")
+	if !exists {
+		return nil
+	}
+	shards, err := parseShards(os.Getenv("KV_SHARDS"))
+	if err != nil {
+		log.Fatal("unable to parse KV_SHARDS", err)
+	}
+	m, err := shard.Divide(shards)
+	if err != nil {
+		log.Fatal("invalid KV_SHARDS", err)
+	}
+	sharded, err := shard.Wrap(kv, m, id)
+	if err != nil {
+		log.Fatal("invalid KV_SHARD_ID", err)
+	}
+	return sharded
+}
+
+func parseShards(env string) ([]shard.Shard, error) {
+	var shards []shard.Shard
+	for _, s := range strings.Split(env, ",") {
+		id, addresses, found := strings.Cut(strings.TrimSpace(s), "=")
+		address, httpAddress, _ := strings.Cut(addresses, "|")
+		if !found || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid shard [%s], expected id=grpcAddress|httpAddress", s)
+		}
+		shards = append(shards, shard.Shard{ID: id, Address: address, HTTPAddress: httpAddress})
+	}
+	return shards, nil
+}
+
+// configureFollower makes the server a read only follower of the leader in KV_LEADER, given as grpcAddress|httpAddress.
+// The follower's copy is kept in memory, and copied from the leader when the server starts.  It returns the follower,
+// and the copy it applies the leader's changes to.
+func configureFollower(leader string, newBuckets func(*store.Revision) *multilock.MultiKVStore,
+	done chan struct{}) (*follower.Store, store.WatchableKVStore) {
+	address, httpAddress, _ := strings.Cut(leader, "|")
+	if address == "" {
+		log.Fatal("invalid KV_LEADER, expected grpcAddress|httpAddress")
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal("invalid KV_LEADER", err)
+	}
+
+	revision := store.NewRevision()
+	kv := watch.Wrap(newBuckets(revision), configureWatch()...)
+	follow := follower.New(kv, revision, follower.Leader{Address: address, HTTPAddress: httpAddress}, conn)
+	go follow.Run(done)
+	return follow, kv
+}
+
+// configureAntiEntropy makes the store a replica which accepts writes itself, and syncs with the other replicas in the
+// background, when KV_SYNC_PEERS lists their gRPC addresses.  It returns nil when KV_SYNC_PEERS isn't set.
+// KV_SYNC_INTERVAL sets how often it syncs, and KV_TOMBSTONE_TTL how long deletes are remembered.
+func configureAntiEntropy(kv store.WatchableKVStore, done chan struct{}) *antientropy.Store {
+	env, exists := os.LookupEnv("KV_SYNC_PEERS")
+	if !exists {
+		return nil
+	}
+
+	interval := defaultSyncInterval
+	if env, exists := os.LookupEnv("KV_SYNC_INTERVAL"); exists {
+		var err error
+		interval, err = time.ParseDuration(env)
+		if err != nil || interval <= 0 {
+			log.Fatal("unable to parse KV_SYNC_INTERVAL", err)
+		}
+	}
+	var opts []antientropy.Option
+	if env, exists := os.LookupEnv("KV_TOMBSTONE_TTL"); exists {
+		ttl, err := time.ParseDuration(env)
+		if err != nil {
+			log.Fatal("unable to parse KV_TOMBSTONE_TTL", err)
+		}
+		opts = append(opts, antientropy.WithTombstoneTTL(ttl))
+	}
+
+	var peers []antientropy.Peer
+	for _, address := range strings.Split(env, ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatal("invalid KV_SYNC_PEERS", err)
+		}
+		peers = append(peers, antientropy.NewGRPCPeer(conn))
+	}
+
+	replica := antientropy.Wrap(kv, opts...)
+	go replica.Run(peers, interval, done)
+	return replica
+}
+
+// envBool parses the environment variable name as a bool, which is false when it isn't set.
+func envBool(name string) bool {
+	env, exists := os.LookupEnv(name)
+	if !exists {
+		return false
+	}
+	value, err := strconv.ParseBool(env)
+	if err != nil {
+		log.Fatal("unable to parse "+name, err)
+	}
+	return value
+}
+
+func envOrDefault(name, value string) string {
+	if env, exists := os.LookupEnv(name); exists {
+		return env
+	}
+	return value
+}
+
+// configureBuckets returns a func which divides a store between buckets made by configureBackend.  KV_BUCKETS sets how
+// many, 10 by default, and KV_HASH how keys are spread across them: jump (the default), ring, xxhash, fnv or simple.
+// The latest store made is kept in current, as a replicated store makes a new one whenever it's rebuilt from a snapshot.
+func configureBuckets(current *atomic.Pointer[multilock.MultiKVStore]) func(*store.Revision) *multilock.MultiKVStore {
+	count := defaultBuckets
+	if env, exists := os.LookupEnv("KV_BUCKETS"); exists {
+		var err error
+		count, err = strconv.Atoi(env)
+		if err != nil || count <= 0 {
+			log.Fatal("unable to parse KV_BUCKETS", err)
+		}
+	}
+
+	var hasher multilock.HashFunc
+	switch name := envOrDefault("KV_HASH", "jump"); name {
+	case "jump":
+		hasher = multilock.JumpHashFunc
+	case "ring":
+		hasher = multilock.NewRingHashFunc(multilock.DefaultVirtualNodes)
+	case "xxhash":
+		hasher = multilock.XXHashFunc
+	case "fnv":
+		hasher = multilock.FNVHashFunc
+	case "simple":
+		hasher = multilock.SimpleHashFunc
+	default:
+		log.Fatal("unknown KV_HASH: " + name)
+	}
+
+	return func(revision *store.Revision) *multilock.MultiKVStore {
+		kv := multilock.New(count, configureBackend(revision), hasher)
+		current.Store(kv)
+		return kv
+	}
+}
+
+// configureBackend returns a factory for the buckets, chosen by KV_BACKEND: skiplist (the default), singlelock or
+// syncmap.
+func configureBackend(revision *store.Revision) func() store.KVStore {
+	name, exists := os.LookupEnv("KV_BACKEND")
+	if !exists {
+		name = "skiplist"
+	}
+
+	switch name {
+	case "skiplist":
+		return func() store.KVStore { return skiplist.New(store.WithRevision(revision)) }
+	case "singlelock":
+		return func() store.KVStore { return singlelock.New(store.WithRevision(revision)) }
+	case "syncmap":
+		return func() store.KVStore { return syncmap.New(store.WithRevision(revision)) }
+	}
+	log.Fatal("unknown KV_BACKEND: " + name)
+	return nil
+}
+
+// configureWatch reads how far a watcher can fall behind from KV_WATCH_QUEUE, and what happens when it does from
+// KV_WATCH_POLICY.  The watchers' queues are reported at /debug/vars.
+func configureWatch() []watch.Option {
+	var opts []watch.Option
+	if env, exists := os.LookupEnv("KV_WATCH_QUEUE"); exists {
+		size, err := strconv.Atoi(env)
+		if err != nil || size <= 0 {
+			log.Fatal("unable to parse KV_WATCH_QUEUE", err)
+		}
+		opts = append(opts, watch.WithQueueSize(size))
+	}
+	if name, exists := os.LookupEnv("KV_WATCH_POLICY"); exists {
+		policy, err := watch.PolicyFromString(name)
+		if err != nil {
+			log.Fatal("unable to parse KV_WATCH_POLICY", err)
+		}
+		opts = append(opts, watch.WithSlowConsumerPolicy(policy))
+	}
+	return opts
+}
+
 func configureLogging() {
 	env, exists := os.LookupEnv("KV_LOGLEVEL")
 	if !exists {
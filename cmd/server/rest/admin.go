@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"kv/internal/store/snapshot"
+	"kv/pkg/rest"
+	"log/slog"
+	"net/http"
+)
+
+type AdminHandlers struct {
+	snapshots *snapshot.Manager
+}
+
+func NewAdmin(snapshots *snapshot.Manager) *AdminHandlers {
+	return &AdminHandlers{
+		snapshots: snapshots,
+	}
+}
+
+func (h *AdminHandlers) Snapshot(w http.ResponseWriter, _ *http.Request) {
+	info, err := h.snapshots.Take()
+	if err != nil {
+		slog.Error("snapshot", "error", err)
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, convertSnapshotInfo(info))
+}
+
+func (h *AdminHandlers) ListSnapshots(w http.ResponseWriter, _ *http.Request) {
+	snapshots, err := h.snapshots.List()
+	if err != nil {
+		slog.Error("list snapshots", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	doc := rest.ListSnapshotsResponse{Snapshots: make([]rest.SnapshotInfo, 0, len(snapshots))}
+	for _, info := range snapshots {
+		doc.Snapshots = append(doc.Snapshots, convertSnapshotInfo(info))
+	}
+	writeJsonResponse(w, doc)
+}
+
+func convertSnapshotInfo(info snapshot.Info) rest.SnapshotInfo {
+	return rest.SnapshotInfo{
+		Name:    info.Name,
+		Index:   info.Index,
+		Size:    info.Size,
+		Created: info.Created,
+	}
+}
@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+// Bulk handles POST /kv/_bulk.  The response is OK whenever the batch was run, and each item has its own status.
+func (h *Handlers) Bulk(w http.ResponseWriter, r *http.Request) {
+	req := rest.BulkRequest{}
+	err := readJson(w, r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	keys := make([]string, len(req.Items))
+	kvs := make([]store.KeyValue, len(req.Items))
+	for i, item := range req.Items {
+		keys[i] = item.Key
+		kvs[i] = store.KeyValue{Key: item.Key, Value: anyval.Canonical(item.Value)}
+	}
+
+	var results []store.BatchResult
+	switch req.Op {
+	case "get":
+		results, err = store.BatchGet(h.kv, keys, req.Atomic)
+	case "put":
+		results, err = store.BatchPut(h.kv, kvs, req.Atomic)
+	case "delete":
+		results, err = store.BatchDelete(h.kv, keys, req.Atomic)
+	default:
+		err = store.NewError(store.ErrInvalid, "unknown op: "+req.Op)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	doc := rest.BulkResponse{Results: make([]rest.BulkResult, len(results))}
+	for i, result := range results {
+		res := rest.BulkResult{Key: result.Key, Status: http.StatusOK}
+		if result.Err != nil {
+			var code string
+			res.Status, code = classify(result.Err)
+			res.Error = &rest.ErrorResponse{Code: code, Message: result.Err.Error()}
+		} else {
+			res.CreateRevision = result.Entry.CreateRevision
+			res.ModRevision = result.Entry.ModRevision
+			res.Version = result.Entry.Version
+			if req.Op == "get" {
+				res.Value = result.Entry.Value
+			}
+		}
+		doc.Results[i] = res
+	}
+	writeJsonResponse(w, doc)
+}
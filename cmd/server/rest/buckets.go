@@ -0,0 +1,53 @@
+package rest
+
+import (
+	"kv/internal/store/multilock"
+	"kv/pkg/rest"
+	"log/slog"
+	"net/http"
+)
+
+// BucketHandlers describe and resize the buckets a server's keys are divided between.  The buckets are local to the
+// server, even when the store is replicated.
+type BucketHandlers struct {
+	buckets func() *multilock.MultiKVStore
+}
+
+func NewBuckets(buckets func() *multilock.MultiKVStore) *BucketHandlers {
+	return &BucketHandlers{
+		buckets: buckets,
+	}
+}
+
+// Stats handles GET /admin/buckets.
+func (h *BucketHandlers) Stats(w http.ResponseWriter, _ *http.Request) {
+	writeJsonResponse(w, convertBucketStats(h.buckets().Stats()))
+}
+
+// Resize handles POST /admin/buckets, returning once every key is in its new bucket.
+func (h *BucketHandlers) Resize(w http.ResponseWriter, r *http.Request) {
+	req := rest.ResizeRequest{}
+	err := readJson(w, r, &req)
+	if err == nil {
+		err = h.buckets().Resize(req.Buckets)
+	}
+	if err != nil {
+		slog.Error("resize buckets", "buckets", req.Buckets, "error", err)
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, convertBucketStats(h.buckets().Stats()))
+}
+
+func convertBucketStats(stats multilock.Stats) rest.BucketsResponse {
+	doc := rest.BucketsResponse{
+		Buckets:  make([]rest.BucketStats, 0, len(stats.Buckets)),
+		Skew:     stats.Skew,
+		Resizing: stats.Resizing,
+		Target:   stats.Target,
+	}
+	for _, b := range stats.Buckets {
+		doc.Buckets = append(doc.Buckets, rest.BucketStats{Keys: b.Keys, Ops: b.Ops})
+	}
+	return doc
+}
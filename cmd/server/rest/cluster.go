@@ -0,0 +1,84 @@
+package rest
+
+import (
+	"kv/internal/raft"
+	"kv/internal/store"
+	"kv/pkg/rest"
+	"log/slog"
+	"net/http"
+)
+
+// errMemberAddress is returned for a member added without an id or an address.
+var errMemberAddress = store.NewError(store.ErrInvalid, "a new member needs an id and an address")
+
+// ClusterHandlers lists and changes the members of a replicated cluster.
+type ClusterHandlers struct {
+	node *raft.Node
+}
+
+func NewCluster(node *raft.Node) *ClusterHandlers {
+	return &ClusterHandlers{
+		node: node,
+	}
+}
+
+// Members handles GET /admin/cluster, describing the cluster as this node sees it.
+func (h *ClusterHandlers) Members(w http.ResponseWriter, _ *http.Request) {
+	status := h.node.Status()
+	doc := rest.ClusterResponse{
+		ID:      status.ID,
+		Leader:  status.Leader,
+		Term:    status.Term,
+		Commit:  status.Commit,
+		Applied: status.Applied,
+		Members: make([]rest.ClusterMember, 0, len(status.Members)),
+	}
+	for _, m := range status.MemberStatuses() {
+		doc.Members = append(doc.Members, rest.ClusterMember{
+			ID:      m.ID,
+			Address: m.Address,
+			Role:    m.Role.String(),
+			Match:   m.Match,
+			Lag:     m.Lag,
+		})
+	}
+	writeJsonResponse(w, doc)
+}
+
+// AddMember handles POST /admin/cluster/members.
+func (h *ClusterHandlers) AddMember(w http.ResponseWriter, r *http.Request) {
+	member := rest.MemberRequest{}
+	err := readJson(w, r, &member)
+	if err == nil && (len(member.ID) == 0 || len(member.Address) == 0) {
+		err = errMemberAddress
+	}
+	if err == nil {
+		err = h.node.AddMember(r.Context(), raft.Member{ID: member.ID, Address: member.Address})
+	}
+	h.respond(w, "add member", member.ID, err)
+}
+
+// RemoveMember handles DELETE /admin/cluster/members/{id}.
+func (h *ClusterHandlers) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	h.respond(w, "remove member", id, h.node.RemoveMember(r.Context(), id))
+}
+
+// TransferLeadership handles POST /admin/cluster/leader, handing leadership over to the member in the body.
+func (h *ClusterHandlers) TransferLeadership(w http.ResponseWriter, r *http.Request) {
+	member := rest.MemberRequest{}
+	err := readJson(w, r, &member)
+	if err == nil {
+		err = h.node.TransferLeadership(r.Context(), member.ID)
+	}
+	h.respond(w, "transfer leadership", member.ID, err)
+}
+
+func (h *ClusterHandlers) respond(w http.ResponseWriter, op, id string, err error) {
+	if err != nil {
+		slog.Error(op, "id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
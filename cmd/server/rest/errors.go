@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"kv/internal/shard"
+	"kv/internal/store"
+	"kv/internal/store/follower"
+	"kv/pkg/rest"
+	"kv/pkg/watch"
+	"log/slog"
+	"net/http"
+)
+
+// writeError writes the status for err, with an ErrorResponse body saying what kind of error it was.
+func writeError(w http.ResponseWriter, err error) {
+	status, code := classify(err)
+	if status == http.StatusInternalServerError {
+		slog.Error("request failed", "err", err)
+	}
+
+	doc := rest.ErrorResponse{Code: code, Message: err.Error()}
+	var moved *shard.MovedError
+	if errors.As(err, &moved) {
+		owner := convertShard(moved.Owner)
+		doc.Owner = &owner
+	}
+	bytes, merr := json.Marshal(doc)
+	if merr != nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, werr := w.Write(bytes)
+	if werr != nil {
+		slog.Error("failed to write error response", "err", werr)
+	}
+}
+
+func classify(err error) (int, string) {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, rest.CodeNotFound
+	case errors.Is(err, store.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, rest.CodePreconditionFailed
+	case errors.Is(err, store.ErrTooLarge), errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge, rest.CodeTooLarge
+	case errors.Is(err, store.ErrUnavailable), errors.Is(err, watch.ErrSlowConsumer), errors.Is(err, watch.ErrClosed):
+		return http.StatusServiceUnavailable, rest.CodeUnavailable
+	case errors.Is(err, store.ErrInvalid), errors.Is(err, watch.ErrInvalidRequest):
+		return http.StatusBadRequest, rest.CodeInvalid
+	case errors.Is(err, store.ErrTypeMismatch):
+		return http.StatusConflict, rest.CodeTypeMismatch
+	case errors.Is(err, store.ErrCompacted):
+		return http.StatusGone, rest.CodeCompacted
+	case errors.Is(err, store.ErrUnsupported):
+		return http.StatusNotImplemented, rest.CodeUnsupported
+	case errors.Is(err, shard.ErrMoved):
+		return http.StatusMisdirectedRequest, rest.CodeMoved
+	case errors.Is(err, follower.ErrReadOnly):
+		return http.StatusForbidden, rest.CodeReadOnly
+	}
+	return http.StatusInternalServerError, rest.CodeInternal
+}
+
+// invalid marks err as a bad request.
+func invalid(err error) error {
+	return store.NewError(store.ErrInvalid, err.Error())
+}
@@ -0,0 +1,13 @@
+package rest
+
+import (
+	"net/http"
+)
+
+// Redirect sends the requests a follower can't serve to its leader at httpAddress.  It's a 307, so the client repeats
+// the request there with the same method and body.
+func Redirect(httpAddress string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+httpAddress+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
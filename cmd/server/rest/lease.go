@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"kv/internal/store/lease"
+	"kv/pkg/rest"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type LeaseHandlers struct {
+	leases *lease.Lessor
+}
+
+func NewLease(leases *lease.Lessor) *LeaseHandlers {
+	return &LeaseHandlers{
+		leases: leases,
+	}
+}
+
+func (h *LeaseHandlers) Grant(w http.ResponseWriter, r *http.Request) {
+	grant := rest.LeaseGrantRequest{}
+	err := readJson(w, r, &grant)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := h.leases.Grant(time.Duration(grant.TTL) * time.Second)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, rest.LeaseResponse{ID: id, TTL: grant.TTL})
+}
+
+func (h *LeaseHandlers) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, ok := leaseID(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.leases.Revoke(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *LeaseHandlers) KeepAlive(w http.ResponseWriter, r *http.Request) {
+	id, ok := leaseID(w, r)
+	if !ok {
+		return
+	}
+
+	ttl, err := h.leases.KeepAlive(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, rest.LeaseResponse{ID: id, TTL: int64(ttl / time.Second)})
+}
+
+func (h *LeaseHandlers) TimeToLive(w http.ResponseWriter, r *http.Request) {
+	id, ok := leaseID(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := h.leases.TimeToLive(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, rest.LeaseTimeToLiveResponse{
+		ID:        info.ID,
+		TTL:       int64(info.TTL / time.Second),
+		Remaining: int64(info.Remaining / time.Second),
+		Keys:      info.Keys,
+	})
+}
+
+// leaseID parses the lease id in the path, and writes a bad request if it's invalid.
+func leaseID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, invalid(err))
+		return 0, false
+	}
+	return id, true
+}
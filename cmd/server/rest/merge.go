@@ -0,0 +1,43 @@
+package rest
+
+import (
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/crdt"
+	"kv/pkg/rest"
+	"net/http"
+	"time"
+)
+
+// Merge handles POST /merge, which changes a CRDT.
+func (h *Handlers) Merge(w http.ResponseWriter, r *http.Request) {
+	req := rest.MergeRequest{}
+	err := readJson(w, r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var change crdt.Merger
+	switch req.Op {
+	case "increment":
+		change = crdt.Increment{Delta: req.Delta}
+	case "add":
+		change = crdt.SetAdd{Elements: req.Elements}
+	case "remove":
+		change = crdt.SetRemove{Elements: req.Elements}
+	case "set":
+		change = crdt.Register{Value: anyval.Canonical(req.Value)}
+	default:
+		writeError(w, store.NewError(store.ErrInvalid, "unknown merge op: "+req.Op))
+		return
+	}
+
+	op := store.Op{Type: store.OpMerge, Key: req.Key, Value: crdt.Stamp(change, h.node, time.Now())}
+	result, err := h.kv.Txn(store.Txn{Then: []store.Op{op}})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, rest.MergeResponse{Value: crdt.Plain(result.Results[0].Entry.Value), Revision: result.Revision})
+}
@@ -0,0 +1,42 @@
+package rest
+
+import (
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+var mutations = map[string]store.MutationType{
+	"increment": store.MutateIncrement,
+	"decrement": store.MutateDecrement,
+	"append":    store.MutateAppend,
+	"pushFront": store.MutatePushFront,
+	"pushBack":  store.MutatePushBack,
+	"popFront":  store.MutatePopFront,
+	"popBack":   store.MutatePopBack,
+}
+
+// Mutate handles POST /mutate, which changes a value atomically.
+func (h *Handlers) Mutate(w http.ResponseWriter, r *http.Request) {
+	req := rest.MutateRequest{}
+	err := readJson(w, r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	t, ok := mutations[req.Op]
+	if !ok {
+		writeError(w, store.NewError(store.ErrInvalid, "unknown mutation: "+req.Op))
+		return
+	}
+
+	// JSON has no integers, but counting from a key which doesn't exist should make one
+	operand := anyval.Canonical(req.Operand)
+	value, popped, revision, err := store.Mutate(h.kv, req.Key, store.Mutation{Type: t, Operand: operand})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJsonResponse(w, rest.MutateResponse{Value: value, Popped: popped, Revision: revision})
+}
@@ -2,72 +2,299 @@ package rest
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"kv/internal/store"
+	"kv/internal/store/lease"
+	"kv/pkg/anyval"
+	"kv/pkg/crdt"
 	"kv/pkg/rest"
 	"kv/pkg/watch"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const maxBodySize = 4 << 20
+
+// errMissingKey is returned for a request to /kv/ without a key.
+var errMissingKey = store.NewError(store.ErrInvalid, "missing key")
+
 type Handlers struct {
-	kv store.KVStore
+	kv     store.KVStore
+	leases *lease.Lessor
+	node   string
 }
 
-func New(kv store.KVStore) *Handlers {
-	return &Handlers{
-		kv: kv,
+type Option func(*Handlers)
+
+// WithNode names the server in the CRDT changes it merges, which must be unique to it.  A random name is used by
+// default.
+func WithNode(id string) Option {
+	return func(h *Handlers) {
+		h.node = id
 	}
 }
 
+func New(kv store.KVStore, leases *lease.Lessor, opts ...Option) *Handlers {
+	h := &Handlers{
+		kv:     kv,
+		leases: leases,
+		node:   crdt.NewNode(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
 func (h *Handlers) Put(w http.ResponseWriter, r *http.Request) {
-	bytes, err := readBody(r)
 	put := rest.PutRequest{}
-	err = json.Unmarshal(bytes, &put)
+	err := readJson(w, r, &put)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// JSON numbers are all float64s, so keep values the way a gRPC client writing the same value would see them
+	put.Value, put.PrevValue = anyval.Canonical(put.Value), anyval.Canonical(put.PrevValue)
+
+	cond, conditional, err := condition(r, put.PrevValue)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
-	err = h.kv.Put(put.Key, put.Value)
+	if put.Lease != 0 && (put.TTL > 0 || conditional) {
+		// the lease decides when the key is removed, and is only attached by unconditional puts
+		writeError(w, store.NewError(store.ErrInvalid, "put with a lease can't have a ttl or a condition"))
+		return
+	}
+
+	if put.Lease != 0 {
+		err = h.leases.Put(put.Key, put.Value, put.Lease)
+	} else if put.TTL > 0 {
+		err = h.putWithTTL(put, cond, conditional)
+	} else if conditional {
+		err = h.kv.PutIf(put.Key, put.Value, cond)
+	} else {
+		err = h.kv.Put(put.Key, put.Value)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// putWithTTL stores a value which expires, using a transaction to check the condition if there is one.
+func (h *Handlers) putWithTTL(put rest.PutRequest, cond store.Condition, conditional bool) error {
+	ttl := time.Duration(put.TTL) * time.Second
+	if !conditional {
+		return store.PutWithTTL(h.kv, put.Key, put.Value, ttl)
+	}
+
+	result, err := h.kv.Txn(store.Txn{
+		Compares: []store.Compare{{Key: put.Key, Condition: cond}},
+		Then:     []store.Op{{Type: store.OpPut, Key: put.Key, Value: put.Value, Expires: time.Now().Add(ttl)}},
+	})
+	if err == nil && !result.Succeeded {
+		err = store.ErrPreconditionFailed
+	}
+	return err
+}
+
+// condition reads the precondition of a write.  If-None-Match: * requires the key to be absent, If-Match requires the
+// key's revision to equal the quoted ETag returned by GET, and prevValue requires the key's value to equal it.  Only one
+// may be used at a time.
+func condition(r *http.Request, prevValue interface{}) (store.Condition, bool, error) {
+	var conds []store.Condition
+	if match := r.Header.Get("If-None-Match"); len(match) != 0 {
+		if match != "*" {
+			return store.Condition{}, false, store.NewError(store.ErrInvalid, "If-None-Match only supports *")
+		}
+		conds = append(conds, store.IfAbsent())
+	}
+	if match := r.Header.Get("If-Match"); len(match) != 0 {
+		revision, err := parseETag(match)
+		if err != nil {
+			return store.Condition{}, false, invalid(err)
+		}
+		conds = append(conds, store.IfRevisionEquals(revision))
+	}
+	if prevValue != nil {
+		conds = append(conds, store.IfValueEquals(prevValue))
+	}
+
+	switch len(conds) {
+	case 0:
+		return store.Condition{}, false, nil
+	case 1:
+		return conds[0], true, nil
+	}
+	return store.Condition{}, false, store.NewError(store.ErrInvalid, "more than one condition")
+}
+
+// etag formats a revision as an entity tag.
+func etag(revision int64) string {
+	return strconv.Quote(strconv.FormatInt(revision, 10))
+}
+
+func parseETag(tag string) (int64, error) {
+	tag, err := strconv.Unquote(strings.TrimPrefix(tag, "W/"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(tag, 10, 64)
+}
+
 func (h *Handlers) Get(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
 	if len(key) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errMissingKey)
 		return
 	}
 
-	value, err := h.kv.Get(key)
+	var revision int64
+	if rev := r.URL.Query().Get("revision"); len(rev) != 0 {
+		var err error
+		revision, err = strconv.ParseInt(rev, 10, 64)
+		if err != nil {
+			writeError(w, invalid(err))
+			return
+		}
+	}
+
+	staleness, err := h.sync(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	e, err := h.kv.GetEntry(key, revision)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 
+	w.Header().Set("ETag", etag(e.ModRevision))
 	doc := rest.GetResponse{
-		Key:   key,
-		Value: value,
+		Key:            key,
+		Value:          e.Value,
+		CreateRevision: e.CreateRevision,
+		ModRevision:    e.ModRevision,
+		Version:        e.Version,
+		Revision:       h.kv.Revision(),
+		Staleness:      staleness,
 	}
 
 	writeJsonResponse(w, doc)
 }
 
+// sync waits until a read has the consistency in its query, which is linearizable unless it's "sequential" or "stale".
+// A sequential read waits for the store to reach the minRevision in the query.  It returns how far behind the read may
+// be for the reads which aren't linearizable.
+func (h *Handlers) sync(r *http.Request) (*rest.Staleness, error) {
+	query := r.URL.Query()
+	consistency, err := store.ConsistencyFromString(query.Get("consistency"))
+	if err != nil {
+		return nil, err
+	}
+	var minRevision int64
+	if rev := query.Get("minRevision"); len(rev) != 0 {
+		minRevision, err = strconv.ParseInt(rev, 10, 64)
+		if err != nil {
+			return nil, invalid(err)
+		}
+	}
+
+	staleness, err := store.Sync(r.Context(), h.kv, consistency, minRevision)
+	if err != nil || consistency == store.Linearizable {
+		return nil, err
+	}
+	return &rest.Staleness{Entries: staleness.Entries, SinceMillis: staleness.Since.Milliseconds()}, nil
+}
+
+// Range handles GET /kv, reading the keys selected by the prefix, or start and end query parameters.
+func (h *Handlers) Range(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	start, end := query.Get("start"), query.Get("end")
+	if prefix := query.Get("prefix"); len(prefix) != 0 {
+		start, end = prefix, store.PrefixEnd(prefix)
+	}
+
+	var limit int
+	if l := query.Get("limit"); len(l) != 0 {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			writeError(w, invalid(err))
+			return
+		}
+	}
+
+	staleness, err := h.sync(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	revision := h.kv.Revision()
+	kvs, token, err := store.RangePage(h.kv, start, end, limit, query.Get("continue"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	doc := rest.RangeResponse{
+		KVs:       make([]rest.KeyValue, 0, len(kvs)),
+		Continue:  token,
+		Revision:  revision,
+		Staleness: staleness,
+	}
+	for _, kv := range kvs {
+		doc.KVs = append(doc.KVs, rest.KeyValue{Key: kv.Key, Value: kv.Value})
+	}
+	writeJsonResponse(w, doc)
+}
+
 func (h *Handlers) Delete(w http.ResponseWriter, r *http.Request) {
 	key := r.PathValue("key")
 	if len(key) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, errMissingKey)
+		return
+	}
+	cond, conditional, err := condition(r, nil)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
-	err := h.kv.Delete(key)
+
+	if conditional {
+		err = h.kv.DeleteIf(key, cond)
+	} else {
+		err = h.kv.Delete(key)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Compact handles POST /compact, discarding the history older than the requested revision.
+func (h *Handlers) Compact(w http.ResponseWriter, r *http.Request) {
+	compact := rest.CompactRequest{}
+	err := readJson(w, r, &compact)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = h.kv.Compact(compact.Revision)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -76,29 +303,58 @@ func (h *Handlers) Delete(w http.ResponseWriter, r *http.Request) {
 func (h *Handlers) Watch(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("/watch", "host", r.Host)
 	watchReq := watch.WatchRequest{}
-	b, err := readBody(r)
+	err := readJson(w, r, &watchReq)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
-	err = json.Unmarshal(b, &watchReq)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	watcher, ok := h.kv.(store.Watcher)
+	if !ok {
+		writeError(w, store.ErrUnsupported)
 		return
 	}
 
-	updateChan, cancel := h.kv.AddWatch(watchReq.Key, watchReq.WatchType)
+	updateChan, cancel, err := watcher.Watch(watchReq)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 	defer cancel()
 
-	w.Header().Set("Cache-Control", "no-cache")
-	writeJsonResponse(w, <-updateChan)
+	select {
+	case <-r.Context().Done():
+	case update, ok := <-updateChan:
+		if !ok {
+			// the channel is only closed without saying why once the watch is cancelled
+			writeError(w, watch.ErrClosed)
+			return
+		} else if update.Err != nil {
+			writeError(w, update.Err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		writeJsonResponse(w, update)
+	}
 }
 
-func readBody(r *http.Request) ([]byte, error) {
-	b, err := io.ReadAll(r.Body)
+// readJson decodes the request body into v.  The body is limited to maxBodySize, the same as the gRPC server's
+// default message size.
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
 	r.Body.Close()
-	return b, err
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return store.NewError(store.ErrTooLarge, fmt.Sprintf("request body is larger than %d bytes", maxBytes.Limit))
+	} else if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return invalid(err)
+	}
+	return nil
 }
 
 func writeJsonResponse(w http.ResponseWriter, value interface{}) {
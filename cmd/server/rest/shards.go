@@ -0,0 +1,38 @@
+package rest
+
+import (
+	"kv/internal/shard"
+	"kv/pkg/rest"
+	"kv/pkg/slot"
+	"net/http"
+)
+
+// ShardHandlers describe how a sharded store's keys are divided between its servers.
+type ShardHandlers struct {
+	m shard.Map
+}
+
+func NewShards(m shard.Map) *ShardHandlers {
+	return &ShardHandlers{
+		m: m,
+	}
+}
+
+// ShardMap handles GET /admin/shards.
+func (h *ShardHandlers) ShardMap(w http.ResponseWriter, _ *http.Request) {
+	doc := rest.ShardMapResponse{Version: h.m.Version, Slots: slot.Count, Shards: make([]rest.Shard, 0, len(h.m.Shards))}
+	for _, s := range h.m.Shards {
+		doc.Shards = append(doc.Shards, convertShard(s))
+	}
+	writeJsonResponse(w, doc)
+}
+
+func convertShard(s shard.Shard) rest.Shard {
+	return rest.Shard{
+		ID:          s.ID,
+		Address:     s.Address,
+		HTTPAddress: s.HTTPAddress,
+		Start:       s.Start,
+		End:         s.End,
+	}
+}
@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+// Txn handles POST /txn.
+func (h *Handlers) Txn(w http.ResponseWriter, r *http.Request) {
+	req := rest.TxnRequest{}
+	err := readJson(w, r, &req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	txn, err := convertTxn(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := h.kv.Txn(txn)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	doc := rest.TxnResponse{
+		Succeeded: result.Succeeded,
+		Results:   make([]rest.TxnOpResult, 0, len(result.Results)),
+		Revision:  result.Revision,
+	}
+	for _, res := range result.Results {
+		doc.Results = append(doc.Results, rest.TxnOpResult{
+			Found:          res.Found,
+			Value:          res.Entry.Value,
+			CreateRevision: res.Entry.CreateRevision,
+			ModRevision:    res.Entry.ModRevision,
+			Version:        res.Entry.Version,
+		})
+	}
+	writeJsonResponse(w, doc)
+}
+
+func convertTxn(req rest.TxnRequest) (store.Txn, error) {
+	txn := store.Txn{}
+	for _, c := range req.Compares {
+		var cond store.Condition
+		switch c.Type {
+		case "absent":
+			cond = store.IfAbsent()
+		case "value":
+			cond = store.IfValueEquals(anyval.Canonical(c.Value))
+		case "revision":
+			cond = store.IfRevisionEquals(c.Revision)
+		default:
+			return txn, store.NewError(store.ErrInvalid, "unknown compare type: "+c.Type)
+		}
+		txn.Compares = append(txn.Compares, store.Compare{Key: c.Key, Condition: cond})
+	}
+
+	var err error
+	txn.Then, err = convertOps(req.Then)
+	if err == nil {
+		txn.Else, err = convertOps(req.Else)
+	}
+	return txn, err
+}
+
+func convertOps(ops []rest.TxnOp) ([]store.Op, error) {
+	converted := make([]store.Op, 0, len(ops))
+	for _, op := range ops {
+		o := store.Op{Key: op.Key, Value: anyval.Canonical(op.Value)}
+		switch op.Op {
+		case "get":
+			o.Type = store.OpGet
+		case "put":
+			o.Type = store.OpPut
+		case "delete":
+			o.Type = store.OpDelete
+		default:
+			return nil, store.NewError(store.ErrInvalid, "unknown op: "+op.Op)
+		}
+		converted = append(converted, o)
+	}
+	return converted, nil
+}
@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"context"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"kv/internal/gen"
+	"kv/internal/store/snapshot"
+	"log/slog"
+)
+
+type AdminHandlers struct {
+	gen.UnimplementedAdminServer
+	snapshots *snapshot.Manager
+}
+
+func NewAdmin(snapshots *snapshot.Manager) *AdminHandlers {
+	return &AdminHandlers{
+		UnimplementedAdminServer: gen.UnimplementedAdminServer{},
+		snapshots:                snapshots,
+	}
+}
+
+func (h *AdminHandlers) Snapshot(_ context.Context, _ *gen.SnapshotRequest) (*gen.SnapshotResponse, error) {
+	response := &gen.SnapshotResponse{Status: gen.Status_ERROR}
+	info, err := h.snapshots.Take()
+	if err != nil {
+		slog.Error("snapshot", "error", err)
+		return response, toStatus(err)
+	}
+
+	response.Status = gen.Status_OK
+	response.Snapshot = convertSnapshotInfo(info)
+	return response, nil
+}
+
+func (h *AdminHandlers) ListSnapshots(_ context.Context, _ *gen.ListSnapshotsRequest) (*gen.ListSnapshotsResponse, error) {
+	response := &gen.ListSnapshotsResponse{Status: gen.Status_ERROR}
+	snapshots, err := h.snapshots.List()
+	if err != nil {
+		slog.Error("list snapshots", "error", err)
+		return response, toStatus(err)
+	}
+
+	response.Status = gen.Status_OK
+	for _, info := range snapshots {
+		response.Snapshots = append(response.Snapshots, convertSnapshotInfo(info))
+	}
+	return response, nil
+}
+
+func convertSnapshotInfo(info snapshot.Info) *gen.SnapshotInfo {
+	return &gen.SnapshotInfo{
+		Name:    info.Name,
+		Index:   info.Index,
+		Size:    info.Size,
+		Created: timestamppb.New(info.Created),
+	}
+}
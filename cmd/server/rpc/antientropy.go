@@ -0,0 +1,48 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/antientropy"
+	"kv/internal/gen"
+)
+
+// AntiEntropyHandlers let other replicas compare Merkle trees with this one, and swap the records which differ.
+type AntiEntropyHandlers struct {
+	gen.UnimplementedAntiEntropyServer
+	replica *antientropy.Store
+}
+
+func NewAntiEntropy(replica *antientropy.Store) *AntiEntropyHandlers {
+	return &AntiEntropyHandlers{
+		UnimplementedAntiEntropyServer: gen.UnimplementedAntiEntropyServer{},
+		replica:                        replica,
+	}
+}
+
+func (h *AntiEntropyHandlers) Tree(ctx context.Context, req *gen.TreeRequest) (*gen.TreeResponse, error) {
+	hashes, err := h.replica.Tree(ctx, int(req.Level), antientropy.FromInt32s(req.Nodes))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &gen.TreeResponse{Hashes: hashes}, nil
+}
+
+func (h *AntiEntropyHandlers) Exchange(ctx context.Context, req *gen.ExchangeRequest) (*gen.ExchangeResponse, error) {
+	records, err := antientropy.FromProtos(req.Records)
+	if err != nil {
+		return nil, toStatus(invalid(err))
+	}
+	mine, err := h.replica.Exchange(ctx, antientropy.FromInt32s(req.Leaves), records)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	response := &gen.ExchangeResponse{}
+	for _, r := range mine {
+		pr, err := antientropy.ToProto(r)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		response.Records = append(response.Records, pr)
+	}
+	return response, nil
+}
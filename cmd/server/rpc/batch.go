@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"log/slog"
+)
+
+func (h *Handlers) BatchGet(_ context.Context, r *gen.BatchGetRequest) (*gen.BatchResponse, error) {
+	results, err := store.BatchGet(h.kv, r.Keys, r.Atomic)
+	if err != nil {
+		slog.Error("batch get", "error", err)
+		return &gen.BatchResponse{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return convertBatch(results, true)
+}
+
+func (h *Handlers) BatchPut(_ context.Context, r *gen.BatchPutRequest) (*gen.BatchResponse, error) {
+	response := &gen.BatchResponse{Status: gen.Status_ERROR}
+	kvs := make([]store.KeyValue, len(r.Kvs))
+	for i, kv := range r.Kvs {
+		value, err := anyval.Unmarshal(kv.GetValue())
+		if err != nil {
+			return response, toStatus(invalid(err))
+		}
+		kvs[i] = store.KeyValue{Key: kv.Key, Value: value}
+	}
+
+	results, err := store.BatchPut(h.kv, kvs, r.Atomic)
+	if err != nil {
+		slog.Error("batch put", "error", err)
+		return response, toStatus(err)
+	}
+	return convertBatch(results, false)
+}
+
+func (h *Handlers) BatchDelete(_ context.Context, r *gen.BatchDeleteRequest) (*gen.BatchResponse, error) {
+	results, err := store.BatchDelete(h.kv, r.Keys, r.Atomic)
+	if err != nil {
+		slog.Error("batch delete", "error", err)
+		return &gen.BatchResponse{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return convertBatch(results, false)
+}
+
+// convertBatch converts each item's result, with its value only when withValues is set, since there's no point
+// sending a put's values back.
+func convertBatch(results []store.BatchResult, withValues bool) (*gen.BatchResponse, error) {
+	response := &gen.BatchResponse{Status: gen.Status_OK, Results: make([]*gen.BatchItemResult, len(results))}
+	for i, result := range results {
+		res := &gen.BatchItemResult{Key: result.Key}
+		if result.Err != nil {
+			_, code := classify(result.Err)
+			res.Error = &gen.BatchError{Code: code, Message: result.Err.Error()}
+		} else {
+			res.CreateRevision = result.Entry.CreateRevision
+			res.ModRevision = result.Entry.ModRevision
+			res.Version = result.Entry.Version
+		}
+
+		if withValues && result.Err == nil {
+			av, err := anyval.Marshal(result.Entry.Value)
+			if err != nil {
+				return &gen.BatchResponse{Status: gen.Status_ERROR}, toStatus(err)
+			}
+			res.Value = av
+		}
+		response.Results[i] = res
+	}
+	return response, nil
+}
@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/gen"
+	"kv/internal/raft"
+	"kv/internal/store"
+	"log/slog"
+)
+
+// errMemberAddress is returned for a member added without an id or an address.
+var errMemberAddress = store.NewError(store.ErrInvalid, "a new member needs an id and an address")
+
+// ClusterHandlers lists and changes the members of a replicated cluster.
+type ClusterHandlers struct {
+	gen.UnimplementedClusterServer
+	node *raft.Node
+}
+
+func NewCluster(node *raft.Node) *ClusterHandlers {
+	return &ClusterHandlers{
+		UnimplementedClusterServer: gen.UnimplementedClusterServer{},
+		node:                       node,
+	}
+}
+
+func (h *ClusterHandlers) Members(_ context.Context, _ *gen.MembersRequest) (*gen.MembersResponse, error) {
+	status := h.node.Status()
+	response := &gen.MembersResponse{
+		Status:  gen.Status_OK,
+		Id:      status.ID,
+		Leader:  status.Leader,
+		Term:    status.Term,
+		Commit:  status.Commit,
+		Applied: status.Applied,
+	}
+	for _, m := range status.MemberStatuses() {
+		response.Members = append(response.Members, &gen.ClusterMember{
+			Id:      m.ID,
+			Address: m.Address,
+			Role:    m.Role.String(),
+			Match:   m.Match,
+			Lag:     m.Lag,
+		})
+	}
+	return response, nil
+}
+
+func (h *ClusterHandlers) AddMember(ctx context.Context, r *gen.MemberRequest) (*gen.Response, error) {
+	var err error = errMemberAddress
+	if len(r.Id) != 0 && len(r.Address) != 0 {
+		err = h.node.AddMember(ctx, raft.Member{ID: r.Id, Address: r.Address})
+	}
+	return h.response("add member", r.Id, err)
+}
+
+func (h *ClusterHandlers) RemoveMember(ctx context.Context, r *gen.MemberRequest) (*gen.Response, error) {
+	return h.response("remove member", r.Id, h.node.RemoveMember(ctx, r.Id))
+}
+
+func (h *ClusterHandlers) TransferLeadership(ctx context.Context, r *gen.MemberRequest) (*gen.Response, error) {
+	return h.response("transfer leadership", r.Id, h.node.TransferLeadership(ctx, r.Id))
+}
+
+func (h *ClusterHandlers) response(op, id string, err error) (*gen.Response, error) {
+	if err != nil {
+		slog.Error(op, "id", id, "error", err)
+		return &gen.Response{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return &gen.Response{Status: gen.Status_OK}, nil
+}
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"kv/internal/shard"
+	"kv/internal/store"
+	"kv/internal/store/follower"
+	"kv/pkg/rest"
+	"kv/pkg/watch"
+)
+
+// toStatus converts err to a gRPC status error.  The code says what kind of error it was, and an ErrorInfo detail
+// gives the same code as the REST API, so clients don't have to guess from the gRPC code.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	} else if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code, reason := classify(err)
+	s := status.New(code, err.Error())
+	info := &errdetails.ErrorInfo{Reason: reason, Domain: rest.ErrorDomain}
+	var moved *shard.MovedError
+	if errors.As(err, &moved) {
+		// the owner's addresses, so a client can go straight there
+		info.Metadata = map[string]string{
+			"shard":       moved.Owner.ID,
+			"address":     moved.Owner.Address,
+			"httpAddress": moved.Owner.HTTPAddress,
+		}
+	}
+	var readOnly *follower.ReadOnlyError
+	if errors.As(err, &readOnly) {
+		info.Metadata = map[string]string{
+			"address":     readOnly.Leader.Address,
+			"httpAddress": readOnly.Leader.HTTPAddress,
+		}
+	}
+	if detailed, derr := s.WithDetails(info); derr == nil {
+		s = detailed
+	}
+	return s.Err()
+}
+
+func classify(err error) (codes.Code, string) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return codes.NotFound, rest.CodeNotFound
+	case errors.Is(err, store.ErrPreconditionFailed):
+		return codes.FailedPrecondition, rest.CodePreconditionFailed
+	case errors.Is(err, store.ErrTooLarge):
+		return codes.ResourceExhausted, rest.CodeTooLarge
+	case errors.Is(err, store.ErrUnavailable):
+		return codes.Unavailable, rest.CodeUnavailable
+	case errors.Is(err, store.ErrInvalid), errors.Is(err, watch.ErrInvalidRequest):
+		return codes.InvalidArgument, rest.CodeInvalid
+	case errors.Is(err, store.ErrTypeMismatch):
+		return codes.FailedPrecondition, rest.CodeTypeMismatch
+	case errors.Is(err, store.ErrCompacted):
+		return codes.OutOfRange, rest.CodeCompacted
+	case errors.Is(err, store.ErrUnsupported):
+		return codes.Unimplemented, rest.CodeUnsupported
+	case errors.Is(err, shard.ErrMoved):
+		return codes.Aborted, rest.CodeMoved
+	case errors.Is(err, follower.ErrReadOnly):
+		return codes.PermissionDenied, rest.CodeReadOnly
+	case errors.Is(err, watch.ErrSlowConsumer):
+		return codes.ResourceExhausted, rest.CodeUnavailable
+	case errors.Is(err, watch.ErrClosed):
+		return codes.Unavailable, rest.CodeUnavailable
+	}
+	return codes.Internal, rest.CodeInternal
+}
+
+// unexpected reports whether err is the server's own failure, rather than one a client caused or can act on.
+func unexpected(err error) bool {
+	code, _ := classify(err)
+	return code == codes.Internal
+}
+
+// invalid marks err as a bad request.
+func invalid(err error) error {
+	return store.NewError(store.ErrInvalid, err.Error())
+}
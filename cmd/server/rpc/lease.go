@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"kv/internal/gen"
+	"kv/internal/store/lease"
+	"log/slog"
+	"time"
+)
+
+type LeaseHandlers struct {
+	gen.UnimplementedLeaseServer
+	leases *lease.Lessor
+}
+
+func NewLease(leases *lease.Lessor) *LeaseHandlers {
+	return &LeaseHandlers{
+		UnimplementedLeaseServer: gen.UnimplementedLeaseServer{},
+		leases:                   leases,
+	}
+}
+
+func (h *LeaseHandlers) LeaseGrant(_ context.Context, r *gen.LeaseGrantRequest) (*gen.LeaseGrantResponse, error) {
+	response := &gen.LeaseGrantResponse{Status: gen.Status_ERROR}
+	id, err := h.leases.Grant(time.Duration(r.Ttl) * time.Second)
+	if err != nil {
+		slog.Error("lease grant", "ttl", r.Ttl, "error", err)
+		return response, toStatus(err)
+	}
+
+	response.Status = gen.Status_OK
+	response.Id = id
+	response.Ttl = r.Ttl
+	return response, nil
+}
+
+func (h *LeaseHandlers) LeaseRevoke(_ context.Context, r *gen.LeaseRevokeRequest) (*gen.Response, error) {
+	err := h.leases.Revoke(r.Id)
+	if err != nil {
+		slog.Debug("lease revoke", "id", r.Id, "error", err)
+		return &gen.Response{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return &gen.Response{Status: gen.Status_OK}, nil
+}
+
+// LeaseKeepAlive renews a lease for each request on the stream.  A lease which doesn't exist is answered with a ttl of
+// zero, rather than ending the stream, since it may be shared by keepalives for other leases.
+func (h *LeaseHandlers) LeaseKeepAlive(stream gen.Lease_LeaseKeepAliveServer) error {
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		response := &gen.LeaseKeepAliveResponse{Id: r.Id}
+		ttl, err := h.leases.KeepAlive(r.Id)
+		if err == nil {
+			response.Ttl = int64(ttl / time.Second)
+		} else {
+			slog.Debug("lease keepalive", "id", r.Id, "error", err)
+		}
+
+		err = stream.Send(response)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *LeaseHandlers) LeaseTimeToLive(_ context.Context, r *gen.LeaseTimeToLiveRequest) (*gen.LeaseTimeToLiveResponse, error) {
+	response := &gen.LeaseTimeToLiveResponse{Status: gen.Status_ERROR}
+	info, err := h.leases.TimeToLive(r.Id)
+	if err != nil {
+		slog.Debug("lease ttl", "id", r.Id, "error", err)
+		return response, toStatus(err)
+	}
+
+	response.Status = gen.Status_OK
+	response.Id = info.ID
+	response.Ttl = int64(info.TTL / time.Second)
+	response.Remaining = int64(info.Remaining / time.Second)
+	response.Keys = info.Keys
+	return response, nil
+}
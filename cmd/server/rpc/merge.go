@@ -0,0 +1,47 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/crdt"
+	"log/slog"
+	"time"
+)
+
+// Merge merges a CRDT, or a change to one, into a key's value, and returns the new value.
+func (h *Handlers) Merge(_ context.Context, r *gen.MergeRequest) (*gen.MergeResponse, error) {
+	response := &gen.MergeResponse{Status: gen.Status_ERROR}
+	value, err := anyval.Unmarshal(r.GetValue())
+	if err != nil {
+		return response, toStatus(invalid(err))
+	}
+	m, err := merger(value, h.node)
+	if err != nil {
+		return response, toStatus(err)
+	}
+
+	result, err := h.kv.Txn(store.Txn{Then: []store.Op{{Type: store.OpMerge, Key: r.Key, Value: m}}})
+	if err != nil {
+		slog.Error("merge", "key", r.Key, "error", err)
+		return response, toStatus(err)
+	}
+	response.Value, err = anyval.Marshal(result.Results[0].Entry.Value)
+	if err != nil {
+		return response, toStatus(err)
+	}
+	response.Revision = result.Revision
+	response.Status = gen.Status_OK
+	return response, nil
+}
+
+// merger checks value is a CRDT, or a change to one, and stamps it as made by node.
+func merger(value interface{}, node string) (store.Merger, error) {
+	m, ok := value.(crdt.Merger)
+	if !ok {
+		return nil, store.NewError(store.ErrInvalid, fmt.Sprintf("a %T can't be merged", value))
+	}
+	return crdt.Stamp(m, node, time.Now()), nil
+}
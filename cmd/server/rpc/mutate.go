@@ -0,0 +1,39 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"log/slog"
+)
+
+// Mutate changes a key's value atomically, and returns the new value along with any element popped.
+func (h *Handlers) Mutate(_ context.Context, r *gen.MutateRequest) (*gen.MutateResponse, error) {
+	response := &gen.MutateResponse{Status: gen.Status_ERROR}
+	if r.GetMutation().GetType() == gen.MutationType_MUTATE_UNSPECIFIED {
+		return response, toStatus(store.NewError(store.ErrInvalid, "the mutation has no type"))
+	}
+	operand, err := anyval.Unmarshal(r.GetMutation().GetOperand())
+	if err != nil {
+		return response, toStatus(invalid(err))
+	}
+
+	m := store.Mutation{Type: store.MutationType(r.Mutation.Type), Operand: operand}
+	value, popped, revision, err := store.Mutate(h.kv, r.Key, m)
+	if err != nil {
+		slog.Error("mutate", "key", r.Key, "error", err)
+		return response, toStatus(err)
+	}
+	if response.Value, err = anyval.Marshal(value); err != nil {
+		return response, toStatus(err)
+	}
+	if m.Pops() {
+		if response.Popped, err = anyval.Marshal(popped); err != nil {
+			return response, toStatus(err)
+		}
+	}
+	response.Revision = revision
+	response.Status = gen.Status_OK
+	return response, nil
+}
@@ -0,0 +1,25 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/gen"
+	"kv/internal/raft"
+)
+
+// RaftHandlers receives messages from the other nodes of the cluster.
+type RaftHandlers struct {
+	gen.UnimplementedRaftServer
+	node *raft.Node
+}
+
+func NewRaft(node *raft.Node) *RaftHandlers {
+	return &RaftHandlers{
+		UnimplementedRaftServer: gen.UnimplementedRaftServer{},
+		node:                    node,
+	}
+}
+
+func (h *RaftHandlers) Step(_ context.Context, m *gen.RaftMessage) (*gen.RaftResponse, error) {
+	h.node.Step(raft.FromProto(m))
+	return &gen.RaftResponse{}, nil
+}
@@ -2,89 +2,267 @@ package rpc
 
 import (
 	"context"
+	"errors"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/anypb"
 	"kv/internal/gen"
 	"kv/internal/store"
+	"kv/internal/store/lease"
 	"kv/pkg/anyval"
+	"kv/pkg/crdt"
 	"kv/pkg/watch"
 	"log/slog"
+	"strconv"
+	"time"
 )
 
 type Handlers struct {
 	gen.UnimplementedKVServer
-	kv store.KVStore
+	kv     store.KVStore
+	leases *lease.Lessor
+	node   string
 }
 
-func New(service store.KVStore) *Handlers {
-	return &Handlers{
+type Option func(*Handlers)
+
+// WithNode names the server in the CRDT changes it merges, which must be unique to it.  A random name is used by
+// default.
+func WithNode(id string) Option {
+	return func(h *Handlers) {
+		h.node = id
+	}
+}
+
+// errTTLAndLease is returned for a put with both a ttl and a lease, since the lease decides when the key is removed.
+var errTTLAndLease = store.NewError(store.ErrInvalid, "put can't have both a ttl and a lease")
+
+func New(service store.KVStore, leases *lease.Lessor, opts ...Option) *Handlers {
+	h := &Handlers{
 		UnimplementedKVServer: gen.UnimplementedKVServer{},
 		kv:                    service,
+		leases:                leases,
+		node:                  crdt.NewNode(),
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *Handlers) Put(_ context.Context, r *gen.PutRequest) (*gen.Response, error) {
 	response := &gen.Response{Status: gen.Status_ERROR}
 	value, err := anyval.Unmarshal(r.GetValue())
 	if err != nil {
-		slog.Error("put", "key", r.Key, "error", err)
-		return response, err
+		slog.Debug("put", "key", r.Key, "error", err)
+		return response, toStatus(invalid(err))
 	}
 
-	err = h.kv.Put(r.Key, value)
+	switch {
+	case r.Lease != 0 && r.Ttl > 0:
+		err = errTTLAndLease
+	case r.Lease != 0:
+		err = h.leases.Put(r.Key, value, r.Lease)
+	case r.Ttl > 0:
+		err = store.PutWithTTL(h.kv, r.Key, value, time.Duration(r.Ttl)*time.Second)
+	default:
+		err = h.kv.Put(r.Key, value)
+	}
 
 	if err != nil {
-		slog.Error("put", "key", r.Key, "value", value)
-		return response, err
+		// failed conditions, bad requests and moved keys are the client's to handle, and values aren't logged
+		if unexpected(err) {
+			slog.Error("put", "key", r.Key, "error", err)
+		}
+		return response, toStatus(err)
 	}
 
 	response.Status = gen.Status_OK
-	return response, err
+	return response, nil
 }
 
-func (h *Handlers) Get(_ context.Context, r *gen.GetRequest) (*gen.GetResponse, error) {
+func (h *Handlers) Get(ctx context.Context, r *gen.GetRequest) (*gen.GetResponse, error) {
 	response := &gen.GetResponse{Status: gen.Status_ERROR}
-	v, err := h.kv.Get(r.Key)
-
-	if err == nil {
-		av, err := anyval.Marshal(v)
-		if err == nil {
-			response.Value = av
-			response.Status = gen.Status_OK
-			slog.Debug("get", "key", r.Key, "found", true)
-		}
-	} else {
+	staleness, err := h.sync(ctx, r.Consistency, r.MinRevision)
+	if err != nil {
+		return response, toStatus(err)
+	}
+	e, err := h.kv.GetEntry(r.Key, r.Revision)
+	if err != nil {
 		slog.Debug("get", "key", r.Key, "found", false)
+		return response, toStatus(err)
+	}
+
+	av, err := anyval.Marshal(e.Value)
+	if err != nil {
+		slog.Error("get", "key", r.Key, "error", err)
+		return response, toStatus(err)
 	}
 
-	return response, err
+	response.Value = av
+	response.CreateRevision = e.CreateRevision
+	response.ModRevision = e.ModRevision
+	response.Version = e.Version
+	response.Revision = h.kv.Revision()
+	response.Staleness = staleness
+	response.Status = gen.Status_OK
+	slog.Debug("get", "key", r.Key, "found", true)
+	return response, nil
+}
+
+// sync waits until a read has the requested consistency, and returns how far behind it may be for the reads which
+// aren't linearizable.
+func (h *Handlers) sync(ctx context.Context, c gen.Consistency, minRevision int64) (*gen.Staleness, error) {
+	consistency := store.Consistency(c)
+	staleness, err := store.Sync(ctx, h.kv, consistency, minRevision)
+	if err != nil || consistency == store.Linearizable {
+		return nil, err
+	}
+	return &gen.Staleness{Entries: staleness.Entries, SinceMillis: staleness.Since.Milliseconds()}, nil
 }
 
 func (h *Handlers) Delete(_ context.Context, r *gen.DeleteRequest) (*gen.Response, error) {
 	err := h.kv.Delete(r.Key)
+	if err != nil {
+		return &gen.Response{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return &gen.Response{Status: gen.Status_OK}, nil
+}
+
+func (h *Handlers) PutIf(_ context.Context, r *gen.PutIfRequest) (*gen.Response, error) {
+	response := &gen.Response{Status: gen.Status_ERROR}
+	value, err := anyval.Unmarshal(r.GetValue())
+	if err != nil {
+		slog.Error("put if", "key", r.Key, "error", err)
+		return response, toStatus(invalid(err))
+	}
+	cond, err := convertCondition(r.Condition)
+	if err != nil {
+		return response, toStatus(err)
+	}
+
+	err = h.kv.PutIf(r.Key, value, cond)
+	if err != nil {
+		if !errors.Is(err, store.ErrPreconditionFailed) {
+			slog.Error("put if", "key", r.Key, "error", err)
+		}
+		return response, toStatus(err)
+	}
+	response.Status = gen.Status_OK
+	return response, nil
+}
+
+func (h *Handlers) DeleteIf(_ context.Context, r *gen.DeleteIfRequest) (*gen.Response, error) {
+	cond, err := convertCondition(r.Condition)
+	if err == nil {
+		err = h.kv.DeleteIf(r.Key, cond)
+	}
+	if err != nil {
+		return &gen.Response{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return &gen.Response{Status: gen.Status_OK}, nil
+}
+
+func convertCondition(c *gen.Condition) (store.Condition, error) {
+	switch c.GetType() {
+	case gen.ConditionType_IF_ABSENT:
+		return store.IfAbsent(), nil
+	case gen.ConditionType_IF_VALUE_EQUALS:
+		value, err := anyval.Unmarshal(c.GetValue())
+		if err != nil {
+			return store.Condition{}, invalid(err)
+		}
+		return store.IfValueEquals(value), nil
+	case gen.ConditionType_IF_REVISION_EQUALS:
+		return store.IfRevisionEquals(c.GetRevision()), nil
+	}
+	return store.Condition{}, store.NewError(store.ErrInvalid, "missing condition")
+}
+
+func (h *Handlers) Range(ctx context.Context, r *gen.RangeRequest) (*gen.RangeResponse, error) {
+	response := &gen.RangeResponse{Status: gen.Status_ERROR}
+	staleness, err := h.sync(ctx, r.Consistency, r.MinRevision)
+	if err != nil {
+		return response, toStatus(err)
+	}
+	start, end := r.Start, r.End
+	if len(r.Prefix) != 0 {
+		start, end = r.Prefix, store.PrefixEnd(r.Prefix)
+	}
 
-	status := gen.Status_OK
+	revision := h.kv.Revision()
+	kvs, token, err := store.RangePage(h.kv, start, end, int(r.Limit), r.Continue)
 	if err != nil {
-		status = gen.Status_ERROR
+		slog.Error("range", "start", start, "end", end, "error", err)
+		return response, toStatus(err)
 	}
-	return &gen.Response{Status: status}, nil
+
+	for _, kv := range kvs {
+		av, err := anyval.Marshal(kv.Value)
+		if err != nil {
+			slog.Error("range", "key", kv.Key, "error", err)
+			return response, toStatus(err)
+		}
+		response.Kvs = append(response.Kvs, &gen.KeyValue{Key: kv.Key, Value: av})
+	}
+
+	response.Continue = token
+	response.Revision = revision
+	response.Staleness = staleness
+	response.Status = gen.Status_OK
+	return response, nil
+}
+
+func (h *Handlers) Compact(_ context.Context, r *gen.CompactRequest) (*gen.Response, error) {
+	err := h.kv.Compact(r.Revision)
+	if err != nil {
+		slog.Error("compact", "revision", r.Revision, "error", err)
+		return &gen.Response{Status: gen.Status_ERROR}, toStatus(err)
+	}
+	return &gen.Response{Status: gen.Status_OK}, nil
 }
 
 func (h *Handlers) Watch(r *gen.WatchRequest, server gen.KV_WatchServer) error {
-	watchChan, cancelFunc := h.kv.AddWatch(r.Key, watch.Operation(r.GetWatchType()))
+	watcher, ok := h.kv.(store.Watcher)
+	if !ok {
+		return toStatus(store.ErrUnsupported)
+	}
+
+	watchChan, cancelFunc, err := watcher.Watch(watch.WatchRequest{
+		Key:       r.Key,
+		WatchType: watch.Operation(r.GetWatchType()),
+		End:       r.End,
+		Prefix:    r.Prefix,
+		Revision:  r.Revision,
+	})
+	if err != nil {
+		return toStatus(err)
+	}
 	defer cancelFunc()
 
-	var err error
+	// send the headers straight away, so the client knows the watch started and where it can resume from
+	err = server.SendHeader(metadata.Pairs(watch.RevisionHeader, strconv.FormatInt(h.kv.Revision(), 10)))
+	if err != nil {
+		return err
+	}
+
 out:
 	for {
 		select {
 		case <-server.Context().Done():
 			break out
-		case update := <-watchChan:
+		case update, ok := <-watchChan:
+			if !ok {
+				// the channel is only closed without saying why once the watch is cancelled
+				return toStatus(watch.ErrClosed)
+			} else if update.Err != nil {
+				return toStatus(update.Err)
+			}
 			var v *anypb.Any
 			if update.Value != nil {
 				v, err = anyval.Marshal(update.Value)
 				if err != nil {
-					break out
+					slog.Error("watch", "key", update.Key, "revision", update.Revision, "error", err)
+					return toStatus(err)
 				}
 			}
 
@@ -92,6 +270,8 @@ out:
 				WatchType: update.Op.Convert(),
 				Key:       update.Key,
 				Value:     v,
+				Revision:  update.Revision,
+				Last:      update.Last,
 			}
 
 			err = server.SendMsg(&m)
@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/gen"
+	"kv/internal/shard"
+	"kv/pkg/slot"
+)
+
+// ShardHandlers describe how a sharded store's keys are divided between its servers.
+type ShardHandlers struct {
+	gen.UnimplementedShardsServer
+	m shard.Map
+}
+
+func NewShards(m shard.Map) *ShardHandlers {
+	return &ShardHandlers{
+		UnimplementedShardsServer: gen.UnimplementedShardsServer{},
+		m:                         m,
+	}
+}
+
+func (h *ShardHandlers) ShardMap(_ context.Context, _ *gen.ShardMapRequest) (*gen.ShardMapResponse, error) {
+	response := &gen.ShardMapResponse{Version: h.m.Version, Slots: slot.Count}
+	for _, s := range h.m.Shards {
+		response.Shards = append(response.Shards, &gen.Shard{
+			Id:          s.ID,
+			Address:     s.Address,
+			HttpAddress: s.HTTPAddress,
+			Start:       int32(s.Start),
+			End:         int32(s.End),
+		})
+	}
+	return response, nil
+}
@@ -0,0 +1,91 @@
+package rpc
+
+import (
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"log/slog"
+)
+
+const (
+	// exportChunkSize is roughly how many bytes of keys and values are sent in each chunk of an export, well under
+	// the default 4MB message limit.
+	exportChunkSize = 1 << 20
+
+	// exportChunkKeys is the most keys sent in each chunk of an export.
+	exportChunkKeys = 1000
+)
+
+// Import stores each chunk before reading the next, so a client sending faster than the store can write is held back
+// by the stream's flow control.
+func (h *Handlers) Import(server gen.KV_ImportServer) error {
+	response := &gen.ImportResponse{Status: gen.Status_ERROR}
+	for {
+		r, err := server.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		kvs := make([]store.KeyValue, len(r.Kvs))
+		for i, kv := range r.Kvs {
+			value, err := anyval.Unmarshal(kv.GetValue())
+			if err != nil {
+				return toStatus(invalid(err))
+			}
+			kvs[i] = store.KeyValue{Key: kv.Key, Value: value}
+		}
+
+		results, err := store.BatchPut(h.kv, kvs, false)
+		if err != nil {
+			slog.Error("import", "imported", response.Count, "error", err)
+			return toStatus(err)
+		}
+		response.Count += int64(len(results))
+		if len(results) > 0 {
+			response.Revision = results[0].Entry.ModRevision
+		}
+	}
+
+	slog.Info("import", "imported", response.Count, "revision", response.Revision)
+	response.Status = gen.Status_OK
+	return server.SendAndClose(response)
+}
+
+func (h *Handlers) Export(r *gen.ExportRequest, server gen.KV_ExportServer) error {
+	kvs, revision, err := store.Export(h.kv, r.Prefix)
+	if err != nil {
+		return toStatus(err)
+	}
+
+	chunk := &gen.ExportResponse{Revision: revision}
+	size, sent := 0, false
+	for _, kv := range kvs {
+		v, err := anyval.Marshal(kv.Value)
+		if err != nil {
+			return toStatus(err)
+		}
+		item := &gen.KeyValue{Key: kv.Key, Value: v}
+		chunk.Kvs = append(chunk.Kvs, item)
+		size += proto.Size(item)
+
+		if size >= exportChunkSize || len(chunk.Kvs) == exportChunkKeys {
+			err = server.Send(chunk)
+			if err != nil {
+				return err
+			}
+			chunk = &gen.ExportResponse{Revision: revision}
+			size, sent = 0, true
+		}
+	}
+
+	// the last chunk is sent even when it's empty, so the client always gets the revision
+	if len(chunk.Kvs) > 0 || !sent {
+		return server.Send(chunk)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"log/slog"
+)
+
+func (h *Handlers) Txn(_ context.Context, r *gen.TxnRequest) (*gen.TxnResponse, error) {
+	response := &gen.TxnResponse{Status: gen.Status_ERROR}
+	txn, err := convertTxn(r, h.node)
+	if err != nil {
+		slog.Error("txn", "error", err)
+		return response, toStatus(err)
+	}
+
+	result, err := h.kv.Txn(txn)
+	if err != nil {
+		slog.Error("txn", "error", err)
+		return response, toStatus(err)
+	}
+
+	for _, opResult := range result.Results {
+		res := &gen.TxnOpResult{
+			Found:          opResult.Found,
+			CreateRevision: opResult.Entry.CreateRevision,
+			ModRevision:    opResult.Entry.ModRevision,
+			Version:        opResult.Entry.Version,
+		}
+		if opResult.Entry.Value != nil {
+			res.Value, err = anyval.Marshal(opResult.Entry.Value)
+			if err != nil {
+				return response, toStatus(err)
+			}
+		}
+		response.Results = append(response.Results, res)
+	}
+
+	response.Succeeded = result.Succeeded
+	response.Revision = result.Revision
+	response.Status = gen.Status_OK
+	return response, nil
+}
+
+func convertTxn(r *gen.TxnRequest, node string) (store.Txn, error) {
+	txn := store.Txn{}
+	for _, c := range r.Compares {
+		cond, err := convertCondition(c.Condition)
+		if err != nil {
+			return txn, err
+		}
+		txn.Compares = append(txn.Compares, store.Compare{Key: c.Key, Condition: cond})
+	}
+
+	var err error
+	txn.Then, err = convertOps(r.Then, node)
+	if err == nil {
+		txn.Else, err = convertOps(r.Else, node)
+	}
+	return txn, err
+}
+
+// convertOps converts the ops of a transaction.  Merges are stamped as made by node.
+func convertOps(ops []*gen.TxnOp, node string) ([]store.Op, error) {
+	converted := make([]store.Op, 0, len(ops))
+	for _, op := range ops {
+		o := store.Op{Key: op.Key}
+		switch op.Type {
+		case gen.TxnOpType_TXN_GET:
+			o.Type = store.OpGet
+		case gen.TxnOpType_TXN_PUT:
+			o.Type = store.OpPut
+			value, err := anyval.Unmarshal(op.GetValue())
+			if err != nil {
+				return nil, invalid(err)
+			}
+			o.Value = value
+		case gen.TxnOpType_TXN_DELETE:
+			o.Type = store.OpDelete
+		case gen.TxnOpType_TXN_MERGE:
+			o.Type = store.OpMerge
+			value, err := anyval.Unmarshal(op.GetValue())
+			if err != nil {
+				return nil, invalid(err)
+			}
+			o.Value, err = merger(value, node)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, store.NewError(store.ErrInvalid, "unknown txn op type")
+		}
+		converted = append(converted, o)
+	}
+	return converted, nil
+}
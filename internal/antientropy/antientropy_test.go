@@ -0,0 +1,268 @@
+package antientropy
+
+import (
+	"context"
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/watch"
+	"kv/pkg/crdt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTime is a clock which only moves when it's told to.
+type fakeTime struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func (f *fakeTime) now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.t
+}
+
+func (f *fakeTime) add(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.t = f.t.Add(d)
+}
+
+func newReplica(opts ...Option) *Store {
+	return Wrap(watch.Wrap(skiplist.New()), opts...)
+}
+
+func syncPair(t *testing.T, a, b *Store) int {
+	t.Helper()
+	n, err := a.SyncWith(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func expectValue(t *testing.T, s *Store, key string, value interface{}) {
+	t.Helper()
+	v, err := s.Get(key)
+	if err != nil || v != value {
+		t.Errorf("expected [%s] to be [%v], got %v, %v", key, value, v, err)
+	}
+}
+
+func TestClock(t *testing.T) {
+	f := &fakeTime{t: time.UnixMilli(1000)}
+	c := NewClock(f.now)
+	a := c.Now()
+	b := c.Now()
+	if b <= a || a.Time() != b.Time() {
+		t.Errorf("expected timestamps in the same millisecond to increase, got %d then %d", a, b)
+	}
+
+	remote := Timestamp(5000) << logicalBits
+	c.Observe(remote)
+	if after := c.Now(); after <= remote {
+		t.Errorf("expected a timestamp after the one observed, got %d", after)
+	}
+	f.add(10 * time.Second)
+	if next := c.Now(); next.Time() != f.now() {
+		t.Errorf("expected the clock to follow the wall clock, got %v", next.Time())
+	}
+}
+
+func TestSync(t *testing.T) {
+	f := &fakeTime{t: time.Now()}
+	a, b := newReplica(WithClock(f.now)), newReplica(WithClock(f.now))
+	for i := 0; i != 100; i++ {
+		a.Put("a"+strconv.Itoa(i), i)
+		b.Put("b"+strconv.Itoa(i), i)
+	}
+	a.Put("shared", "old")
+	f.add(time.Millisecond)
+	b.Put("shared", "new")
+	a.Delete("a0")
+
+	if n := syncPair(t, a, b); n == 0 {
+		t.Fatal("expected the replicas to differ")
+	}
+	for _, s := range []*Store{a, b} {
+		expectValue(t, s, "a1", 1)
+		expectValue(t, s, "b1", 1)
+		expectValue(t, s, "shared", "new")
+		if _, err := s.Get("a0"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected a0 to be deleted, got %v", err)
+		}
+	}
+	if a.tree()[0][0] != b.tree()[0][0] {
+		t.Error("expected the trees to match")
+	}
+	if n := syncPair(t, b, a); n != 0 {
+		t.Errorf("expected nothing to differ after a sync, got [%d] leaves", n)
+	}
+}
+
+func TestDeleteWins(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	a.Put("k", "v")
+	syncPair(t, a, b)
+	expectValue(t, b, "k", "v")
+
+	// a later delete replaces the put, and isn't undone by the replica which still has the key
+	b.Delete("k")
+	syncPair(t, a, b)
+	for _, s := range []*Store{a, b} {
+		if _, err := s.Get("k"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected k to be deleted, got %v", err)
+		}
+	}
+
+	a.Put("k", "again")
+	syncPair(t, b, a)
+	expectValue(t, b, "k", "again")
+}
+
+func TestTxnStamps(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	_, err := a.Txn(store.Txn{
+		Compares: []store.Compare{{Key: "x", Condition: store.IfAbsent()}},
+		Then:     []store.Op{{Type: store.OpPut, Key: "x", Value: "1"}, {Type: store.OpPut, Key: "y", Value: "2"}},
+		Else:     []store.Op{{Type: store.OpPut, Key: "z", Value: "3"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncPair(t, b, a)
+	expectValue(t, b, "x", "1")
+	expectValue(t, b, "y", "2")
+	if _, err := b.Get("z"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected the branch which wasn't applied to be ignored, got %v", err)
+	}
+}
+
+func TestExistingKeysLose(t *testing.T) {
+	kv := watch.Wrap(skiplist.New())
+	kv.Put("k", "restored")
+	a, b := Wrap(kv), newReplica()
+	b.Put("k", "written")
+	syncPair(t, a, b)
+	expectValue(t, a, "k", "written")
+}
+
+func TestTombstoneTTL(t *testing.T) {
+	f := &fakeTime{t: time.Now()}
+	a := newReplica(WithClock(f.now), WithTombstoneTTL(time.Minute))
+	a.Put("k", "v")
+	a.Delete("k")
+	if m := a.Metrics(); m.Tombstones != 1 {
+		t.Fatalf("expected a tombstone, got %+v", m)
+	}
+
+	f.add(2 * time.Minute)
+	a.purge()
+	if m := a.Metrics(); m.Keys != 0 {
+		t.Errorf("expected the tombstone to be forgotten, got %+v", m)
+	}
+
+	// and one from a peer which is just as old isn't taken back
+	b := newReplica(WithClock(f.now), WithTombstoneTTL(time.Minute))
+	stale := Record{Key: "k", Deleted: true, Stamp: Timestamp(f.now().Add(-time.Hour).UnixMilli()) << logicalBits}
+	if n, err := b.Merge([]Record{stale}); n != 0 || err != nil {
+		t.Errorf("expected an expired tombstone to be ignored, got %d, %v", n, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	a.Put("k1", 1)
+	b.Put("k2", 2)
+	syncPair(t, a, b)
+	m := a.Metrics()
+	if m.Rounds != 1 || m.Failed != 0 || m.LeavesDiffered != 2 || m.Sent != 1 || m.Received != 1 || m.Repaired != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+	if m.LastSync.IsZero() || m.Keys != 2 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+	if _, err := a.Tree(context.Background(), Depth+1, []int{0}); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("expected a level below the leaves to be invalid, got %v", err)
+	}
+}
+
+func TestConcurrentWritesConverge(t *testing.T) {
+	replicas := []*Store{newReplica(), newReplica(), newReplica()}
+	var wg sync.WaitGroup
+	for i, s := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j != 200; j++ {
+				key := "k" + strconv.Itoa(j%50)
+				if j%7 == i {
+					s.Delete(key)
+				} else {
+					s.Put(key, strconv.Itoa(i*1000+j))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for round := 0; round != 2; round++ {
+		for i, s := range replicas {
+			syncPair(t, s, replicas[(i+1)%len(replicas)])
+		}
+	}
+	root := replicas[0].tree()[0][0]
+	for _, s := range replicas[1:] {
+		if s.tree()[0][0] != root {
+			t.Fatal("expected the replicas to converge")
+		}
+	}
+	for j := 0; j != 50; j++ {
+		key := "k" + strconv.Itoa(j)
+		want, wantErr := replicas[0].Get(key)
+		for _, s := range replicas[1:] {
+			if got, err := s.Get(key); got != want || (err == nil) != (wantErr == nil) {
+				t.Errorf("replicas disagree on [%s]: %v, %v and %v, %v", key, want, wantErr, got, err)
+			}
+		}
+	}
+}
+
+func TestCRDTsMerge(t *testing.T) {
+	f := &fakeTime{t: time.Now()}
+	a, b := newReplica(WithClock(f.now)), newReplica(WithClock(f.now))
+	increment := func(s *Store, node string, delta int64) {
+		t.Helper()
+		op := store.Op{Type: store.OpMerge, Key: "count", Value: crdt.Increment{Node: node, Delta: delta}}
+		if _, err := s.Txn(store.Txn{Then: []store.Op{op}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	increment(a, "a", 5)
+	f.add(time.Millisecond)
+	increment(b, "b", 3)
+	increment(b, "b", -1)
+
+	// the latest write would win if they weren't merged
+	syncPair(t, a, b)
+	for _, s := range []*Store{a, b} {
+		v, _ := s.Get("count")
+		if c, ok := v.(crdt.Counter); !ok || c.Value() != 7 {
+			t.Errorf("expected a counter of [7], got %v", v)
+		}
+	}
+	if a.tree()[0][0] != b.tree()[0][0] {
+		t.Error("expected the trees to match")
+	}
+	if n := syncPair(t, b, a); n != 0 {
+		t.Errorf("expected nothing to differ after a sync, got [%d] leaves", n)
+	}
+
+	// values which aren't CRDTs of the same kind still go to the latest write
+	a.Put("count", "plain")
+	syncPair(t, a, b)
+	expectValue(t, b, "count", "plain")
+}
@@ -0,0 +1,49 @@
+package antientropy
+
+import (
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock reading.  The top 48 bits are wall clock milliseconds, and the bottom 16 count
+// the events within a millisecond, so timestamps order events by the time they happened while still respecting
+// causality when the nodes' clocks disagree.
+type Timestamp uint64
+
+const logicalBits = 16
+
+// Time returns the wall clock part of the timestamp.
+func (t Timestamp) Time() time.Time {
+	return time.UnixMilli(int64(t >> logicalBits))
+}
+
+// Clock hands out timestamps which never go backwards, and are after any timestamp it has been told about.
+type Clock struct {
+	lock sync.Mutex
+	last Timestamp
+	now  func() time.Time
+}
+
+func NewClock(now func() time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns a timestamp later than every one returned or observed before.
+func (c *Clock) Now() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	wall := Timestamp(c.now().UnixMilli()) << logicalBits
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Observe moves the clock past a timestamp from another node.
+func (c *Clock) Observe(t Timestamp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.last = max(c.last, t)
+}
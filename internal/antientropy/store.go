@@ -0,0 +1,454 @@
+// Package antientropy keeps replicas which accept writes independently in step.  Each replica summarises its keys in a
+// Merkle tree, and replicas compare trees to find the parts of the keyspace where they differ, then swap just the keys
+// in those parts.  Every write is stamped by a hybrid logical clock, and the latest write to a key wins, with deletes
+// kept as tombstones so they win too.  The exception is two CRDTs of the same kind, from kv/pkg/crdt, which are merged
+// so that neither replica's changes are lost.
+package antientropy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"hash/fnv"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/crdt"
+	"kv/pkg/watch"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTombstoneTTL is how long a deleted key is remembered, so the delete reaches every replica.  A replica which
+// is out of touch for longer may bring the key back.
+const DefaultTombstoneTTL = 24 * time.Hour
+
+// Record is the latest write to a key, as it's sent between replicas.
+type Record struct {
+	Key     string
+	Value   interface{}
+	Expires time.Time
+	Stamp   Timestamp
+	Deleted bool
+}
+
+// hash covers everything replicas must agree on, so two replicas with the same record have the same hash.
+func (r Record) hash() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(r.Key))
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Stamp))
+	if r.Deleted {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+		if !r.Expires.IsZero() {
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(r.Expires.UnixNano()))
+		}
+		if v, err := anyval.Marshal(r.Value); err == nil {
+			buf, _ = proto.MarshalOptions{Deterministic: true}.MarshalAppend(buf, v)
+		}
+	}
+	h.Write(buf)
+	return h.Sum64()
+}
+
+// newer reports whether r should replace a record with stamp and hash.  Equal stamps are broken by the hash, so every
+// replica picks the same winner.
+func (r Record) newer(stamp Timestamp, hash uint64) bool {
+	return r.Stamp > stamp || r.Stamp == stamp && r.hash() > hash
+}
+
+// version is what a replica keeps about a key to take part in anti-entropy.
+type version struct {
+	stamp   Timestamp
+	deleted bool
+	hash    uint64
+}
+
+type leaf struct {
+	lock     sync.Mutex
+	hash     atomic.Uint64
+	versions map[string]version
+}
+
+// set replaces key's version, keeping the leaf's hash up to date.  The leaf must be locked.
+func (l *leaf) set(key string, v version) {
+	old, found := l.versions[key]
+	if found {
+		l.hash.Store(l.hash.Load() ^ old.hash)
+	}
+	l.versions[key] = v
+	l.hash.Store(l.hash.Load() ^ v.hash)
+}
+
+func (l *leaf) remove(key string) {
+	if old, found := l.versions[key]; found {
+		l.hash.Store(l.hash.Load() ^ old.hash)
+		delete(l.versions, key)
+	}
+}
+
+// Store is a replica which can be kept in step with others.  Writes through it are stamped, and it applies the writes
+// of other replicas with Merge.  Keys already in the wrapped store are given a zero stamp, so a write made anywhere
+// replaces them.
+type Store struct {
+	kv           store.WatchableKVStore
+	clock        *Clock
+	now          func() time.Time
+	tombstoneTTL time.Duration
+	leaves       []leaf
+	counters     counters
+}
+
+type Option func(*Store)
+
+// WithTombstoneTTL remembers deleted keys for ttl, instead of DefaultTombstoneTTL.
+func WithTombstoneTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		s.tombstoneTTL = ttl
+	}
+}
+
+// WithClock reads the time from now, instead of time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// Wrap makes kv a replica, summarising the keys it already has.
+func Wrap(kv store.WatchableKVStore, opts ...Option) *Store {
+	s := &Store{kv: kv, now: time.Now, tombstoneTTL: DefaultTombstoneTTL, leaves: make([]leaf, Leaves)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.clock = NewClock(s.now)
+	for i := range s.leaves {
+		s.leaves[i].versions = make(map[string]version)
+	}
+	kv.ForEach(func(key string, entry store.Entry) bool {
+		r := Record{Key: key, Value: entry.Value, Expires: entry.Expires}
+		s.leaves[Leaf(key)].set(key, version{hash: r.hash()})
+		return true
+	})
+	return s
+}
+
+// lock locks the leaves of keys, in order, and returns a func to unlock them.
+func (s *Store) lock(keys ...string) func() {
+	var indexes []int
+	for _, key := range keys {
+		indexes = append(indexes, Leaf(key))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		s.leaves[i].lock.Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			s.leaves[i].lock.Unlock()
+		}
+	}
+}
+
+// stamp records a local write to key, reading what the write left behind.  The key's leaf must be locked.
+func (s *Store) stamp(key string) {
+	l := &s.leaves[Leaf(key)]
+	r := Record{Key: key}
+	entry, err := s.kv.GetEntry(key, 0)
+	if err != nil {
+		if v, found := l.versions[key]; !found || v.deleted {
+			return
+		}
+		r.Deleted = true
+	} else {
+		r.Value, r.Expires = entry.Value, entry.Expires
+	}
+	r.Stamp = s.clock.Now()
+	l.set(key, version{stamp: r.Stamp, deleted: r.Deleted, hash: r.hash()})
+}
+
+func (s *Store) Put(key string, value interface{}) error {
+	defer s.lock(key)()
+	err := s.kv.Put(key, value)
+	if err == nil {
+		s.stamp(key)
+	}
+	return err
+}
+
+func (s *Store) Get(key string) (interface{}, error) {
+	return s.kv.Get(key)
+}
+
+func (s *Store) GetEntry(key string, revision int64) (store.Entry, error) {
+	return s.kv.GetEntry(key, revision)
+}
+
+func (s *Store) Delete(key string) error {
+	defer s.lock(key)()
+	err := s.kv.Delete(key)
+	if err == nil {
+		s.stamp(key)
+	}
+	return err
+}
+
+func (s *Store) PutIf(key string, value interface{}, cond store.Condition) error {
+	defer s.lock(key)()
+	err := s.kv.PutIf(key, value, cond)
+	if err == nil {
+		s.stamp(key)
+	}
+	return err
+}
+
+func (s *Store) DeleteIf(key string, cond store.Condition) error {
+	defer s.lock(key)()
+	err := s.kv.DeleteIf(key, cond)
+	if err == nil {
+		s.stamp(key)
+	}
+	return err
+}
+
+func (s *Store) Txn(txn store.Txn) (store.TxnResult, error) {
+	var written []string
+	for _, op := range slices.Concat(txn.Then, txn.Else) {
+		if op.Type != store.OpGet {
+			written = append(written, op.Key)
+		}
+	}
+	defer s.lock(written...)()
+	result, err := s.kv.Txn(txn)
+	if err != nil {
+		return result, err
+	}
+	ops := txn.Else
+	if result.Succeeded {
+		ops = txn.Then
+	}
+	for _, op := range ops {
+		if op.Type != store.OpGet {
+			s.stamp(op.Key)
+		}
+	}
+	return result, nil
+}
+
+func (s *Store) BatchGet(keys []string) ([]store.BatchResult, error) {
+	return store.BatchGet(s.kv, keys, false)
+}
+
+// Restore sets the entry without stamping it, as it comes from a snapshot rather than a write.
+func (s *Store) Restore(key string, entry store.Entry) error {
+	defer s.lock(key)()
+	err := s.kv.Restore(key, entry)
+	if err == nil {
+		l := &s.leaves[Leaf(key)]
+		if e, gerr := s.kv.GetEntry(key, 0); gerr == nil {
+			r := Record{Key: key, Value: e.Value, Expires: e.Expires}
+			l.set(key, version{hash: r.hash()})
+		} else {
+			l.remove(key)
+		}
+	}
+	return err
+}
+
+func (s *Store) ForEach(f func(key string, entry store.Entry) bool) {
+	s.kv.ForEach(f)
+}
+
+func (s *Store) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.kv.Range(start, end, limit)
+}
+
+func (s *Store) Export(start, end string) ([]store.KeyValue, int64, error) {
+	return store.ExportRange(s.kv, start, end)
+}
+
+func (s *Store) Expired(now time.Time, limit int) []string {
+	return s.kv.Expired(now, limit)
+}
+
+func (s *Store) Revision() int64 {
+	return s.kv.Revision()
+}
+
+func (s *Store) Compact(revision int64) error {
+	return s.kv.Compact(revision)
+}
+
+func (s *Store) Sync(ctx context.Context, c store.Consistency, minRevision int64) (store.Staleness, error) {
+	return store.Sync(ctx, s.kv, c, minRevision)
+}
+
+func (s *Store) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
+	return s.kv.AddWatch(key, op)
+}
+
+func (s *Store) Watch(req watch.WatchRequest) (chan watch.Update, func(), error) {
+	return s.kv.Watch(req)
+}
+
+var errInvalidNode = store.NewError(store.ErrInvalid, "antientropy: no such node in the tree")
+
+// Tree returns the hashes of nodes at level of the store's Merkle tree.
+func (s *Store) Tree(_ context.Context, level int, nodes []int) ([]uint64, error) {
+	hashes, ok := s.tree().hashes(level, nodes)
+	if !ok {
+		return nil, errInvalidNode
+	}
+	return hashes, nil
+}
+
+func (s *Store) tree() tree {
+	leaves := make([]uint64, Leaves)
+	for i := range s.leaves {
+		leaves[i] = s.leaves[i].hash.Load()
+	}
+	return buildTree(leaves)
+}
+
+// Records returns the record of every key in leaves.
+func (s *Store) Records(leaves []int) ([]Record, error) {
+	var records []Record
+	for _, i := range leaves {
+		if i < 0 || i >= Leaves {
+			return nil, errInvalidNode
+		}
+		l := &s.leaves[i]
+		l.lock.Lock()
+		for key, v := range l.versions {
+			r := Record{Key: key, Stamp: v.stamp, Deleted: v.deleted}
+			if !v.deleted {
+				entry, err := s.kv.GetEntry(key, 0)
+				if err != nil {
+					// it expired, and will be stamped as deleted when it's reaped
+					continue
+				}
+				r.Value, r.Expires = entry.Value, entry.Expires
+			}
+			records = append(records, r)
+		}
+		l.lock.Unlock()
+	}
+	return records, nil
+}
+
+// Merge applies the records which are newer than this replica's, and returns how many it applied.
+func (s *Store) Merge(records []Record) (int, error) {
+	applied := 0
+	var errs []error
+	for _, r := range records {
+		ok, err := s.merge(r)
+		if err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			applied++
+		}
+	}
+	s.counters.repaired.Add(uint64(applied))
+	s.counters.superseded.Add(uint64(len(records) - applied - len(errs)))
+	return applied, errors.Join(errs...)
+}
+
+func (s *Store) merge(r Record) (bool, error) {
+	if r.Deleted && r.Stamp.Time().Before(s.now().Add(-s.tombstoneTTL)) {
+		return false, nil
+	}
+	s.clock.Observe(r.Stamp)
+	l := &s.leaves[Leaf(r.Key)]
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	v, found := l.versions[r.Key]
+	if found && !v.deleted && !r.Deleted {
+		if changed, joined, err := s.join(r, v); joined {
+			return changed, err
+		}
+	}
+	if found && !r.newer(v.stamp, v.hash) {
+		return false, nil
+	}
+
+	op := store.Op{Type: store.OpPut, Key: r.Key, Value: r.Value, Expires: r.Expires}
+	if r.Deleted {
+		op = store.Op{Type: store.OpDelete, Key: r.Key}
+	}
+	if _, err := s.kv.Txn(store.Txn{Then: []store.Op{op}}); err != nil {
+		return false, err
+	}
+	l.set(r.Key, version{stamp: r.Stamp, deleted: r.Deleted, hash: r.hash()})
+	return true, nil
+}
+
+// join merges a record holding a CRDT into the key's own CRDT of the same kind, rather than keeping whichever was
+// written last, and reports false in joined when they aren't both CRDTs of that kind.  When the result is one of the
+// two, it keeps the later stamp, so replicas which have made the same changes agree.  Otherwise it's a new write.
+// The leaf must be locked.
+func (s *Store) join(r Record, v version) (changed, joined bool, err error) {
+	m, ok := r.Value.(crdt.Merger)
+	if !ok {
+		return false, false, nil
+	}
+	entry, err := s.kv.GetEntry(r.Key, 0)
+	if err != nil || reflect.TypeOf(entry.Value) != reflect.TypeOf(r.Value) {
+		return false, false, nil
+	}
+	value, err := m.Merge(entry.Value, true)
+	if err != nil {
+		return false, false, nil
+	}
+
+	merged, mine, theirs := Record{Key: r.Key, Value: value}, Record{Key: r.Key, Value: entry.Value}, Record{Key: r.Key, Value: r.Value}
+	if merged.hash() != mine.hash() {
+		_, err = s.kv.Txn(store.Txn{Then: []store.Op{{Type: store.OpMerge, Key: r.Key, Value: m}}})
+		if err != nil {
+			return false, true, err
+		}
+	}
+
+	stamp := max(v.stamp, r.Stamp)
+	if merged.hash() != mine.hash() && merged.hash() != theirs.hash() {
+		stamp = s.clock.Now()
+	}
+	if stamp == v.stamp && merged.hash() == mine.hash() {
+		return false, true, nil
+	}
+	l := &s.leaves[Leaf(r.Key)]
+	merged.Expires, merged.Stamp = entry.Expires, stamp
+	l.set(r.Key, version{stamp: stamp, hash: merged.hash()})
+	return true, true, nil
+}
+
+// Exchange merges records from a peer, and returns this replica's records in leaves from before the merge, so the
+// peer can take the ones which are newer than its own.
+func (s *Store) Exchange(_ context.Context, leaves []int, records []Record) ([]Record, error) {
+	mine, err := s.Records(leaves)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.Merge(records)
+	return mine, err
+}
+
+// purge forgets tombstones older than the tombstone TTL.
+func (s *Store) purge() {
+	before := s.now().Add(-s.tombstoneTTL)
+	for i := range s.leaves {
+		l := &s.leaves[i]
+		l.lock.Lock()
+		for key, v := range l.versions {
+			if v.deleted && v.stamp.Time().Before(before) {
+				l.remove(key)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
@@ -0,0 +1,252 @@
+package antientropy
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"kv/internal/gen"
+	"kv/pkg/anyval"
+	"log/slog"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// exchangeLeaves is how many leaves are swapped in one Exchange, to keep the messages small.
+const exchangeLeaves = 64
+
+var errTreeMismatch = errors.New("antientropy: peer returned the wrong number of hashes")
+
+// Peer is another replica.  A Store is a Peer itself, so replicas in the same process can sync directly.
+type Peer interface {
+	// Tree returns the hashes of nodes at level of the peer's Merkle tree.
+	Tree(ctx context.Context, level int, nodes []int) ([]uint64, error)
+
+	// Exchange merges records into the peer, and returns the peer's records in leaves.
+	Exchange(ctx context.Context, leaves []int, records []Record) ([]Record, error)
+}
+
+// SyncWith compares trees with peer, then swaps the records of the leaves which differ, so both replicas end up with
+// the latest write to each of those keys.  It returns how many leaves differed.
+func (s *Store) SyncWith(ctx context.Context, peer Peer) (int, error) {
+	s.counters.rounds.Add(1)
+	n, err := s.syncWith(ctx, peer)
+	if err != nil {
+		s.counters.failed.Add(1)
+	} else {
+		s.counters.lastSync.Store(s.now().UnixMilli())
+	}
+	return n, err
+}
+
+func (s *Store) syncWith(ctx context.Context, peer Peer) (int, error) {
+	// walk down the tree, only looking below nodes which differ
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		theirs, err := peer.Tree(ctx, level, nodes)
+		if err != nil {
+			return 0, err
+		}
+		if len(theirs) != len(nodes) {
+			return 0, errTreeMismatch
+		}
+		ours, _ := s.tree().hashes(level, nodes)
+		var differ []int
+		for i := range nodes {
+			if ours[i] != theirs[i] {
+				differ = append(differ, nodes[i])
+			}
+		}
+		if len(differ) == 0 || level == Depth {
+			nodes = differ
+			break
+		}
+		nodes = children(differ)
+	}
+	s.counters.differed.Add(uint64(len(nodes)))
+
+	for start := 0; start < len(nodes); start += exchangeLeaves {
+		leaves := nodes[start:min(start+exchangeLeaves, len(nodes))]
+		records, err := s.Records(leaves)
+		if err != nil {
+			return 0, err
+		}
+		theirs, err := peer.Exchange(ctx, leaves, records)
+		if err != nil {
+			return 0, err
+		}
+		s.counters.sent.Add(uint64(len(records)))
+		s.counters.received.Add(uint64(len(theirs)))
+		if _, err := s.Merge(theirs); err != nil {
+			return 0, err
+		}
+	}
+	return len(nodes), nil
+}
+
+// Run syncs with a random peer every interval, and forgets old tombstones, until done is closed.
+func (s *Store) Run(peers []Peer, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.purge()
+			if len(peers) == 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			n, err := s.SyncWith(ctx, peers[rand.IntN(len(peers))])
+			cancel()
+			if err != nil {
+				slog.Warn("anti-entropy sync failed", "err", err)
+			} else if n > 0 {
+				slog.Debug("anti-entropy repaired leaves", "count", n)
+			}
+		}
+	}
+}
+
+type counters struct {
+	rounds, failed, differed, sent, received, repaired, superseded atomic.Uint64
+	lastSync                                                       atomic.Int64
+}
+
+// Metrics reports what anti-entropy has done since the store started.
+type Metrics struct {
+	// Rounds counts the syncs this replica started, and Failed the ones which didn't finish.
+	Rounds uint64 `json:"rounds"`
+	Failed uint64 `json:"failed"`
+
+	// LeavesDiffered counts the leaves of the tree which differed from a peer's, so had their records swapped.
+	LeavesDiffered uint64 `json:"leavesDiffered"`
+
+	// Sent and Received count the records swapped, whether they were newer or not.
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+
+	// Repaired counts the records from peers which were newer, so were applied.  Superseded counts the ones which
+	// lost to a newer write here.
+	Repaired   uint64 `json:"repaired"`
+	Superseded uint64 `json:"superseded"`
+
+	// Keys is how many keys the tree covers, and Tombstones how many of them were deleted.
+	Keys       int `json:"keys"`
+	Tombstones int `json:"tombstones"`
+
+	// LastSync is when a sync started here last finished, or zero.
+	LastSync time.Time `json:"lastSync"`
+}
+
+func (s *Store) Metrics() Metrics {
+	m := Metrics{
+		Rounds:         s.counters.rounds.Load(),
+		Failed:         s.counters.failed.Load(),
+		LeavesDiffered: s.counters.differed.Load(),
+		Sent:           s.counters.sent.Load(),
+		Received:       s.counters.received.Load(),
+		Repaired:       s.counters.repaired.Load(),
+		Superseded:     s.counters.superseded.Load(),
+	}
+	if last := s.counters.lastSync.Load(); last != 0 {
+		m.LastSync = time.UnixMilli(last)
+	}
+	for i := range s.leaves {
+		l := &s.leaves[i]
+		l.lock.Lock()
+		m.Keys += len(l.versions)
+		for _, v := range l.versions {
+			if v.deleted {
+				m.Tombstones++
+			}
+		}
+		l.lock.Unlock()
+	}
+	return m
+}
+
+// GRPCPeer is a replica reached with the AntiEntropy gRPC service.
+type GRPCPeer struct {
+	client gen.AntiEntropyClient
+}
+
+func NewGRPCPeer(conn grpc.ClientConnInterface) *GRPCPeer {
+	return &GRPCPeer{client: gen.NewAntiEntropyClient(conn)}
+}
+
+func (p *GRPCPeer) Tree(ctx context.Context, level int, nodes []int) ([]uint64, error) {
+	resp, err := p.client.Tree(ctx, &gen.TreeRequest{Level: int32(level), Nodes: toInt32s(nodes)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Hashes, nil
+}
+
+func (p *GRPCPeer) Exchange(ctx context.Context, leaves []int, records []Record) ([]Record, error) {
+	req := &gen.ExchangeRequest{Leaves: toInt32s(leaves)}
+	for _, r := range records {
+		pr, err := ToProto(r)
+		if err != nil {
+			return nil, err
+		}
+		req.Records = append(req.Records, pr)
+	}
+	resp, err := p.client.Exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return FromProtos(resp.Records)
+}
+
+func ToProto(r Record) (*gen.SyncRecord, error) {
+	pr := &gen.SyncRecord{Key: r.Key, Stamp: uint64(r.Stamp), Deleted: r.Deleted}
+	if !r.Expires.IsZero() {
+		pr.Expires = r.Expires.UnixNano()
+	}
+	if !r.Deleted {
+		v, err := anyval.Marshal(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		pr.Value = v
+	}
+	return pr, nil
+}
+
+func FromProtos(prs []*gen.SyncRecord) ([]Record, error) {
+	records := make([]Record, 0, len(prs))
+	for _, pr := range prs {
+		r := Record{Key: pr.Key, Stamp: Timestamp(pr.Stamp), Deleted: pr.Deleted}
+		if pr.Expires != 0 {
+			r.Expires = time.Unix(0, pr.Expires)
+		}
+		if !r.Deleted {
+			v, err := anyval.Unmarshal(pr.Value)
+			if err != nil {
+				return nil, err
+			}
+			r.Value = v
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func toInt32s(ints []int) []int32 {
+	out := make([]int32, len(ints))
+	for i, n := range ints {
+		out[i] = int32(n)
+	}
+	return out
+}
+
+// FromInt32s converts the nodes or leaves of a request.
+func FromInt32s(ints []int32) []int {
+	out := make([]int, len(ints))
+	for i, n := range ints {
+		out[i] = int(n)
+	}
+	return out
+}
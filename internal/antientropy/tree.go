@@ -0,0 +1,71 @@
+package antientropy
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// The tree has Depth levels below the root, each node with Fanout children, so there are Leaves leaves.  Every key
+// hashes to a leaf, whose hash combines the records of its keys.  Level 0 is the root.
+const (
+	Fanout = 16
+	Depth  = 3
+	Leaves = Fanout * Fanout * Fanout
+)
+
+// Leaf returns the leaf key belongs to.
+func Leaf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % Leaves)
+}
+
+// tree is the hashes of every node, by level.
+type tree [Depth + 1][]uint64
+
+// buildTree hashes the levels above the leaves.
+func buildTree(leaves []uint64) tree {
+	var t tree
+	t[Depth] = leaves
+	for level := Depth - 1; level >= 0; level-- {
+		below := t[level+1]
+		t[level] = make([]uint64, len(below)/Fanout)
+		buf := make([]byte, 0, 8*Fanout)
+		for i := range t[level] {
+			buf = buf[:0]
+			for _, child := range below[i*Fanout : (i+1)*Fanout] {
+				buf = binary.LittleEndian.AppendUint64(buf, child)
+			}
+			h := fnv.New64a()
+			h.Write(buf)
+			t[level][i] = h.Sum64()
+		}
+	}
+	return t
+}
+
+// hashes returns the hashes of nodes at level, or false if any of them isn't in the tree.
+func (t tree) hashes(level int, nodes []int) ([]uint64, bool) {
+	if level < 0 || level > Depth {
+		return nil, false
+	}
+	hashes := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		if node < 0 || node >= len(t[level]) {
+			return nil, false
+		}
+		hashes[i] = t[level][node]
+	}
+	return hashes, true
+}
+
+// children returns the children of nodes, in order.
+func children(nodes []int) []int {
+	var c []int
+	for _, node := range nodes {
+		for i := 0; i != Fanout; i++ {
+			c = append(c, node*Fanout+i)
+		}
+	}
+	return c
+}
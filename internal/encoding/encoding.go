@@ -0,0 +1,21 @@
+// Package encoding has the helpers shared by the binary formats of the WAL, raft's log and state, and replicated
+// commands.
+package encoding
+
+import "encoding/binary"
+
+// AppendBytes encodes b as | length uvarint | bytes |.
+func AppendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// ReadBytes reads a uvarint length followed by that many bytes, and returns the rest of data.  Ok is false when data
+// is too short, and the caller decides what error that is.
+func ReadBytes(data []byte) (b []byte, rest []byte, ok bool) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || uint64(len(data)-size) < n {
+		return nil, nil, false
+	}
+	return data[size : size+int(n)], data[size+int(n):], true
+}
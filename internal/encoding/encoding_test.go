@@ -0,0 +1,23 @@
+package encoding
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadBytes(t *testing.T) {
+	buf := AppendBytes(AppendBytes(nil, []byte("key")), nil)
+	b, rest, ok := ReadBytes(buf)
+	if !ok || string(b) != "key" {
+		t.Fatalf("expected [key], got [%s] %v", b, ok)
+	}
+	if b, rest, ok = ReadBytes(rest); !ok || len(b) != 0 || len(rest) != 0 {
+		t.Errorf("expected an empty value and nothing left, got [%s] [%s] %v", b, rest, ok)
+	}
+
+	for _, data := range [][]byte{nil, buf[:2], {0xff}, bytes.Repeat([]byte{0xff}, 11)} {
+		if _, _, ok := ReadBytes(data); ok {
+			t.Errorf("expected %v to be too short", data)
+		}
+	}
+}
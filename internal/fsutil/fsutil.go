@@ -0,0 +1,14 @@
+// Package fsutil has the file system helpers shared by the WAL, snapshots and raft's storage.
+package fsutil
+
+import "os"
+
+// SyncDir flushes directory entries, so created and renamed files survive a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"kv/internal/encoding"
+)
+
+var errCorrupt = errors.New("raft: corrupt data")
+
+// appendString encodes s as | length uvarint | bytes |.
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 {
+		return 0, nil, errCorrupt
+	}
+	return n, data[size:], nil
+}
+
+// appendMembers encodes members as | count uvarint |, followed by | id | address | for each.
+func appendMembers(buf []byte, members []Member) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(members)))
+	for _, m := range members {
+		buf = appendString(buf, m.ID)
+		buf = appendString(buf, m.Address)
+	}
+	return buf
+}
+
+func readMembers(data []byte) ([]Member, []byte, error) {
+	count, data, err := readUvarint(data)
+	if err != nil || count > uint64(len(data)) {
+		return nil, nil, errCorrupt
+	}
+
+	members := make([]Member, count)
+	for i := range members {
+		var id, address []byte
+		var ok bool
+		if id, data, ok = encoding.ReadBytes(data); ok {
+			address, data, ok = encoding.ReadBytes(data)
+		}
+		if !ok {
+			return nil, nil, errCorrupt
+		}
+		members[i] = Member{ID: string(id), Address: string(address)}
+	}
+	return members, data, nil
+}
+
+type changeType byte
+
+const (
+	addMember changeType = iota + 1
+	removeMember
+)
+
+// A proposed membership change is encoded as | type byte | id | address |.  The leader turns it into an EntryConfig
+// with the whole membership.
+func encodeChange(change changeType, m Member) []byte {
+	return appendMembers([]byte{byte(change)}, []Member{m})
+}
+
+func decodeChange(data []byte) (changeType, Member, error) {
+	if len(data) == 0 {
+		return 0, Member{}, errCorrupt
+	}
+	members, _, err := readMembers(data[1:])
+	if err != nil || len(members) != 1 {
+		return 0, Member{}, errCorrupt
+	}
+	return changeType(data[0]), members[0], nil
+}
+
+// appendEntry encodes e as | index uvarint | term uvarint | type byte | data |.
+func appendEntry(buf []byte, e Entry) []byte {
+	buf = binary.AppendUvarint(buf, e.Index)
+	buf = binary.AppendUvarint(buf, e.Term)
+	buf = append(buf, byte(e.Type))
+	return append(buf, e.Data...)
+}
+
+func decodeEntry(data []byte) (Entry, error) {
+	e := Entry{}
+	var err error
+	e.Index, data, err = readUvarint(data)
+	if err == nil {
+		e.Term, data, err = readUvarint(data)
+	}
+	if err != nil || len(data) == 0 {
+		return e, errCorrupt
+	}
+	e.Type = EntryType(data[0])
+	e.Data = append([]byte(nil), data[1:]...)
+	return e, nil
+}
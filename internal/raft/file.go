@@ -0,0 +1,292 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"kv/internal/encoding"
+	"kv/internal/fsutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage keeps a node's state in three files in a directory:
+//
+//   - state holds the HardState, as | term uvarint | vote |
+//   - snapshot holds the latest snapshot, as | index uvarint | term uvarint | members | data |
+//   - log holds the entries after the snapshot, each framed as | length uint32 | crc32c uint32 | entry |
+//
+// state and snapshot are replaced whole, and end with a crc32c of the rest of the file.  Entries are only ever added
+// to the end of the log, so an entry replaces any earlier ones at the same index or after it when the log is read.
+type FileStorage struct {
+	lock sync.Mutex
+	dir  string
+	log  *os.File
+	buf  []byte
+}
+
+const (
+	stateFile    = "state"
+	snapshotFile = "snapshot"
+	logFile      = "log"
+	frameHeader  = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewFileStorage opens, or creates, the storage in dir.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{dir: dir, log: log}, nil
+}
+
+func (s *FileStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.log.Close()
+}
+
+func (s *FileStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := HardState{}
+	data, err := s.readFile(stateFile)
+	if err == nil && data != nil {
+		state.Term, data, err = readUvarint(data)
+		if err == nil {
+			vote, _, ok := encoding.ReadBytes(data)
+			if !ok {
+				err = errCorrupt
+			}
+			state.Vote = string(vote)
+		}
+	}
+	if err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+
+	snap := Snapshot{}
+	data, err = s.readFile(snapshotFile)
+	if err == nil && data != nil {
+		snap, err = decodeSnapshot(data)
+	}
+	if err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+
+	entries, err := s.readLog()
+	if err != nil {
+		return HardState{}, Snapshot{}, nil, err
+	}
+
+	// the log may have been rewritten before the snapshot was saved, or the other way round
+	if len(entries) > 0 && entries[0].Index <= snap.Index {
+		entries = entriesAfter(entries, snap)
+	} else if len(entries) > 0 && entries[0].Index != snap.Index+1 {
+		entries = nil
+	}
+	return state, snap, entries, nil
+}
+
+// readLog reads the entries in the log, truncating a torn entry at the end of it.
+func (s *FileStorage) readLog() ([]Entry, error) {
+	_, err := s.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(s.log)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	offset := 0
+	for offset < len(data) {
+		payload, size := readFrame(data[offset:])
+		if payload == nil {
+			break
+		}
+		e, err := decodeEntry(payload)
+		if err != nil {
+			return nil, err
+		}
+		entries = appendEntries(entries, []Entry{e})
+		offset += size
+	}
+
+	if offset < len(data) {
+		slog.Warn("truncating torn raft log entry", "dir", s.dir, "offset", offset, "size", len(data)-offset)
+		err = s.log.Truncate(int64(offset))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// readFrame returns the payload of the frame at the start of data and the frame's size, or nil if it's incomplete or
+// fails its checksum.
+func readFrame(data []byte) ([]byte, int) {
+	if len(data) < frameHeader {
+		return nil, 0
+	}
+	length := binary.LittleEndian.Uint32(data)
+	end := frameHeader + int(length)
+	if len(data) < end {
+		return nil, 0
+	}
+	payload := data[frameHeader:end]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0
+	}
+	return payload, end
+}
+
+func appendFrame(buf []byte, e Entry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, frameHeader)...)
+	buf = appendEntry(buf, e)
+	payload := buf[start+frameHeader:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+func (s *FileStorage) SaveState(state HardState) error {
+	buf := binary.AppendUvarint(nil, state.Term)
+	buf = appendString(buf, state.Vote)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.writeFile(stateFile, buf)
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.buf = s.buf[:0]
+	for _, e := range entries {
+		s.buf = appendFrame(s.buf, e)
+	}
+	_, err := s.log.Write(s.buf)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	return err
+}
+
+// SaveSnapshot saves snap, then rewrites the log without the entries it covers.
+func (s *FileStorage) SaveSnapshot(snap Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.writeFile(snapshotFile, encodeSnapshot(snap))
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.readLog()
+	if err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	for _, e := range entriesAfter(entries, snap) {
+		s.buf = appendFrame(s.buf, e)
+	}
+	err = s.writeFile(logFile, s.buf)
+	if err != nil {
+		return err
+	}
+
+	log, err := os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log = log
+	return nil
+}
+
+func encodeSnapshot(snap Snapshot) []byte {
+	buf := binary.AppendUvarint(nil, snap.Index)
+	buf = binary.AppendUvarint(buf, snap.Term)
+	buf = appendMembers(buf, snap.Members)
+	return append(buf, snap.Data...)
+}
+
+func decodeSnapshot(data []byte) (Snapshot, error) {
+	snap := Snapshot{}
+	var err error
+	snap.Index, data, err = readUvarint(data)
+	if err == nil {
+		snap.Term, data, err = readUvarint(data)
+	}
+	if err == nil {
+		snap.Members, data, err = readMembers(data)
+	}
+	snap.Data = data
+	return snap, err
+}
+
+// readFile returns the contents of one of the files which are replaced whole, without its checksum, or nil if it
+// doesn't exist.
+func (s *FileStorage) readFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, errCorrupt
+	}
+	data, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(sum) {
+		return nil, errCorrupt
+	}
+	return data, nil
+}
+
+// writeFile replaces a file with data.  Files other than the log have a checksum added.
+func (s *FileStorage) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// a no-op once the file has been renamed
+		os.Remove(tmp.Name())
+	}()
+
+	if name != logFile {
+		data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	return fsutil.SyncDir(s.dir)
+}
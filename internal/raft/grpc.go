@@ -0,0 +1,150 @@
+package raft
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"kv/internal/gen"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// peerQueueSize is how many messages wait to be sent to a peer before more are dropped.
+	peerQueueSize = 256
+
+	sendTimeout = 5 * time.Second
+)
+
+// GRPCTransport sends messages with the Raft gRPC service.  Each peer has its own connection and queue, so a slow or
+// unreachable peer doesn't hold up the others.
+type GRPCTransport struct {
+	lock   sync.Mutex
+	peers  map[string]*peer
+	closed bool
+}
+
+type peer struct {
+	conn   *grpc.ClientConn
+	client gen.RaftClient
+	queue  chan *gen.RaftMessage
+}
+
+func NewGRPCTransport() *GRPCTransport {
+	return &GRPCTransport{peers: map[string]*peer{}}
+}
+
+func (t *GRPCTransport) Send(to Member, m Message) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.peer(to.Address)
+	if p == nil {
+		return
+	}
+	select {
+	case p.queue <- ToProto(m):
+	default:
+		slog.Debug("raft: dropping message to a slow peer", "to", to.ID, "type", m.Type)
+	}
+}
+
+// peer returns the peer at address, connecting to it the first time.  The lock must be held.
+func (t *GRPCTransport) peer(address string) *peer {
+	if t.closed || address == "" {
+		return nil
+	}
+	if p, found := t.peers[address]; found {
+		return p
+	}
+
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(math.MaxInt32)))
+	if err != nil {
+		slog.Error("raft: invalid peer address", "address", address, "err", err)
+		return nil
+	}
+	p := &peer{conn: conn, client: gen.NewRaftClient(conn), queue: make(chan *gen.RaftMessage, peerQueueSize)}
+	t.peers[address] = p
+	go p.run()
+	return p
+}
+
+func (p *peer) run() {
+	for m := range p.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		_, err := p.client.Step(ctx, m)
+		cancel()
+		if err != nil {
+			slog.Debug("raft: sending message failed", "to", m.To, "err", err)
+		}
+	}
+	p.conn.Close()
+}
+
+// Close stops sending messages and closes the connections.
+func (t *GRPCTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	for address, p := range t.peers {
+		close(p.queue)
+		delete(t.peers, address)
+	}
+}
+
+func ToProto(m Message) *gen.RaftMessage {
+	pm := &gen.RaftMessage{
+		Type:     int32(m.Type),
+		From:     m.From,
+		To:       m.To,
+		Term:     m.Term,
+		Index:    m.Index,
+		LogTerm:  m.LogTerm,
+		Commit:   m.Commit,
+		Reject:   m.Reject,
+		Proposal: m.Proposal,
+		Error:    m.Error,
+		Round:    m.Round,
+		Transfer: m.Transfer,
+	}
+	for _, e := range m.Entries {
+		pm.Entries = append(pm.Entries, &gen.RaftEntry{Index: e.Index, Term: e.Term, Type: int32(e.Type), Data: e.Data})
+	}
+	if s := m.Snapshot; s != nil {
+		pm.Snapshot = &gen.RaftSnapshot{Index: s.Index, Term: s.Term, Data: s.Data}
+		for _, member := range s.Members {
+			pm.Snapshot.Members = append(pm.Snapshot.Members, &gen.RaftMember{Id: member.ID, Address: member.Address})
+		}
+	}
+	return pm
+}
+
+func FromProto(pm *gen.RaftMessage) Message {
+	m := Message{
+		Type:     MessageType(pm.Type),
+		From:     pm.From,
+		To:       pm.To,
+		Term:     pm.Term,
+		Index:    pm.Index,
+		LogTerm:  pm.LogTerm,
+		Commit:   pm.Commit,
+		Reject:   pm.Reject,
+		Proposal: pm.Proposal,
+		Error:    pm.Error,
+		Round:    pm.Round,
+		Transfer: pm.Transfer,
+	}
+	for _, e := range pm.Entries {
+		m.Entries = append(m.Entries, Entry{Index: e.Index, Term: e.Term, Type: EntryType(e.Type), Data: e.Data})
+	}
+	if s := pm.Snapshot; s != nil {
+		m.Snapshot = &Snapshot{Index: s.Index, Term: s.Term, Data: s.Data}
+		for _, member := range s.Members {
+			m.Snapshot.Members = append(m.Snapshot.Members, Member{ID: member.Id, Address: member.Address})
+		}
+	}
+	return m
+}
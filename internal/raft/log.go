@@ -0,0 +1,69 @@
+package raft
+
+// raftLog is the part of the log after the latest snapshot.  The entry at snapIndex is only known by its term.
+type raftLog struct {
+	snapIndex uint64
+	snapTerm  uint64
+	entries   []Entry
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, and false if it's been compacted or doesn't exist yet.
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	switch {
+	case index == l.snapIndex:
+		return l.snapTerm, true
+	case index < l.snapIndex || index > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// slice returns the entries from index from up to, but not including, to.  From must be after the snapshot.
+func (l *raftLog) slice(from, to uint64) []Entry {
+	return l.entries[from-l.snapIndex-1 : to-l.snapIndex-1]
+}
+
+// truncate removes the entry at index and every one after it.
+func (l *raftLog) truncate(index uint64) {
+	l.entries = l.entries[:index-l.snapIndex-1]
+}
+
+func (l *raftLog) append(entries ...Entry) {
+	l.entries = append(l.entries, entries...)
+}
+
+// compact drops the entries up to and including index, which a snapshot now covers.
+func (l *raftLog) compact(index, term uint64) {
+	l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	l.snapIndex, l.snapTerm = index, term
+}
+
+// restore replaces the log with a snapshot's position.  Entries which follow on from the snapshot are kept.
+func (l *raftLog) restore(index, term uint64) {
+	if t, ok := l.term(index); ok && t == term && index >= l.snapIndex {
+		l.compact(index, term)
+		return
+	}
+	l.entries = nil
+	l.snapIndex, l.snapTerm = index, term
+}
+
+// upToDate reports whether a log ending with an entry at index and term is at least as up to date as this one.
+func (l *raftLog) upToDate(index, term uint64) bool {
+	return term > l.lastTerm() || term == l.lastTerm() && index >= l.lastIndex()
+}
@@ -0,0 +1,112 @@
+package raft
+
+type MessageType int
+
+const (
+	// MsgPreVote asks whether a node would vote for the sender at Term, without changing the receiver's term.
+	MsgPreVote MessageType = iota + 1
+	MsgPreVoteResponse
+
+	// MsgVote asks for a node's vote at Term.  Index and LogTerm describe the last entry of the candidate's log.
+	MsgVote
+	MsgVoteResponse
+
+	// MsgAppend sends the entries after Index, whose term is LogTerm, and the leader's Commit.  With no entries, it's a
+	// heartbeat.
+	MsgAppend
+
+	// MsgAppendResponse has the index of the follower's last matching entry, or a hint of where to retry from when
+	// Reject is set.
+	MsgAppendResponse
+
+	// MsgSnapshot sends a snapshot to a follower which is missing entries the leader no longer has.  It's answered
+	// with a MsgAppendResponse.
+	MsgSnapshot
+
+	// MsgPropose forwards a follower's proposal to the leader.
+	MsgPropose
+
+	// MsgProposeResponse tells the follower where its proposal went in the log, so it can wait for it to be applied.
+	MsgProposeResponse
+
+	// MsgReadIndex asks the leader for its commit index, once it has confirmed it's still the leader.
+	MsgReadIndex
+
+	// MsgReadIndexResponse has the leader's confirmed commit in Index, or Reject if it isn't the leader.
+	MsgReadIndexResponse
+
+	// MsgTransferLeader asks the leader to hand leadership over to Transfer.
+	MsgTransferLeader
+
+	// MsgTimeoutNow tells the node leadership is being transferred to that it's caught up, and should start an
+	// election straight away.
+	MsgTimeoutNow
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgPreVote:
+		return "pre-vote"
+	case MsgPreVoteResponse:
+		return "pre-vote-response"
+	case MsgVote:
+		return "vote"
+	case MsgVoteResponse:
+		return "vote-response"
+	case MsgAppend:
+		return "append"
+	case MsgAppendResponse:
+		return "append-response"
+	case MsgSnapshot:
+		return "snapshot"
+	case MsgPropose:
+		return "propose"
+	case MsgProposeResponse:
+		return "propose-response"
+	case MsgReadIndex:
+		return "read-index"
+	case MsgReadIndexResponse:
+		return "read-index-response"
+	case MsgTransferLeader:
+		return "transfer-leader"
+	case MsgTimeoutNow:
+		return "timeout-now"
+	}
+	return "unknown"
+}
+
+// Message is sent between nodes.  Which fields are used depends on the Type.
+type Message struct {
+	Type MessageType
+	From string
+	To   string
+	Term uint64
+
+	Index   uint64
+	LogTerm uint64
+	Entries []Entry
+	Commit  uint64
+	Reject  bool
+
+	Snapshot *Snapshot
+
+	// Proposal identifies a forwarded proposal, so the response can be matched to it.
+	Proposal uint64
+
+	// Error says why a forwarded proposal was rejected.
+	Error string
+
+	// Round is the leader's heartbeat round when it sent a MsgAppend or MsgSnapshot, which the response echoes.  A
+	// round answered by a majority confirms the sender was still the leader when it started.
+	Round uint64
+
+	// Transfer is the node leadership is being transferred to.  It's also set on the votes of the election the node
+	// starts, so they aren't ignored for the sake of the old leader's lease.
+	Transfer string
+}
+
+// Transport sends messages to other nodes.  The receiving side of a transport passes messages to Node.Step.
+type Transport interface {
+	// Send sends m to a member without blocking.  Messages may be lost or reordered, which the protocol allows for.
+	Send(to Member, m Message)
+}
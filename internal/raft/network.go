@@ -0,0 +1,76 @@
+package raft
+
+import "sync"
+
+// Network connects nodes in the same process, so a cluster can be tested without sockets.  It can be split into
+// partitions which can't reach each other.
+type Network struct {
+	lock  sync.RWMutex
+	nodes map[string]*Node
+
+	// group is the partition each node is in, when the network is partitioned.
+	group map[string]int
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: map[string]*Node{}}
+}
+
+// Transport returns the transport for the node id to send messages with.
+func (n *Network) Transport(id string) Transport {
+	return networkTransport{network: n, from: id}
+}
+
+// Add connects a node, so it receives the messages sent to it.  A node which is added again replaces the old one.
+func (n *Network) Add(node *Node) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.nodes[node.id] = node
+}
+
+// Remove disconnects a node.
+func (n *Network) Remove(id string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.nodes, id)
+}
+
+// Partition splits the network into groups of nodes which can only reach each other.  A node which isn't in any group
+// can't reach anything.
+func (n *Network) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.group = map[string]int{}
+	for i, ids := range groups {
+		for _, id := range ids {
+			n.group[id] = i + 1
+		}
+	}
+}
+
+// Heal removes the partitions.
+func (n *Network) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.group = nil
+}
+
+func (n *Network) deliver(from string, m Message) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	if n.group != nil && (n.group[from] == 0 || n.group[from] != n.group[m.To]) {
+		return
+	}
+	if node := n.nodes[m.To]; node != nil {
+		node.Step(m)
+	}
+}
+
+type networkTransport struct {
+	network *Network
+	from    string
+}
+
+func (t networkTransport) Send(to Member, m Message) {
+	t.network.deliver(t.from, m)
+}
@@ -0,0 +1,1314 @@
+package raft
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Node is one member of a cluster.  Everything it does happens under its lock: messages and ticks are handled by its
+// own goroutine, and proposals by the goroutine making them.
+type Node struct {
+	lock      sync.Mutex
+	opts      Options
+	id        string
+	storage   Storage
+	transport Transport
+	machine   StateMachine
+
+	term    uint64
+	vote    string
+	leader  string
+	role    Role
+	log     raftLog
+	commit  uint64
+	applied uint64
+
+	// members come from the latest config entry in the log, which is at configIndex, or from the snapshot when
+	// configIndex is zero.
+	members     []Member
+	configIndex uint64
+	snapshot    Snapshot
+
+	// addresses remembers every member seen, so messages can still be sent to a node after it's removed.
+	addresses map[string]string
+
+	electionElapsed  int
+	heartbeatElapsed int
+	electionTimeout  int
+
+	votes    map[string]bool
+	progress map[string]*progress
+
+	// waiters are the proposals waiting to be applied, by index, and forwarded the proposals waiting to hear where
+	// the leader put them.
+	waiters      map[uint64]waiter
+	forwarded    map[uint64]chan outcome
+	nextProposal uint64
+
+	// reads wait for the leader to confirm it's still the leader, by a majority answering a heartbeat round started
+	// after they arrived.  The rounds are started at roundTicks, and the latest a majority answered is confirmed.
+	reads      []read
+	round      uint64
+	confirmed  uint64
+	roundTicks map[uint64]int
+	ticks      int
+	termStart  uint64
+
+	// forwardedReads are the reads waiting to hear the leader's commit index, and applying those waiting for it to be
+	// applied.
+	forwardedReads map[uint64]chan outcome
+	applying       []waiter
+
+	// lastContact is when a follower last heard from its leader.
+	lastContact time.Time
+
+	// transferee is the member the leader is handing leadership over to, for up to an election timeout.  Proposals
+	// are rejected meanwhile, and lease reads until leaseBlocked, as the transferee's election ignores the lease.
+	transferee      string
+	transferElapsed int
+	leaseBlocked    int
+
+	// leaderChanged is closed and replaced whenever the leader changes.
+	leaderChanged chan struct{}
+
+	inbox   chan Message
+	done    chan struct{}
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// progress is the leader's view of a follower.
+type progress struct {
+	match uint64
+	next  uint64
+
+	// active is set when the follower responds, and cleared every election timeout by the leader's quorum check.
+	active bool
+
+	// snapshot is the index of a snapshot sent to the follower, which no entries are sent after until it responds.
+	snapshot uint64
+
+	// round is the latest heartbeat round the follower has answered.
+	round uint64
+}
+
+// waiter waits for an entry to be applied.  Term is the entry's term when waiting for a proposal.
+type waiter struct {
+	index uint64
+	term  uint64
+	ch    chan outcome
+}
+
+// read is a read waiting for the leader to be confirmed.  A forwarded read has the follower's id and proposal number
+// instead of a channel.
+type read struct {
+	round    uint64
+	index    uint64
+	ch       chan outcome
+	from     string
+	proposal uint64
+}
+
+type outcome struct {
+	result interface{}
+	err    error
+}
+
+const inboxSize = 1024
+
+// New starts a node.  A node with nothing in its storage creates a cluster of opts.Peers, unless opts.Join is set.
+func New(opts Options) (*Node, error) {
+	opts.setDefaults()
+	if opts.ID == "" || opts.Storage == nil || opts.Transport == nil || opts.StateMachine == nil {
+		return nil, errors.New("raft: ID, Storage, Transport and StateMachine are required")
+	}
+
+	state, snap, entries, err := opts.Storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	if state.Term == 0 && snap.Index == 0 && len(entries) == 0 && len(snap.Members) == 0 && !opts.Join {
+		snap.Members = opts.Peers
+		err = opts.Storage.SaveSnapshot(snap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if snap.Index > 0 {
+		err = opts.StateMachine.Restore(snap.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n := &Node{
+		opts:      opts,
+		id:        opts.ID,
+		storage:   opts.Storage,
+		transport: opts.Transport,
+		machine:   opts.StateMachine,
+		term:      state.Term,
+		vote:      state.Vote,
+		role:      Follower,
+		log:       raftLog{snapIndex: snap.Index, snapTerm: snap.Term, entries: entries},
+		commit:    snap.Index,
+		applied:   snap.Index,
+		snapshot:  snap,
+		addresses: map[string]string{},
+		waiters:   map[uint64]waiter{},
+		forwarded: map[uint64]chan outcome{},
+		inbox:     make(chan Message, inboxSize),
+		done:      make(chan struct{}),
+
+		roundTicks:     map[uint64]int{},
+		forwardedReads: map[uint64]chan outcome{},
+		lastContact:    time.Now(),
+		leaderChanged:  make(chan struct{}),
+	}
+	for _, m := range opts.Peers {
+		n.addresses[m.ID] = m.Address
+	}
+	n.updateMembers()
+	n.resetElectionTimeout()
+
+	n.wg.Add(1)
+	go n.run()
+	return n, nil
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.lock.Lock()
+			n.tick()
+			n.lock.Unlock()
+		case m := <-n.inbox:
+			n.lock.Lock()
+			n.step(m)
+			n.lock.Unlock()
+		}
+	}
+}
+
+// Stop stops the node.  Proposals still waiting fail with ErrStopped.
+func (n *Node) Stop() {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.done)
+	for index, w := range n.waiters {
+		w.ch <- outcome{err: ErrStopped}
+		delete(n.waiters, index)
+	}
+	for id, ch := range n.forwarded {
+		ch <- outcome{err: ErrStopped}
+		delete(n.forwarded, id)
+	}
+	for id, ch := range n.forwardedReads {
+		ch <- outcome{err: ErrStopped}
+		delete(n.forwardedReads, id)
+	}
+	for _, r := range n.reads {
+		if r.ch != nil {
+			r.ch <- outcome{err: ErrStopped}
+		}
+	}
+	for _, w := range n.applying {
+		w.ch <- outcome{err: ErrStopped}
+	}
+	n.reads, n.applying = nil, nil
+	n.lock.Unlock()
+	n.wg.Wait()
+}
+
+// Step hands a message from another node to this one.  It doesn't wait for the message to be handled, and drops it if
+// the node is too far behind.
+func (n *Node) Step(m Message) {
+	select {
+	case n.inbox <- m:
+	default:
+	}
+}
+
+// Propose replicates a command, and returns the result of applying it on this node.
+func (n *Node) Propose(ctx context.Context, data []byte) (interface{}, error) {
+	return n.propose(ctx, Entry{Type: EntryCommand, Data: data})
+}
+
+// AddMember adds a node to the cluster.  The node should be started with Options.Join.
+func (n *Node) AddMember(ctx context.Context, m Member) error {
+	_, err := n.propose(ctx, Entry{Type: EntryConfig, Data: encodeChange(addMember, m)})
+	return err
+}
+
+// RemoveMember removes a node from the cluster.  A leader which removes itself steps down once the change is
+// committed.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	_, err := n.propose(ctx, Entry{Type: EntryConfig, Data: encodeChange(removeMember, Member{ID: id})})
+	return err
+}
+
+func (n *Node) propose(ctx context.Context, e Entry) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.opts.ProposalTimeout)
+	defer cancel()
+
+	ch := make(chan outcome, 1)
+	n.lock.Lock()
+	var proposal uint64
+	switch {
+	case n.stopped:
+		n.lock.Unlock()
+		return nil, ErrStopped
+	case n.role == Leader:
+		index, term, err := n.appendProposal(e)
+		if err != nil {
+			n.lock.Unlock()
+			return nil, err
+		}
+		n.wait(index, term, ch)
+		n.replicate()
+	case n.leader != "":
+		n.nextProposal++
+		proposal = n.nextProposal
+		n.forwarded[proposal] = ch
+		n.send(n.leader, Message{Type: MsgPropose, Proposal: proposal, Entries: []Entry{e}})
+	default:
+		n.lock.Unlock()
+		return nil, ErrNoLeader
+	}
+	n.lock.Unlock()
+
+	select {
+	case o := <-ch:
+		return o.result, o.err
+	case <-ctx.Done():
+		n.lock.Lock()
+		delete(n.forwarded, proposal)
+		n.lock.Unlock()
+		return nil, ErrUnknown
+	}
+}
+
+// TransferLeadership hands leadership over to the member id, and waits for it to take over.  The leader first brings
+// the member's log up to date, then has it start an election, which it wins as its log is the most up to date.
+func (n *Node) TransferLeadership(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, n.opts.ProposalTimeout)
+	defer cancel()
+
+	n.lock.Lock()
+	switch {
+	case n.stopped:
+		n.lock.Unlock()
+		return ErrStopped
+	case !n.isMember(id):
+		n.lock.Unlock()
+		return ErrMembership
+	case n.leader == id:
+	case n.role == Leader:
+		n.transferLeadership(id)
+	case n.leader != "":
+		n.send(n.leader, Message{Type: MsgTransferLeader, Transfer: id})
+	default:
+		n.lock.Unlock()
+		return ErrNoLeader
+	}
+
+	for n.leader != id {
+		changed := n.leaderChanged
+		n.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ErrTransfer
+		}
+		n.lock.Lock()
+	}
+	n.lock.Unlock()
+	return nil
+}
+
+func (n *Node) transferLeadership(id string) {
+	pr := n.progress[id]
+	if id == n.id || pr == nil {
+		return
+	}
+	slog.Info("raft: transferring leadership", "id", n.id, "to", id, "term", n.term)
+	n.transferee = id
+	n.transferElapsed = 0
+	if pr.match == n.log.lastIndex() {
+		n.sendTimeoutNow(id)
+	} else {
+		n.sendAppend(id)
+	}
+}
+
+func (n *Node) sendTimeoutNow(id string) {
+	n.leaseBlocked = n.ticks + n.opts.ElectionTicks
+	n.send(id, Message{Type: MsgTimeoutNow})
+}
+
+func (n *Node) setLeader(id string) {
+	if id != n.leader {
+		n.leader = id
+		close(n.leaderChanged)
+		n.leaderChanged = make(chan struct{})
+	}
+}
+
+// wait registers ch to receive the outcome of the entry at index, which was proposed in term.
+func (n *Node) wait(index, term uint64, ch chan outcome) {
+	if index <= n.applied {
+		ch <- outcome{err: ErrUnknown}
+		return
+	}
+	if w, found := n.waiters[index]; found {
+		w.ch <- outcome{err: ErrDropped}
+	}
+	n.waiters[index] = waiter{index: index, term: term, ch: ch}
+}
+
+// ReadIndex waits until this node has applied everything the leader had committed when it was called, and returns
+// that index.  Reads of the state machine made after it returns see every command which completed before it was
+// called.  The leader confirms it's still the leader with a round of heartbeats, or with its lease when
+// Options.LeaseReads is set.
+func (n *Node) ReadIndex(ctx context.Context) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.opts.ProposalTimeout)
+	defer cancel()
+
+	ch := make(chan outcome, 1)
+	n.lock.Lock()
+	var proposal uint64
+	switch {
+	case n.stopped:
+		n.lock.Unlock()
+		return 0, ErrStopped
+	case n.role == Leader:
+		n.readIndex(read{ch: ch})
+	case n.leader != "":
+		n.nextProposal++
+		proposal = n.nextProposal
+		n.forwardedReads[proposal] = ch
+		n.send(n.leader, Message{Type: MsgReadIndex, Proposal: proposal})
+	default:
+		n.lock.Unlock()
+		return 0, ErrNoLeader
+	}
+	n.lock.Unlock()
+
+	select {
+	case o := <-ch:
+		index, _ := o.result.(uint64)
+		return index, o.err
+	case <-ctx.Done():
+		n.lock.Lock()
+		delete(n.forwardedReads, proposal)
+		n.lock.Unlock()
+		return 0, ErrReadTimeout
+	}
+}
+
+// readIndex starts confirming the leader for r.  The index to read at is the commit index, or the leader's first entry
+// if it hasn't committed it yet, as only then does it know everything committed by earlier leaders.
+func (n *Node) readIndex(r read) {
+	r.index = max(n.commit, n.termStart)
+	if n.opts.LeaseReads && n.inLeaderLease() {
+		n.finishRead(r)
+		return
+	}
+	r.round = n.startRound()
+	n.reads = append(n.reads, r)
+	n.broadcast()
+	n.confirmRounds()
+}
+
+// inLeaderLease reports whether the followers which confirmed the leader's latest round are still ignoring other
+// candidates.  A tick is left as a margin for the nodes' clocks drifting apart.
+func (n *Node) inLeaderLease() bool {
+	start, found := n.roundTicks[n.confirmed]
+	return found && n.ticks-start < n.opts.ElectionTicks-1 && n.transferee == "" && n.ticks >= n.leaseBlocked
+}
+
+func (n *Node) startRound() uint64 {
+	n.round++
+	n.roundTicks[n.round] = n.ticks
+	return n.round
+}
+
+// confirmRounds confirms the latest round a majority have answered, and finishes the reads waiting for it.
+func (n *Node) confirmRounds() {
+	var rounds []uint64
+	for _, m := range n.members {
+		if m.ID == n.id {
+			rounds = append(rounds, n.round)
+		} else if pr := n.progress[m.ID]; pr != nil {
+			rounds = append(rounds, pr.round)
+		} else {
+			rounds = append(rounds, 0)
+		}
+	}
+	if len(rounds) == 0 {
+		return
+	}
+	slices.SortFunc(rounds, func(a, b uint64) int {
+		return cmp.Compare(b, a)
+	})
+	round := rounds[n.quorum()-1]
+	if round <= n.confirmed {
+		return
+	}
+
+	// the confirmed round's start is kept for the lease
+	n.confirmed = round
+	for r := range n.roundTicks {
+		if r < round {
+			delete(n.roundTicks, r)
+		}
+	}
+	i := 0
+	for ; i < len(n.reads) && n.reads[i].round <= round; i++ {
+		n.finishRead(n.reads[i])
+	}
+	n.reads = slices.Delete(n.reads, 0, i)
+}
+
+func (n *Node) finishRead(r read) {
+	if r.ch != nil {
+		n.waitApplied(r.index, r.ch)
+	} else {
+		n.send(r.from, Message{Type: MsgReadIndexResponse, Proposal: r.proposal, Index: r.index})
+	}
+}
+
+// failReads fails the reads a leader was confirming when it stops being the leader.
+func (n *Node) failReads() {
+	for _, r := range n.reads {
+		if r.ch != nil {
+			r.ch <- outcome{err: ErrNoLeader}
+		} else {
+			n.send(r.from, Message{Type: MsgReadIndexResponse, Proposal: r.proposal, Reject: true})
+		}
+	}
+	n.reads = nil
+	clear(n.roundTicks)
+	n.confirmed = 0
+}
+
+// waitApplied sends index to ch once it has been applied.
+func (n *Node) waitApplied(index uint64, ch chan outcome) {
+	if index <= n.applied {
+		ch <- outcome{result: index}
+		return
+	}
+	n.applying = append(n.applying, waiter{index: index, ch: ch})
+}
+
+// notifyApplied finishes the reads waiting for entries which have now been applied.
+func (n *Node) notifyApplied() {
+	n.applying = slices.DeleteFunc(n.applying, func(w waiter) bool {
+		if w.index > n.applied {
+			return false
+		}
+		w.ch <- outcome{result: w.index}
+		return true
+	})
+}
+
+// appendProposal adds a proposal to the leader's log.  A membership change is turned into the complete membership.
+func (n *Node) appendProposal(e Entry) (uint64, uint64, error) {
+	if n.transferee != "" {
+		return 0, 0, ErrRejected
+	}
+	if e.Type == EntryConfig {
+		members, err := n.changeMembers(e.Data)
+		if err != nil {
+			return 0, 0, err
+		}
+		e.Data = appendMembers(nil, members)
+	} else if e.Type != EntryCommand {
+		return 0, 0, ErrRejected
+	}
+
+	e.Index = n.log.lastIndex() + 1
+	e.Term = n.term
+	err := n.appendEntries(e)
+	if err != nil {
+		return 0, 0, err
+	}
+	return e.Index, e.Term, nil
+}
+
+// changeMembers returns the members after a proposed change.  Only one change may be in progress at a time, and not
+// until the leader has committed an entry of its own term, so no two leaders ever hold overlapping changes.
+func (n *Node) changeMembers(data []byte) ([]Member, error) {
+	change, m, err := decodeChange(data)
+	if err != nil {
+		return nil, ErrMembership
+	}
+	if t, _ := n.log.term(n.commit); n.configIndex > n.commit || t != n.term {
+		return nil, ErrRejected
+	}
+
+	i := slices.IndexFunc(n.members, func(member Member) bool {
+		return member.ID == m.ID
+	})
+	members := slices.Clone(n.members)
+	switch {
+	case change == addMember && i < 0 && m.ID != "":
+		return append(members, m), nil
+	case change == removeMember && i >= 0 && len(members) > 1:
+		return slices.Delete(members, i, i+1), nil
+	}
+	return nil, ErrMembership
+}
+
+// appendEntries saves entries and adds them to the log, replacing any from the first one's index onwards.
+func (n *Node) appendEntries(entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	err := n.storage.Append(entries)
+	if err != nil {
+		slog.Error("raft: saving entries failed", "err", err)
+		return err
+	}
+
+	first := entries[0].Index
+	truncated := first <= n.log.lastIndex()
+	if truncated {
+		n.log.truncate(first)
+	}
+	n.log.append(entries...)
+
+	if truncated && n.configIndex >= first {
+		n.updateMembers()
+		return nil
+	}
+	for _, e := range entries {
+		if e.Type == EntryConfig {
+			n.updateMembers()
+			break
+		}
+	}
+	return nil
+}
+
+// updateMembers finds the latest membership in the log.  A leader starts or stops replicating to the members which
+// changed.
+func (n *Node) updateMembers() {
+	n.members, n.configIndex = n.membersAt(n.log.lastIndex())
+	for _, m := range n.members {
+		n.addresses[m.ID] = m.Address
+	}
+
+	if n.role != Leader {
+		return
+	}
+	for id := range n.progress {
+		if !n.isMember(id) {
+			delete(n.progress, id)
+		}
+	}
+	for _, m := range n.members {
+		if _, found := n.progress[m.ID]; !found && m.ID != n.id {
+			n.progress[m.ID] = &progress{next: n.log.lastIndex() + 1}
+		}
+	}
+}
+
+// membersAt returns the membership in effect at index, and the index of the config entry it comes from.
+func (n *Node) membersAt(index uint64) ([]Member, uint64) {
+	for i := index; i > n.log.snapIndex; i-- {
+		e := n.log.entry(i)
+		if e.Type != EntryConfig {
+			continue
+		}
+		members, _, err := readMembers(e.Data)
+		if err != nil {
+			slog.Error("raft: invalid config entry", "index", i, "err", err)
+			continue
+		}
+		return members, i
+	}
+	return slices.Clone(n.snapshot.Members), 0
+}
+
+func (n *Node) isMember(id string) bool {
+	return slices.ContainsFunc(n.members, func(m Member) bool {
+		return m.ID == id
+	})
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) send(to string, m Message) {
+	m.From = n.id
+	m.To = to
+	if m.Term == 0 {
+		m.Term = n.term
+	}
+	n.transport.Send(Member{ID: to, Address: n.addresses[to]}, m)
+}
+
+func (n *Node) saveState() {
+	err := n.storage.SaveState(HardState{Term: n.term, Vote: n.vote})
+	if err != nil {
+		slog.Error("raft: saving state failed", "err", err)
+	}
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionTimeout = n.opts.ElectionTicks + rand.IntN(n.opts.ElectionTicks)
+}
+
+// inLease reports whether this node has heard from a leader within the minimum election timeout.  Votes are ignored
+// then, so a node which was cut off can't depose a leader which still has a majority.
+func (n *Node) inLease() bool {
+	return n.leader != "" && n.electionElapsed < n.opts.ElectionTicks
+}
+
+func (n *Node) tick() {
+	n.ticks++
+	n.electionElapsed++
+	if n.role != Leader {
+		if n.electionElapsed >= n.electionTimeout && n.isMember(n.id) {
+			n.preCampaign()
+		}
+		return
+	}
+
+	if n.transferee != "" {
+		n.transferElapsed++
+		if n.transferElapsed >= n.opts.ElectionTicks {
+			slog.Warn("raft: leadership transfer timed out", "id", n.id, "to", n.transferee)
+			n.transferee = ""
+		}
+	}
+	if n.electionElapsed >= n.opts.ElectionTicks {
+		n.electionElapsed = 0
+		if !n.checkQuorum() {
+			slog.Warn("raft: leader lost contact with a majority, stepping down", "id", n.id, "term", n.term)
+			n.becomeFollower(n.term, "")
+			return
+		}
+	}
+	n.heartbeatElapsed++
+	if n.heartbeatElapsed >= n.opts.HeartbeatTicks {
+		// every heartbeat starts a round, which keeps the lease up to date
+		n.heartbeatElapsed = 0
+		n.startRound()
+		n.broadcast()
+		n.confirmRounds()
+	}
+}
+
+// checkQuorum reports whether a majority responded since the last check.  Snapshots which got no response are resent
+// after it.
+func (n *Node) checkQuorum() bool {
+	active := 0
+	for _, m := range n.members {
+		pr := n.progress[m.ID]
+		if m.ID == n.id || pr != nil && pr.active {
+			active++
+		}
+	}
+	for _, pr := range n.progress {
+		pr.active = false
+		pr.snapshot = 0
+	}
+	return active >= n.quorum()
+}
+
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.saveState()
+	}
+	if n.role == Leader {
+		n.failReads()
+	}
+	if n.role == Leader || leader != n.leader {
+		n.failForwarded()
+	}
+	n.role = Follower
+	n.setLeader(leader)
+	n.progress = nil
+	n.transferee = ""
+	n.electionElapsed = 0
+	n.resetElectionTimeout()
+}
+
+// failForwarded fails the proposals and reads sent to a previous leader which haven't heard back.
+func (n *Node) failForwarded() {
+	for id, ch := range n.forwarded {
+		ch <- outcome{err: ErrUnknown}
+		delete(n.forwarded, id)
+	}
+	for id, ch := range n.forwardedReads {
+		ch <- outcome{err: ErrNoLeader}
+		delete(n.forwardedReads, id)
+	}
+}
+
+// preCampaign asks the other members whether they would vote for this node, without disrupting them by starting an
+// election they'd reject.
+func (n *Node) preCampaign() {
+	n.role = PreCandidate
+	n.setLeader("")
+	n.electionElapsed = 0
+	n.resetElectionTimeout()
+	n.votes = map[string]bool{n.id: true}
+	if n.won() {
+		n.campaign(false)
+		return
+	}
+	for _, m := range n.members {
+		if m.ID != n.id {
+			n.send(m.ID, Message{Type: MsgPreVote, Term: n.term + 1, Index: n.log.lastIndex(), LogTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+// campaign starts an election.  One started by a leadership transfer is marked, so the other members vote even though
+// they've heard from the leader recently.
+func (n *Node) campaign(transfer bool) {
+	n.role = Candidate
+	n.term++
+	n.vote = n.id
+	n.saveState()
+	n.electionElapsed = 0
+	n.resetElectionTimeout()
+	n.votes = map[string]bool{n.id: true}
+	if n.won() {
+		n.becomeLeader()
+		return
+	}
+	var transferee string
+	if transfer {
+		transferee = n.id
+	}
+	for _, m := range n.members {
+		if m.ID != n.id {
+			n.send(m.ID, Message{Type: MsgVote, Index: n.log.lastIndex(), LogTerm: n.log.lastTerm(), Transfer: transferee})
+		}
+	}
+}
+
+func (n *Node) won() bool {
+	granted := 0
+	for _, m := range n.members {
+		if n.votes[m.ID] {
+			granted++
+		}
+	}
+	return granted >= n.quorum()
+}
+
+func (n *Node) lost() bool {
+	rejected := 0
+	for _, m := range n.members {
+		if granted, found := n.votes[m.ID]; found && !granted {
+			rejected++
+		}
+	}
+	return rejected >= n.quorum()
+}
+
+func (n *Node) becomeLeader() {
+	slog.Info("raft: became leader", "id", n.id, "term", n.term)
+	n.role = Leader
+	n.setLeader(n.id)
+	n.transferee = ""
+	n.electionElapsed = 0
+	n.heartbeatElapsed = 0
+	n.progress = map[string]*progress{}
+	for _, m := range n.members {
+		if m.ID != n.id {
+			n.progress[m.ID] = &progress{next: n.log.lastIndex() + 1}
+		}
+	}
+
+	// committing an entry of its own term commits everything before it
+	n.termStart = n.log.lastIndex() + 1
+	err := n.appendEntries(Entry{Index: n.termStart, Term: n.term, Type: EntryNoop})
+	if err != nil {
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.replicate()
+}
+
+// replicate commits what it can, and otherwise sends new entries to the followers.
+func (n *Node) replicate() {
+	if !n.maybeCommit() {
+		n.broadcast()
+	}
+}
+
+func (n *Node) broadcast() {
+	for id := range n.progress {
+		n.sendAppend(id)
+	}
+}
+
+// sendAppend sends a follower the entries it's missing, or a snapshot if they've been compacted.  Next is advanced
+// straight away, so entries can be sent again before the follower responds.
+func (n *Node) sendAppend(id string) {
+	pr := n.progress[id]
+	if pr.snapshot != 0 {
+		return
+	}
+
+	pr.next = min(pr.next, n.log.lastIndex()+1)
+	prev := pr.next - 1
+	prevTerm, ok := n.log.term(prev)
+	if !ok {
+		pr.snapshot = n.snapshot.Index
+		snap := n.snapshot
+		n.send(id, Message{Type: MsgSnapshot, Snapshot: &snap, Round: n.round})
+		return
+	}
+
+	to := min(n.log.lastIndex()+1, pr.next+uint64(n.opts.MaxEntries))
+	var entries []Entry
+	if pr.next < to {
+		// copied, as the log's array is reused if it's truncated while the message is in flight
+		entries = slices.Clone(n.log.slice(pr.next, to))
+	}
+	n.send(id, Message{Type: MsgAppend, Index: prev, LogTerm: prevTerm, Entries: entries, Commit: n.commit, Round: n.round})
+	pr.next = to
+}
+
+// maybeCommit commits the entries a majority have, and reports whether the commit index moved.  Only an entry of the
+// leader's own term is committed by counting, as an earlier term's entry can still be replaced.
+func (n *Node) maybeCommit() bool {
+	var matches []uint64
+	for _, m := range n.members {
+		if m.ID == n.id {
+			matches = append(matches, n.log.lastIndex())
+		} else if pr := n.progress[m.ID]; pr != nil {
+			matches = append(matches, pr.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return false
+	}
+	slices.SortFunc(matches, func(a, b uint64) int {
+		return cmp.Compare(b, a)
+	})
+
+	index := matches[n.quorum()-1]
+	if t, _ := n.log.term(index); index <= n.commit || t != n.term {
+		return false
+	}
+	n.commit = index
+	n.broadcast()
+	n.apply()
+	return true
+}
+
+// apply applies the committed entries, and passes the results to whoever is waiting for them.
+func (n *Node) apply() {
+	for n.applied < n.commit {
+		e := n.log.entry(n.applied + 1)
+		var result interface{}
+		switch e.Type {
+		case EntryCommand:
+			result = n.machine.Apply(e.Data)
+		case EntryConfig:
+			n.applyConfig(e)
+		}
+		n.applied = e.Index
+
+		if w, found := n.waiters[e.Index]; found {
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.ch <- outcome{result: result}
+			} else {
+				w.ch <- outcome{err: ErrDropped}
+			}
+		}
+	}
+	n.notifyApplied()
+	n.maybeSnapshot()
+}
+
+// applyConfig steps down a leader which has been removed, once its removal is committed.
+func (n *Node) applyConfig(e Entry) {
+	members, _, err := readMembers(e.Data)
+	if err != nil {
+		return
+	}
+	slog.Info("raft: membership changed", "id", n.id, "members", members)
+	if n.role == Leader && !slices.ContainsFunc(members, func(m Member) bool { return m.ID == n.id }) {
+		n.becomeFollower(n.term, "")
+	}
+}
+
+// maybeSnapshot replaces the applied entries with a snapshot once there are enough of them.
+func (n *Node) maybeSnapshot() {
+	if n.applied-n.log.snapIndex < n.opts.SnapshotEntries {
+		return
+	}
+	data, err := n.machine.Snapshot()
+	if err != nil {
+		slog.Error("raft: snapshot failed", "err", err)
+		return
+	}
+
+	term, _ := n.log.term(n.applied)
+	members, _ := n.membersAt(n.applied)
+	snap := Snapshot{Index: n.applied, Term: term, Members: members, Data: data}
+	err = n.storage.SaveSnapshot(snap)
+	if err != nil {
+		slog.Error("raft: saving snapshot failed", "err", err)
+		return
+	}
+	n.log.compact(snap.Index, snap.Term)
+	n.snapshot = snap
+	n.members, n.configIndex = n.membersAt(n.log.lastIndex())
+}
+
+func (n *Node) step(m Message) {
+	switch m.Type {
+	case MsgPropose:
+		n.handlePropose(m)
+		return
+	case MsgProposeResponse:
+		n.handleProposeResponse(m)
+		return
+	case MsgReadIndex:
+		n.handleReadIndex(m)
+		return
+	case MsgReadIndexResponse:
+		n.handleReadIndexResponse(m)
+		return
+	case MsgTransferLeader:
+		if n.role == Leader && n.isMember(m.Transfer) {
+			n.transferLeadership(m.Transfer)
+		}
+		return
+	}
+
+	switch {
+	case m.Term > n.term:
+		vote := m.Type == MsgVote || m.Type == MsgPreVote
+		if vote && n.inLease() && m.Transfer == "" {
+			return
+		}
+		if m.Type == MsgPreVote || m.Type == MsgPreVoteResponse && !m.Reject {
+			break
+		}
+		leader := ""
+		if m.Type == MsgAppend || m.Type == MsgSnapshot {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	case m.Term < n.term:
+		// tell a stale leader or pre-candidate about the new term
+		switch m.Type {
+		case MsgAppend, MsgSnapshot:
+			n.send(m.From, Message{Type: MsgAppendResponse, Index: n.log.lastIndex()})
+		case MsgPreVote:
+			n.send(m.From, Message{Type: MsgPreVoteResponse, Reject: true})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgPreVote:
+		grant := m.Term > n.term && n.log.upToDate(m.Index, m.LogTerm)
+		term := n.term
+		if grant {
+			term = m.Term
+		}
+		n.send(m.From, Message{Type: MsgPreVoteResponse, Term: term, Reject: !grant})
+	case MsgVote:
+		grant := (n.vote == m.From || n.vote == "" && n.leader == "") && n.log.upToDate(m.Index, m.LogTerm)
+		if grant {
+			n.vote = m.From
+			n.saveState()
+			n.electionElapsed = 0
+		}
+		n.send(m.From, Message{Type: MsgVoteResponse, Reject: !grant})
+	case MsgPreVoteResponse:
+		if n.role == PreCandidate && (m.Term == n.term+1 || m.Reject) {
+			n.countVote(m, func() { n.campaign(false) })
+		}
+	case MsgVoteResponse:
+		if n.role == Candidate {
+			n.countVote(m, n.becomeLeader)
+		}
+	case MsgAppend:
+		n.heardFrom(m.From)
+		n.handleAppend(m)
+	case MsgSnapshot:
+		n.heardFrom(m.From)
+		n.handleSnapshot(m)
+	case MsgAppendResponse:
+		if n.role == Leader {
+			n.handleAppendResponse(m)
+		}
+	case MsgTimeoutNow:
+		if n.role == Follower && n.leader == m.From && n.isMember(n.id) {
+			slog.Info("raft: starting an election to take over leadership", "id", n.id, "term", n.term)
+			n.campaign(true)
+		}
+	}
+}
+
+func (n *Node) countVote(m Message, win func()) {
+	if n.role != PreCandidate && n.role != Candidate {
+		return
+	}
+	n.votes[m.From] = !m.Reject
+	switch {
+	case n.won():
+		win()
+	case n.lost():
+		n.becomeFollower(n.term, "")
+	}
+}
+
+func (n *Node) heardFrom(leader string) {
+	if n.role != Follower || n.leader != leader {
+		n.becomeFollower(n.term, leader)
+	}
+	n.electionElapsed = 0
+	n.lastContact = time.Now()
+}
+
+func (n *Node) handleAppend(m Message) {
+	if m.Index < n.commit {
+		n.send(m.From, Message{Type: MsgAppendResponse, Index: n.commit, Round: m.Round})
+		return
+	}
+
+	if t, ok := n.log.term(m.Index); !ok || t != m.LogTerm {
+		// hint where the leader should retry from, skipping the whole of a conflicting term
+		hint := min(m.Index-1, n.log.lastIndex())
+		if ok {
+			for hint > n.commit {
+				if ht, _ := n.log.term(hint); ht != t {
+					break
+				}
+				hint--
+			}
+		}
+		n.send(m.From, Message{Type: MsgAppendResponse, Index: hint, Reject: true, Round: m.Round})
+		return
+	}
+
+	for i, e := range m.Entries {
+		if t, ok := n.log.term(e.Index); ok && t == e.Term {
+			continue
+		}
+		if n.appendEntries(m.Entries[i:]...) != nil {
+			return
+		}
+		break
+	}
+
+	last := m.Index + uint64(len(m.Entries))
+	if commit := min(m.Commit, last); commit > n.commit {
+		n.commit = commit
+		n.apply()
+	}
+	n.send(m.From, Message{Type: MsgAppendResponse, Index: last, Round: m.Round})
+}
+
+func (n *Node) handleSnapshot(m Message) {
+	snap := m.Snapshot
+	if snap == nil {
+		return
+	}
+	if snap.Index <= n.commit {
+		n.send(m.From, Message{Type: MsgAppendResponse, Index: n.commit, Round: m.Round})
+		return
+	}
+	if t, ok := n.log.term(snap.Index); ok && t == snap.Term {
+		n.commit = snap.Index
+		n.apply()
+		n.send(m.From, Message{Type: MsgAppendResponse, Index: snap.Index, Round: m.Round})
+		return
+	}
+
+	err := n.machine.Restore(snap.Data)
+	if err == nil {
+		err = n.storage.SaveSnapshot(*snap)
+	}
+	if err != nil {
+		slog.Error("raft: installing snapshot failed", "index", snap.Index, "err", err)
+		n.send(m.From, Message{Type: MsgAppendResponse, Index: n.commit, Reject: true, Round: m.Round})
+		return
+	}
+	slog.Info("raft: installed snapshot", "id", n.id, "index", snap.Index, "term", snap.Term)
+
+	n.log.restore(snap.Index, snap.Term)
+	n.snapshot = *snap
+	n.commit = snap.Index
+	n.applied = snap.Index
+	n.updateMembers()
+	for index, w := range n.waiters {
+		if index <= snap.Index {
+			w.ch <- outcome{err: ErrUnknown}
+			delete(n.waiters, index)
+		}
+	}
+	n.notifyApplied()
+	n.send(m.From, Message{Type: MsgAppendResponse, Index: snap.Index, Round: m.Round})
+}
+
+func (n *Node) handleAppendResponse(m Message) {
+	pr := n.progress[m.From]
+	if pr == nil {
+		return
+	}
+	pr.active = true
+	if m.Round > pr.round {
+		pr.round = m.Round
+		n.confirmRounds()
+	}
+
+	if m.Reject {
+		pr.snapshot = 0
+		if m.Index+1 < pr.next {
+			pr.next = max(m.Index+1, pr.match+1)
+			n.sendAppend(m.From)
+		}
+		return
+	}
+
+	if pr.snapshot != 0 && m.Index >= pr.snapshot {
+		pr.snapshot = 0
+	}
+	pr.next = max(pr.next, m.Index+1)
+	if m.Index > pr.match {
+		pr.match = m.Index
+		n.maybeCommit()
+		if m.From == n.transferee && pr.match == n.log.lastIndex() {
+			n.sendTimeoutNow(m.From)
+		}
+	}
+	if n.role == Leader && pr.next <= n.log.lastIndex() {
+		n.sendAppend(m.From)
+	}
+}
+
+func (n *Node) handlePropose(m Message) {
+	reply := Message{Type: MsgProposeResponse, Proposal: m.Proposal}
+	var err error
+	if n.role != Leader || len(m.Entries) != 1 {
+		err = ErrRejected
+	} else {
+		reply.Index, reply.LogTerm, err = n.appendProposal(m.Entries[0])
+	}
+	if err != nil {
+		reply.Reject = true
+		reply.Error = err.Error()
+	}
+
+	// the response has to go first, so it arrives before the entry is committed
+	n.send(m.From, reply)
+	if err == nil {
+		n.replicate()
+	}
+}
+
+func (n *Node) handleProposeResponse(m Message) {
+	ch, found := n.forwarded[m.Proposal]
+	if !found {
+		return
+	}
+	delete(n.forwarded, m.Proposal)
+
+	if m.Reject {
+		var err error = ErrRejected
+		for _, known := range []error{ErrMembership, ErrNoLeader} {
+			if m.Error == known.Error() {
+				err = known
+			}
+		}
+		ch <- outcome{err: err}
+		return
+	}
+	n.wait(m.Index, m.LogTerm, ch)
+}
+
+func (n *Node) handleReadIndex(m Message) {
+	if n.role != Leader {
+		n.send(m.From, Message{Type: MsgReadIndexResponse, Proposal: m.Proposal, Reject: true})
+		return
+	}
+	n.readIndex(read{from: m.From, proposal: m.Proposal})
+}
+
+func (n *Node) handleReadIndexResponse(m Message) {
+	ch, found := n.forwardedReads[m.Proposal]
+	if !found {
+		return
+	}
+	delete(n.forwardedReads, m.Proposal)
+	if m.Reject {
+		ch <- outcome{err: ErrNoLeader}
+		return
+	}
+	n.waitApplied(m.Index, ch)
+}
+
+// Status describes the node.
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	status := Status{
+		ID:        n.id,
+		Role:      n.role,
+		Term:      n.term,
+		Leader:    n.leader,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.log.lastIndex(),
+		Members:   slices.Clone(n.members),
+
+		LastContact: n.lastContact,
+	}
+	if n.role == Leader {
+		status.LastContact = time.Now()
+		status.Progress = map[string]Progress{}
+		for id, pr := range n.progress {
+			status.Progress[id] = Progress{Match: pr.match, Next: pr.next}
+		}
+	}
+	return status
+}
+
+// Leader returns the current leader, if there is one.
+func (n *Node) Leader() (Member, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.leader == "" {
+		return Member{}, false
+	}
+	return Member{ID: n.leader, Address: n.addresses[n.leader]}, true
+}
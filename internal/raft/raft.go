@@ -0,0 +1,249 @@
+// Package raft replicates a log of commands across a cluster of nodes with the Raft consensus algorithm, and applies
+// them in the same order to a StateMachine on every node.  It covers leader election with pre-votes, log replication,
+// snapshots, and membership changes of one node at a time.  Nodes talk through a Transport, which can be a Network in
+// the same process for tests.
+package raft
+
+import (
+	"kv/internal/store"
+	"time"
+)
+
+var (
+	// ErrNoLeader is returned for a proposal made while the cluster has no leader, during an election or when the node
+	// can't reach a majority.
+	ErrNoLeader = store.NewError(store.ErrUnavailable, "raft: no leader")
+
+	// ErrDropped is returned for a proposal which was replaced in the log during a change of leader.  It wasn't
+	// applied, so it can be retried.
+	ErrDropped = store.NewError(store.ErrUnavailable, "raft: proposal was dropped by a change of leader")
+
+	// ErrUnknown is returned when a proposal may or may not have been applied, because the node stopped waiting for it
+	// or skipped over it by installing a snapshot.
+	ErrUnknown = store.NewError(store.ErrUnavailable, "raft: the outcome of the proposal is unknown")
+
+	// ErrRejected is returned for a proposal the leader refused, because it stopped being the leader or a membership
+	// change is already in progress.
+	ErrRejected = store.NewError(store.ErrUnavailable, "raft: proposal was rejected by the leader")
+
+	// ErrReadTimeout is returned by ReadIndex when the leader couldn't be confirmed, or the node didn't catch up with
+	// it, in time.
+	ErrReadTimeout = store.NewError(store.ErrUnavailable, "raft: timed out waiting for a read index")
+
+	// ErrTransfer is returned when leadership didn't move to the requested member in time.
+	ErrTransfer = store.NewError(store.ErrUnavailable, "raft: leadership transfer didn't complete")
+
+	// ErrStopped is returned once the node has been stopped.
+	ErrStopped = store.NewError(store.ErrUnavailable, "raft: node stopped")
+
+	// ErrMembership is returned for a membership change which doesn't change anything, like adding a member twice, or
+	// a leadership transfer to a node which isn't a member.
+	ErrMembership = store.NewError(store.ErrInvalid, "raft: invalid membership change")
+)
+
+// Role is a node's part in the cluster.
+type Role int
+
+const (
+	Follower Role = iota + 1
+
+	// PreCandidate is a node checking it could win an election before starting one, so a node which was cut off from
+	// the cluster doesn't disrupt it when it comes back.
+	PreCandidate
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case PreCandidate:
+		return "pre-candidate"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+type EntryType byte
+
+const (
+	// EntryCommand is applied to the state machine.
+	EntryCommand EntryType = iota + 1
+
+	// EntryConfig holds the cluster's members.  It takes effect as soon as it's in a node's log.
+	EntryConfig
+
+	// EntryNoop is appended by a new leader, to commit the entries of previous terms.
+	EntryNoop
+)
+
+// Entry is one record of the replicated log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// Member is a node of the cluster.  Address is where its Transport can reach it.
+type Member struct {
+	ID      string
+	Address string
+}
+
+// Snapshot is the state machine's state after the entry at Index was applied, along with the members at that point.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []Member
+	Data    []byte
+}
+
+// HardState is what a node must remember across restarts, besides its log, to vote safely.
+type HardState struct {
+	Term uint64
+	Vote string
+}
+
+// StateMachine is what the log is applied to.  Every node applies the same commands in the same order, so Apply must
+// be deterministic.
+type StateMachine interface {
+	// Apply applies a committed command.  The result is returned to the proposer, if it's on this node.
+	Apply(data []byte) interface{}
+
+	// Snapshot returns the state, as of the last command applied.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state with a snapshot's.
+	Restore(data []byte) error
+}
+
+// Options configures a Node.
+type Options struct {
+	ID string
+
+	// Peers are the members a new cluster starts with, and addresses for reaching them.  A node joining an existing
+	// cluster starts with no members, and learns them from the leader once it has been added, but still needs the
+	// addresses of Peers to answer the leader until then.
+	Peers []Member
+
+	// Join starts a node with no state as a new member of an existing cluster, instead of creating one with Peers.
+	Join bool
+
+	Storage      Storage
+	Transport    Transport
+	StateMachine StateMachine
+
+	// TickInterval is the unit of the election and heartbeat timeouts.
+	TickInterval time.Duration
+
+	// ElectionTicks is how long a follower waits to hear from a leader before starting an election.  The actual
+	// timeout is randomised between it and twice it.
+	ElectionTicks int
+
+	// HeartbeatTicks is how often a leader contacts its followers when there's nothing to send.
+	HeartbeatTicks int
+
+	// SnapshotEntries is how many entries are applied between snapshots.
+	SnapshotEntries uint64
+
+	// MaxEntries is the most entries sent to a follower in one message.
+	MaxEntries int
+
+	// ProposalTimeout is how long a proposal waits to be applied, when its context has no earlier deadline.  ReadIndex
+	// waits as long.
+	ProposalTimeout time.Duration
+
+	// LeaseReads lets a leader answer ReadIndex without a round of heartbeats, while a majority confirmed it within
+	// the last election timeout.  It relies on the nodes' clocks running at about the same rate.
+	LeaseReads bool
+}
+
+const (
+	DefaultTickInterval    = 100 * time.Millisecond
+	DefaultElectionTicks   = 10
+	DefaultHeartbeatTicks  = 1
+	DefaultSnapshotEntries = 10000
+	DefaultMaxEntries      = 256
+	DefaultProposalTimeout = 5 * time.Second
+)
+
+func (o *Options) setDefaults() {
+	if o.TickInterval <= 0 {
+		o.TickInterval = DefaultTickInterval
+	}
+	if o.ElectionTicks <= 0 {
+		o.ElectionTicks = DefaultElectionTicks
+	}
+	if o.HeartbeatTicks <= 0 {
+		o.HeartbeatTicks = DefaultHeartbeatTicks
+	}
+	if o.SnapshotEntries == 0 {
+		o.SnapshotEntries = DefaultSnapshotEntries
+	}
+	if o.MaxEntries <= 0 {
+		o.MaxEntries = DefaultMaxEntries
+	}
+	if o.ProposalTimeout <= 0 {
+		o.ProposalTimeout = DefaultProposalTimeout
+	}
+}
+
+// Status describes a node.  Progress is only known by the leader.  LastContact is when the node last heard from the
+// leader, which is now on the leader itself.
+type Status struct {
+	ID          string
+	Role        Role
+	Term        uint64
+	Leader      string
+	Commit      uint64
+	Applied     uint64
+	LastIndex   uint64
+	Members     []Member
+	Progress    map[string]Progress
+	LastContact time.Time
+}
+
+// Progress is how much of the leader's log a follower has.  Match is the last entry known to be in the follower's
+// log, and Next the next one to send.
+type Progress struct {
+	Match uint64
+	Next  uint64
+}
+
+// MemberStatus is a member as seen by a node.  Only the node itself and the leader's roles are known for certain, and
+// Match and Lag, how many entries the member is behind the leader's log, are only known by the leader.
+type MemberStatus struct {
+	Member
+	Role  Role
+	Match uint64
+	Lag   uint64
+}
+
+// MemberStatuses describes each of the members.
+func (s Status) MemberStatuses() []MemberStatus {
+	statuses := make([]MemberStatus, 0, len(s.Members))
+	for _, m := range s.Members {
+		ms := MemberStatus{Member: m, Role: Follower}
+		switch {
+		case m.ID == s.ID:
+			ms.Role = s.Role
+		case m.ID == s.Leader:
+			ms.Role = Leader
+		}
+
+		if s.Role == Leader {
+			ms.Match = s.LastIndex
+			if pr, found := s.Progress[m.ID]; found {
+				ms.Match = pr.Match
+			}
+			ms.Lag = s.LastIndex - ms.Match
+		}
+		statuses = append(statuses, ms)
+	}
+	return statuses
+}
@@ -0,0 +1,469 @@
+package raft_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv/internal/raft"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// machine records the commands applied to it.
+type machine struct {
+	lock   sync.Mutex
+	values []string
+}
+
+func (m *machine) Apply(data []byte) interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values = append(m.values, string(data))
+	return len(m.values)
+}
+
+func (m *machine) Snapshot() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return []byte(strings.Join(m.values, ",")), nil
+}
+
+func (m *machine) Restore(data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values = nil
+	if len(data) > 0 {
+		m.values = strings.Split(string(data), ",")
+	}
+	return nil
+}
+
+func (m *machine) Values() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return slices.Clone(m.values)
+}
+
+type cluster struct {
+	t        *testing.T
+	network  *raft.Network
+	peers    []raft.Member
+	nodes    map[string]*raft.Node
+	machines map[string]*machine
+	options  func(*raft.Options)
+}
+
+func newCluster(t *testing.T, options func(*raft.Options), ids ...string) *cluster {
+	c := &cluster{
+		t:        t,
+		network:  raft.NewNetwork(),
+		nodes:    map[string]*raft.Node{},
+		machines: map[string]*machine{},
+		options:  options,
+	}
+	for _, id := range ids {
+		c.peers = append(c.peers, raft.Member{ID: id, Address: id})
+	}
+	for _, id := range ids {
+		c.start(id, raft.NewMemoryStorage(), false)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+func (c *cluster) start(id string, storage raft.Storage, join bool) *raft.Node {
+	opts := raft.Options{
+		ID:              id,
+		Peers:           c.peers,
+		Join:            join,
+		Storage:         storage,
+		Transport:       c.network.Transport(id),
+		StateMachine:    &machine{},
+		TickInterval:    5 * time.Millisecond,
+		ProposalTimeout: time.Second,
+	}
+	if c.options != nil {
+		c.options(&opts)
+	}
+	n, err := raft.New(opts)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+	c.machines[id] = opts.StateMachine.(*machine)
+	c.network.Add(n)
+	return n
+}
+
+// leader waits for one of ids to be the leader, and for the others to follow it.
+func (c *cluster) leader(ids ...string) *raft.Node {
+	c.t.Helper()
+	var leader *raft.Node
+	c.eventually(func() bool {
+		leader = nil
+		for _, id := range ids {
+			if s := c.nodes[id].Status(); s.Role == raft.Leader {
+				leader = c.nodes[id]
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		term := leader.Status().Term
+		for _, id := range ids {
+			if s := c.nodes[id].Status(); s.Term != term || s.Leader != leader.Status().ID {
+				return false
+			}
+		}
+		return true
+	}, "no leader elected among %v", ids)
+	return leader
+}
+
+// converged waits for the machines of ids to have applied want.
+func (c *cluster) converged(want []string, ids ...string) {
+	c.t.Helper()
+	c.eventually(func() bool {
+		for _, id := range ids {
+			if !slices.Equal(c.machines[id].Values(), want) {
+				return false
+			}
+		}
+		return true
+	}, "machines didn't converge on %v", want)
+}
+
+func (c *cluster) eventually(f func() bool, format string, args ...interface{}) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf(format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func propose(t *testing.T, n *raft.Node, value string) {
+	t.Helper()
+	_, err := n.Propose(context.Background(), []byte(value))
+	if err != nil {
+		t.Fatalf("proposing [%s]: %v", value, err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, nil, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+
+	result, err := leader.Propose(context.Background(), []byte("x"))
+	if err != nil || result != 1 {
+		t.Fatalf("expected result [1], got %v, %v", result, err)
+	}
+	c.converged([]string{"x"}, "a", "b", "c")
+
+	status := leader.Status()
+	if len(status.Progress) != 2 || len(status.Members) != 3 {
+		t.Errorf("unexpected leader status %+v", status)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	c := newCluster(t, nil, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+
+	for id, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		result, err := n.Propose(context.Background(), []byte(id))
+		if err != nil || result != 1 {
+			t.Fatalf("expected result [1] from follower [%s], got %v, %v", id, result, err)
+		}
+		c.converged([]string{id}, "a", "b", "c")
+		return
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newCluster(t, nil, "a")
+	propose(t, c.leader("a"), "x")
+	c.converged([]string{"x"}, "a")
+}
+
+func TestPartition(t *testing.T) {
+	c := newCluster(t, func(o *raft.Options) {
+		o.ProposalTimeout = 200 * time.Millisecond
+	}, "a", "b", "c")
+	old := c.leader("a", "b", "c")
+	propose(t, old, "x")
+
+	var rest []string
+	for id, n := range c.nodes {
+		if n != old {
+			rest = append(rest, id)
+		}
+	}
+	c.network.Partition(rest)
+
+	_, err := old.Propose(context.Background(), []byte("lost"))
+	if !errors.Is(err, raft.ErrUnknown) && !errors.Is(err, raft.ErrNoLeader) {
+		t.Errorf("expected a proposal in the minority to fail, got %v", err)
+	}
+
+	leader := c.leader(rest...)
+	propose(t, leader, "y")
+	c.eventually(func() bool {
+		return old.Status().Role != raft.Leader
+	}, "the old leader didn't step down")
+
+	c.network.Heal()
+	c.leader("a", "b", "c")
+	c.converged([]string{"x", "y"}, "a", "b", "c")
+}
+
+func TestReadIndex(t *testing.T) {
+	c := newCluster(t, func(o *raft.Options) {
+		o.ProposalTimeout = 200 * time.Millisecond
+	}, "a", "b", "c")
+	old := c.leader("a", "b", "c")
+	propose(t, old, "x")
+
+	// every node has applied x by the time its read index is returned
+	for id, n := range c.nodes {
+		index, err := n.ReadIndex(context.Background())
+		if err != nil || index == 0 {
+			t.Fatalf("read index on [%s] returned %d, %v", id, index, err)
+		}
+		if values := c.machines[id].Values(); !slices.Equal(values, []string{"x"}) {
+			t.Errorf("expected [%s] to have applied x, got %v", id, values)
+		}
+	}
+
+	var rest []string
+	for id, n := range c.nodes {
+		if n != old {
+			rest = append(rest, id)
+		}
+	}
+	c.network.Partition(rest)
+	_, err := old.ReadIndex(context.Background())
+	if !errors.Is(err, raft.ErrReadTimeout) && !errors.Is(err, raft.ErrNoLeader) {
+		t.Errorf("expected a read in the minority to fail, got %v", err)
+	}
+}
+
+func TestLeaseReads(t *testing.T) {
+	c := newCluster(t, func(o *raft.Options) {
+		o.ProposalTimeout = 200 * time.Millisecond
+		o.LeaseReads = true
+	}, "a", "b", "c")
+	old := c.leader("a", "b", "c")
+	propose(t, old, "x")
+	if _, err := old.ReadIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var rest []string
+	for id, n := range c.nodes {
+		if n != old {
+			rest = append(rest, id)
+		}
+	}
+	c.network.Partition(rest)
+	leader := c.leader(rest...)
+	propose(t, leader, "y")
+
+	// the old leader's lease ran out before the others could elect a new one
+	if _, err := old.ReadIndex(context.Background()); err == nil {
+		t.Error("expected a read from the old leader to fail once there's a new leader")
+	}
+	if _, err := leader.ReadIndex(context.Background()); err != nil {
+		t.Errorf("read from the new leader failed: %v", err)
+	}
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c := newCluster(t, nil, "a", "b", "c")
+	old := c.leader("a", "b", "c")
+	propose(t, old, "x")
+
+	var followers []string
+	for id, n := range c.nodes {
+		if n != old {
+			followers = append(followers, id)
+		}
+	}
+
+	// asked of the other follower, which forwards it to the leader
+	to := followers[0]
+	if err := c.nodes[followers[1]].TransferLeadership(context.Background(), to); err != nil {
+		t.Fatal(err)
+	}
+	if leader := c.leader("a", "b", "c"); leader != c.nodes[to] {
+		t.Fatalf("expected [%s] to be the leader, got [%s]", to, leader.Status().ID)
+	}
+	propose(t, c.nodes[to], "y")
+	c.converged([]string{"x", "y"}, "a", "b", "c")
+
+	if err := old.TransferLeadership(context.Background(), "z"); !errors.Is(err, raft.ErrMembership) {
+		t.Errorf("expected a transfer to a non-member to fail, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newCluster(t, func(o *raft.Options) {
+		o.SnapshotEntries = 5
+		o.MaxEntries = 2
+	}, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+
+	var lagging string
+	var rest []string
+	for id, n := range c.nodes {
+		if n != leader && lagging == "" {
+			lagging = id
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	c.network.Partition(rest)
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprint(i))
+		propose(t, leader, want[i])
+	}
+	c.converged(want, rest...)
+	if s := leader.Status(); s.LastIndex-s.Applied > 5 {
+		t.Errorf("expected the leader's log to be compacted, got %+v", s)
+	}
+
+	c.network.Heal()
+	c.converged(want, "a", "b", "c")
+}
+
+func TestMembership(t *testing.T) {
+	c := newCluster(t, nil, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	propose(t, leader, "x")
+
+	d := raft.Member{ID: "d", Address: "d"}
+	c.start("d", raft.NewMemoryStorage(), true)
+	err := leader.AddMember(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = leader.AddMember(context.Background(), d)
+	if !errors.Is(err, raft.ErrMembership) {
+		t.Errorf("expected adding a member twice to fail, got %v", err)
+	}
+	propose(t, leader, "y")
+	c.converged([]string{"x", "y"}, "a", "b", "c", "d")
+	if s := c.nodes["d"].Status(); len(s.Members) != 4 {
+		t.Errorf("expected the new member to know of 4 members, got %+v", s.Members)
+	}
+
+	// a leader which removes itself hands over to the others
+	id := leader.Status().ID
+	err = leader.RemoveMember(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rest []string
+	for _, m := range []string{"a", "b", "c", "d"} {
+		if m != id {
+			rest = append(rest, m)
+		}
+	}
+	next := c.leader(rest...)
+	propose(t, next, "z")
+	c.converged([]string{"x", "y", "z"}, rest...)
+	if s := next.Status(); len(s.Members) != 3 {
+		t.Errorf("expected 3 members, got %+v", s.Members)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := raft.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCluster(t, func(o *raft.Options) {
+		o.SnapshotEntries = 3
+	}, "a")
+	c.nodes["a"].Stop()
+	c.start("a", storage, false)
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		want = append(want, fmt.Sprint(i))
+		propose(t, c.leader("a"), want[i])
+	}
+	c.nodes["a"].Stop()
+	storage.Close()
+
+	storage, err = raft.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	c.start("a", storage, false)
+	c.leader("a")
+	c.converged(want, "a")
+	if s := c.nodes["a"].Status(); s.Term < 2 {
+		t.Errorf("expected the term to survive a restart, got %d", s.Term)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := raft.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []raft.Entry{
+		{Index: 1, Term: 1, Type: raft.EntryCommand, Data: []byte("a")},
+		{Index: 2, Term: 1, Type: raft.EntryCommand, Data: []byte("b")},
+		{Index: 3, Term: 1, Type: raft.EntryCommand, Data: []byte("c")},
+	}
+	check(t, s.SaveState(raft.HardState{Term: 2, Vote: "a"}))
+	check(t, s.Append(entries))
+	check(t, s.Append([]raft.Entry{{Index: 3, Term: 2, Type: raft.EntryNoop}}))
+	check(t, s.SaveSnapshot(raft.Snapshot{Index: 1, Term: 1, Members: []raft.Member{{ID: "a", Address: "x"}}, Data: []byte("a")}))
+	check(t, s.Close())
+
+	s, err = raft.NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	state, snap, loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Term != 2 || state.Vote != "a" {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if snap.Index != 1 || string(snap.Data) != "a" || len(snap.Members) != 1 || snap.Members[0].Address != "x" {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+	if len(loaded) != 2 || loaded[0].Index != 2 || loaded[1].Term != 2 || loaded[1].Type != raft.EntryNoop {
+		t.Errorf("unexpected entries %+v", loaded)
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
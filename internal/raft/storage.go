@@ -0,0 +1,88 @@
+package raft
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// Storage keeps a node's state so it survives restarts.  Every method must have made its change durable by the time it
+// returns.
+type Storage interface {
+	// Load returns what has been saved.  For a node which has never saved anything, everything is empty.
+	Load() (HardState, Snapshot, []Entry, error)
+
+	SaveState(state HardState) error
+
+	// Append saves entries, replacing the saved entries from the index of the first one onwards.
+	Append(entries []Entry) error
+
+	// SaveSnapshot saves snap, and discards the entries it covers.  The entries after it are kept only when the saved
+	// entry at the snapshot's index has the snapshot's term, otherwise they're discarded too.
+	SaveSnapshot(snap Snapshot) error
+}
+
+// MemoryStorage keeps a node's state in memory, so it's lost when the process exits.  It's for tests, and nodes which
+// rejoin their cluster from scratch after a restart.
+type MemoryStorage struct {
+	lock     sync.Mutex
+	state    HardState
+	snapshot Snapshot
+	entries  []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, Snapshot, []Entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state, s.snapshot, slices.Clone(s.entries), nil
+}
+
+func (s *MemoryStorage) SaveState(state HardState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = appendEntries(s.entries, entries)
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(snap Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = entriesAfter(s.entries, snap)
+	s.snapshot = snap
+	return nil
+}
+
+// appendEntries adds entries to saved, replacing the saved entries from the first one's index onwards.
+func appendEntries(saved []Entry, entries []Entry) []Entry {
+	if len(entries) == 0 {
+		return saved
+	}
+	i, _ := slices.BinarySearchFunc(saved, entries[0].Index, func(e Entry, index uint64) int {
+		return cmp.Compare(e.Index, index)
+	})
+	return append(saved[:i], entries...)
+}
+
+// entriesAfter returns the entries which follow on from snap.
+func entriesAfter(saved []Entry, snap Snapshot) []Entry {
+	for i, e := range saved {
+		if e.Index == snap.Index {
+			if e.Term != snap.Term {
+				return nil
+			}
+			return slices.Clone(saved[i+1:])
+		}
+	}
+	return nil
+}
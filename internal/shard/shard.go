@@ -0,0 +1,100 @@
+// Package shard divides the keyspace between several servers.  Every key hashes to one of slot.Count slots, and a Map
+// gives each server a contiguous range of them.  A server's store is wrapped with Wrap, which turns away keys it doesn't own
+// with a MovedError naming the shard which does.
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"kv/pkg/slot"
+)
+
+// ErrMoved is returned for a key which belongs to another shard.
+var ErrMoved = errors.New("moved")
+
+// Shard is one server of a sharded store, owning the slots where Start <= slot < End.
+type Shard struct {
+	ID string
+
+	// Address is the shard's gRPC address, and HTTPAddress its REST address.
+	Address     string
+	HTTPAddress string
+
+	Start int
+	End   int
+}
+
+// Map assigns every slot to a shard.
+type Map struct {
+	// Version is increased whenever the slots are assigned differently, so a client can tell if its copy is current.
+	Version int64
+	Shards  []Shard
+}
+
+// Divide makes a Map giving each of shards an even share of the slots, in the order given.  The shards' Start and End
+// are ignored.
+func Divide(shards []Shard) (Map, error) {
+	if len(shards) == 0 || len(shards) > slot.Count {
+		return Map{}, fmt.Errorf("a shard map needs between 1 and %d shards", slot.Count)
+	}
+	m := Map{Version: 1, Shards: make([]Shard, len(shards))}
+	for i, s := range shards {
+		s.Start, s.End = i*slot.Count/len(shards), (i+1)*slot.Count/len(shards)
+		m.Shards[i] = s
+	}
+	return m, m.Validate()
+}
+
+// Validate checks that the shards have distinct ids, and own every slot exactly once, in order.
+func (m Map) Validate() error {
+	next := 0
+	ids := make(map[string]bool)
+	for _, s := range m.Shards {
+		if s.ID == "" || ids[s.ID] {
+			return fmt.Errorf("shard ids must be distinct and not empty, got [%s]", s.ID)
+		} else if s.Start != next || s.End <= s.Start {
+			return fmt.Errorf("shard [%s] owns slots [%d, %d), expected it to start at [%d]", s.ID, s.Start, s.End, next)
+		}
+		ids[s.ID] = true
+		next = s.End
+	}
+	if next != slot.Count {
+		return fmt.Errorf("the shards own slots up to [%d] of [%d]", next, slot.Count)
+	}
+	return nil
+}
+
+// Owner returns the shard owning key.
+func (m Map) Owner(key string) Shard {
+	n := slot.Of(key)
+	for _, s := range m.Shards {
+		if n < s.End {
+			return s
+		}
+	}
+	return m.Shards[len(m.Shards)-1]
+}
+
+// Get returns the shard with id.
+func (m Map) Get(id string) (Shard, bool) {
+	for _, s := range m.Shards {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Shard{}, false
+}
+
+// MovedError is returned for a key which belongs to Owner rather than the shard it was sent to.
+type MovedError struct {
+	Key   string
+	Owner Shard
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("key [%s] belongs to shard [%s] at [%s]", e.Key, e.Owner.ID, e.Owner.Address)
+}
+
+func (e *MovedError) Unwrap() error {
+	return ErrMoved
+}
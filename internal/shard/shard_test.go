@@ -0,0 +1,87 @@
+package shard
+
+import (
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/watch"
+	"kv/pkg/slot"
+	"strconv"
+	"testing"
+)
+
+func threeShards(t *testing.T) Map {
+	m, err := Divide([]Shard{{ID: "a"}, {ID: "b"}, {ID: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDivide(t *testing.T) {
+	m := threeShards(t)
+	if m.Shards[0].Start != 0 || m.Shards[2].End != slot.Count {
+		t.Errorf("expected the shards to cover every slot, got %+v", m.Shards)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i != 3000; i++ {
+		key := "key" + strconv.Itoa(i)
+		owner := m.Owner(key)
+		if s := slot.Of(key); s < owner.Start || s >= owner.End {
+			t.Fatalf("key [%s] in slot [%d] given to %+v", key, s, owner)
+		}
+		counts[owner.ID]++
+	}
+	for id, n := range counts {
+		if n < 800 || n > 1200 {
+			t.Errorf("expected about 1000 keys in shard [%s], got [%d]", id, n)
+		}
+	}
+
+	if _, err := Divide(nil); err == nil {
+		t.Error("expected a map without shards to be rejected")
+	}
+	m.Shards[1].Start++
+	if m.Validate() == nil {
+		t.Error("expected a gap between shards to be rejected")
+	}
+}
+
+func TestStore(t *testing.T) {
+	m := threeShards(t)
+	s, err := Wrap(watch.Wrap(skiplist.New()), m, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Wrap(watch.Wrap(skiplist.New()), m, "z"); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("expected an unknown shard to be invalid, got %v", err)
+	}
+
+	var local, remote string
+	for i := 0; local == "" || remote == ""; i++ {
+		key := "key" + strconv.Itoa(i)
+		if m.Owner(key).ID == "a" {
+			local = key
+		} else if m.Owner(key).ID == "b" {
+			remote = key
+		}
+	}
+
+	if err := s.Put(local, "v"); err != nil {
+		t.Fatal(err)
+	}
+	var moved *MovedError
+	if err := s.Put(remote, "v"); !errors.As(err, &moved) || moved.Owner.ID != "b" {
+		t.Errorf("expected [%s] to have moved to shard b, got %v", remote, err)
+	}
+
+	_, err = s.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: local}, {Type: store.OpPut, Key: remote}}})
+	if !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("expected a transaction across shards to be invalid, got %v", err)
+	}
+	_, err = s.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: remote}, {Type: store.OpPut, Key: "{" + remote + "}x"}}})
+	if !errors.Is(err, ErrMoved) {
+		t.Errorf("expected a transaction on another shard to have moved, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Package shardtest runs a sharded store in-process for tests.  Each shard is a full server, with the gRPC and REST
+// APIs listening on local ports, so requests take the same path they would between processes.
+package shardtest
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"kv/cmd/server/rest"
+	"kv/cmd/server/rpc"
+	"kv/internal/gen"
+	"kv/internal/shard"
+	"kv/internal/store"
+	"kv/internal/store/lease"
+	"kv/internal/store/multilock"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/watch"
+	"kv/pkg/client"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// Cluster is a sharded store of in-process servers.
+type Cluster struct {
+	Map   shard.Map
+	Nodes []*Node
+}
+
+// Node is one shard's server.  Store is its local store, which can be read directly to see which keys it holds.
+type Node struct {
+	Shard shard.Shard
+	Store *shard.Store
+}
+
+// Start runs a cluster of n shards, which is stopped when the test finishes.
+func Start(t testing.TB, n int) *Cluster {
+	t.Helper()
+	var shards []shard.Shard
+	var listeners [][2]net.Listener
+	for i := 0; i != n; i++ {
+		grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, [2]net.Listener{grpcListener, httpListener})
+		shards = append(shards, shard.Shard{
+			ID:          "s" + strconv.Itoa(i+1),
+			Address:     grpcListener.Addr().String(),
+			HTTPAddress: httpListener.Addr().String(),
+		})
+	}
+
+	m, err := shard.Divide(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Cluster{Map: m}
+	for i, s := range m.Shards {
+		c.Nodes = append(c.Nodes, startNode(t, m, s, listeners[i][0], listeners[i][1]))
+	}
+	return c
+}
+
+func startNode(t testing.TB, m shard.Map, s shard.Shard, grpcListener, httpListener net.Listener) *Node {
+	revision := store.NewRevision()
+	kv := multilock.New(4, func() store.KVStore {
+		return skiplist.New(store.WithRevision(revision))
+	}, multilock.JumpHashFunc)
+	sharded, err := shard.Wrap(watch.Wrap(kv), m, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := lease.New(sharded)
+
+	grpcServer := grpc.NewServer()
+	gen.RegisterKVServer(grpcServer, rpc.New(sharded, leases))
+	gen.RegisterShardsServer(grpcServer, rpc.NewShards(m))
+	go grpcServer.Serve(grpcListener)
+
+	h := rest.New(sharded, leases)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /kv/", h.Put)
+	mux.HandleFunc("POST /kv/_bulk", h.Bulk)
+	mux.HandleFunc("GET /kv", h.Range)
+	mux.HandleFunc("GET /kv/{key}", h.Get)
+	mux.HandleFunc("DELETE /kv/{key}", h.Delete)
+	mux.HandleFunc("POST /txn", h.Txn)
+	mux.HandleFunc("POST /merge", h.Merge)
+	mux.HandleFunc("POST /mutate", h.Mutate)
+	mux.HandleFunc("GET /admin/shards", rest.NewShards(m).ShardMap)
+	httpServer := &http.Server{Handler: mux}
+	go httpServer.Serve(httpListener)
+
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		httpServer.Close()
+	})
+	return &Node{Shard: s, Store: sharded}
+}
+
+// GRPC returns a gRPC client of the shard id, rather than of the whole store.
+func (c *Cluster) GRPC(t testing.TB, id string) *client.GPRCClient {
+	t.Helper()
+	s, ok := c.Map.Get(id)
+	if !ok {
+		t.Fatalf("no shard [%s]", id)
+	}
+	conn, err := grpc.NewClient(s.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return client.NewGRPC(conn)
+}
+
+// Client returns a ShardedClient of the whole store, which talks gRPC to the shards.
+func (c *Cluster) Client(t testing.TB) *client.ShardedClient {
+	t.Helper()
+	kv, err := client.NewSharded(context.Background(), c.GRPC(t, c.Map.Shards[0].ID), func(s client.ShardInfo) (client.KV, error) {
+		return c.GRPC(t, s.ID), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+// RESTClient returns a ShardedClient of the whole store, which talks REST to the shards.
+func (c *Cluster) RESTClient(t testing.TB) *client.ShardedClient {
+	t.Helper()
+	seed := client.NewRest(c.Map.Shards[0].HTTPAddress).(client.Shards)
+	kv, err := client.NewSharded(context.Background(), seed, func(s client.ShardInfo) (client.KV, error) {
+		return client.NewRest(s.HTTPAddress), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+// Owner returns the node owning key.
+func (c *Cluster) Owner(key string) *Node {
+	owner := c.Map.Owner(key)
+	for _, n := range c.Nodes {
+		if n.Shard.ID == owner.ID {
+			return n
+		}
+	}
+	return nil
+}
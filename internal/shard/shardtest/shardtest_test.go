@@ -0,0 +1,311 @@
+package shardtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kv/pkg/client"
+	"kv/pkg/watch"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShardedClient(t *testing.T) {
+	c := Start(t, 3)
+	for name, kv := range map[string]*client.ShardedClient{"grpc": c.Client(t), "rest": c.RESTClient(t)} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i != 60; i++ {
+				err := kv.Put(ctx, fmt.Sprintf("%s%02d", name, i), i)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// every shard has some of the keys, and only the ones it owns
+			for _, n := range c.Nodes {
+				kvs, _ := n.Store.Range(name, name+"~", 0)
+				if len(kvs) == 0 {
+					t.Errorf("expected shard [%s] to have some keys", n.Shard.ID)
+				}
+				for _, item := range kvs {
+					if owner := c.Owner(item.Key); owner != n {
+						t.Errorf("key [%s] is in shard [%s], but belongs to [%s]", item.Key, n.Shard.ID, owner.Shard.ID)
+					}
+				}
+			}
+
+			for i := 0; i != 60; i++ {
+				value, err := kv.Get(ctx, fmt.Sprintf("%s%02d", name, i))
+				if err != nil || fmt.Sprint(value) != fmt.Sprint(i) {
+					t.Errorf("expected %s%02d to be [%d], got %v, %v", name, i, i, value, err)
+				}
+			}
+
+			// pages are merged from every shard, in key order
+			var keys []string
+			token := ""
+			for {
+				kvs, next, err := kv.Prefix(ctx, name, 25, token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, item := range kvs {
+					keys = append(keys, item.Key)
+				}
+				if next == "" {
+					break
+				}
+				token = next
+			}
+			if len(keys) != 60 {
+				t.Fatalf("expected 60 keys, got [%d]", len(keys))
+			}
+			for i, key := range keys {
+				if key != fmt.Sprintf("%s%02d", name, i) {
+					t.Fatalf("expected key [%d] to be %s%02d, got [%s]", i, name, i, key)
+				}
+			}
+		})
+	}
+}
+
+func TestShardedCRDTs(t *testing.T) {
+	c := Start(t, 3)
+	for name, kv := range map[string]*client.ShardedClient{"grpc": c.Client(t), "rest": c.RESTClient(t)} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, delta := range []int64{5, 3, -2} {
+				if _, err := kv.IncrementCounter(ctx, name+"-count", delta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n, err := kv.IncrementCounter(ctx, name+"-count", 0); err != nil || n != 6 {
+				t.Errorf("expected a count of [6], got %d, %v", n, err)
+			}
+
+			if _, err := kv.SetAdd(ctx, name+"-set", "x", "y", "z"); err != nil {
+				t.Fatal(err)
+			}
+			elements, err := kv.SetRemove(ctx, name+"-set", "y")
+			if err != nil || fmt.Sprint(elements) != "[x z]" {
+				t.Errorf("expected [x z], got %v, %v", elements, err)
+			}
+
+			kv.SetRegister(ctx, name+"-register", "first")
+			if v, err := kv.SetRegister(ctx, name+"-register", "second"); err != nil || v != "second" {
+				t.Errorf("expected [second], got %v, %v", v, err)
+			}
+
+			kv.Put(ctx, name+"-plain", "v")
+			if _, err := kv.IncrementCounter(ctx, name+"-plain", 1); !errors.Is(err, client.ErrTypeMismatch) {
+				t.Errorf("expected ErrTypeMismatch for a value which isn't a counter, got %v", err)
+			}
+		})
+	}
+}
+
+func TestShardedMutations(t *testing.T) {
+	c := Start(t, 3)
+	for name, kv := range map[string]*client.ShardedClient{"grpc": c.Client(t), "rest": c.RESTClient(t)} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			kv.Increment(ctx, name+"-n", 5)
+			if v, err := kv.Decrement(ctx, name+"-n", nil); err != nil || fmt.Sprint(v) != "4" {
+				t.Errorf("expected [4], got %v, %v", v, err)
+			}
+
+			kv.Put(ctx, name+"-s", "ab")
+			if v, err := kv.Append(ctx, name+"-s", "cd"); err != nil || v != "abcd" {
+				t.Errorf("expected [abcd], got %v, %v", v, err)
+			}
+
+			kv.PushBack(ctx, name+"-list", "b")
+			kv.PushBack(ctx, name+"-list", "c")
+			if v, err := kv.PushFront(ctx, name+"-list", "a"); err != nil || fmt.Sprint(v) != "[a b c]" {
+				t.Errorf("expected [a b c], got %v, %v", v, err)
+			}
+			if v, err := kv.Pop(ctx, name+"-list", false); err != nil || v != "c" {
+				t.Errorf("expected to pop [c], got %v, %v", v, err)
+			}
+			if v, err := kv.Pop(ctx, name+"-list", true); err != nil || v != "a" {
+				t.Errorf("expected to pop [a], got %v, %v", v, err)
+			}
+
+			if _, err := kv.Increment(ctx, name+"-s", 1); !errors.Is(err, client.ErrTypeMismatch) {
+				t.Errorf("expected ErrTypeMismatch for a value which isn't a number, got %v", err)
+			}
+			if _, err := kv.Pop(ctx, name+"-missing", true); !errors.Is(err, client.ErrNotFound) {
+				t.Errorf("expected ErrNotFound popping a key which doesn't exist, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDocumentsAcrossTransports(t *testing.T) {
+	c := Start(t, 2)
+	ctx := context.Background()
+	grpcKV, restKV := c.Client(t), c.RESTClient(t)
+	doc := map[string]interface{}{
+		"name":   "a",
+		"count":  float64(2),
+		"nested": map[string]interface{}{"ok": true, "tags": []interface{}{"x", "y"}},
+	}
+	for _, test := range []struct {
+		name           string
+		writer, reader client.KV
+	}{
+		{"rest to grpc", restKV, grpcKV},
+		{"grpc to rest", grpcKV, restKV},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			key := test.name + "-doc"
+			if err := test.writer.Put(ctx, key, doc); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := test.reader.Get(ctx, key); err != nil || !reflect.DeepEqual(v, doc) {
+				t.Errorf("expected %+v, got %+v, %v", doc, v, err)
+			}
+			if err := test.reader.PutIfValueEquals(ctx, key, "replaced", doc); err != nil {
+				t.Errorf("expected the document read back to equal the one written, got %v", err)
+			}
+
+			list := []interface{}{"a", float64(1), doc}
+			test.writer.Put(ctx, key+"-list", list)
+			if v, err := test.reader.Get(ctx, key+"-list"); err != nil || !reflect.DeepEqual(v, list) {
+				t.Errorf("expected %+v, got %+v, %v", list, v, err)
+			}
+
+			// a number is the same number whichever transport wrote it
+			if err := test.writer.Put(ctx, key+"-n", int64(1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := test.reader.PutIfValueEquals(ctx, key+"-n", int64(2), float64(1)); err != nil {
+				t.Errorf("expected 1 to equal 1.0, got %v", err)
+			}
+			if err := test.writer.PutIfValueEquals(ctx, key+"-n", int64(3), int64(2)); err != nil {
+				t.Errorf("expected 2 to equal 2, got %v", err)
+			}
+			if err := test.reader.PutIfValueEquals(ctx, key+"-n", int64(4), 3.5); !errors.Is(err, client.ErrPreconditionFailed) {
+				t.Errorf("expected 3.5 not to equal 3, got %v", err)
+			}
+		})
+	}
+}
+
+func TestShardMapOwner(t *testing.T) {
+	c := Start(t, 3)
+	m, err := c.GRPC(t, c.Nodes[0].Shard.ID).ShardMap(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 100; i++ {
+		key := fmt.Sprint("key", i)
+		if owner, ok := m.Owner(key); !ok || owner.ID != c.Owner(key).Shard.ID {
+			t.Errorf("expected the client to agree [%s] belongs to [%s], got [%s]", key, c.Owner(key).Shard.ID, owner.ID)
+		}
+	}
+	if _, ok := (client.ShardMap{}).Owner("key"); ok {
+		t.Error("expected a map without shards to have no owner")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	c := Start(t, 2)
+	ctx := context.Background()
+	key := "a"
+	var wrong string
+	for _, n := range c.Nodes {
+		if n != c.Owner(key) {
+			wrong = n.Shard.ID
+		}
+	}
+
+	err := c.GRPC(t, wrong).Put(ctx, key, "v")
+	if !errors.Is(err, client.ErrMoved) {
+		t.Errorf("expected the wrong shard to say the key moved, got %v", err)
+	}
+	s, _ := c.Map.Get(wrong)
+	err = client.NewRest(s.HTTPAddress).Put(ctx, key, "v")
+	if !errors.Is(err, client.ErrMoved) {
+		t.Errorf("expected the wrong shard to say the key moved over REST, got %v", err)
+	}
+
+	err = c.Client(t).Put(ctx, key, "v")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShardedTxnAndBatch(t *testing.T) {
+	c := Start(t, 3)
+	kv := c.Client(t)
+	ctx := context.Background()
+
+	// keys sharing a hash tag can be used together
+	r, err := kv.Txn(ctx, []client.Compare{client.IfAbsent("{order1}.status")},
+		[]client.Op{client.PutOp("{order1}.status", "new"), client.PutOp("{order1}.total", 10)}, nil)
+	if err != nil || !r.Succeeded {
+		t.Fatalf("expected the transaction to succeed, got %+v, %v", r, err)
+	}
+
+	// find two keys on different shards
+	other := ""
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprint("key", i); c.Owner(key) != c.Owner("{order1}") {
+			other = key
+		}
+	}
+	_, err = kv.Txn(ctx, nil, []client.Op{client.PutOp("{order1}.status", "paid"), client.PutOp(other, 1)}, nil)
+	if !errors.Is(err, client.ErrInvalid) {
+		t.Errorf("expected a transaction across shards to be invalid, got %v", err)
+	}
+
+	keys := []string{"{order1}.status", other, "{order1}.total", "missing"}
+	results, err := kv.BatchGet(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Key != keys[i] {
+			t.Errorf("expected result [%d] to be for [%s], got [%s]", i, keys[i], result.Key)
+		}
+	}
+	if results[0].Err != nil || results[0].Entry.Value != "new" || !errors.Is(results[1].Err, client.ErrNotFound) {
+		t.Errorf("unexpected batch results %+v", results)
+	}
+	if _, err = kv.BatchGet(ctx, keys, client.Atomic()); !errors.Is(err, client.ErrInvalid) {
+		t.Errorf("expected an atomic batch across shards to be invalid, got %v", err)
+	}
+}
+
+func TestShardedWatch(t *testing.T) {
+	c := Start(t, 3)
+	kv := c.Client(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates, err := kv.Watch(ctx, "w/", watch.Put, client.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]bool)
+	for i := 0; i != 10; i++ {
+		key := fmt.Sprint("w/", i)
+		want[key] = true
+		if err := kv.Put(ctx, key, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(5 * time.Second)
+	for len(want) != 0 {
+		select {
+		case u := <-updates:
+			delete(want, u.Key)
+		case <-timeout:
+			t.Fatalf("timed out waiting for updates to %v", want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package shard
+
+import (
+	"context"
+	"kv/internal/store"
+	"kv/pkg/slot"
+	"kv/pkg/watch"
+	"time"
+)
+
+// Store is one shard of a sharded store.  Operations on a key it doesn't own fail with a MovedError, and a
+// transaction's keys must all belong to it.  Range, Export and watches of a range only see the shard's own keys, so a
+// client reads a range from every shard and merges them.
+type Store struct {
+	kv    store.WatchableKVStore
+	m     Map
+	local Shard
+}
+
+// Wrap makes kv the shard id of m.
+func Wrap(kv store.WatchableKVStore, m Map, id string) (*Store, error) {
+	local, ok := m.Get(id)
+	if !ok {
+		return nil, store.NewError(store.ErrInvalid, "shard ["+id+"] isn't in the shard map")
+	}
+	return &Store{kv: kv, m: m, local: local}, nil
+}
+
+// Map returns the shard map the store was made with.
+func (s *Store) Map() Map {
+	return s.m
+}
+
+// check returns a MovedError if key belongs to another shard.
+func (s *Store) check(key string) error {
+	if n := slot.Of(key); n < s.local.Start || n >= s.local.End {
+		return &MovedError{Key: key, Owner: s.m.Owner(key)}
+	}
+	return nil
+}
+
+// checkAll returns a MovedError if every key belongs to the same other shard, so the whole request can be sent there,
+// or an error if they're split between shards.
+func (s *Store) checkAll(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	owner := s.m.Owner(keys[0])
+	for _, key := range keys[1:] {
+		if other := s.m.Owner(key); other.ID != owner.ID {
+			return store.NewError(store.ErrInvalid, "keys ["+keys[0]+"] and ["+key+"] belong to different shards, "+
+				"use a hash tag to keep them together")
+		}
+	}
+	return s.check(keys[0])
+}
+
+func (s *Store) Put(key string, value interface{}) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.kv.Put(key, value)
+}
+
+func (s *Store) Get(key string) (interface{}, error) {
+	if err := s.check(key); err != nil {
+		return nil, err
+	}
+	return s.kv.Get(key)
+}
+
+func (s *Store) GetEntry(key string, revision int64) (store.Entry, error) {
+	if err := s.check(key); err != nil {
+		return store.Entry{}, err
+	}
+	return s.kv.GetEntry(key, revision)
+}
+
+func (s *Store) Delete(key string) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.kv.Delete(key)
+}
+
+func (s *Store) PutIf(key string, value interface{}, cond store.Condition) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.kv.PutIf(key, value, cond)
+}
+
+func (s *Store) DeleteIf(key string, cond store.Condition) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.kv.DeleteIf(key, cond)
+}
+
+func (s *Store) Txn(txn store.Txn) (store.TxnResult, error) {
+	if err := s.checkAll(txn.Keys()); err != nil {
+		return store.TxnResult{}, err
+	}
+	return s.kv.Txn(txn)
+}
+
+func (s *Store) BatchGet(keys []string) ([]store.BatchResult, error) {
+	if err := s.checkAll(keys); err != nil {
+		return nil, err
+	}
+	return store.BatchGet(s.kv, keys, false)
+}
+
+func (s *Store) Restore(key string, entry store.Entry) error {
+	if err := s.check(key); err != nil {
+		return err
+	}
+	return s.kv.Restore(key, entry)
+}
+
+func (s *Store) ForEach(f func(key string, entry store.Entry) bool) {
+	s.kv.ForEach(f)
+}
+
+func (s *Store) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.kv.Range(start, end, limit)
+}
+
+func (s *Store) Export(start, end string) ([]store.KeyValue, int64, error) {
+	return store.ExportRange(s.kv, start, end)
+}
+
+func (s *Store) Expired(now time.Time, limit int) []string {
+	return s.kv.Expired(now, limit)
+}
+
+func (s *Store) Revision() int64 {
+	return s.kv.Revision()
+}
+
+func (s *Store) Compact(revision int64) error {
+	return s.kv.Compact(revision)
+}
+
+func (s *Store) Sync(ctx context.Context, c store.Consistency, minRevision int64) (store.Staleness, error) {
+	return store.Sync(ctx, s.kv, c, minRevision)
+}
+
+func (s *Store) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
+	// a key owned elsewhere never changes here, so its watch is never sent anything
+	return s.kv.AddWatch(key, op)
+}
+
+// Watch checks the key of a single key watch.  A watch of a range or prefix sees the shard's part of it.
+func (s *Store) Watch(req watch.WatchRequest) (chan watch.Update, func(), error) {
+	if req.End == "" && !req.Prefix {
+		if err := s.check(req.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return s.kv.Watch(req)
+}
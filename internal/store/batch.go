@@ -0,0 +1,157 @@
+package store
+
+import "fmt"
+
+// MaxBatchSize is the most items a batch can have.
+const MaxBatchSize = 10000
+
+var (
+	// ErrAborted is given to the items of an atomic batch which weren't applied because another item failed.
+	ErrAborted = NewError(ErrPreconditionFailed, "not applied, since another item of the atomic batch failed")
+
+	errBatchTooLarge = NewError(ErrTooLarge, fmt.Sprintf("batch has more than %d items", MaxBatchSize))
+	errDuplicateKey  = NewError(ErrInvalid, "batch writes the same key more than once")
+)
+
+// BatchResult is the outcome of one item of a batch.  For a get, Entry is the key's entry, and for a put it's the new
+// entry.  Err is nil when the item succeeded.
+type BatchResult struct {
+	Key   string
+	Entry Entry
+	Err   error
+}
+
+// BatchGetter is implemented by stores which can read many keys more cheaply than one at a time.
+type BatchGetter interface {
+	// BatchGet reads the current entry of each key.  The reads aren't atomic as a whole.
+	BatchGet(keys []string) ([]BatchResult, error)
+}
+
+// BatchGet reads the current entry of each key, using kv's own BatchGet when it has one.  When atomic is set, they're
+// read in one transaction, so every entry is from the same revision.
+func BatchGet(kv KVStore, keys []string, atomic bool) ([]BatchResult, error) {
+	if len(keys) > MaxBatchSize {
+		return nil, errBatchTooLarge
+	}
+	if atomic {
+		ops := make([]Op, len(keys))
+		for i, key := range keys {
+			ops[i] = Op{Type: OpGet, Key: key}
+		}
+		r, err := kv.Txn(Txn{Then: ops})
+		if err != nil {
+			return nil, err
+		}
+		return txnResults(keys, r), nil
+	}
+
+	if getter, ok := kv.(BatchGetter); ok {
+		return getter.BatchGet(keys)
+	}
+	results := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		e, err := kv.GetEntry(key, 0)
+		results[i] = BatchResult{Key: key, Entry: e, Err: err}
+	}
+	return results, nil
+}
+
+// BatchPut stores every value in one transaction, so the batch is logged and sent to watchers as a single write.  Puts
+// can't fail one at a time, so atomic makes no difference to them.
+func BatchPut(kv KVStore, kvs []KeyValue, _ bool) ([]BatchResult, error) {
+	keys := make([]string, len(kvs))
+	ops := make([]Op, len(kvs))
+	for i, item := range kvs {
+		keys[i] = item.Key
+		ops[i] = Op{Type: OpPut, Key: item.Key, Value: item.Value}
+	}
+	err := checkBatch(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := kv.Txn(Txn{Then: ops})
+	if err != nil {
+		return nil, err
+	}
+	return txnResults(keys, r), nil
+}
+
+// BatchDelete removes every key in one transaction.  A key which doesn't exist fails on its own, unless atomic is set,
+// when none of the keys are removed.
+func BatchDelete(kv KVStore, keys []string, atomic bool) ([]BatchResult, error) {
+	err := checkBatch(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	deletes := make([]Op, len(keys))
+	for i, key := range keys {
+		deletes[i] = Op{Type: OpDelete, Key: key}
+	}
+	if !atomic {
+		r, err := kv.Txn(Txn{Then: deletes})
+		if err != nil {
+			return nil, err
+		}
+		return txnResults(keys, r), nil
+	}
+
+	// every key has to exist, so they're read, then deleted if none has changed since.  A key which changed in between
+	// means reading them again.
+	for {
+		read, err := BatchGet(kv, keys, true)
+		if err != nil {
+			return nil, err
+		}
+
+		txn := Txn{Then: deletes}
+		missing := false
+		for _, r := range read {
+			missing = missing || r.Err != nil
+			txn.Compares = append(txn.Compares, Compare{Key: r.Key, Condition: IfRevisionEquals(r.Entry.ModRevision)})
+		}
+		if missing {
+			for i := range read {
+				if read[i].Err == nil {
+					read[i] = BatchResult{Key: read[i].Key, Err: ErrAborted}
+				}
+			}
+			return read, nil
+		}
+
+		r, err := kv.Txn(txn)
+		if err != nil {
+			return nil, err
+		} else if r.Succeeded {
+			return txnResults(keys, r), nil
+		}
+	}
+}
+
+func checkBatch(keys []string) error {
+	if len(keys) > MaxBatchSize {
+		return errBatchTooLarge
+	}
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			return errDuplicateKey
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
+
+// txnResults converts the results of a transaction with one op for each key.  A get or delete of a key which doesn't
+// exist fails with ErrNotFound.
+func txnResults(keys []string, r TxnResult) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		results[i] = BatchResult{Key: key, Entry: r.Results[i].Entry}
+		if !r.Results[i].Found {
+			results[i].Err = KeyNotFound(key)
+		}
+	}
+	return results
+}
@@ -0,0 +1,92 @@
+package store_test
+
+import (
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"testing"
+)
+
+func TestBatchPut(t *testing.T) {
+	kv := skiplist.New()
+	kv.Put("a", "old")
+
+	results, err := store.BatchPut(kv, []store.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Entry.ModRevision != 2 {
+			t.Errorf("expected [%s] to be written at revision [2], got %+v", r.Key, r)
+		}
+	}
+	if results[0].Entry.Version != 2 {
+		t.Errorf("expected [a] to be at version [2], got [%d]", results[0].Entry.Version)
+	}
+
+	_, err = store.BatchPut(kv, []store.KeyValue{{Key: "c"}, {Key: "c"}}, false)
+	if !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("expected a duplicate key to be %v, got %v", store.ErrInvalid, err)
+	}
+	_, err = store.BatchPut(kv, make([]store.KeyValue, store.MaxBatchSize+1), false)
+	if !errors.Is(err, store.ErrTooLarge) {
+		t.Errorf("expected a large batch to be %v, got %v", store.ErrTooLarge, err)
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	kv := skiplist.New()
+	kv.Put("a", "1")
+	kv.Put("b", "2")
+
+	for _, atomic := range []bool{false, true} {
+		results, err := store.BatchGet(kv, []string{"b", "missing", "a"}, atomic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Entry.Value != "2" || results[2].Entry.Value != "1" {
+			t.Errorf("atomic [%t]: unexpected results %+v", atomic, results)
+		}
+		if !errors.Is(results[1].Err, store.ErrNotFound) {
+			t.Errorf("atomic [%t]: expected a missing key to be %v, got %v", atomic, store.ErrNotFound, results[1].Err)
+		}
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	kv := skiplist.New()
+	kv.Put("a", "1")
+	kv.Put("b", "2")
+
+	// an atomic batch with a missing key deletes nothing
+	results, err := store.BatchDelete(kv, []string{"a", "missing"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[0].Err, store.ErrAborted) || !errors.Is(results[1].Err, store.ErrNotFound) {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if !errors.Is(results[0].Err, store.ErrPreconditionFailed) {
+		t.Errorf("expected an aborted item to be %v", store.ErrPreconditionFailed)
+	}
+	if _, err := kv.Get("a"); err != nil {
+		t.Errorf("expected [a] to be kept, got %v", err)
+	}
+
+	// otherwise only the missing key fails
+	results, err = store.BatchDelete(kv, []string{"a", "missing"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || !errors.Is(results[1].Err, store.ErrNotFound) {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	results, err = store.BatchDelete(kv, []string{"b"}, true)
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("unexpected results %+v, %v", results, err)
+	}
+	if _, err := kv.Get("b"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected [b] to be deleted, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"kv/internal/store"
 	"kv/internal/store/multilock"
 	"kv/internal/store/singlelock"
+	"kv/internal/store/skiplist"
 	"kv/internal/store/syncmap"
 	"log"
 	"math/rand"
@@ -58,6 +59,15 @@ func BenchmarkSyncMap(b *testing.B) {
 	}
 }
 
+func BenchmarkSkipList(b *testing.B) {
+	kv := skiplist.New()
+	for _, count := range iterations {
+		b.Run(fmt.Sprintf("iter-%d", count), func(b *testing.B) {
+			benchmarkDriver(kv, b)
+		})
+	}
+}
+
 func BenchmarkBasicKVService(b *testing.B) {
 	kv := basicKV()
 	for _, count := range iterations {
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"kv/pkg/anyval"
+	"reflect"
+)
+
+var (
+	// ErrPreconditionFailed is returned when a conditional write's condition doesn't hold.
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	errInvalidCondition = NewError(ErrInvalid, "invalid condition")
+)
+
+type conditionType int
+
+const (
+	absent conditionType = iota + 1
+	valueEquals
+	revisionEquals
+)
+
+// Condition must hold for a key's current entry before a conditional write is applied.
+type Condition struct {
+	kind     conditionType
+	value    interface{}
+	revision int64
+}
+
+// IfAbsent holds when the key doesn't exist.
+func IfAbsent() Condition {
+	return Condition{kind: absent}
+}
+
+// IfValueEquals holds when the key exists and its value is equal to value, once both are in their anyval.Canonical form,
+// so a number written over REST equals the same number written over gRPC.
+func IfValueEquals(value interface{}) Condition {
+	return Condition{kind: valueEquals, value: value}
+}
+
+// IfRevisionEquals holds when the key was last changed at revision.  A missing key has a revision of zero.
+func IfRevisionEquals(revision int64) Condition {
+	return Condition{kind: revisionEquals, revision: revision}
+}
+
+// Check returns ErrPreconditionFailed unless the condition holds for e.  Exists is false when the key doesn't exist.
+func (c Condition) Check(e Entry, exists bool) error {
+	ok := false
+	switch c.kind {
+	case absent:
+		ok = !exists
+	case valueEquals:
+		ok = exists && reflect.DeepEqual(anyval.Canonical(c.value), anyval.Canonical(e.Value))
+	case revisionEquals:
+		if exists {
+			ok = c.revision == e.ModRevision
+		} else {
+			ok = c.revision == 0
+		}
+	}
+
+	if !ok {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// MarshalBinary encodes the condition as | kind byte | revision uvarint |, followed by the value as an anypb.Any for
+// IfValueEquals.  It lets a conditional write be sent to other nodes.
+func (c Condition) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint([]byte{byte(c.kind)}, uint64(c.revision))
+	if c.kind != valueEquals {
+		return buf, nil
+	}
+	v, err := anyval.Marshal(c.value)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{}.MarshalAppend(buf, v)
+}
+
+func (c *Condition) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errInvalidCondition
+	}
+	kind := conditionType(data[0])
+	revision, n := binary.Uvarint(data[1:])
+	if n <= 0 || kind < absent || kind > revisionEquals {
+		return errInvalidCondition
+	}
+
+	*c = Condition{kind: kind, revision: int64(revision)}
+	if kind == valueEquals {
+		v := &anypb.Any{}
+		err := proto.Unmarshal(data[1+n:], v)
+		if err != nil {
+			return errInvalidCondition
+		}
+		c.value, err = anyval.Unmarshal(v)
+		return err
+	}
+	return nil
+}
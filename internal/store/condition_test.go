@@ -0,0 +1,33 @@
+package store_test
+
+import (
+	"errors"
+	"kv/internal/store"
+	"testing"
+)
+
+func TestIfValueEquals(t *testing.T) {
+	doc := map[string]interface{}{"count": int64(2), "tags": []string{"a"}}
+	tests := []struct {
+		stored, compared interface{}
+		equal            bool
+	}{
+		{int64(1), float64(1), true},
+		{int32(1), uint8(1), true},
+		{"1", "1", true},
+		{doc, map[string]interface{}{"count": float64(2), "tags": []interface{}{"a"}}, true},
+		{[]int64{1, 2}, []interface{}{float64(1), float64(2)}, true},
+		{int64(1), 1.5, false},
+		{int64(1), "1", false},
+		{doc, map[string]interface{}{"count": float64(3), "tags": []interface{}{"a"}}, false},
+	}
+	for _, test := range tests {
+		err := store.IfValueEquals(test.compared).Check(store.Entry{Value: test.stored}, true)
+		if test.equal && err != nil || !test.equal && !errors.Is(err, store.ErrPreconditionFailed) {
+			t.Errorf("%#v compared to %#v: expected equal to be %v, got %v", test.stored, test.compared, test.equal, err)
+		}
+	}
+	if err := store.IfValueEquals(nil).Check(store.Entry{}, false); !errors.Is(err, store.ErrPreconditionFailed) {
+		t.Errorf("expected a missing key to fail, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Consistency is how up to date a read must be.  It only matters for a Replica, as a single store is always up to
+// date.
+type Consistency int
+
+const (
+	// Linearizable reads see every write which completed before they started.  It's the default.
+	Linearizable Consistency = iota
+
+	// Sequential reads are served by the local copy once it has reached a minimum revision, so a client which passes
+	// the highest revision it has seen never sees an older state, whichever node it reads from.
+	Sequential
+
+	// Stale reads are served by the local copy straight away.
+	Stale
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case Linearizable:
+		return "linearizable"
+	case Sequential:
+		return "sequential"
+	case Stale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+// ConsistencyFromString parses a Consistency by name, with an empty name being Linearizable.
+func ConsistencyFromString(name string) (Consistency, error) {
+	switch name {
+	case "", "linearizable":
+		return Linearizable, nil
+	case "sequential":
+		return Sequential, nil
+	case "stale":
+		return Stale, nil
+	}
+	return 0, NewError(ErrInvalid, "unknown consistency: "+name)
+}
+
+// Staleness is how far behind a read of a replica's local copy may be.
+type Staleness struct {
+	// Entries is how many writes the replica knew had been committed, but hadn't applied yet.
+	Entries uint64
+
+	// Since is how long it had been since the replica last heard from the rest of the cluster.  Writes made since then
+	// may be missing.
+	Since time.Duration
+}
+
+// Replica is implemented by stores which are one copy of a replicated store, whose reads may be behind the others'.
+type Replica interface {
+	// Sync waits until reads of the store have consistency c, having reached minRevision for a Sequential read, and
+	// returns how far behind they may still be.
+	Sync(ctx context.Context, c Consistency, minRevision int64) (Staleness, error)
+}
+
+// Sync calls kv's Sync if it's a Replica.  Any other store is already up to date.
+func Sync(ctx context.Context, kv KVStore, c Consistency, minRevision int64) (Staleness, error) {
+	if r, ok := kv.(Replica); ok {
+		return r.Sync(ctx, c, minRevision)
+	}
+	return Staleness{}, nil
+}
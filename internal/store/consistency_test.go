@@ -0,0 +1,31 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"testing"
+)
+
+func TestConsistencyFromString(t *testing.T) {
+	for _, c := range []store.Consistency{store.Linearizable, store.Sequential, store.Stale} {
+		parsed, err := store.ConsistencyFromString(c.String())
+		if err != nil || parsed != c {
+			t.Errorf("expected [%s] to parse, got %v, %v", c, parsed, err)
+		}
+	}
+	if c, err := store.ConsistencyFromString(""); err != nil || c != store.Linearizable {
+		t.Errorf("expected the default to be linearizable, got %v, %v", c, err)
+	}
+	if _, err := store.ConsistencyFromString("eventual"); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("expected an unknown consistency to be invalid, got %v", err)
+	}
+}
+
+func TestSyncUnreplicated(t *testing.T) {
+	staleness, err := store.Sync(context.Background(), skiplist.New(), store.Stale, 10)
+	if err != nil || staleness != (store.Staleness{}) {
+		t.Errorf("expected a single store to be up to date, got %+v, %v", staleness, err)
+	}
+}
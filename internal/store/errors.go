@@ -0,0 +1,48 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of error a store returns, along with ErrPreconditionFailed, ErrCompacted and ErrUnsupported.  Other errors
+// wrap one of them, so the servers can map any error to a status with errors.Is.
+var (
+	// ErrNotFound is returned for a key, or anything else, which doesn't exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrTooLarge is returned for a request which is bigger than the server accepts.
+	ErrTooLarge = errors.New("too large")
+
+	// ErrUnavailable is returned when the store can't serve requests at the moment, and they may succeed if retried.
+	ErrUnavailable = errors.New("unavailable")
+
+	// ErrInvalid is returned for a request which can never succeed as it is.
+	ErrInvalid = errors.New("invalid argument")
+
+	// ErrTypeMismatch is returned for an operation on a key whose value is of a type the operation doesn't apply to.
+	ErrTypeMismatch = errors.New("type mismatch")
+)
+
+// Error is an error of one of the kinds above, with a message of its own.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+func NewError(kind error, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// KeyNotFound returns the ErrNotFound error for key.
+func KeyNotFound(key string) error {
+	return NewError(ErrNotFound, fmt.Sprintf("key [%s] not found", key))
+}
@@ -0,0 +1,36 @@
+package store_test
+
+import (
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/singlelock"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/syncmap"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	backends := map[string]store.KVStore{
+		"skiplist":   skiplist.New(),
+		"singlelock": singlelock.New(),
+		"syncmap":    syncmap.New(),
+	}
+	for name, kv := range backends {
+		if _, err := kv.Get("missing"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("%s: expected get of a missing key to be %v, got %v", name, store.ErrNotFound, err)
+		}
+		if err := kv.Delete("missing"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("%s: expected delete of a missing key to be %v, got %v", name, store.ErrNotFound, err)
+		}
+	}
+
+	// the specific errors keep their own identity, as well as their kind
+	for _, err := range []error{store.ErrInvalidTxn, store.ErrInvalidToken, store.ErrFutureRevision} {
+		if !errors.Is(err, store.ErrInvalid) || !errors.Is(err, err) {
+			t.Errorf("expected [%v] to be %v", err, store.ErrInvalid)
+		}
+	}
+	if err := store.KeyNotFound("foo"); err.Error() != "key [foo] not found" {
+		t.Errorf("unexpected message [%v]", err)
+	}
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// ExpiryIndex orders a backend's keys by when they expire, so the expired ones can be found without visiting every
+// key.  The backend updates it whenever a key's latest entry changes.  The zero value is empty and ready to use, and
+// it's safe for concurrent use.
+type ExpiryIndex struct {
+	lock  sync.Mutex
+	heap  expiryHeap
+	items map[string]*expiryItem
+}
+
+type expiryItem struct {
+	key     string
+	expires time.Time
+	index   int
+}
+
+// expiryHeap is a min-heap of keys by when they expire.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// Update records when the latest entry of key's history expires, or forgets key if it's deleted or doesn't expire.
+func (x *ExpiryIndex) Update(key string, h *History) {
+	var expires time.Time
+	if e, ok := h.latest(); ok {
+		expires = e.Expires
+	}
+	x.Set(key, expires)
+}
+
+// Set records when key expires.  A zero time forgets key.
+func (x *ExpiryIndex) Set(key string, expires time.Time) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	item, ok := x.items[key]
+	switch {
+	case expires.IsZero():
+		if ok {
+			heap.Remove(&x.heap, item.index)
+			delete(x.items, key)
+		}
+	case ok:
+		item.expires = expires
+		heap.Fix(&x.heap, item.index)
+	default:
+		if x.items == nil {
+			x.items = make(map[string]*expiryItem)
+		}
+		item = &expiryItem{key: key, expires: expires}
+		heap.Push(&x.heap, item)
+		x.items[key] = item
+	}
+}
+
+// Expired returns the keys which had expired by now, at most limit of them unless limit is zero or less.  Only the
+// expired keys are visited.
+func (x *ExpiryIndex) Expired(now time.Time, limit int) []string {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	// every key below an unexpired one in the heap expires later, so the walk stops there
+	var keys []string
+	pending := []int{0}
+	for len(pending) != 0 && (limit <= 0 || len(keys) < limit) {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if i >= len(x.heap) || x.heap[i].expires.After(now) {
+			continue
+		}
+		keys = append(keys, x.heap[i].key)
+		pending = append(pending, 2*i+2, 2*i+1)
+	}
+	return keys
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpiryIndex(t *testing.T) {
+	var x ExpiryIndex
+	start := time.Now()
+	for i := 0; i != 100; i++ {
+		x.Set("key"+strconv.Itoa(i), start.Add(time.Duration(i)*time.Second))
+	}
+	x.Set("key5", time.Time{})
+	x.Set("key99", start.Add(-time.Second))
+	x.Set("key0", start.Add(time.Hour))
+
+	keys := x.Expired(start.Add(3*time.Second), 0)
+	slices.Sort(keys)
+	if expected := []string{"key1", "key2", "key3", "key99"}; !slices.Equal(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+	if keys := x.Expired(start.Add(10*time.Second), 2); len(keys) != 2 {
+		t.Errorf("expected two keys, got %v", keys)
+	}
+	if keys := x.Expired(start.Add(-time.Hour), 0); len(keys) != 0 {
+		t.Errorf("expected nothing to have expired, got %v", keys)
+	}
+
+	h := NewHistory(2)
+	h.Put(Entry{Value: "v", ModRevision: 1, Expires: start})
+	x.Update("key1", h)
+	h = NewHistory(2)
+	h.Put(Entry{Value: "v", ModRevision: 2, Expires: start.Add(time.Hour)})
+	x.Update("key2", h)
+	h.Delete(3)
+	x.Update("key2", h)
+	if keys := x.Expired(start.Add(2*time.Hour), 0); !slices.Contains(keys, "key1") || slices.Contains(keys, "key2") {
+		t.Errorf("expected a history's latest entry to be indexed, got %v", keys)
+	}
+}
@@ -0,0 +1,39 @@
+package store
+
+// exportAttempts is how many times Export reads a store which isn't an Exporter before giving up on finding a revision
+// without concurrent writes.
+const exportAttempts = 10
+
+var errExportBusy = NewError(ErrUnavailable, "the store kept changing during the export")
+
+// Exporter is implemented by stores which can read a range of keys at a single revision, even when the keys are spread
+// over several backends.
+type Exporter interface {
+	// Export returns every key and value where start <= key < end, in key order, along with the revision they were
+	// read at.  An empty end has no upper bound.
+	Export(start, end string) ([]KeyValue, int64, error)
+}
+
+// Export reads every key beginning with prefix at a single revision.
+func Export(kv KVStore, prefix string) ([]KeyValue, int64, error) {
+	return ExportRange(kv, prefix, PrefixEnd(prefix))
+}
+
+// ExportRange reads every key where start <= key < end at a single revision, using kv's own Export when it has one.
+// Otherwise the keys are read with Range, which is retried until no write was made during the read.
+func ExportRange(kv KVStore, start, end string) ([]KeyValue, int64, error) {
+	if exporter, ok := kv.(Exporter); ok {
+		return exporter.Export(start, end)
+	}
+
+	for i := 0; i != exportAttempts; i++ {
+		revision := kv.Revision()
+		kvs, err := kv.Range(start, end, 0)
+		if err != nil {
+			return nil, 0, err
+		} else if kv.Revision() == revision {
+			return kvs, revision, nil
+		}
+	}
+	return nil, 0, errExportBusy
+}
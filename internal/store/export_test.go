@@ -0,0 +1,29 @@
+package store_test
+
+import (
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	kv := skiplist.New()
+	for _, key := range []string{"b", "a", "ab", "c"} {
+		kv.Put(key, key)
+	}
+
+	kvs, revision, err := store.Export(kv, "a")
+	if err != nil {
+		t.Fatal(err)
+	} else if revision != 4 {
+		t.Errorf("expected revision [4], got [%d]", revision)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "a" || kvs[1].Key != "ab" {
+		t.Errorf("unexpected export %+v", kvs)
+	}
+
+	kvs, _, err = store.Export(kv, "")
+	if err != nil || len(kvs) != 4 {
+		t.Errorf("expected every key, got %+v, %v", kvs, err)
+	}
+}
@@ -0,0 +1,434 @@
+// Package follower keeps a read only copy of another server's store, without raft.  A follower copies the leader's
+// keys with an export, then applies the leader's watch stream to its copy, writing each change at the leader's
+// revision so the copy goes through the same revisions.  It serves reads from the copy and turns writes away, pointing
+// the client at the leader.  Replication is asynchronous, so reads can be behind the leader.
+package follower
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"kv/pkg/watch"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a read waits for the copy to catch up.
+	DefaultTimeout = 5 * time.Second
+
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 5 * time.Second
+)
+
+// ErrReadOnly is returned for a write to a follower.  The error is a *ReadOnlyError, which says where the leader is.
+var ErrReadOnly = errors.New("read only")
+
+// Leader is the server a follower copies.
+type Leader struct {
+	Address     string
+	HTTPAddress string
+}
+
+// ReadOnlyError is returned for a write to a follower, which should be sent to Leader instead.
+type ReadOnlyError struct {
+	Leader Leader
+}
+
+func (e *ReadOnlyError) Error() string {
+	return "this server is a read only follower, send writes to the leader at [" + e.Leader.Address + "]"
+}
+
+func (e *ReadOnlyError) Unwrap() error {
+	return ErrReadOnly
+}
+
+// Store is a follower's copy of the leader's store.
+type Store struct {
+	kv       store.WatchableKVStore
+	revision *store.Revision
+	leader   Leader
+	client   gen.KVClient
+	timeout  time.Duration
+
+	// lock guards applied, which is closed and replaced whenever the copy changes, and the leader's state.
+	lock           sync.RWMutex
+	applied        chan struct{}
+	leaderRevision int64
+	connected      bool
+	lastContact    time.Time
+
+	bootstraps, reconnects, updates atomic.Uint64
+}
+
+// New makes kv a copy of the leader reached over conn.  Revision must be kv's revision counter, which follows the
+// leader's.  Any keys kv already has are replaced when Run bootstraps it.
+func New(kv store.WatchableKVStore, revision *store.Revision, leader Leader, conn grpc.ClientConnInterface) *Store {
+	return &Store{
+		kv:       kv,
+		revision: revision,
+		leader:   leader,
+		client:   gen.NewKVClient(conn),
+		timeout:  DefaultTimeout,
+		applied:  make(chan struct{}),
+	}
+}
+
+// Leader returns the server the follower copies.
+func (s *Store) Leader() Leader {
+	return s.leader
+}
+
+// Run bootstraps the copy, then replicates the leader until done is closed.  When the watch stream breaks it
+// reconnects, and carries on from the last revision applied, unless the leader no longer has the changes since then,
+// when the copy is bootstrapped again.
+func (s *Store) Run(done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	bootstrap := true
+	delay := minRetryDelay
+	for ctx.Err() == nil {
+		var err error
+		if bootstrap {
+			err = s.bootstrap(ctx)
+		}
+		if err == nil {
+			bootstrap = false
+			err = s.follow(ctx, func() { delay = minRetryDelay })
+		}
+		s.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.OutOfRange {
+			slog.Warn("follower: the leader has compacted changes it hasn't sent, bootstrapping again",
+				"revision", s.kv.Revision())
+			bootstrap = true
+		} else {
+			slog.Warn("follower: replication failed, reconnecting", "leader", s.leader.Address, "err", err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay = min(2*delay, maxRetryDelay)
+		s.reconnects.Add(1)
+	}
+}
+
+// bootstrap replaces the copy with an export of the leader's keys.  The keys are written at the export's revision, and
+// the copy's history before it is compacted, as it never had it.
+func (s *Store) bootstrap(ctx context.Context) error {
+	stream, err := s.client.Export(ctx, &gen.ExportRequest{})
+	if err != nil {
+		return err
+	}
+	exported := make(map[string]bool)
+	var revision int64
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		revision = r.Revision
+		txn := store.Txn{Revision: revision}
+		for _, kv := range r.Kvs {
+			value, err := anyval.Unmarshal(kv.Value)
+			if err != nil {
+				return err
+			}
+			txn.Then = append(txn.Then, store.Op{Type: store.OpPut, Key: kv.Key, Value: value})
+			exported[kv.Key] = true
+		}
+		if _, err := s.kv.Txn(txn); err != nil {
+			return err
+		}
+	}
+
+	// keys deleted from the leader while the follower wasn't watching
+	stale := store.Txn{Revision: revision}
+	s.kv.ForEach(func(key string, _ store.Entry) bool {
+		if !exported[key] {
+			stale.Then = append(stale.Then, store.Op{Type: store.OpDelete, Key: key})
+		}
+		return true
+	})
+	if _, err := s.kv.Txn(stale); err != nil {
+		return err
+	}
+
+	s.revision.Restore(revision)
+	s.bootstraps.Add(1)
+	s.observe(revision)
+	s.notifyApplied()
+	slog.Info("follower: bootstrapped from the leader", "leader", s.leader.Address, "keys", len(exported),
+		"revision", revision)
+	return nil
+}
+
+// follow applies the leader's changes after the copy's revision until the stream fails.  Connected is called once the
+// stream is open.
+func (s *Store) follow(ctx context.Context, connected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := s.client.Watch(ctx, &gen.WatchRequest{
+		Prefix:    true,
+		WatchType: gen.OpType_ALL,
+		Revision:  s.kv.Revision() + 1,
+	})
+	if err != nil {
+		return err
+	}
+	header, err := stream.Header()
+	if err == nil && header == nil {
+		err = stream.RecvMsg(&gen.WatchResponse{})
+	}
+	if err != nil {
+		return err
+	}
+	if values := header.Get(watch.RevisionHeader); len(values) != 0 {
+		revision, _ := strconv.ParseInt(values[0], 10, 64)
+		s.observe(revision)
+	}
+	s.setConnected(true)
+	connected()
+
+	// the updates of one write are applied together, in one transaction at the write's revision
+	txn := store.Txn{}
+	for {
+		u, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		// the leader sends writes in revision order, so one at or before the copy's revision has been applied already
+		if u.Revision <= s.kv.Revision() {
+			continue
+		}
+		if txn.Revision != 0 && u.Revision != txn.Revision {
+			return fmt.Errorf("follower: the updates of revision [%d] ended without the last one", txn.Revision)
+		}
+		txn.Revision = u.Revision
+
+		op := store.Op{Type: store.OpDelete, Key: u.Key}
+		if u.WatchType == gen.OpType_PUT {
+			value, err := anyval.Unmarshal(u.Value)
+			if err != nil {
+				return err
+			}
+			op = store.Op{Type: store.OpPut, Key: u.Key, Value: value}
+		}
+		txn.Then = append(txn.Then, op)
+		s.observe(u.Revision)
+		if !u.Last {
+			continue
+		}
+
+		if _, err := s.kv.Txn(txn); err != nil {
+			return err
+		}
+		s.revision.Advance(txn.Revision)
+		s.updates.Add(1)
+		s.notifyApplied()
+		txn = store.Txn{}
+	}
+}
+
+// observe records a revision the leader has reached.
+func (s *Store) observe(revision int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.leaderRevision = max(s.leaderRevision, revision)
+	s.lastContact = time.Now()
+}
+
+func (s *Store) setConnected(connected bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.connected = connected
+	s.lastContact = time.Now()
+}
+
+// notifyApplied wakes the reads waiting for the copy to change.
+func (s *Store) notifyApplied() {
+	s.lock.Lock()
+	close(s.applied)
+	s.applied = make(chan struct{})
+	s.lock.Unlock()
+}
+
+// Sync waits until reads of the copy have consistency c.  A linearizable read asks the leader for its revision and
+// waits for the copy to reach it, and a sequential one waits for the copy to reach minRevision.
+func (s *Store) Sync(ctx context.Context, c store.Consistency, minRevision int64) (store.Staleness, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	switch c {
+	case store.Linearizable:
+		resp, err := s.client.Range(ctx, &gen.RangeRequest{Limit: 1})
+		if err != nil {
+			return store.Staleness{}, store.NewError(store.ErrUnavailable, "follower can't reach the leader: "+err.Error())
+		}
+		s.observe(resp.Revision)
+		return store.Staleness{}, s.waitForRevision(ctx, resp.Revision)
+	case store.Sequential:
+		if err := s.waitForRevision(ctx, minRevision); err != nil {
+			return store.Staleness{}, err
+		}
+	}
+
+	st := s.Status()
+	staleness := store.Staleness{Entries: uint64(st.Lag)}
+	if !st.Connected {
+		staleness.Since = time.Since(st.LastContact)
+	}
+	return staleness, nil
+}
+
+func (s *Store) waitForRevision(ctx context.Context, revision int64) error {
+	for {
+		s.lock.RLock()
+		applied := s.applied
+		s.lock.RUnlock()
+		if s.kv.Revision() >= revision {
+			return nil
+		}
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return store.NewError(store.ErrUnavailable, fmt.Sprintf("timed out waiting for revision [%d]", revision))
+		}
+	}
+}
+
+// Status is how far the follower has got.
+type Status struct {
+	Leader string `json:"leader"`
+
+	// Revision is the leader's revision the copy has reached, and LeaderRevision the latest the follower knows the
+	// leader has reached.  Lag is how many revisions the copy is behind.
+	Revision       int64 `json:"revision"`
+	LeaderRevision int64 `json:"leaderRevision"`
+	Lag            int64 `json:"lag"`
+
+	// Connected reports whether the follower is watching the leader, and LastContact when it last heard from it.
+	Connected   bool      `json:"connected"`
+	LastContact time.Time `json:"lastContact"`
+
+	// Bootstraps counts the times the copy was replaced with an export, Reconnects the times the watch was reopened,
+	// and Updates the writes applied from it.
+	Bootstraps uint64 `json:"bootstraps"`
+	Reconnects uint64 `json:"reconnects"`
+	Updates    uint64 `json:"updates"`
+}
+
+func (s *Store) Status() Status {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	revision := s.kv.Revision()
+	return Status{
+		Leader:         s.leader.Address,
+		Revision:       revision,
+		LeaderRevision: max(s.leaderRevision, revision),
+		Lag:            max(s.leaderRevision-revision, 0),
+		Connected:      s.connected,
+		LastContact:    s.lastContact,
+		Bootstraps:     s.bootstraps.Load(),
+		Reconnects:     s.reconnects.Load(),
+		Updates:        s.updates.Load(),
+	}
+}
+
+func (s *Store) readOnly() error {
+	return &ReadOnlyError{Leader: s.leader}
+}
+
+func (s *Store) Put(string, interface{}) error {
+	return s.readOnly()
+}
+
+func (s *Store) Get(key string) (interface{}, error) {
+	return s.kv.Get(key)
+}
+
+func (s *Store) GetEntry(key string, revision int64) (store.Entry, error) {
+	return s.kv.GetEntry(key, revision)
+}
+
+func (s *Store) Delete(string) error {
+	return s.readOnly()
+}
+
+func (s *Store) PutIf(string, interface{}, store.Condition) error {
+	return s.readOnly()
+}
+
+func (s *Store) DeleteIf(string, store.Condition) error {
+	return s.readOnly()
+}
+
+// Txn serves transactions which only read, and turns away ones which may write.
+func (s *Store) Txn(txn store.Txn) (store.TxnResult, error) {
+	if store.HasWrites(txn.Then) || store.HasWrites(txn.Else) {
+		return store.TxnResult{}, s.readOnly()
+	}
+	return s.kv.Txn(txn)
+}
+
+func (s *Store) BatchGet(keys []string) ([]store.BatchResult, error) {
+	return store.BatchGet(s.kv, keys, false)
+}
+
+func (s *Store) ForEach(f func(key string, entry store.Entry) bool) {
+	s.kv.ForEach(f)
+}
+
+func (s *Store) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.kv.Range(start, end, limit)
+}
+
+func (s *Store) Export(start, end string) ([]store.KeyValue, int64, error) {
+	return store.ExportRange(s.kv, start, end)
+}
+
+func (s *Store) Expired(now time.Time, limit int) []string {
+	// keys are only removed when the leader removes them
+	return nil
+}
+
+func (s *Store) Revision() int64 {
+	return s.kv.Revision()
+}
+
+func (s *Store) Compact(int64) error {
+	return s.readOnly()
+}
+
+// Restore is used by a snapshot of the copy, so it isn't turned away.
+func (s *Store) Restore(key string, entry store.Entry) error {
+	return s.kv.Restore(key, entry)
+}
+
+func (s *Store) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
+	return s.kv.AddWatch(key, op)
+}
+
+func (s *Store) Watch(req watch.WatchRequest) (chan watch.Update, func(), error) {
+	return s.kv.Watch(req)
+}
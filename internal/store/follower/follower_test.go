@@ -0,0 +1,181 @@
+package follower_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"kv/cmd/server/rpc"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/internal/store/follower"
+	"kv/internal/store/lease"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/watch"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// leader serves a store over gRPC, and can be stopped and started again at the same address.
+type leader struct {
+	kv      store.WatchableKVStore
+	address string
+	server  *grpc.Server
+}
+
+func startLeader(t *testing.T, opts ...watch.Option) *leader {
+	l := &leader{kv: watch.Wrap(skiplist.New(), opts...), address: "127.0.0.1:0"}
+	l.start(t)
+	t.Cleanup(l.stop)
+	return l
+}
+
+func (l *leader) start(t *testing.T) {
+	listener, err := net.Listen("tcp", l.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.address = listener.Addr().String()
+	l.server = grpc.NewServer()
+	gen.RegisterKVServer(l.server, rpc.New(l.kv, lease.New(l.kv)))
+	go l.server.Serve(listener)
+}
+
+func (l *leader) stop() {
+	l.server.Stop()
+}
+
+func startFollower(t *testing.T, l *leader) *follower.Store {
+	conn, err := grpc.NewClient(l.address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision := store.NewRevision()
+	kv := watch.Wrap(skiplist.New(store.WithRevision(revision)))
+	f := follower.New(kv, revision, follower.Leader{Address: l.address}, conn)
+	done := make(chan struct{})
+	go f.Run(done)
+	t.Cleanup(func() {
+		close(done)
+		conn.Close()
+	})
+	return f
+}
+
+// caughtUp waits for the follower to reach the leader's revision.
+func caughtUp(t *testing.T, f *follower.Store, l *leader) {
+	t.Helper()
+	_, err := f.Sync(context.Background(), store.Sequential, l.kv.Revision())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectSame checks the follower has the leader's values for keys.  Keys copied by a bootstrap are at the revision of
+// the export, rather than their own, so revisions are only compared when revisions is set.
+func expectSame(t *testing.T, f *follower.Store, l *leader, revisions bool, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		want, wantErr := l.kv.GetEntry(key, 0)
+		got, err := f.GetEntry(key, 0)
+		if (err == nil) != (wantErr == nil) || fmt.Sprint(got.Value) != fmt.Sprint(want.Value) ||
+			revisions && got.ModRevision != want.ModRevision {
+			t.Errorf("expected [%s] to be %+v, %v, got %+v, %v", key, want, wantErr, got, err)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	l := startLeader(t)
+	for i := 0; i != 10; i++ {
+		l.kv.Put("k"+strconv.Itoa(i), i)
+	}
+	f := startFollower(t, l)
+	caughtUp(t, f, l)
+	expectSame(t, f, l, false, "k0", "k9")
+
+	l.kv.Put("k0", "changed")
+	l.kv.Delete("k1")
+	l.kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "a", Value: 1},
+		{Type: store.OpPut, Key: "b", Value: 2},
+	}})
+	caughtUp(t, f, l)
+	expectSame(t, f, l, true, "k0", "k1", "a", "b")
+	if f.Revision() != l.kv.Revision() {
+		t.Errorf("expected the follower to be at the leader's revision [%d], got [%d]", l.kv.Revision(), f.Revision())
+	}
+
+	// a linearizable read asks the leader how far to catch up
+	l.kv.Put("k2", "latest")
+	if _, err := f.Sync(context.Background(), store.Linearizable, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectSame(t, f, l, true, "k2")
+	if st := f.Status(); !st.Connected || st.Lag != 0 || st.Bootstraps != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+}
+
+func TestWritesRejected(t *testing.T) {
+	l := startLeader(t)
+	f := startFollower(t, l)
+
+	var readOnly *follower.ReadOnlyError
+	if err := f.Put("k", "v"); !errors.As(err, &readOnly) || readOnly.Leader.Address != l.address {
+		t.Errorf("expected a write to be sent to the leader, got %v", err)
+	}
+	_, err := f.Txn(store.Txn{Then: []store.Op{{Type: store.OpDelete, Key: "k"}}})
+	if !errors.Is(err, follower.ErrReadOnly) {
+		t.Errorf("expected a transaction which writes to be rejected, got %v", err)
+	}
+	if _, err := f.Txn(store.Txn{Then: []store.Op{{Type: store.OpGet, Key: "k"}}}); err != nil {
+		t.Errorf("expected a transaction which only reads to be served, got %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l := startLeader(t)
+	l.kv.Put("before", 1)
+	f := startFollower(t, l)
+	caughtUp(t, f, l)
+
+	l.stop()
+	l.kv.Put("during", 2)
+	l.kv.Delete("before")
+	l.start(t)
+
+	caughtUp(t, f, l)
+	expectSame(t, f, l, true, "before", "during")
+	if st := f.Status(); st.Reconnects == 0 || st.Bootstraps != 1 {
+		t.Errorf("expected the follower to resume without bootstrapping again, got %+v", st)
+	}
+}
+
+func TestBootstrapAfterCompaction(t *testing.T) {
+	l := startLeader(t, watch.WithEventHistory(4))
+	l.kv.Put("gone", 1)
+	f := startFollower(t, l)
+	caughtUp(t, f, l)
+
+	// more changes than the leader keeps, so the follower can't resume from where it was
+	l.stop()
+	l.kv.Delete("gone")
+	for i := 0; i != 10; i++ {
+		l.kv.Put("k"+strconv.Itoa(i), i)
+	}
+	l.start(t)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Status().Bootstraps != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	caughtUp(t, f, l)
+	expectSame(t, f, l, false, "gone", "k0", "k9")
+	if st := f.Status(); st.Bootstraps != 2 {
+		t.Errorf("expected the follower to bootstrap again, got %+v", st)
+	}
+}
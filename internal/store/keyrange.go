@@ -0,0 +1,86 @@
+package store
+
+import (
+	"encoding/base64"
+	"slices"
+	"strings"
+)
+
+const (
+	// DefaultPageSize is the number of keys returned by RangePage when no limit is given.
+	DefaultPageSize = 100
+
+	// MaxPageSize is the most keys RangePage will return at once.
+	MaxPageSize = 1000
+)
+
+// ErrInvalidToken is returned when a continuation token can't be decoded.
+var ErrInvalidToken = NewError(ErrInvalid, "invalid continuation token")
+
+// KeyValue is a key and its value, as returned by range reads.
+type KeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+// InRange reports whether start <= key < end.  An empty end has no upper bound.
+func InRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// SortAndLimit sorts kvs by key and trims it to limit entries.  A limit of zero or less keeps everything.
+func SortAndLimit(kvs []KeyValue, limit int) []KeyValue {
+	slices.SortFunc(kvs, func(a, b KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	if limit > 0 && len(kvs) > limit {
+		kvs = kvs[:limit]
+	}
+	return kvs
+}
+
+// PrefixEnd returns the first key after every key starting with prefix, for use as the end of a range.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// the prefix is empty or all 0xff, so there is no upper bound
+	return ""
+}
+
+// Prefix returns up to limit keys starting with prefix, in key order.
+func Prefix(kv KVStore, prefix string, limit int) ([]KeyValue, error) {
+	return kv.Range(prefix, PrefixEnd(prefix), limit)
+}
+
+// RangePage reads one page of the keys in [start, end) from kv.  A non-empty token continues from the page it was
+// returned with.  The returned token is empty once there are no more keys.
+func RangePage(kv KVStore, start, end string, limit int, token string) ([]KeyValue, string, error) {
+	if token != "" {
+		next, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, "", ErrInvalidToken
+		}
+		start = max(start, string(next))
+	}
+
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+
+	// read one more than needed to find out if there is another page
+	kvs, err := kv.Range(start, end, limit+1)
+	if err != nil || len(kvs) <= limit {
+		return kvs, "", err
+	}
+
+	kvs = kvs[:limit]
+	// the smallest key after the last one returned
+	next := kvs[limit-1].Key + "\x00"
+	return kvs, base64.RawURLEncoding.EncodeToString([]byte(next)), nil
+}
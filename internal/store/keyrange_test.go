@@ -0,0 +1,61 @@
+package store_test
+
+import (
+	"fmt"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"testing"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"":           "",
+		"a":          "b",
+		"config/":    "config0",
+		"a\xff":      "b",
+		"\xff\xff":   "",
+		"ab\xff\xff": "ac",
+	}
+	for prefix, expected := range cases {
+		if actual := store.PrefixEnd(prefix); actual != expected {
+			t.Errorf("prefix [%q]: expected [%q], got [%q]", prefix, expected, actual)
+		}
+	}
+}
+
+func TestRangePage(t *testing.T) {
+	kv := skiplist.New()
+	for i := range 25 {
+		kv.Put(fmt.Sprintf("key-%02d", i), i)
+	}
+
+	var keys []string
+	token := ""
+	pages := 0
+	for {
+		kvs, next, err := store.RangePage(kv, "key-05", "", 10, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if pages != 2 {
+		t.Errorf("expected [2] pages, got [%d]", pages)
+	}
+	if len(keys) != 20 || keys[0] != "key-05" || keys[19] != "key-24" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	_, _, err := store.RangePage(kv, "", "", 10, "not base64!")
+	if err != store.ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+}
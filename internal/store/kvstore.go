@@ -1,8 +1,15 @@
 package store
 
-import "kv/pkg/watch"
+import (
+	"errors"
+	"kv/pkg/watch"
+	"time"
+)
 
-// KVStore defines the methods for key value store.
+// ErrUnsupported is returned for an operation the store doesn't have the capability for.
+var ErrUnsupported = errors.New("operation not supported by this store")
+
+// KVStore defines the methods for key value store.  Watching is a separate capability, see Watcher.
 type KVStore interface {
 	// Put stores a value in the KV store.
 	Put(key string, value interface{}) error
@@ -10,10 +17,59 @@ type KVStore interface {
 	// Get retrieves a value from the KV store.
 	Get(key string) (interface{}, error)
 
+	// GetEntry retrieves a key's entry as of revision.  A revision of zero or less returns the current entry.
+	GetEntry(key string, revision int64) (Entry, error)
+
 	// Delete removes a key from the KV store.
 	Delete(key string) error
 
+	// PutIf stores a value when cond holds for the key's current entry, otherwise it returns ErrPreconditionFailed.
+	// The check and the write are atomic.
+	PutIf(key string, value interface{}, cond Condition) error
+
+	// DeleteIf removes a key when cond holds for its current entry, otherwise it returns ErrPreconditionFailed.
+	DeleteIf(key string, cond Condition) error
+
+	// Txn applies a group of ops atomically, choosing between two branches based on a list of conditions.
+	Txn(txn Txn) (TxnResult, error)
+
+	// ForEach calls f for the current entry of every key in the KV store, stopping early if f returns false.
+	// Changes made while iterating may or may not be visited.
+	ForEach(f func(key string, entry Entry) bool)
+
+	// Range returns up to limit keys and values where start <= key < end, in key order.  An empty end has no upper
+	// bound, and a limit of zero or less returns every key in the range.
+	Range(start, end string, limit int) ([]KeyValue, error)
+
+	// Expired returns up to limit keys which had expired by now, but haven't been removed.  Remove them with an OpExpire
+	// transaction.  A limit of zero or less returns every expired key.
+	Expired(now time.Time, limit int) []string
+
+	// Revision returns the revision of the latest change.
+	Revision() int64
+
+	// Compact discards history older than revision.
+	Compact(revision int64) error
+
+	// Restore sets a key's entry directly, without creating a new revision.  It's used to rebuild a store from a
+	// snapshot.
+	Restore(key string, entry Entry) error
+}
+
+// Watcher is implemented by stores which can send updates to their keys.  Stores which can't are wrapped in a
+// watch.KVStoreWatcher.
+type Watcher interface {
 	// AddWatch sends updates to values over the returned channel.
 	// Call the cancel function when updates are no longer needed.
 	AddWatch(key string, op watch.Operation) (chan watch.Update, func())
+
+	// Watch sends updates to the keys selected by req, like AddWatch.  When req starts from a past revision, the
+	// updates made since are sent first, or ErrCompacted is returned if they're no longer kept.
+	Watch(req watch.WatchRequest) (chan watch.Update, func(), error)
+}
+
+// WatchableKVStore is a KVStore which can send updates to its keys.
+type WatchableKVStore interface {
+	KVStore
+	Watcher
 }
@@ -0,0 +1,258 @@
+package lease
+
+import (
+	"kv/internal/store"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RecoveredTTL is given to leases recreated from keys restored at startup.  Leases themselves aren't persisted, so this
+// gives their owners time to reconnect and keep them alive before the keys are removed.
+const RecoveredTTL = time.Minute
+
+var (
+	// ErrNotFound is returned for a lease which doesn't exist, or has expired.
+	ErrNotFound = store.NewError(store.ErrNotFound, "lease not found")
+
+	// ErrInvalidTTL is returned when granting a lease without a positive TTL.
+	ErrInvalidTTL = store.NewError(store.ErrInvalid, "lease ttl must be positive")
+
+	// ErrReplicated refuses leases for a store replicated with raft.  A lease is only kept in the memory of the node
+	// which granted it, so it would be lost, and its keys never removed, when another node became the leader.
+	ErrReplicated = store.NewError(store.ErrUnsupported, "leases aren't supported by a store replicated with raft")
+)
+
+type lease struct {
+	id      int64
+	ttl     time.Duration
+	expires time.Time
+	keys    map[string]struct{}
+}
+
+// Info describes a lease.
+type Info struct {
+	ID int64
+
+	// TTL is the lease's time to live when it's granted or kept alive.
+	TTL time.Duration
+
+	// Remaining is how long until the lease expires.
+	Remaining time.Duration
+
+	// Keys are the keys attached to the lease.
+	Keys []string
+}
+
+// Lessor grants leases, and removes the keys attached to a lease when it's revoked or expires.  Keys are removed
+// through kv, so watchers see them deleted.
+type Lessor struct {
+	lock   sync.Mutex
+	kv     store.KVStore
+	leases map[int64]*lease
+	nextID int64
+
+	// refused is returned by every request of a disabled lessor.
+	refused error
+}
+
+func New(kv store.KVStore) *Lessor {
+	return &Lessor{
+		kv:     kv,
+		leases: make(map[int64]*lease),
+
+		// start from the clock, so ids from before a restart aren't handed out again
+		nextID: time.Now().UnixNano(),
+	}
+}
+
+// Disabled returns a lessor which refuses every request with err, for a store which can't support leases.
+func Disabled(err error) *Lessor {
+	return &Lessor{leases: make(map[int64]*lease), refused: err}
+}
+
+// Recover recreates the leases of every key in the store which is attached to one.
+func (l *Lessor) Recover() {
+	if l.refused != nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.kv.ForEach(func(key string, entry store.Entry) bool {
+		if entry.Lease == 0 {
+			return true
+		}
+		le, ok := l.leases[entry.Lease]
+		if !ok {
+			le = &lease{id: entry.Lease, ttl: RecoveredTTL, expires: now.Add(RecoveredTTL), keys: make(map[string]struct{})}
+			l.leases[entry.Lease] = le
+			l.nextID = max(l.nextID, entry.Lease)
+		}
+		le.keys[key] = struct{}{}
+		return true
+	})
+	if len(l.leases) != 0 {
+		slog.Info("recovered leases", "count", len(l.leases))
+	}
+}
+
+// Grant creates a lease which expires after ttl unless it's kept alive.
+func (l *Lessor) Grant(ttl time.Duration) (int64, error) {
+	if l.refused != nil {
+		return 0, l.refused
+	} else if ttl <= 0 {
+		return 0, ErrInvalidTTL
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.nextID++
+	l.leases[l.nextID] = &lease{
+		id:      l.nextID,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+		keys:    make(map[string]struct{}),
+	}
+	return l.nextID, nil
+}
+
+// KeepAlive resets the time to live of a lease, and returns it.
+func (l *Lessor) KeepAlive(id int64) (time.Duration, error) {
+	if l.refused != nil {
+		return 0, l.refused
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	le, ok := l.live(id)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	le.expires = time.Now().Add(le.ttl)
+	return le.ttl, nil
+}
+
+// TimeToLive describes a lease.
+func (l *Lessor) TimeToLive(id int64) (Info, error) {
+	if l.refused != nil {
+		return Info{}, l.refused
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	le, ok := l.live(id)
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	keys := make([]string, 0, len(le.keys))
+	for key := range le.keys {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return Info{ID: id, TTL: le.ttl, Remaining: time.Until(le.expires), Keys: keys}, nil
+}
+
+// live returns a lease unless it has expired.  The caller must hold the lock.
+func (l *Lessor) live(id int64) (*lease, bool) {
+	le, ok := l.leases[id]
+	if !ok || !time.Now().Before(le.expires) {
+		return nil, false
+	}
+	return le, true
+}
+
+// Put stores a value attached to a lease, so it's removed along with the lease.
+func (l *Lessor) Put(key string, value interface{}, id int64) error {
+	if l.refused != nil {
+		return l.refused
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	le, ok := l.live(id)
+	if !ok {
+		return ErrNotFound
+	}
+
+	_, err := l.kv.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: key, Value: value, Lease: id}}})
+	if err == nil {
+		le.keys[key] = struct{}{}
+	}
+	return err
+}
+
+// Revoke removes a lease and deletes its keys.
+func (l *Lessor) Revoke(id int64) error {
+	if l.refused != nil {
+		return l.refused
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	le, ok := l.leases[id]
+	if !ok {
+		return ErrNotFound
+	}
+	return l.revoke(le)
+}
+
+// revoke deletes the keys which are still attached to the lease, then forgets it.  Keys which have since been
+// overwritten or deleted are left alone.  The caller must hold the lock.
+func (l *Lessor) revoke(le *lease) error {
+	for {
+		txn := store.Txn{}
+		for key := range le.keys {
+			e, err := l.kv.GetEntry(key, 0)
+			if err != nil || e.Lease != le.id {
+				continue
+			}
+			txn.Compares = append(txn.Compares, store.Compare{Key: key, Condition: store.IfRevisionEquals(e.ModRevision)})
+			txn.Then = append(txn.Then, store.Op{Type: store.OpDelete, Key: key})
+		}
+		if len(txn.Then) == 0 {
+			break
+		}
+
+		// a key changed since it was read, so check them all again
+		result, err := l.kv.Txn(txn)
+		if err != nil {
+			return err
+		} else if result.Succeeded {
+			break
+		}
+	}
+	delete(l.leases, le.id)
+	return nil
+}
+
+// Expire revokes the leases which had expired by now.
+func (l *Lessor) Expire(now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, le := range l.leases {
+		if now.Before(le.expires) {
+			continue
+		}
+		err := l.revoke(le)
+		if err != nil {
+			return err
+		}
+		slog.Debug("lease expired", "id", le.id, "keys", len(le.keys))
+	}
+	return nil
+}
+
+// Run expires leases every interval until done is closed.
+func (l *Lessor) Run(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			err := l.Expire(now)
+			if err != nil {
+				slog.Error("expiring leases failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package lease
+
+import (
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	w "kv/internal/store/watch"
+	"kv/pkg/watch"
+	"testing"
+	"time"
+)
+
+func TestRevoke(t *testing.T) {
+	kv := w.New(skiplist.New())
+	l := New(kv)
+	id, err := l.Grant(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates, cancel := kv.AddWatch("b", watch.Delete)
+	defer cancel()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := l.Put(key, "up", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// c no longer belongs to the lease once it's overwritten
+	kv.Put("c", "kept")
+
+	info, err := l.TimeToLive(id)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(info.Keys) != 3 || info.TTL != time.Hour {
+		t.Errorf("unexpected lease %+v", info)
+	}
+
+	if err := l.Revoke(id); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := kv.Get(key); err == nil {
+			t.Errorf("key [%s] wasn't deleted", key)
+		}
+	}
+	if v, err := kv.Get("c"); err != nil || v != "kept" {
+		t.Errorf("expected [kept], got [%v] %v", v, err)
+	}
+
+	select {
+	case u := <-updates:
+		if u.Op != watch.Delete || u.Key != "b" {
+			t.Errorf("unexpected update %+v", u)
+		}
+	case <-time.After(time.Second):
+		t.Error("no delete event for [b]")
+	}
+
+	if err := l.Revoke(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if err := l.Put("d", "up", id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	kv := skiplist.New()
+	l := New(kv)
+	short, _ := l.Grant(time.Minute)
+	long, _ := l.Grant(time.Hour)
+	l.Put("short", 1, short)
+	l.Put("long", 2, long)
+
+	if _, err := l.KeepAlive(short); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Expire(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get("short"); err == nil {
+		t.Error("key of expired lease wasn't deleted")
+	}
+	if _, err := l.KeepAlive(short); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := kv.Get("long"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	kv := skiplist.New()
+	kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "a", Value: 1, Lease: 7},
+		{Type: store.OpPut, Key: "b", Value: 2, Lease: 7},
+		{Type: store.OpPut, Key: "c", Value: 3},
+	}})
+
+	l := New(kv)
+	l.Recover()
+	info, err := l.TimeToLive(7)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(info.Keys) != 2 || info.TTL != RecoveredTTL {
+		t.Errorf("unexpected lease %+v", info)
+	}
+
+	// new leases don't reuse recovered ids
+	if id, _ := l.Grant(time.Hour); id <= 7 {
+		t.Errorf("expected a new lease id, got [%d]", id)
+	}
+	if err := l.Revoke(7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get("c"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l := Disabled(ErrReplicated)
+	l.Recover()
+	if _, err := l.Grant(time.Minute); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("expected a disabled lessor to refuse a grant, got %v", err)
+	}
+	if err := l.Put("a", "v", 1); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("expected a disabled lessor to refuse a put, got %v", err)
+	}
+	if _, err := l.KeepAlive(1); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("expected a disabled lessor to refuse a keepalive, got %v", err)
+	}
+	if _, err := l.TimeToLive(1); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("expected a disabled lessor to refuse a ttl, got %v", err)
+	}
+	if err := l.Revoke(1); !errors.Is(err, store.ErrUnsupported) {
+		t.Errorf("expected a disabled lessor to refuse a revoke, got %v", err)
+	}
+	if err := l.Expire(time.Now()); err != nil {
+		t.Errorf("expected a disabled lessor to have nothing to expire, got %v", err)
+	}
+}
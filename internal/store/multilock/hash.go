@@ -0,0 +1,181 @@
+package multilock
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// HashFunc picks which of buckets buckets a key belongs to.  It must return the same bucket for a key every time it's
+// called with the same number of buckets.
+type HashFunc func(buckets int, key string) int
+
+// SimpleHashFunc uses a key's first byte, so keys sharing a first letter share a bucket.  It's cheap, but skews badly
+// for most keyspaces, and moves nearly every key when the bucket count changes.
+func SimpleHashFunc(buckets int, key string) int {
+	if key == "" {
+		return 0
+	}
+	return int(key[0]) % buckets
+}
+
+// FNVHashFunc spreads keys evenly with 64-bit FNV-1a, but like any modulo hash moves nearly every key when the bucket
+// count changes.
+func FNVHashFunc(buckets int, key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(buckets))
+}
+
+// XXHashFunc spreads keys evenly with 64-bit xxHash, which is faster than FNV for long keys.  It also moves nearly
+// every key when the bucket count changes.
+func XXHashFunc(buckets int, key string) int {
+	return int(xxhash(key) % uint64(buckets))
+}
+
+// JumpHashFunc is Lamping and Veach's jump consistent hash.  Growing from n to m buckets only moves the keys which
+// belong in the new buckets, and shrinking only moves the keys of the buckets removed.
+func JumpHashFunc(buckets int, key string) int {
+	h := xxhash(key)
+	b, j := int64(-1), int64(0)
+	for j < int64(buckets) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return int(b)
+}
+
+// DefaultVirtualNodes is how many points each bucket has on a ring by default.
+const DefaultVirtualNodes = 64
+
+// NewRingHashFunc places vnodes points for each bucket on a hash ring, and gives a key to the bucket of the first point
+// at or after its hash.  Like JumpHashFunc, changing the bucket count only moves the keys of the buckets added or
+// removed, at the cost of a lookup in the ring.  More virtual nodes spread the keys more evenly.
+func NewRingHashFunc(vnodes int) HashFunc {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	// a ring is built the first time each bucket count is used
+	var rings sync.Map
+	return func(buckets int, key string) int {
+		r, ok := rings.Load(buckets)
+		if !ok {
+			r, _ = rings.LoadOrStore(buckets, newRing(buckets, vnodes))
+		}
+		return r.(*ring).find(xxhash(key))
+	}
+}
+
+type point struct {
+	hash   uint64
+	bucket int
+}
+
+// ring is sorted by hash.  A bucket's points don't depend on how many buckets there are, which is what keeps keys in
+// place as buckets are added and removed.
+type ring []point
+
+func newRing(buckets, vnodes int) *ring {
+	r := make(ring, 0, buckets*vnodes)
+	for b := 0; b != buckets; b++ {
+		for v := 0; v != vnodes; v++ {
+			r = append(r, point{hash: xxhash(strconv.Itoa(b) + "#" + strconv.Itoa(v)), bucket: b})
+		}
+	}
+	slices.SortFunc(r, func(a, b point) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.bucket, b.bucket))
+	})
+	return &r
+}
+
+func (r *ring) find(hash uint64) int {
+	i, _ := slices.BinarySearchFunc(*r, hash, func(p point, hash uint64) int {
+		return cmp.Compare(p.hash, hash)
+	})
+	if i == len(*r) {
+		i = 0
+	}
+	return (*r)[i].bucket
+}
+
+const (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// xxhash is XXH64 with a zero seed.
+func xxhash(s string) uint64 {
+	n := len(s)
+	i := 0
+	var h uint64
+	if n >= 32 {
+		v1, v2, v3, v4 := prime1, prime2, uint64(0), uint64(0)
+		v1 += prime2
+		v4 -= prime1
+		for ; i+32 <= n; i += 32 {
+			v1 = xxround(v1, le64(s[i:]))
+			v2 = xxround(v2, le64(s[i+8:]))
+			v3 = xxround(v3, le64(s[i+16:]))
+			v4 = xxround(v4, le64(s[i+24:]))
+		}
+		h = rotl(v1, 1) + rotl(v2, 7) + rotl(v3, 12) + rotl(v4, 18)
+		h = xxmerge(h, v1)
+		h = xxmerge(h, v2)
+		h = xxmerge(h, v3)
+		h = xxmerge(h, v4)
+	} else {
+		h = prime5
+	}
+
+	h += uint64(n)
+	for ; i+8 <= n; i += 8 {
+		h ^= xxround(0, le64(s[i:]))
+		h = rotl(h, 27)*prime1 + prime4
+	}
+	if i+4 <= n {
+		h ^= uint64(le32(s[i:])) * prime1
+		h = rotl(h, 23)*prime2 + prime3
+		i += 4
+	}
+	for ; i < n; i++ {
+		h ^= uint64(s[i]) * prime5
+		h = rotl(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+func xxround(acc, input uint64) uint64 {
+	acc += input * prime2
+	return rotl(acc, 31) * prime1
+}
+
+func xxmerge(acc, v uint64) uint64 {
+	acc ^= xxround(0, v)
+	return acc*prime1 + prime4
+}
+
+func rotl(x uint64, r uint) uint64 {
+	return x<<r | x>>(64-r)
+}
+
+func le64(s string) uint64 {
+	return uint64(s[0]) | uint64(s[1])<<8 | uint64(s[2])<<16 | uint64(s[3])<<24 |
+		uint64(s[4])<<32 | uint64(s[5])<<40 | uint64(s[6])<<48 | uint64(s[7])<<56
+}
+
+func le32(s string) uint32 {
+	return uint32(s[0]) | uint32(s[1])<<8 | uint32(s[2])<<16 | uint32(s[3])<<24
+}
@@ -0,0 +1,76 @@
+package multilock
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestXXHash(t *testing.T) {
+	// reference values from the xxHash test suite
+	for s, want := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	} {
+		if got := xxhash(s); got != want {
+			t.Errorf("xxhash(%q): expected [%x], got [%x]", s, want, got)
+		}
+	}
+}
+
+func TestSimpleHashEmptyKey(t *testing.T) {
+	if idx := SimpleHashFunc(13, ""); idx != 0 {
+		t.Errorf("expected the empty key in bucket 0, got [%d]", idx)
+	}
+}
+
+func TestHashSpread(t *testing.T) {
+	const buckets, keys = 16, 16000
+	for name, hasher := range map[string]HashFunc{
+		"fnv":    FNVHashFunc,
+		"xxhash": XXHashFunc,
+		"jump":   JumpHashFunc,
+		"ring":   NewRingHashFunc(DefaultVirtualNodes),
+	} {
+		counts := make([]int, buckets)
+		for i := 0; i != keys; i++ {
+			idx := hasher(buckets, "user:"+strconv.Itoa(i))
+			if idx < 0 || idx >= buckets {
+				t.Fatalf("%s: bucket [%d] out of range", name, idx)
+			}
+			counts[idx]++
+		}
+
+		// keys sharing a prefix all land in one bucket with SimpleHashFunc
+		for idx, n := range counts {
+			if n < keys/buckets/2 || n > keys/buckets*2 {
+				t.Errorf("%s: bucket [%d] has [%d] keys, expected around [%d]", name, idx, n, keys/buckets)
+			}
+		}
+	}
+}
+
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	for name, hasher := range map[string]HashFunc{
+		"jump": JumpHashFunc,
+		"ring": NewRingHashFunc(DefaultVirtualNodes),
+	} {
+		moved := 0
+		for i := 0; i != 10000; i++ {
+			key := "key" + strconv.Itoa(i)
+			before, after := hasher(8, key), hasher(10, key)
+			if before != after {
+				moved++
+				if after < 8 {
+					t.Errorf("%s: key [%s] moved from [%d] to existing bucket [%d]", name, key, before, after)
+				}
+			}
+		}
+
+		// a fifth of the keys belong in the two new buckets
+		if moved < 1000 || moved > 3000 {
+			t.Errorf("%s: expected about 2000 keys to move, got [%d]", name, moved)
+		}
+	}
+}
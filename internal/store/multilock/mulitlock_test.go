@@ -1,10 +1,15 @@
 package multilock
 
 import (
+	"errors"
 	"kv/internal/store"
 	"kv/internal/store/singlelock"
 	w "kv/internal/store/watch"
+	"kv/pkg/crdt"
 	"kv/pkg/watch"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -67,14 +72,11 @@ func TestDelete(t *testing.T) {
 	}
 }
 
-func watchingKV() store.KVStore {
-	return w.New(basicKV())
-}
-
 func TestWatch(t *testing.T) {
 	expected := "an expected value"
 	done := make(chan struct{})
-	mkv := New(13, watchingKV, SimpleHashFunc)
+	// the buckets can't watch, so the store is wrapped, as the server does
+	mkv := w.Wrap(New(13, basicKV, SimpleHashFunc))
 	ch, cancel := mkv.AddWatch("foo", watch.Put)
 	defer cancel()
 	go func() {
@@ -91,3 +93,453 @@ func TestWatch(t *testing.T) {
 	}
 	<-done
 }
+
+func TestForEach(t *testing.T) {
+	mkv := New(13, basicKV, SimpleHashFunc)
+	for i := range data {
+		mkv.Put(data[i][0], data[i][1])
+	}
+
+	seen := make(map[string]interface{})
+	mkv.ForEach(func(key string, entry store.Entry) bool {
+		seen[key] = entry.Value
+		return true
+	})
+	if len(seen) != len(data) {
+		t.Errorf("expected [%d] keys, got [%d]", len(data), len(seen))
+	}
+
+	count := 0
+	mkv.ForEach(func(key string, entry store.Entry) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("iteration should have stopped after one key, visited [%d]", count)
+	}
+}
+
+func TestRange(t *testing.T) {
+	mkv := New(13, basicKV, SimpleHashFunc)
+	for i := range data {
+		mkv.Put(data[i][0], data[i][1])
+	}
+
+	kvs, err := mkv.Range("b", "x", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"complete", "cute", "encouraging"}
+	if len(kvs) != len(expected) {
+		t.Fatalf("expected [%d] keys, got %v", len(expected), kvs)
+	}
+	for i := range expected {
+		if kvs[i].Key != expected[i] {
+			t.Errorf("expected [%s], got [%s]", expected[i], kvs[i].Key)
+		}
+	}
+}
+
+func TestSharedRevision(t *testing.T) {
+	revision := store.NewRevision()
+	mkv := New(13, func() store.KVStore {
+		return singlelock.New(store.WithRevision(revision))
+	}, SimpleHashFunc)
+
+	for i := range data {
+		mkv.Put(data[i][0], data[i][1])
+	}
+	if mkv.Revision() != int64(len(data)) {
+		t.Errorf("expected revision [%d], got [%d]", len(data), mkv.Revision())
+	}
+
+	for i := range data {
+		e, err := mkv.GetEntry(data[i][0], 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if e.ModRevision != int64(i+1) {
+			t.Errorf("key [%s]: expected revision [%d], got [%d]", data[i][0], i+1, e.ModRevision)
+		}
+	}
+}
+
+func TestPutIfConcurrent(t *testing.T) {
+	mkv := New(13, basicKV, SimpleHashFunc)
+	mkv.Put("counter", int64(0))
+
+	// every increment retries until its compare and swap succeeds, so none are lost
+	const workers, increments = 8, 100
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				for {
+					e, err := mkv.GetEntry("counter", 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					err = mkv.PutIf("counter", e.Value.(int64)+1, store.IfRevisionEquals(e.ModRevision))
+					if err == nil {
+						break
+					} else if !errors.Is(err, store.ErrPreconditionFailed) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _ := mkv.Get("counter"); v != int64(workers*increments) {
+		t.Errorf("expected [%d], got [%v]", workers*increments, v)
+	}
+
+	if err := mkv.PutIf("counter", int64(0), store.IfValueEquals(int64(1))); !errors.Is(err, store.ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed, got %v", err)
+	}
+	if err := mkv.DeleteIf("counter", store.IfValueEquals(int64(workers*increments))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTxnAcrossBuckets(t *testing.T) {
+	revision := store.NewRevision()
+	mkv := New(13, func() store.KVStore {
+		return singlelock.New(store.WithRevision(revision))
+	}, SimpleHashFunc)
+
+	// "config" and "version" hash to different buckets
+	if SimpleHashFunc(13, "config") == SimpleHashFunc(13, "version") {
+		t.Fatal("keys should be in different buckets")
+	}
+	mkv.Put("version", int64(1))
+
+	txn := store.Txn{
+		Compares: []store.Compare{{Key: "version", Condition: store.IfValueEquals(int64(1))}},
+		Then: []store.Op{
+			{Type: store.OpPut, Key: "config", Value: "blob"},
+			{Type: store.OpPut, Key: "version", Value: int64(2)},
+			{Type: store.OpGet, Key: "config"},
+		},
+		Else: []store.Op{{Type: store.OpGet, Key: "version"}},
+	}
+
+	result, err := mkv.Txn(txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if !result.Succeeded || len(result.Results) != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if result.Revision != 2 {
+		t.Errorf("expected revision [2], got [%d]", result.Revision)
+	}
+	for _, key := range []string{"config", "version"} {
+		e, _ := mkv.GetEntry(key, 0)
+		if e.ModRevision != result.Revision {
+			t.Errorf("key [%s]: expected revision [%d], got [%d]", key, result.Revision, e.ModRevision)
+		}
+	}
+	if r := result.Results[2]; !r.Found || r.Entry.Value != "blob" {
+		t.Errorf("expected to read [blob], got %+v", r)
+	}
+
+	// the compare no longer holds, so only the else branch runs
+	result, err = mkv.Txn(txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if result.Succeeded || len(result.Results) != 1 || result.Results[0].Entry.Value != int64(2) {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.Revision != 2 {
+		t.Errorf("a read only branch should not change the revision, got [%d]", result.Revision)
+	}
+
+	_, err = mkv.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: "a"}, {Type: store.OpDelete, Key: "a"}}})
+	if !errors.Is(err, store.ErrInvalidTxn) {
+		t.Errorf("expected ErrInvalidTxn, got %v", err)
+	}
+}
+
+func TestMergeAcrossBuckets(t *testing.T) {
+	revision := store.NewRevision()
+	mkv := New(13, func() store.KVStore {
+		return singlelock.New(store.WithRevision(revision))
+	}, SimpleHashFunc)
+	mkv.Put("version", "plain")
+
+	// the merge into version fails, so the one into config isn't applied either
+	txn := store.Txn{Then: []store.Op{
+		{Type: store.OpMerge, Key: "config", Value: crdt.Increment{Node: "a", Delta: 1}},
+		{Type: store.OpMerge, Key: "version", Value: crdt.Increment{Node: "a", Delta: 1}},
+	}}
+	if _, err := mkv.Txn(txn); !errors.Is(err, store.ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+	if _, err := mkv.Get("config"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected config not to be written, got %v", err)
+	}
+
+	txn.Then = txn.Then[:1]
+	for i := 0; i != 2; i++ {
+		if _, err := mkv.Txn(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, _ := mkv.Get("config")
+	if c, ok := v.(crdt.Counter); !ok || c.Value() != 2 {
+		t.Errorf("expected a counter of [2], got %v", v)
+	}
+}
+
+func TestBatchGet(t *testing.T) {
+	mkv := New(13, basicKV, SimpleHashFunc)
+	keys := make([]string, 0, len(data)+1)
+	for i := range data {
+		mkv.Put(data[i][0], data[i][1])
+		keys = append(keys, data[i][0])
+	}
+	keys = append(keys, "missing")
+
+	results, err := store.BatchGet(mkv, keys, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(results) != len(keys) {
+		t.Fatalf("expected [%d] results, got [%d]", len(keys), len(results))
+	}
+	for i := range data {
+		if results[i].Key != data[i][0] || results[i].Err != nil || results[i].Entry.Value != data[i][1] {
+			t.Errorf("unexpected result %+v for key [%s]", results[i], data[i][0])
+		}
+	}
+	if last := results[len(data)]; last.Key != "missing" || !errors.Is(last.Err, store.ErrNotFound) {
+		t.Errorf("expected [missing] not to be found, got %+v", last)
+	}
+}
+
+func TestExport(t *testing.T) {
+	revision := store.NewRevision()
+	mkv := New(13, func() store.KVStore {
+		return singlelock.New(store.WithRevision(revision))
+	}, SimpleHashFunc)
+	for _, key := range []string{"user/b", "config", "user/a", "user/c"} {
+		mkv.Put(key, key)
+	}
+	mkv.Delete("user/c")
+
+	kvs, rev, err := store.Export(mkv, "user/")
+	if err != nil {
+		t.Fatal(err)
+	} else if rev != 5 {
+		t.Errorf("expected revision [5], got [%d]", rev)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "user/a" || kvs[1].Key != "user/b" {
+		t.Errorf("unexpected export %+v", kvs)
+	}
+}
+
+func sharedRevisionKV(revision *store.Revision) func() store.KVStore {
+	return func() store.KVStore {
+		return singlelock.New(store.WithRevision(revision))
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, n := range []int{3, 20, 1} {
+		revision := store.NewRevision()
+		mkv := New(7, sharedRevisionKV(revision), JumpHashFunc)
+		for i := 0; i != 100; i++ {
+			mkv.Put("key"+strconv.Itoa(i), i)
+		}
+		before, _ := mkv.GetEntry("key42", 0)
+
+		err := mkv.Resize(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := mkv.Stats()
+		if len(stats.Buckets) != n || stats.Resizing {
+			t.Fatalf("expected [%d] buckets, got %+v", n, stats)
+		}
+
+		kvs, _ := mkv.Range("", "", 0)
+		if len(kvs) != 100 {
+			t.Errorf("resizing to [%d]: expected 100 keys, got [%d]", n, len(kvs))
+		}
+		for i := 0; i != 100; i++ {
+			value, err := mkv.Get("key" + strconv.Itoa(i))
+			if err != nil || value != i {
+				t.Errorf("resizing to [%d]: expected key%d to be [%d], got %v, %v", n, i, i, value, err)
+			}
+		}
+		after, _ := mkv.GetEntry("key42", 0)
+		if after != before || mkv.Revision() != 100 {
+			t.Errorf("expected a resize to keep revisions, got %+v then %+v at [%d]", before, after, mkv.Revision())
+		}
+	}
+}
+
+func TestResizeInvalid(t *testing.T) {
+	mkv := New(3, basicKV, JumpHashFunc)
+	if err := mkv.Resize(0); !errors.Is(err, store.ErrInvalid) {
+		t.Errorf("expected zero buckets to be invalid, got %v", err)
+	}
+}
+
+func TestResizeUnderLoad(t *testing.T) {
+	revision := store.NewRevision()
+	mkv := New(4, sharedRevisionKV(revision), NewRingHashFunc(DefaultVirtualNodes))
+	for i := 0; i != 500; i++ {
+		mkv.Put("key"+strconv.Itoa(i), 0)
+	}
+
+	// each writer owns its own keys, so it knows what every read should see
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w != 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 1; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := "key" + strconv.Itoa(w*100+n%100)
+				err := mkv.Put(key, n)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				value, err := mkv.Get(key)
+				if err != nil || value != n {
+					t.Errorf("expected [%s] to be [%d], got %v, %v", key, n, value, err)
+					return
+				}
+				_, err = mkv.Txn(store.Txn{Then: []store.Op{
+					{Type: store.OpPut, Key: key, Value: n},
+					{Type: store.OpPut, Key: "key" + strconv.Itoa(400+n%100), Value: 0},
+				}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for _, n := range []int{9, 2, 16, 5} {
+		err := mkv.Resize(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kvs, _ := mkv.Range("", "", 0)
+		if len(kvs) != 500 {
+			t.Errorf("resizing to [%d]: expected 500 keys, got [%d]", n, len(kvs))
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestStats(t *testing.T) {
+	mkv := New(4, basicKV, SimpleHashFunc)
+	for _, key := range []string{"apple", "avocado", "apricot", "banana"} {
+		mkv.Put(key, key)
+	}
+	mkv.Get("apple")
+
+	stats := mkv.Stats()
+	keys := 0
+	for _, b := range stats.Buckets {
+		keys += b.Keys
+	}
+	if keys != 4 {
+		t.Errorf("expected 4 keys, got %+v", stats)
+	}
+
+	// three of the four keys share a first letter, so one bucket has three times its share
+	if stats.Skew != 3 {
+		t.Errorf("expected a skew of 3, got [%v]", stats.Skew)
+	}
+	a := stats.Buckets[SimpleHashFunc(4, "apple")]
+	if a.Keys != 3 || a.Ops != 4 {
+		t.Errorf("expected the 'a' bucket to have 3 keys and 4 ops, got %+v", a)
+	}
+}
+
+// failingStore fails every transaction which writes a key beginning with "fail".
+type failingStore struct {
+	store.KVStore
+}
+
+func (s failingStore) Txn(txn store.Txn) (store.TxnResult, error) {
+	for _, key := range txn.Keys() {
+		if strings.HasPrefix(key, "fail") {
+			return store.TxnResult{}, store.NewError(store.ErrUnavailable, "disk full")
+		}
+	}
+	return s.KVStore.Txn(txn)
+}
+
+func (s failingStore) Undo(keys []string, revision int64) {
+	s.KVStore.(store.Undoer).Undo(keys, revision)
+}
+
+func (s failingStore) Release(revision int64) {
+	s.KVStore.(store.Undoer).Release(revision)
+}
+
+func TestTxnRollback(t *testing.T) {
+	revision := store.NewRevision()
+	mkv := New(13, func() store.KVStore {
+		return failingStore{singlelock.New(store.WithRevision(revision))}
+	}, SimpleHashFunc)
+
+	// buckets are written in order, and the first letters put the other keys in a bucket before the failing one's
+	existing, added, fail := "apple", "banana", "fail"
+	mkv.Put(existing, "old")
+
+	txn := store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: existing, Value: "new"},
+		{Type: store.OpPut, Key: added, Value: "new"},
+		{Type: store.OpPut, Key: fail, Value: "new"},
+	}}
+	if _, err := mkv.Txn(txn); !errors.Is(err, store.ErrUnavailable) {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+	if v, err := mkv.Get(existing); err != nil || v != "old" {
+		t.Errorf("expected [%s] to be rolled back to [old], got %v, %v", existing, v, err)
+	}
+	if _, err := mkv.Get(added); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected [%s] to be rolled back, got %v", added, err)
+	}
+
+	// the failed transaction leaves no trace: no revision, version or history
+	if r := mkv.Revision(); r != 1 {
+		t.Errorf("expected the revision to stay at 1, got %d", r)
+	}
+	if e, err := mkv.GetEntry(existing, 0); err != nil || e.ModRevision != 1 || e.Version != 1 || e.CreateRevision != 1 {
+		t.Errorf("expected [%s] to be as it was at revision 1, got %+v, %v", existing, e, err)
+	}
+	if e, err := mkv.GetEntry(existing, 1); err != nil || e.Value != "old" {
+		t.Errorf("expected [%s] at revision 1 to be [old], got %+v, %v", existing, e, err)
+	}
+	if _, err := mkv.GetEntry(added, 2); !errors.Is(err, store.ErrFutureRevision) {
+		t.Errorf("expected revision 2 not to exist, got %v", err)
+	}
+	if err := mkv.PutIf(existing, "newer", store.IfRevisionEquals(1)); err != nil {
+		t.Errorf("expected a compare and swap on the revision read before to succeed, got %v", err)
+	}
+	if _, err := mkv.GetEntry(added, 2); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected no tombstone or entry for [%s] at revision 2, got %v", added, err)
+	}
+	if e, err := mkv.GetEntry(existing, 0); err != nil || e.ModRevision != 2 || e.Version != 2 {
+		t.Errorf("expected the next write to be revision 2 and version 2, got %+v, %v", e, err)
+	}
+}
@@ -1,50 +1,602 @@
 package multilock
 
 import (
+	"errors"
+	"fmt"
 	"kv/internal/store"
-	"kv/pkg/watch"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // MultiKVStore Implements KVStore and divides the keyspace.  This will prevent one write from locking
-// the whole store.
+// the whole store.  The number of buckets can be changed with Resize while the store is in use.
 type MultiKVStore struct {
-	size   int
-	store  []store.KVStore
-	hasher func(buckets int, key string) int
+	factory func() store.KVStore
+	hasher  HashFunc
+	layout  atomic.Pointer[layout]
+
+	// resizing is held for the whole of a Resize, so only one runs at a time
+	resizing sync.Mutex
+
+	// moving is held exclusively while a bucket's keys move, and shared by reads which visit every bucket, so they
+	// never see a key twice or miss one which moved from a bucket they hadn't reached to one they had
+	moving sync.RWMutex
+}
+
+type bucket struct {
+	// shared by operations on a single bucket, and held exclusively by transactions spanning buckets and by Resize
+	// while keys move in or out
+	sync.RWMutex
+	kv  store.KVStore
+	ops atomic.Uint64
 }
 
-func New(bucketCount int, factory func() store.KVStore, hashFunc func(buckets int, key string) int) *MultiKVStore {
-	buckets := make([]store.KVStore, bucketCount)
+// layout is which buckets keys belong to.  It's replaced rather than changed, apart from moved.
+type layout struct {
+	buckets []*bucket
+
+	// size is the number of buckets keys are hashed over
+	size int
+
+	// target is the bucket count a resize is moving keys to, and the same as size otherwise.  While resizing, a key
+	// belongs to its bucket by size until that bucket is marked as moved, then to its bucket by target.
+	target int
+
+	// moved is guarded by the lock of the bucket at the same index
+	moved []bool
+}
+
+func (l *layout) resizing() bool {
+	return l.size != l.target
+}
+
+// New creates bucketCount buckets with factory.  Buckets should share a store.Revision, so that revisions are global
+// across the whole store.  Resize uses factory for any buckets it adds.
+func New(bucketCount int, factory func() store.KVStore, hashFunc HashFunc) *MultiKVStore {
+	buckets := make([]*bucket, bucketCount)
 	for i := 0; i != bucketCount; i++ {
-		buckets[i] = factory()
+		buckets[i] = &bucket{kv: factory()}
 	}
-	return &MultiKVStore{
-		size:   bucketCount,
-		store:  buckets,
-		hasher: hashFunc,
+	m := &MultiKVStore{
+		factory: factory,
+		hasher:  hashFunc,
 	}
+	m.layout.Store(&layout{buckets: buckets, size: bucketCount, target: bucketCount})
+	return m
 }
 
-func SimpleHashFunc(buckets int, key string) int {
-	return int(key[0]) % buckets
+// route returns the index of key's bucket in l.  The bucket's lock must be held if l is resizing.
+func (m *MultiKVStore) route(l *layout, key string) int {
+	idx := m.hasher(l.size, key)
+	if l.resizing() && l.moved[idx] {
+		idx = m.hasher(l.target, key)
+	}
+	return idx
+}
+
+// bucket returns key's bucket, with its lock shared.  Call the returned func to release it.
+func (m *MultiKVStore) bucket(key string) (*bucket, func()) {
+	for {
+		l := m.layout.Load()
+		b := l.buckets[m.hasher(l.size, key)]
+		b.RLock()
+		if l.resizing() {
+			idx := m.route(l, key)
+			if b != l.buckets[idx] {
+				// the key's old bucket has moved, and once it has the key never goes back
+				b.RUnlock()
+				b = l.buckets[idx]
+				b.RLock()
+			}
+		}
+
+		// a bucket can only move while the layout which is moving it is current
+		if l == m.layout.Load() {
+			b.ops.Add(1)
+			return b, b.RUnlock
+		}
+		b.RUnlock()
+	}
 }
 
 func (m *MultiKVStore) Put(key string, value interface{}) error {
-	idx := m.hasher(m.size, key)
-	return m.store[idx].Put(key, value)
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.Put(key, value)
 }
 
 func (m *MultiKVStore) Get(key string) (interface{}, error) {
-	idx := m.hasher(m.size, key)
-	return m.store[idx].Get(key)
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.Get(key)
+}
+
+func (m *MultiKVStore) GetEntry(key string, revision int64) (store.Entry, error) {
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.GetEntry(key, revision)
 }
 
 func (m *MultiKVStore) Delete(key string) error {
-	idx := m.hasher(m.size, key)
-	return m.store[idx].Delete(key)
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.Delete(key)
+}
+
+// PutIf is atomic because every key belongs to exactly one bucket, which checks and writes under its own lock.
+func (m *MultiKVStore) PutIf(key string, value interface{}, cond store.Condition) error {
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.PutIf(key, value, cond)
+}
+
+func (m *MultiKVStore) DeleteIf(key string, cond store.Condition) error {
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.DeleteIf(key, cond)
+}
+
+// BatchGet groups keys by bucket, so each bucket's lock is taken once rather than once per key.  Keys whose bucket is
+// moving when it's reached are read one at a time instead.
+func (m *MultiKVStore) BatchGet(keys []string) ([]store.BatchResult, error) {
+	l := m.layout.Load()
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		idx := m.hasher(l.size, key)
+		groups[idx] = append(groups[idx], i)
+	}
+
+	results := make([]store.BatchResult, len(keys))
+	for idx, group := range groups {
+		b := l.buckets[idx]
+		b.RLock()
+		if l != m.layout.Load() || l.resizing() && l.moved[idx] {
+			b.RUnlock()
+			for _, i := range group {
+				e, err := m.GetEntry(keys[i], 0)
+				results[i] = store.BatchResult{Key: keys[i], Entry: e, Err: err}
+			}
+			continue
+		}
+		for _, i := range group {
+			e, err := b.kv.GetEntry(keys[i], 0)
+			results[i] = store.BatchResult{Key: keys[i], Entry: e, Err: err}
+		}
+		b.ops.Add(uint64(len(group)))
+		b.RUnlock()
+	}
+	return results, nil
+}
+
+// lock takes the locks of every bucket keys could be in exclusively, in bucket order so concurrent transactions can't
+// deadlock.  Call the returned func to release them.
+func (m *MultiKVStore) lock(keys []string) (*layout, func()) {
+	for {
+		l := m.layout.Load()
+		var idxs []int
+		for _, key := range keys {
+			idxs = append(idxs, m.hasher(l.size, key))
+			if l.resizing() {
+				idxs = append(idxs, m.hasher(l.target, key))
+			}
+		}
+		slices.Sort(idxs)
+		idxs = slices.Compact(idxs)
+		for _, idx := range idxs {
+			l.buckets[idx].Lock()
+		}
+		unlock := func() {
+			for _, idx := range idxs {
+				l.buckets[idx].Unlock()
+			}
+		}
+
+		if l == m.layout.Load() {
+			return l, unlock
+		}
+		unlock()
+	}
+}
+
+// Txn locks every bucket the transaction uses.  The compares are checked here, then each bucket applies its share of
+// the chosen branch at the same revision.  Every share is checked before any is applied, and if a bucket fails anyway,
+// the shares already applied are undone, leaving no trace in the revision or the keys' histories, so the transaction
+// is applied to every bucket or none.
+func (m *MultiKVStore) Txn(txn store.Txn) (store.TxnResult, error) {
+	err := txn.Validate()
+	if err != nil {
+		return store.TxnResult{}, err
+	}
+
+	l, unlock := m.lock(txn.Keys())
+	defer unlock()
+
+	result := store.TxnResult{Succeeded: true}
+	for _, c := range txn.Compares {
+		e, err := l.buckets[m.route(l, c.Key)].kv.GetEntry(c.Key, 0)
+		if c.Condition.Check(e, err == nil) != nil {
+			result.Succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Then
+	if !result.Succeeded {
+		ops = txn.Else
+	}
+
+	// merges are worked out first and applied as puts, so one which fails doesn't leave other buckets written
+	ops = slices.Clone(ops)
+	for i, op := range ops {
+		if op.Type != store.OpMerge {
+			continue
+		}
+		e, err := l.buckets[m.route(l, op.Key)].kv.GetEntry(op.Key, 0)
+		if ops[i], err = store.ResolveMerge(op, e, err == nil); err != nil {
+			return store.TxnResult{}, err
+		}
+	}
+
+	// each bucket keeps the order of its own ops, which is all that matters since buckets don't share keys
+	groups := make(map[int][]int)
+	var buckets []int
+	for i, op := range ops {
+		idx := m.route(l, op.Key)
+		if _, ok := groups[idx]; !ok {
+			buckets = append(buckets, idx)
+		}
+		groups[idx] = append(groups[idx], i)
+	}
+	slices.Sort(buckets)
+
+	shares := make([]store.Txn, len(buckets))
+	for n, idx := range buckets {
+		group := groups[idx]
+		shares[n] = store.Txn{Then: make([]store.Op, len(group))}
+		for i, j := range group {
+			shares[n].Then[i] = ops[j]
+		}
+		if err := shares[n].Validate(); err != nil {
+			return store.TxnResult{}, err
+		}
+	}
+
+	result.Revision = txn.Revision
+	result.Results = make([]store.OpResult, len(ops))
+	for n, idx := range buckets {
+		shares[n].Revision = result.Revision
+		b := l.buckets[idx]
+		b.ops.Add(1)
+		r, err := b.kv.Txn(shares[n])
+		if err != nil {
+			if rerr := m.rollback(l, buckets[:n], groups, ops, result.Revision, txn.Revision == 0); rerr != nil {
+				return store.TxnResult{}, errors.Join(err, rerr)
+			}
+			return store.TxnResult{}, err
+		}
+
+		// the first bucket to write allocates the revision for the rest
+		if result.Revision == 0 && store.HasWrites(shares[n].Then) {
+			result.Revision = r.Revision
+		}
+		for i, j := range groups[idx] {
+			result.Results[j] = r.Results[i]
+		}
+	}
+
+	if result.Revision == 0 {
+		result.Revision = m.Revision()
+	}
+	return result, nil
+}
+
+// rollback takes back the writes a transaction made to buckets at revision, leaving the keys' histories as they were.
+// The revision is given back too when the transaction was handed it.
+func (m *MultiKVStore) rollback(l *layout, buckets []int, groups map[int][]int, ops []store.Op, revision int64,
+	allocated bool) error {
+	var undoer store.Undoer
+	for _, idx := range buckets {
+		var keys []string
+		for _, j := range groups[idx] {
+			if ops[j].Type != store.OpGet {
+				keys = append(keys, ops[j].Key)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		var ok bool
+		if undoer, ok = l.buckets[idx].kv.(store.Undoer); !ok {
+			return fmt.Errorf("rolling back bucket [%d]: %w", idx, store.ErrUnsupported)
+		}
+		undoer.Undo(keys, revision)
+	}
+	if allocated && undoer != nil {
+		undoer.Release(revision)
+	}
+	return nil
+}
+
+// ForEach visits the buckets one at a time.  f mustn't call ForEach, Range, Export or Expired itself, as a Resize
+// waiting to move keys would block it.
+func (m *MultiKVStore) ForEach(f func(key string, entry store.Entry) bool) {
+	m.moving.RLock()
+	defer m.moving.RUnlock()
+
+	more := true
+	visit := func(key string, entry store.Entry) bool {
+		more = f(key, entry)
+		return more
+	}
+	for _, b := range m.layout.Load().buckets {
+		if !more {
+			break
+		}
+		b.RLock()
+		b.kv.ForEach(visit)
+		b.RUnlock()
+	}
+}
+
+// Range reads the range from every bucket, then merges the results.
+func (m *MultiKVStore) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	m.moving.RLock()
+	defer m.moving.RUnlock()
+
+	var kvs []store.KeyValue
+	for _, b := range m.layout.Load().buckets {
+		b.RLock()
+		bucketKVs, err := b.kv.Range(start, end, limit)
+		b.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, bucketKVs...)
+	}
+	return store.SortAndLimit(kvs, limit), nil
 }
 
-func (m *MultiKVStore) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
-	idx := m.hasher(m.size, key)
-	return m.store[idx].AddWatch(key, op)
+// Export holds every bucket exclusively while it reads, so no write can land between the buckets.  Writes wait for the
+// copy, but not for the caller to use it.
+func (m *MultiKVStore) Export(start, end string) ([]store.KeyValue, int64, error) {
+	m.moving.RLock()
+	defer m.moving.RUnlock()
+
+	buckets := m.layout.Load().buckets
+	for _, b := range buckets {
+		b.Lock()
+		defer b.Unlock()
+	}
+
+	var kvs []store.KeyValue
+	for _, b := range buckets {
+		bucketKVs, err := b.kv.Range(start, end, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		kvs = append(kvs, bucketKVs...)
+	}
+	return store.SortAndLimit(kvs, 0), m.Revision(), nil
+}
+
+func (m *MultiKVStore) Expired(now time.Time, limit int) []string {
+	m.moving.RLock()
+	defer m.moving.RUnlock()
+
+	var keys []string
+	for _, b := range m.layout.Load().buckets {
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+		b.RLock()
+		keys = append(keys, b.kv.Expired(now, limit-len(keys))...)
+		b.RUnlock()
+	}
+	return keys
+}
+
+// Revision returns the latest revision of any bucket.
+func (m *MultiKVStore) Revision() int64 {
+	var revision int64
+	for _, b := range m.layout.Load().buckets {
+		revision = max(revision, b.kv.Revision())
+	}
+	return revision
+}
+
+// Compact also removes the entries left behind by keys which moved bucket before revision.
+func (m *MultiKVStore) Compact(revision int64) error {
+	for _, b := range m.layout.Load().buckets {
+		b.RLock()
+		err := b.kv.Compact(revision)
+		b.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiKVStore) Restore(key string, entry store.Entry) error {
+	b, unlock := m.bucket(key)
+	defer unlock()
+	return b.kv.Restore(key, entry)
+}
+
+// Resize changes the number of buckets to n, moving keys to their new buckets while the store stays in use.  Buckets
+// move one at a time, and only operations on the bucket being moved and the buckets receiving its keys wait for it.
+// With JumpHashFunc or a ring, only the keys which belong in the added buckets, or belonged to the removed ones, move.
+//
+// A moved key keeps its current entry but not its history, as if it had been restored from a snapshot.  A key which
+// has expired but not been reaped is dropped rather than moved.  If moving a bucket fails, the store is left part way
+// through the resize, and the next Resize finishes it first.
+func (m *MultiKVStore) Resize(n int) error {
+	if n <= 0 {
+		return store.NewError(store.ErrInvalid, "a store needs at least one bucket")
+	}
+	m.resizing.Lock()
+	defer m.resizing.Unlock()
+
+	l := m.layout.Load()
+	if l.resizing() {
+		err := m.finish(l)
+		if err != nil {
+			return err
+		}
+		l = m.layout.Load()
+	}
+	if n == l.size {
+		return nil
+	}
+
+	buckets := slices.Clone(l.buckets)
+	for len(buckets) < n {
+		buckets = append(buckets, &bucket{kv: m.factory()})
+	}
+	next := &layout{buckets: buckets, size: l.size, target: n, moved: make([]bool, l.size)}
+	m.layout.Store(next)
+	return m.finish(next)
+}
+
+// finish moves every bucket of l which hasn't moved yet, then switches to the layout l was resizing to.
+func (m *MultiKVStore) finish(l *layout) error {
+	for i := 0; i != l.size; i++ {
+		err := m.move(l, i)
+		if err != nil {
+			return err
+		}
+	}
+	m.layout.Store(&layout{buckets: l.buckets[:l.target], size: l.target, target: l.target})
+	return nil
+}
+
+// move moves the keys of bucket i which belong elsewhere by l.target, and marks the bucket as moved.
+func (m *MultiKVStore) move(l *layout, i int) error {
+	m.moving.Lock()
+	defer m.moving.Unlock()
+
+	src := l.buckets[i]
+	for {
+		// find which buckets the keys are going to, so they can be locked in order along with the source
+		src.RLock()
+		if l.moved[i] {
+			src.RUnlock()
+			return nil
+		}
+		idxs := []int{i}
+		src.kv.ForEach(func(key string, _ store.Entry) bool {
+			idxs = append(idxs, m.hasher(l.target, key))
+			return true
+		})
+		src.RUnlock()
+
+		slices.Sort(idxs)
+		idxs = slices.Compact(idxs)
+		for _, idx := range idxs {
+			l.buckets[idx].Lock()
+		}
+		done, err := m.moveLocked(l, i, idxs)
+		for _, idx := range idxs {
+			l.buckets[idx].Unlock()
+		}
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// moveLocked moves bucket i's keys with the locks of idxs held.  It returns false without moving anything if a key
+// was written since idxs were found which belongs in a bucket outside them.
+func (m *MultiKVStore) moveLocked(l *layout, i int, idxs []int) (bool, error) {
+	src := l.buckets[i]
+	var keys []string
+	var entries []store.Entry
+	locked := true
+	src.kv.ForEach(func(key string, entry store.Entry) bool {
+		idx := m.hasher(l.target, key)
+		if idx == i {
+			return true
+		}
+		if _, found := slices.BinarySearch(idxs, idx); !found {
+			locked = false
+			return false
+		}
+		keys = append(keys, key)
+		entries = append(entries, entry)
+		return true
+	})
+	if !locked {
+		return false, nil
+	}
+
+	// keys are removed with tombstones, which compaction clears away.  Every key is copied before any is removed, so a
+	// failed copy can leave the bucket as it was.
+	revision := src.kv.Revision()
+	for j, key := range keys {
+		err := l.buckets[m.hasher(l.target, key)].kv.Restore(key, entries[j])
+		if err != nil {
+			for _, copied := range keys[:j] {
+				l.buckets[m.hasher(l.target, copied)].kv.Restore(copied, store.Entry{ModRevision: revision})
+			}
+			return false, err
+		}
+	}
+	for _, key := range keys {
+		src.kv.Restore(key, store.Entry{ModRevision: revision})
+	}
+	for _, key := range src.kv.Expired(time.Now(), 0) {
+		if m.hasher(l.target, key) != i {
+			src.kv.Restore(key, store.Entry{ModRevision: revision})
+		}
+	}
+	l.moved[i] = true
+	return true, nil
+}
+
+// BucketStats describes one bucket.
+type BucketStats struct {
+	// Keys is the number of keys in the bucket.
+	Keys int
+
+	// Ops counts the operations the bucket has served.
+	Ops uint64
+}
+
+// Stats describes how the store's keys are spread across its buckets.
+type Stats struct {
+	Buckets []BucketStats
+
+	// Skew is the most keys in any bucket divided by the mean, so 1 is a perfect spread.  It's zero for an empty store.
+	Skew float64
+
+	// Resizing is true while keys are moving to Target buckets.
+	Resizing bool
+	Target   int
+}
+
+// Stats counts the keys in each bucket.  It visits every key, so it's meant for occasional monitoring.
+func (m *MultiKVStore) Stats() Stats {
+	m.moving.RLock()
+	defer m.moving.RUnlock()
+
+	l := m.layout.Load()
+	stats := Stats{Buckets: make([]BucketStats, len(l.buckets)), Resizing: l.resizing(), Target: l.target}
+	total, most := 0, 0
+	for i, b := range l.buckets {
+		b.RLock()
+		b.kv.ForEach(func(string, store.Entry) bool {
+			stats.Buckets[i].Keys++
+			return true
+		})
+		b.RUnlock()
+		stats.Buckets[i].Ops = b.ops.Load()
+		total += stats.Buckets[i].Keys
+		most = max(most, stats.Buckets[i].Keys)
+	}
+	if total > 0 {
+		stats.Skew = float64(most) * float64(len(l.buckets)) / float64(total)
+	}
+	return stats
 }
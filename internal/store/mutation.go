@@ -0,0 +1,312 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+type MutationType int
+
+const (
+	// MutateIncrement adds the operand, a number, to a number.  A key which doesn't exist starts from zero.
+	MutateIncrement MutationType = iota + 1
+
+	// MutateDecrement subtracts the operand, a number, from a number.  A key which doesn't exist starts from zero.
+	MutateDecrement
+
+	// MutateAppend appends the operand to a string, bytes or a slice.  A slice is appended either a slice or a single
+	// element.  A key which doesn't exist is set to the operand, which must be a string, bytes or a slice.
+	MutateAppend
+
+	// MutatePushFront adds the operand to the front of a slice.  A key which doesn't exist becomes a slice of one.
+	MutatePushFront
+
+	// MutatePushBack adds the operand to the back of a slice.  A key which doesn't exist becomes a slice of one.
+	MutatePushBack
+
+	// MutatePopFront removes the first element of a slice.
+	MutatePopFront
+
+	// MutatePopBack removes the last element of a slice.
+	MutatePopBack
+)
+
+// Mutation is an atomic change to a key's value, which is made on the server with OpMerge rather than read, changed
+// and written back by the client.  It returns ErrTypeMismatch for a value of the wrong type.
+type Mutation struct {
+	Type    MutationType
+	Operand interface{}
+}
+
+func (m Mutation) Merge(current interface{}, found bool) (interface{}, error) {
+	switch m.Type {
+	case MutateIncrement, MutateDecrement:
+		return m.add(current, found)
+	case MutateAppend:
+		return m.append(current, found)
+	case MutatePushFront, MutatePushBack:
+		return m.push(current, found)
+	case MutatePopFront, MutatePopBack:
+		return m.pop(current, found)
+	}
+	return nil, NewError(ErrInvalid, "unknown mutation")
+}
+
+// Pops reports whether m removes an element.
+func (m Mutation) Pops() bool {
+	return m.Type == MutatePopFront || m.Type == MutatePopBack
+}
+
+// Mutate applies m to key, and returns the key's new value.  A pop also returns the element it removed.
+func Mutate(kv KVStore, key string, m Mutation) (value, popped interface{}, revision int64, err error) {
+	result, err := kv.Txn(Txn{Then: []Op{{Type: OpGet, Key: key}, {Type: OpMerge, Key: key, Value: m}}})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if m.Pops() {
+		old := reflect.ValueOf(result.Results[0].Entry.Value)
+		i := 0
+		if m.Type == MutatePopBack {
+			i = old.Len() - 1
+		}
+		popped = old.Index(i).Interface()
+	}
+	return result.Results[1].Entry.Value, popped, result.Revision, nil
+}
+
+func mismatch(current interface{}, want string) error {
+	return NewError(ErrTypeMismatch, fmt.Sprintf("the value is a %T, not %s", current, want))
+}
+
+func (m Mutation) add(current interface{}, found bool) (interface{}, error) {
+	operand := m.Operand
+	if operand == nil {
+		operand = int64(1)
+	}
+	delta := reflect.ValueOf(operand)
+	if !isNumber(delta.Kind()) {
+		return nil, NewError(ErrInvalid, fmt.Sprintf("can't add a %T to a number", operand))
+	}
+	if !found {
+		current = reflect.Zero(delta.Type()).Interface()
+	}
+	c := reflect.ValueOf(current)
+	if !isNumber(c.Kind()) {
+		return nil, mismatch(current, "a number")
+	}
+	decrement := m.Type == MutateDecrement
+
+	result := reflect.New(c.Type()).Elem()
+	if isFloat(c.Kind()) {
+		f := toFloat(delta)
+		if decrement {
+			f = -f
+		}
+		result.SetFloat(c.Float() + f)
+		return result.Interface(), nil
+	}
+
+	n, ok := toInt(delta)
+	if !ok || decrement && n == math.MinInt64 {
+		return nil, NewError(ErrInvalid, fmt.Sprintf("can't add %v to an integer", operand))
+	}
+	if decrement {
+		n = -n
+	}
+	if isInt(c.Kind()) {
+		sum := c.Int() + n
+		if n > 0 && sum < c.Int() || n < 0 && sum > c.Int() || result.OverflowInt(sum) {
+			return nil, NewError(ErrInvalid, "the result overflows")
+		}
+		result.SetInt(sum)
+	} else if n >= 0 {
+		sum := c.Uint() + uint64(n)
+		if sum < c.Uint() || result.OverflowUint(sum) {
+			return nil, NewError(ErrInvalid, "the result overflows")
+		}
+		result.SetUint(sum)
+	} else {
+		if uint64(-n) > c.Uint() {
+			return nil, NewError(ErrInvalid, "the result is below zero")
+		}
+		result.SetUint(c.Uint() - uint64(-n))
+	}
+	return result.Interface(), nil
+}
+
+func (m Mutation) append(current interface{}, found bool) (interface{}, error) {
+	if m.Operand == nil {
+		return nil, NewError(ErrInvalid, "nothing to append")
+	}
+	c, o := reflect.ValueOf(current), reflect.ValueOf(m.Operand)
+	if !found {
+		// the key is set to the operand, which has to be something a later append can extend
+		if o.Kind() != reflect.String && o.Kind() != reflect.Slice {
+			return nil, NewError(ErrInvalid, fmt.Sprintf("can't append a %T to a key which doesn't exist, only a "+
+				"string, bytes or a slice", m.Operand))
+		}
+		return m.Operand, nil
+	}
+	switch c.Kind() {
+	case reflect.String:
+		if o.Kind() != reflect.String {
+			return nil, NewError(ErrTypeMismatch, fmt.Sprintf("can't append a %T to a string", m.Operand))
+		}
+		return c.String() + o.String(), nil
+	case reflect.Slice:
+		var elements []reflect.Value
+		if o.Kind() == reflect.Slice && o.Type() != c.Type().Elem() {
+			for i := 0; i != o.Len(); i++ {
+				elements = append(elements, o.Index(i))
+			}
+		} else {
+			elements = []reflect.Value{o}
+		}
+		return insert(c, elements, c.Len())
+	}
+	return nil, mismatch(current, "a string, bytes or a slice")
+}
+
+func (m Mutation) push(current interface{}, found bool) (interface{}, error) {
+	if m.Operand == nil {
+		return nil, NewError(ErrInvalid, "nothing to push")
+	}
+	o := reflect.ValueOf(m.Operand)
+	if !found {
+		current = reflect.MakeSlice(sliceType(o.Type()), 0, 0).Interface()
+	}
+	c := reflect.ValueOf(current)
+	if c.Kind() != reflect.Slice {
+		return nil, mismatch(current, "a slice")
+	}
+	at := 0
+	if m.Type == MutatePushBack {
+		at = c.Len()
+	}
+	return insert(c, []reflect.Value{o}, at)
+}
+
+func (m Mutation) pop(current interface{}, found bool) (interface{}, error) {
+	if !found {
+		return nil, NewError(ErrNotFound, "the key doesn't exist")
+	}
+	c := reflect.ValueOf(current)
+	if c.Kind() != reflect.Slice {
+		return nil, mismatch(current, "a slice")
+	} else if c.Len() == 0 {
+		return nil, NewError(ErrNotFound, "the list is empty")
+	}
+	start := 0
+	if m.Type == MutatePopFront {
+		start = 1
+	}
+	result := reflect.MakeSlice(c.Type(), c.Len()-1, c.Len()-1)
+	reflect.Copy(result, c.Slice(start, start+c.Len()-1))
+	return result.Interface(), nil
+}
+
+// insert returns a copy of the slice s, with elements inserted at index at.  The elements are converted to the type of
+// the slice's elements.
+func insert(s reflect.Value, elements []reflect.Value, at int) (interface{}, error) {
+	t := s.Type().Elem()
+	result := reflect.MakeSlice(s.Type(), 0, s.Len()+len(elements))
+	result = reflect.AppendSlice(result, s.Slice(0, at))
+	for _, e := range elements {
+		converted, ok := convert(e, t)
+		if !ok {
+			return nil, NewError(ErrTypeMismatch, fmt.Sprintf("can't add a %s to a %s", e.Type(), s.Type()))
+		}
+		result = reflect.Append(result, converted)
+	}
+	return reflect.AppendSlice(result, s.Slice(at, s.Len())).Interface(), nil
+}
+
+// convert returns v as a t, if it's one already or it's a number which t can hold exactly.
+func convert(v reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return reflect.Zero(t), t.Kind() == reflect.Interface
+	} else if v.Type().AssignableTo(t) {
+		return v, true
+	} else if !isNumber(v.Kind()) || !isNumber(t.Kind()) {
+		return v, false
+	}
+
+	result := reflect.New(t).Elem()
+	switch {
+	case isFloat(t.Kind()):
+		result.SetFloat(toFloat(v))
+	case isInt(t.Kind()):
+		n, ok := toInt(v)
+		if !ok || result.OverflowInt(n) {
+			return v, false
+		}
+		result.SetInt(n)
+	default:
+		n, ok := toInt(v)
+		if !ok || n < 0 || result.OverflowUint(uint64(n)) {
+			return v, false
+		}
+		result.SetUint(uint64(n))
+	}
+	return result, true
+}
+
+// sliceType returns the type of slice a key which doesn't exist becomes when an element of type t is pushed, which is
+// one anyval can marshal.  Anything but a string or a number makes a document's list.
+func sliceType(t reflect.Type) reflect.Type {
+	switch {
+	case t.Kind() == reflect.String:
+		return reflect.TypeOf([]string(nil))
+	case t.Kind() == reflect.Int32:
+		return reflect.TypeOf([]int32(nil))
+	case t.Kind() == reflect.Float32:
+		return reflect.TypeOf([]float32(nil))
+	case isInt(t.Kind()), isUint(t.Kind()):
+		return reflect.TypeOf([]int64(nil))
+	case isFloat(t.Kind()):
+		return reflect.TypeOf([]float64(nil))
+	}
+	return reflect.TypeOf([]interface{}(nil))
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uint64
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isNumber(k reflect.Kind) bool {
+	return isInt(k) || isUint(k) || isFloat(k)
+}
+
+// toInt returns the number v as an int64, if it's a whole number which fits.
+func toInt(v reflect.Value) (int64, bool) {
+	switch {
+	case isInt(v.Kind()):
+		return v.Int(), true
+	case isUint(v.Kind()):
+		return int64(v.Uint()), v.Uint() <= math.MaxInt64
+	}
+	f := v.Float()
+	return int64(f), f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v.Kind()):
+		return float64(v.Int())
+	case isUint(v.Kind()):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
@@ -0,0 +1,94 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"math"
+	"testing"
+)
+
+func TestMutate(t *testing.T) {
+	kv := skiplist.New()
+	kv.Put("n", int32(5))
+	kv.Put("f", 1.5)
+	kv.Put("s", "ab")
+	kv.Put("list", []string{"b"})
+
+	tests := []struct {
+		key      string
+		mutation store.Mutation
+		value    string
+		popped   string
+	}{
+		{"n", store.Mutation{Type: store.MutateIncrement}, "6", ""},
+		{"n", store.Mutation{Type: store.MutateDecrement, Operand: int64(10)}, "-4", ""},
+		{"f", store.Mutation{Type: store.MutateIncrement, Operand: 2}, "3.5", ""},
+		{"missing", store.Mutation{Type: store.MutateIncrement, Operand: uint64(3)}, "3", ""},
+		{"s", store.Mutation{Type: store.MutateAppend, Operand: "cd"}, "abcd", ""},
+		{"list", store.Mutation{Type: store.MutateAppend, Operand: []string{"c", "d"}}, "[b c d]", ""},
+		{"bytes", store.Mutation{Type: store.MutateAppend, Operand: []byte("ab")}, "[97 98]", ""},
+		{"list", store.Mutation{Type: store.MutatePushFront, Operand: "a"}, "[a b c d]", ""},
+		{"list", store.Mutation{Type: store.MutatePushBack, Operand: "e"}, "[a b c d e]", ""},
+		{"list", store.Mutation{Type: store.MutatePopFront}, "[b c d e]", "a"},
+		{"list", store.Mutation{Type: store.MutatePopBack}, "[b c d]", "e"},
+		{"nums", store.Mutation{Type: store.MutatePushBack, Operand: 7}, "[7]", ""},
+		{"docs", store.Mutation{Type: store.MutatePushBack, Operand: map[string]interface{}{"a": "b"}}, "[map[a:b]]", ""},
+	}
+	for _, test := range tests {
+		value, popped, _, err := store.Mutate(kv, test.key, test.mutation)
+		if err != nil {
+			t.Errorf("%s %+v: %v", test.key, test.mutation, err)
+			continue
+		}
+		if fmt.Sprint(value) != test.value || test.popped != "" && fmt.Sprint(popped) != test.popped {
+			t.Errorf("%s %+v: expected [%s] popping [%s], got [%v] popping [%v]", test.key, test.mutation, test.value,
+				test.popped, value, popped)
+		}
+	}
+	if v, _ := kv.Get("n"); v != int32(-4) {
+		t.Errorf("expected [n] to stay an int32, got %T", v)
+	}
+	if v, _ := kv.Get("nums"); fmt.Sprintf("%T", v) != "[]int64" {
+		t.Errorf("expected a new list of ints to be an []int64, got %T", v)
+	}
+}
+
+func TestMutateErrors(t *testing.T) {
+	kv := skiplist.New()
+	kv.Put("s", "ab")
+	kv.Put("n", uint8(250))
+	kv.Put("max", int64(math.MaxInt64))
+	kv.Put("list", []int32{1})
+	kv.Put("empty", []string{})
+
+	tests := []struct {
+		key      string
+		mutation store.Mutation
+		kind     error
+	}{
+		{"s", store.Mutation{Type: store.MutateIncrement}, store.ErrTypeMismatch},
+		{"n", store.Mutation{Type: store.MutateAppend, Operand: "x"}, store.ErrTypeMismatch},
+		{"s", store.Mutation{Type: store.MutatePushBack, Operand: "x"}, store.ErrTypeMismatch},
+		{"s", store.Mutation{Type: store.MutatePopFront}, store.ErrTypeMismatch},
+		{"list", store.Mutation{Type: store.MutatePushBack, Operand: "x"}, store.ErrTypeMismatch},
+		{"list", store.Mutation{Type: store.MutatePushBack, Operand: 1.5}, store.ErrTypeMismatch},
+		{"n", store.Mutation{Type: store.MutateIncrement, Operand: 10}, store.ErrInvalid},
+		{"n", store.Mutation{Type: store.MutateDecrement, Operand: 251}, store.ErrInvalid},
+		{"max", store.Mutation{Type: store.MutateIncrement}, store.ErrInvalid},
+		{"s", store.Mutation{Type: store.MutateIncrement, Operand: "1"}, store.ErrInvalid},
+		{"empty", store.Mutation{Type: store.MutatePopBack}, store.ErrNotFound},
+		{"missing", store.Mutation{Type: store.MutatePopFront}, store.ErrNotFound},
+		{"missing", store.Mutation{Type: store.MutateAppend, Operand: 1}, store.ErrInvalid},
+	}
+	for _, test := range tests {
+		_, _, _, err := store.Mutate(kv, test.key, test.mutation)
+		if !errors.Is(err, test.kind) {
+			t.Errorf("%s %+v: expected %v, got %v", test.key, test.mutation, test.kind, err)
+		}
+	}
+	if v, _ := kv.Get("n"); v != uint8(250) {
+		t.Errorf("expected a failed mutation to leave the value alone, got %v", v)
+	}
+}
@@ -0,0 +1,122 @@
+package replicated
+
+import (
+	"encoding/binary"
+	"kv/internal/encoding"
+	"kv/internal/store"
+	"kv/internal/store/wal"
+	"time"
+)
+
+type commandType byte
+
+const (
+	// cmdTxn is | time uvarint | compare count uvarint |, a | key | condition | for each compare, then the | then ops |
+	// else ops | encoded by wal.EncodeOps.  Every field but the time and count is prefixed with its length.  The time
+	// is when the command was proposed, in Unix nanoseconds, and is what every copy judges expiry by when applying it.
+	cmdTxn commandType = iota + 1
+
+	// cmdCompact is | revision uvarint |.
+	cmdCompact
+)
+
+var errInvalidCommand = store.NewError(store.ErrInvalid, "replicated: invalid command")
+
+// command is a write, which is proposed to the cluster and then applied by every node.
+type command struct {
+	Type     commandType
+	Txn      store.Txn
+	Revision int64
+	Time     time.Time
+}
+
+// result is what applying a command returns to the node which proposed it.
+type result struct {
+	txn store.TxnResult
+	err error
+}
+
+func encodeTxn(txn store.Txn, now time.Time) ([]byte, error) {
+	buf := []byte{byte(cmdTxn)}
+	buf = binary.AppendUvarint(buf, uint64(now.UnixNano()))
+	buf = binary.AppendUvarint(buf, uint64(len(txn.Compares)))
+	for _, c := range txn.Compares {
+		cond, err := c.Condition.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = encoding.AppendBytes(buf, []byte(c.Key))
+		buf = encoding.AppendBytes(buf, cond)
+	}
+	for _, ops := range [][]store.Op{txn.Then, txn.Else} {
+		encoded, err := wal.EncodeOps(ops)
+		if err != nil {
+			return nil, err
+		}
+		buf = encoding.AppendBytes(buf, encoded)
+	}
+	return buf, nil
+}
+
+func encodeCompact(revision int64) []byte {
+	return binary.AppendUvarint([]byte{byte(cmdCompact)}, uint64(revision))
+}
+
+func decodeCommand(data []byte) (command, error) {
+	if len(data) == 0 {
+		return command{}, errInvalidCommand
+	}
+	cmd := command{Type: commandType(data[0])}
+	data = data[1:]
+
+	switch cmd.Type {
+	case cmdCompact:
+		revision, n := binary.Uvarint(data)
+		if n <= 0 {
+			return command{}, errInvalidCommand
+		}
+		cmd.Revision = int64(revision)
+		return cmd, nil
+	case cmdTxn:
+	default:
+		return command{}, errInvalidCommand
+	}
+
+	nanos, n := binary.Uvarint(data)
+	if n <= 0 {
+		return command{}, errInvalidCommand
+	}
+	cmd.Time = time.Unix(0, int64(nanos))
+	data = data[n:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return command{}, errInvalidCommand
+	}
+	data = data[n:]
+	cmd.Txn.Compares = make([]store.Compare, count)
+	for i := range cmd.Txn.Compares {
+		var key, cond []byte
+		ok := false
+		if key, data, ok = encoding.ReadBytes(data); ok {
+			cond, data, ok = encoding.ReadBytes(data)
+		}
+		if !ok || cmd.Txn.Compares[i].Condition.UnmarshalBinary(cond) != nil {
+			return command{}, errInvalidCommand
+		}
+		cmd.Txn.Compares[i].Key = string(key)
+	}
+
+	for _, ops := range []*[]store.Op{&cmd.Txn.Then, &cmd.Txn.Else} {
+		var encoded []byte
+		var err error
+		ok := false
+		if encoded, data, ok = encoding.ReadBytes(data); ok {
+			*ops, err = wal.DecodeOps(encoded)
+		}
+		if !ok || err != nil {
+			return command{}, errInvalidCommand
+		}
+	}
+	return cmd, nil
+}
@@ -0,0 +1,314 @@
+// Package replicated keeps a copy of a store on every node of a raft cluster.  Writes are proposed to the cluster, from
+// any node, and applied to every copy in the same order, so every copy goes through the same revisions.  Reads are
+// served by the local copy, which can be behind the leader's, so Sync first to read with a given store.Consistency.
+package replicated
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"kv/internal/raft"
+	"kv/internal/store"
+	"kv/internal/store/snapshot"
+	"kv/pkg/watch"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is a store.WatchableKVStore replicated with raft.
+type Store struct {
+	// lock guards kv, which is replaced when a snapshot is installed, and applied, which is closed and replaced
+	// whenever the copy changes.
+	lock     sync.RWMutex
+	kv       store.WatchableKVStore
+	applied  chan struct{}
+	newStore func(*store.Revision) store.WatchableKVStore
+	node     *raft.Node
+
+	// applying is the time of the command being applied, in Unix nanoseconds, or zero between commands.
+	applying atomic.Int64
+
+	// timeout is how long a sequential read waits for the copy to reach its revision.
+	timeout time.Duration
+}
+
+// New creates the local copy with newStore, and starts a raft node with opts to replicate it.  NewStore is called again
+// with a fresh Revision whenever the copy is rebuilt from a snapshot.
+func New(newStore func(*store.Revision) store.WatchableKVStore, opts raft.Options) (*Store, error) {
+	s := &Store{
+		applied:  make(chan struct{}),
+		newStore: newStore,
+		timeout:  opts.ProposalTimeout,
+	}
+	s.kv = newStore(s.newRevision())
+	if s.timeout <= 0 {
+		s.timeout = raft.DefaultProposalTimeout
+	}
+	opts.StateMachine = machine{s}
+	node, err := raft.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	s.node = node
+	return s, nil
+}
+
+// newRevision returns a Revision for a new local copy.  The copy judges expiry by the time of the command being
+// applied, so every copy, and a copy replaying its log, applies a command the same way whatever its own clock says.
+// Between commands, reads judge it by this node's clock.  A key which has expired stays until the leader proposes its
+// expiry.
+func (s *Store) newRevision() *store.Revision {
+	revision := store.NewRevision()
+	revision.SetClock(func() time.Time {
+		if nanos := s.applying.Load(); nanos != 0 {
+			return time.Unix(0, nanos)
+		}
+		return time.Now()
+	})
+	return revision
+}
+
+// Node returns the raft node, for passing it messages from other nodes and managing the cluster.
+func (s *Store) Node() *raft.Node {
+	return s.node
+}
+
+// Local returns the local copy.  It changes when a snapshot is installed.
+func (s *Store) Local() store.WatchableKVStore {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.kv
+}
+
+// Close stops the raft node.
+func (s *Store) Close() {
+	s.node.Stop()
+}
+
+// Sync waits until reads of the local copy have consistency c.  A linearizable read waits for the copy to catch up with
+// the leader's commit index, and a sequential one for the copy to reach minRevision.  Sequential and stale reads
+// return how far behind the leader the copy may be.
+func (s *Store) Sync(ctx context.Context, c store.Consistency, minRevision int64) (store.Staleness, error) {
+	switch c {
+	case store.Linearizable:
+		_, err := s.node.ReadIndex(ctx)
+		return store.Staleness{}, err
+	case store.Sequential:
+		err := s.waitForRevision(ctx, minRevision)
+		if err != nil {
+			return store.Staleness{}, err
+		}
+	}
+
+	status := s.node.Status()
+	return store.Staleness{
+		Entries: status.Commit - status.Applied,
+		Since:   time.Since(status.LastContact),
+	}, nil
+}
+
+func (s *Store) waitForRevision(ctx context.Context, revision int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	for {
+		s.lock.RLock()
+		kv, applied := s.kv, s.applied
+		s.lock.RUnlock()
+		if kv.Revision() >= revision {
+			return nil
+		}
+
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return store.NewError(store.ErrUnavailable, fmt.Sprintf("timed out waiting for revision [%d]", revision))
+		}
+	}
+}
+
+// notifyApplied wakes the reads waiting for the copy to change.
+func (s *Store) notifyApplied() {
+	s.lock.Lock()
+	close(s.applied)
+	s.applied = make(chan struct{})
+	s.lock.Unlock()
+}
+
+func (s *Store) propose(data []byte) (store.TxnResult, error) {
+	r, err := s.node.Propose(context.Background(), data)
+	if err != nil {
+		return store.TxnResult{}, err
+	}
+	res := r.(result)
+	return res.txn, res.err
+}
+
+func (s *Store) Put(key string, value interface{}) error {
+	_, err := s.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: key, Value: value}}})
+	return err
+}
+
+func (s *Store) PutIf(key string, value interface{}, cond store.Condition) error {
+	result, err := s.Txn(store.Txn{
+		Compares: []store.Compare{{Key: key, Condition: cond}},
+		Then:     []store.Op{{Type: store.OpPut, Key: key, Value: value}},
+	})
+	if err == nil && !result.Succeeded {
+		err = store.ErrPreconditionFailed
+	}
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	result, err := s.Txn(store.Txn{Then: []store.Op{{Type: store.OpDelete, Key: key}}})
+	if err == nil && !result.Results[0].Found {
+		err = store.KeyNotFound(key)
+	}
+	return err
+}
+
+func (s *Store) DeleteIf(key string, cond store.Condition) error {
+	result, err := s.Txn(store.Txn{
+		Compares: []store.Compare{{Key: key, Condition: cond}},
+		Then:     []store.Op{{Type: store.OpDelete, Key: key}},
+	})
+	if err == nil && !result.Succeeded {
+		err = store.ErrPreconditionFailed
+	} else if err == nil && !result.Results[0].Found {
+		err = store.KeyNotFound(key)
+	}
+	return err
+}
+
+// Txn proposes a transaction which writes.  One which only reads is run against the local copy.
+func (s *Store) Txn(txn store.Txn) (store.TxnResult, error) {
+	err := txn.Validate()
+	if err != nil {
+		return store.TxnResult{}, err
+	}
+	if !store.HasWrites(txn.Then) && !store.HasWrites(txn.Else) {
+		return s.Local().Txn(txn)
+	}
+
+	// revisions are allocated by each copy as the transaction is applied
+	txn.Revision = 0
+	data, err := encodeTxn(txn, time.Now())
+	if err != nil {
+		return store.TxnResult{}, err
+	}
+	return s.propose(data)
+}
+
+func (s *Store) Compact(revision int64) error {
+	_, err := s.propose(encodeCompact(revision))
+	return err
+}
+
+// Restore isn't supported, as it would only change the local copy.
+func (s *Store) Restore(string, store.Entry) error {
+	return store.ErrUnsupported
+}
+
+// Expired only returns keys on the leader, so the other nodes don't propose the same expiries.
+func (s *Store) Expired(now time.Time, limit int) []string {
+	if s.node.Status().Role != raft.Leader {
+		return nil
+	}
+	return s.Local().Expired(now, limit)
+}
+
+func (s *Store) Get(key string) (interface{}, error) {
+	return s.Local().Get(key)
+}
+
+func (s *Store) GetEntry(key string, revision int64) (store.Entry, error) {
+	return s.Local().GetEntry(key, revision)
+}
+
+func (s *Store) ForEach(f func(key string, entry store.Entry) bool) {
+	s.Local().ForEach(f)
+}
+
+func (s *Store) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.Local().Range(start, end, limit)
+}
+
+func (s *Store) BatchGet(keys []string) ([]store.BatchResult, error) {
+	return store.BatchGet(s.Local(), keys, false)
+}
+
+func (s *Store) Export(start, end string) ([]store.KeyValue, int64, error) {
+	return store.ExportRange(s.Local(), start, end)
+}
+
+func (s *Store) Revision() int64 {
+	return s.Local().Revision()
+}
+
+func (s *Store) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
+	return s.Local().AddWatch(key, op)
+}
+
+// Watch watches the local copy.  Watches are ended when the copy is replaced by a snapshot, as the updates in between
+// aren't known.
+func (s *Store) Watch(req watch.WatchRequest) (chan watch.Update, func(), error) {
+	return s.Local().Watch(req)
+}
+
+// machine is the raft node's state machine, which applies commands to the local copy.
+type machine struct {
+	s *Store
+}
+
+// Apply applies a committed command to the local copy.
+func (m machine) Apply(data []byte) interface{} {
+	cmd, err := decodeCommand(data)
+	if err != nil {
+		return result{err: err}
+	}
+
+	s := m.s
+	kv := s.Local()
+	defer s.notifyApplied()
+	switch cmd.Type {
+	case cmdCompact:
+		return result{err: kv.Compact(cmd.Revision)}
+	default:
+		s.applying.Store(cmd.Time.UnixNano())
+		defer s.applying.Store(0)
+		r, err := kv.Txn(cmd.Txn)
+		return result{txn: r, err: err}
+	}
+}
+
+// Snapshot encodes the local copy in the format of a snapshot file.  Raft only calls it between commands, so nothing
+// changes it meanwhile.
+func (m machine) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := snapshot.WriteTo(&buf, 0, m.s.Local())
+	return buf.Bytes(), err
+}
+
+// Restore replaces the local copy with a new one built from a snapshot.  The old copy's watches are ended.
+func (m machine) Restore(data []byte) error {
+	s := m.s
+	revision := s.newRevision()
+	kv := s.newStore(revision)
+	info, err := snapshot.ReadFrom(data, kv)
+	if err != nil {
+		return err
+	}
+	revision.Restore(info.Revision)
+
+	s.lock.Lock()
+	old := s.kv
+	s.kv = kv
+	close(s.applied)
+	s.applied = make(chan struct{})
+	s.lock.Unlock()
+	if closer, ok := old.(interface{ Close() }); ok {
+		closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package replicated
+
+import (
+	"context"
+	"errors"
+	"kv/internal/raft"
+	"kv/internal/store"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/watch"
+	"testing"
+	"time"
+)
+
+func newLocal(revision *store.Revision) store.WatchableKVStore {
+	return watch.New(skiplist.New(store.WithRevision(revision)))
+}
+
+func newCluster(t *testing.T, snapshotEntries uint64) (*raft.Network, map[string]*Store) {
+	network := raft.NewNetwork()
+	peers := []raft.Member{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	stores := map[string]*Store{}
+	for _, p := range peers {
+		s, err := New(newLocal, raft.Options{
+			ID:              p.ID,
+			Peers:           peers,
+			Storage:         raft.NewMemoryStorage(),
+			Transport:       network.Transport(p.ID),
+			TickInterval:    5 * time.Millisecond,
+			SnapshotEntries: snapshotEntries,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.Add(s.Node())
+		stores[p.ID] = s
+		t.Cleanup(s.Close)
+	}
+	return network, stores
+}
+
+// waitForLeader returns a leader among ids, once the others follow it.
+func waitForLeader(t *testing.T, stores map[string]*Store, ids ...string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := stores[ids[0]].Node().Status().Leader
+		agreed := leader != ""
+		for _, id := range ids {
+			agreed = agreed && stores[id].Node().Status().Leader == leader
+		}
+		if agreed {
+			return leader
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no leader among %v", ids)
+	return ""
+}
+
+// waitForRevision waits for every store to reach revision.
+func waitForRevision(t *testing.T, stores map[string]*Store, revision int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for id, s := range stores {
+		for s.Revision() < revision {
+			if time.Now().After(deadline) {
+				t.Fatalf("store [%s] is at revision [%d], expected [%d]", id, s.Revision(), revision)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestReplicatedWrites(t *testing.T) {
+	_, stores := newCluster(t, 0)
+	leader := waitForLeader(t, stores, "a", "b", "c")
+	var follower *Store
+	for id, s := range stores {
+		if id != leader {
+			follower = s
+		}
+	}
+
+	if err := follower.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.PutIf("a", "2", store.IfAbsent()); !errors.Is(err, store.ErrPreconditionFailed) {
+		t.Errorf("expected a failed precondition, got %v", err)
+	}
+	if err := stores[leader].PutIf("a", "2", store.IfValueEquals("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Delete("missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	result, err := follower.Txn(store.Txn{
+		Compares: []store.Compare{{Key: "a", Condition: store.IfRevisionEquals(2)}},
+		Then:     []store.Op{{Type: store.OpPut, Key: "b", Value: int64(3)}, {Type: store.OpGet, Key: "a"}},
+	})
+	if err != nil || !result.Succeeded || result.Revision != 4 || result.Results[1].Entry.Value != "2" {
+		t.Fatalf("unexpected txn result %+v, %v", result, err)
+	}
+
+	waitForRevision(t, stores, 4)
+	for id, s := range stores {
+		e, err := s.GetEntry("b", 0)
+		if err != nil || e.Value != int64(3) || e.ModRevision != 4 {
+			t.Errorf("store [%s] has %+v, %v", id, e, err)
+		}
+	}
+	if keys := follower.Expired(time.Now(), 0); keys != nil {
+		t.Errorf("expected a follower to leave expiry to the leader, got %v", keys)
+	}
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	network, stores := newCluster(t, 5)
+	leader := waitForLeader(t, stores, "a", "b", "c")
+
+	var lagging string
+	var rest []string
+	for id := range stores {
+		if id != leader && lagging == "" {
+			lagging = id
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	c, _ := stores[lagging].AddWatch("k", 0)
+	network.Partition(rest)
+
+	for i := 0; i < 20; i++ {
+		if err := stores[leader].Put("k", int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	network.Heal()
+	waitForRevision(t, stores, 20)
+
+	if v, err := stores[lagging].Get("k"); err != nil || v != int64(19) {
+		t.Errorf("expected the lagging store to catch up, got %v, %v", v, err)
+	}
+	select {
+	case _, ok := <-c:
+		for ok {
+			_, ok = <-c
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the watch to end when the snapshot was installed")
+	}
+
+	// the restored copy carries on with the same revisions
+	if err := stores[lagging].Put("k", "next"); err != nil {
+		t.Fatal(err)
+	}
+	waitForRevision(t, stores, 21)
+	if e, err := stores[lagging].GetEntry("k", 0); err != nil || e.ModRevision != 21 || e.Version != 21 {
+		t.Errorf("unexpected entry %+v, %v", e, err)
+	}
+}
+
+func TestConsistentReads(t *testing.T) {
+	network, stores := newCluster(t, 0)
+	leader := waitForLeader(t, stores, "a", "b", "c")
+	var lagging string
+	var rest []string
+	for id := range stores {
+		if id != leader && lagging == "" {
+			lagging = id
+		} else {
+			rest = append(rest, id)
+		}
+	}
+	follower := stores[lagging]
+	if err := stores[leader].Put("k", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Sync(context.Background(), store.Linearizable, 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := follower.Get("k"); err != nil || v != "1" {
+		t.Fatalf("expected a linearizable read to see the write, got %v, %v", v, err)
+	}
+
+	network.Partition(rest)
+	if err := stores[leader].Put("k", "2"); err != nil {
+		t.Fatal(err)
+	}
+	revision := stores[leader].Revision()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := follower.Sync(ctx, store.Linearizable, 0); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("expected a linearizable read to fail while partitioned, got %v", err)
+	}
+	if _, err := follower.Sync(ctx, store.Sequential, revision); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("expected a sequential read of an unseen revision to fail, got %v", err)
+	}
+	staleness, err := follower.Sync(context.Background(), store.Stale, 0)
+	if err != nil || staleness.Since < 100*time.Millisecond {
+		t.Errorf("expected a stale read to report how long the follower was cut off, got %+v, %v", staleness, err)
+	}
+	if v, _ := follower.Get("k"); v != "1" {
+		t.Errorf("expected a stale read of the old value, got %v", v)
+	}
+
+	network.Heal()
+	if _, err := follower.Sync(context.Background(), store.Sequential, revision); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := follower.Get("k"); v != "2" {
+		t.Errorf("expected a sequential read to see revision [%d], got %v", revision, v)
+	}
+}
+
+// TestApplyIsDeterministic applies the same commands to two copies at different times, where the second only gets
+// them after a key has expired, and expects them to agree.
+func TestApplyIsDeterministic(t *testing.T) {
+	now := time.Now()
+	put, err := encodeTxn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "a", Value: "v", Expires: now.Add(50 * time.Millisecond)},
+	}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas, err := encodeTxn(store.Txn{
+		Compares: []store.Compare{{Key: "a", Condition: store.IfValueEquals("v")}},
+		Then:     []store.Op{{Type: store.OpPut, Key: "a", Value: "w"}, {Type: store.OpPut, Key: "b", Value: "then"}},
+		Else:     []store.Op{{Type: store.OpPut, Key: "b", Value: "else"}},
+	}, now.Add(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copies := make([]*Store, 2)
+	for i := range copies {
+		s := &Store{applied: make(chan struct{}), newStore: newLocal}
+		s.kv = newLocal(s.newRevision())
+		copies[i] = s
+		if r := (machine{s}).Apply(put).(result); r.err != nil {
+			t.Fatal(r.err)
+		}
+		if i == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if r := (machine{s}).Apply(cas).(result); r.err != nil || !r.txn.Succeeded {
+			t.Fatalf("expected the compare to hold when the command was proposed, got %+v %v", r.txn, r.err)
+		}
+	}
+
+	for _, key := range []string{"a", "b"} {
+		first, err := copies[0].GetEntry(key, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := copies[1].GetEntry(key, 0)
+		if err != nil || first != second {
+			t.Errorf("expected [%s] to be %+v on both copies, got %+v %v", key, first, second, err)
+		}
+	}
+	if copies[0].Revision() != copies[1].Revision() {
+		t.Errorf("expected both copies at revision %d, got %d", copies[0].Revision(), copies[1].Revision())
+	}
+}
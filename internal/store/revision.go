@@ -0,0 +1,321 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHistory is the number of entries kept for each key.
+const DefaultHistory = 10
+
+var (
+	// ErrCompacted is returned when reading a revision older than the history kept.
+	ErrCompacted = errors.New("revision has been compacted")
+
+	// ErrFutureRevision is returned when reading a revision newer than the store's.
+	ErrFutureRevision = NewError(ErrInvalid, "revision is in the future")
+)
+
+// Entry is a value along with its revision metadata.
+type Entry struct {
+	Value interface{}
+
+	// CreateRevision is the revision the key was created at.
+	CreateRevision int64
+
+	// ModRevision is the revision of the key's last change.
+	ModRevision int64
+
+	// Version counts the changes to the key since it was created.
+	Version int64
+
+	// Expires is when the key expires, or zero if it doesn't.
+	Expires time.Time
+
+	// Lease is the id of the lease the key is attached to, or zero.
+	Lease int64
+}
+
+// Expired reports whether the entry has expired by now.
+func (e Entry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+// Revision is incremented by every change to a store.  Backends which make up a single store, like the buckets of a
+// multilock.MultiKVStore, should share one so revisions are global.
+type Revision struct {
+	current   atomic.Int64
+	compacted atomic.Int64
+	clock     func() time.Time
+}
+
+func NewRevision() *Revision {
+	return &Revision{}
+}
+
+// SetClock makes the backends sharing r judge whether keys have expired by the time clock returns, rather than
+// time.Now.  It must be called before r is given to any backend.
+func (r *Revision) SetClock(clock func() time.Time) {
+	r.clock = clock
+}
+
+// Now returns the time keys expire by.
+func (r *Revision) Now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// Release takes back rev, the latest revision handed out, for a write which failed without leaving anything at it.
+// When a later revision has been handed out since, rev is left as a gap.
+func (r *Revision) Release(rev int64) {
+	r.current.CompareAndSwap(rev, rev-1)
+}
+
+// Next returns a new revision.
+func (r *Revision) Next() int64 {
+	return r.current.Add(1)
+}
+
+// Current returns the latest revision handed out.
+func (r *Revision) Current() int64 {
+	return r.current.Load()
+}
+
+// Advance moves the current revision forward to rev, if it's behind.
+func (r *Revision) Advance(rev int64) {
+	for {
+		current := r.current.Load()
+		if current >= rev || r.current.CompareAndSwap(current, rev) {
+			return
+		}
+	}
+}
+
+// Restore moves the current revision forward to rev, and marks everything before it as compacted.  It's used when a
+// store has been rebuilt from a snapshot taken at rev, which doesn't include history.
+func (r *Revision) Restore(rev int64) {
+	r.Advance(rev)
+	for {
+		compacted := r.compacted.Load()
+		if compacted >= rev || r.compacted.CompareAndSwap(compacted, rev) {
+			return
+		}
+	}
+}
+
+// Compacted returns the revision history has been compacted to.
+func (r *Revision) Compacted() int64 {
+	return r.compacted.Load()
+}
+
+// Compact records that history before rev is being discarded.
+func (r *Revision) Compact(rev int64) error {
+	if rev > r.Current() {
+		return ErrFutureRevision
+	}
+	for {
+		compacted := r.compacted.Load()
+		if rev < compacted {
+			return ErrCompacted
+		} else if rev == compacted || r.compacted.CompareAndSwap(compacted, rev) {
+			return nil
+		}
+	}
+}
+
+// Check returns an error when rev can't be read.  A rev of zero or less refers to the current revision.
+func (r *Revision) Check(rev int64) error {
+	if rev <= 0 {
+		return nil
+	} else if rev > r.Current() {
+		return ErrFutureRevision
+	} else if rev < r.Compacted() {
+		return ErrCompacted
+	}
+	return nil
+}
+
+// Options configures revision tracking for a backend.
+type Options struct {
+	Revision *Revision
+	History  int
+}
+
+type Option func(*Options)
+
+// WithRevision shares a revision counter with other backends.
+func WithRevision(r *Revision) Option {
+	return func(o *Options) {
+		o.Revision = r
+	}
+}
+
+// WithHistory sets the number of entries kept for each key.
+func WithHistory(n int) Option {
+	return func(o *Options) {
+		o.History = n
+	}
+}
+
+func NewOptions(opts ...Option) Options {
+	o := Options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Revision == nil {
+		o.Revision = NewRevision()
+	}
+	if o.History <= 0 {
+		o.History = DefaultHistory
+	}
+	return o
+}
+
+// NewHistory returns a History for a key of a backend with these options, which judges expiry by the revision's clock.
+func (o Options) NewHistory() *History {
+	h := NewHistory(o.History)
+	h.now = o.Revision.Now
+	return h
+}
+
+// History holds the recent entries of a key, oldest first.  A deleted key ends with a tombstone, which has a zero
+// Version.  History is not safe for concurrent use.
+type History struct {
+	entries []Entry
+	limit   int
+	now     func() time.Time
+
+	// entries before floor have been dropped to stay within the limit
+	floor int64
+
+	// dropped is the entry the latest one pushed out of the history, and the floor before, so Undo can put it back
+	dropped      *Entry
+	droppedFloor int64
+}
+
+func NewHistory(limit int) *History {
+	return &History{limit: max(limit, 1), now: time.Now}
+}
+
+// Current returns the latest entry, unless the key has been deleted or has expired.  An expired key stays in the
+// history until it's removed by Expire.
+func (h *History) Current() (Entry, bool) {
+	e, ok := h.latest()
+	return e, ok && !e.Expired(h.now())
+}
+
+func (h *History) latest() (Entry, bool) {
+	if len(h.entries) == 0 {
+		return Entry{}, false
+	}
+	e := h.entries[len(h.entries)-1]
+	return e, e.Version != 0
+}
+
+// Put records a new entry.  Only the value, mod revision, expiry and lease of e are used, the rest are set from the
+// previous entry.
+func (h *History) Put(e Entry) Entry {
+	e.CreateRevision = e.ModRevision
+	e.Version = 1
+	if current, ok := h.Current(); ok {
+		e.CreateRevision = current.CreateRevision
+		e.Version = current.Version + 1
+	}
+	h.append(e)
+	return e
+}
+
+// Delete records a tombstone at rev.  It returns false if the key doesn't exist.
+func (h *History) Delete(rev int64) bool {
+	if _, ok := h.Current(); !ok {
+		return false
+	}
+	h.append(Entry{ModRevision: rev})
+	return true
+}
+
+// Expired reports whether the latest entry had expired by now.
+func (h *History) Expired(now time.Time) bool {
+	e, ok := h.latest()
+	return ok && e.Expired(now)
+}
+
+// Expire records a tombstone at rev if the latest entry had expired by now.
+func (h *History) Expire(now time.Time, rev int64) bool {
+	if !h.Expired(now) {
+		return false
+	}
+	h.append(Entry{ModRevision: rev})
+	return true
+}
+
+// Restore replaces the history with a single entry.
+func (h *History) Restore(e Entry) {
+	h.entries = append(h.entries[:0], e)
+	h.floor = 0
+	h.dropped = nil
+}
+
+// Undo takes back the latest entry if it was recorded at rev, as though it had never been written, and puts back the
+// entry it pushed out of the history.  It returns true when nothing is left, and the key can be removed.
+func (h *History) Undo(rev int64) bool {
+	if n := len(h.entries); n != 0 && h.entries[n-1].ModRevision == rev {
+		h.entries = h.entries[:n-1]
+		if h.dropped != nil {
+			h.entries = slices.Insert(h.entries, 0, *h.dropped)
+			h.floor = h.droppedFloor
+		}
+	}
+	h.dropped = nil
+	return len(h.entries) == 0
+}
+
+func (h *History) append(e Entry) {
+	h.dropped = nil
+	h.entries = append(h.entries, e)
+	if len(h.entries) > h.limit {
+		dropped := h.entries[0]
+		h.dropped, h.droppedFloor = &dropped, h.floor
+		h.entries = h.entries[len(h.entries)-h.limit:]
+		h.floor = h.entries[0].ModRevision
+	}
+}
+
+// At returns the entry which was current at rev.  A rev of zero or less returns the current entry.
+func (h *History) At(rev int64) (Entry, bool, error) {
+	if rev <= 0 {
+		e, ok := h.Current()
+		return e, ok, nil
+	} else if rev < h.floor {
+		return Entry{}, false, ErrCompacted
+	}
+
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if e := h.entries[i]; e.ModRevision <= rev {
+			return e, e.Version != 0, nil
+		}
+	}
+	return Entry{}, false, nil
+}
+
+// Compact drops the entries superseded before rev.  It returns true when nothing is left, and the key can be removed.
+func (h *History) Compact(rev int64) bool {
+	keep := 0
+	for i, e := range h.entries {
+		if e.ModRevision <= rev {
+			keep = i
+		}
+	}
+	h.entries = h.entries[keep:]
+	h.dropped = nil
+
+	// a tombstone is only needed to hide older entries
+	if len(h.entries) != 0 && h.entries[0].Version == 0 && h.entries[0].ModRevision <= rev {
+		h.entries = h.entries[1:]
+	}
+	return len(h.entries) == 0
+}
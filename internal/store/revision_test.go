@@ -0,0 +1,124 @@
+package store_test
+
+import (
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/singlelock"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/syncmap"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	kv := skiplist.New(store.WithHistory(3))
+	kv.Put("foo", "a") // 1
+	kv.Put("foo", "b") // 2
+	kv.Delete("foo")   // 3
+	kv.Put("foo", "c") // 4
+
+	e, err := kv.GetEntry("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if e.Value != "c" || e.CreateRevision != 4 || e.ModRevision != 4 || e.Version != 1 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	e, err = kv.GetEntry("foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if e.Value != "b" || e.CreateRevision != 1 || e.Version != 2 {
+		t.Errorf("unexpected entry at revision [2] %+v", e)
+	}
+
+	if _, err = kv.GetEntry("foo", 3); err == nil {
+		t.Error("key should not exist at revision [3]")
+	}
+	if _, err = kv.GetEntry("foo", 1); !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("revision [1] should be outside the history, got %v", err)
+	}
+	if _, err = kv.GetEntry("foo", 5); !errors.Is(err, store.ErrFutureRevision) {
+		t.Errorf("expected ErrFutureRevision, got %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	kv := skiplist.New()
+	kv.Put("foo", "a") // 1
+	kv.Put("bar", "a") // 2
+	kv.Put("foo", "b") // 3
+	kv.Delete("bar")   // 4
+
+	if err := kv.Compact(5); !errors.Is(err, store.ErrFutureRevision) {
+		t.Errorf("expected ErrFutureRevision, got %v", err)
+	}
+	if err := kv.Compact(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Compact(2); !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("expected ErrCompacted, got %v", err)
+	}
+
+	if _, err := kv.GetEntry("foo", 2); !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("expected ErrCompacted, got %v", err)
+	}
+	if e, err := kv.GetEntry("foo", 3); err != nil || e.Value != "b" {
+		t.Errorf("expected [b] at revision [3], got %+v %v", e, err)
+	}
+	if e, err := kv.GetEntry("bar", 3); err != nil || e.Value != "a" {
+		t.Errorf("expected [a] at revision [3], got %+v %v", e, err)
+	}
+
+	// the tombstone goes once it no longer hides anything
+	if err := kv.Compact(4); err != nil {
+		t.Fatal(err)
+	}
+	if kvs, _ := kv.Range("", "", 0); len(kvs) != 1 || kvs[0].Key != "foo" {
+		t.Errorf("expected only [foo], got %v", kvs)
+	}
+	if kv.Revision() != 4 {
+		t.Errorf("compacting should not change the revision, got [%d]", kv.Revision())
+	}
+}
+
+func TestUndo(t *testing.T) {
+	for name, kv := range map[string]store.KVStore{
+		"skiplist":   skiplist.New(store.WithHistory(2)),
+		"singlelock": singlelock.New(store.WithHistory(2)),
+		"syncmap":    syncmap.New(store.WithHistory(2)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			kv.Put("foo", "a") // 1
+			kv.Put("foo", "b") // 2
+			result, err := kv.Txn(store.Txn{Then: []store.Op{
+				{Type: store.OpPut, Key: "foo", Value: "c"},
+				{Type: store.OpPut, Key: "bar", Value: "c"},
+				{Type: store.OpDelete, Key: "missing"},
+			}})
+			if err != nil || result.Revision != 3 {
+				t.Fatalf("expected the transaction to write revision 3, got %+v, %v", result, err)
+			}
+
+			undoer := kv.(store.Undoer)
+			undoer.Undo([]string{"foo", "bar", "missing"}, result.Revision)
+			undoer.Release(result.Revision)
+			if kv.Revision() != 2 {
+				t.Errorf("expected revision 3 to be given back, got %d", kv.Revision())
+			}
+			if e, err := kv.GetEntry("foo", 0); err != nil || e.Value != "b" || e.Version != 2 || e.ModRevision != 2 {
+				t.Errorf("expected [foo] to be as it was at revision 2, got %+v, %v", e, err)
+			}
+			if e, err := kv.GetEntry("foo", 1); err != nil || e.Value != "a" {
+				t.Errorf("expected the entry pushed out of the history to be put back, got %+v, %v", e, err)
+			}
+			if _, err := kv.GetEntry("bar", 0); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("expected [bar] not to exist, got %v", err)
+			}
+			kv.ForEach(func(key string, _ store.Entry) bool {
+				if key != "foo" {
+					t.Errorf("expected only [foo] to be left, got [%s]", key)
+				}
+				return true
+			})
+		})
+	}
+}
@@ -1,58 +1,238 @@
 package singlelock
 
 import (
-	"errors"
-	"fmt"
-	"kv/pkg/watch"
+	"kv/internal/store"
 	"sync"
+	"time"
 )
 
 // KVSingleLockMap uses a single lock for the whole key value store.
 type KVSingleLockMap struct {
-	m     sync.RWMutex
-	store map[string]interface{}
+	m       sync.RWMutex
+	store   map[string]*store.History
+	options store.Options
+	expiry  store.ExpiryIndex
 }
 
-func New() *KVSingleLockMap {
+func New(opts ...store.Option) *KVSingleLockMap {
 	return &KVSingleLockMap{
-		m:     sync.RWMutex{},
-		store: make(map[string]interface{}),
+		m:       sync.RWMutex{},
+		store:   make(map[string]*store.History),
+		options: store.NewOptions(opts...),
 	}
 }
 
 func (kv *KVSingleLockMap) Put(key string, value interface{}) error {
 	kv.m.Lock()
 	defer kv.m.Unlock()
-	kv.store[key] = value
+	kv.put(key, value)
 	return nil
 }
 
+func (kv *KVSingleLockMap) PutIf(key string, value interface{}, cond store.Condition) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	err := kv.check(key, cond)
+	if err == nil {
+		kv.put(key, value)
+	}
+	return err
+}
+
+func (kv *KVSingleLockMap) put(key string, value interface{}) {
+	h, ok := kv.store[key]
+	if !ok {
+		h = kv.options.NewHistory()
+		kv.store[key] = h
+	}
+	h.Put(store.Entry{Value: value, ModRevision: kv.options.Revision.Next()})
+	kv.expiry.Update(key, h)
+}
+
+// check tests cond against the current entry for key.  The caller must hold the lock.
+func (kv *KVSingleLockMap) check(key string, cond store.Condition) error {
+	var e store.Entry
+	ok := false
+	if h, exists := kv.store[key]; exists {
+		e, ok = h.Current()
+	}
+	return cond.Check(e, ok)
+}
+
 func (kv *KVSingleLockMap) Get(key string) (interface{}, error) {
+	e, err := kv.GetEntry(key, 0)
+	return e.Value, err
+}
+
+func (kv *KVSingleLockMap) GetEntry(key string, revision int64) (store.Entry, error) {
 	kv.m.RLock()
 	defer kv.m.RUnlock()
-	v, ok := kv.store[key]
 
-	var err error
-	if !ok {
-		err = errors.New(fmt.Sprintf("key [%s] not found", key))
+	err := kv.options.Revision.Check(revision)
+	if err != nil {
+		return store.Entry{}, err
+	}
+
+	var e store.Entry
+	ok := false
+	if h, exists := kv.store[key]; exists {
+		e, ok, err = h.At(revision)
+	}
+
+	if err == nil && !ok {
+		err = store.KeyNotFound(key)
 	}
 
-	return v, err
+	return e, err
 }
 
 func (kv *KVSingleLockMap) Delete(key string) error {
 	kv.m.Lock()
 	defer kv.m.Unlock()
-	_, ok := kv.store[key]
+	return kv.delete(key)
+}
+
+func (kv *KVSingleLockMap) DeleteIf(key string, cond store.Condition) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	err := kv.check(key, cond)
+	if err == nil {
+		err = kv.delete(key)
+	}
+	return err
+}
+
+func (kv *KVSingleLockMap) delete(key string) error {
+	h, ok := kv.store[key]
+	if ok {
+		_, ok = h.Current()
+	}
+
 	var err error
 	if ok {
-		delete(kv.store, key)
+		h.Delete(kv.options.Revision.Next())
+		kv.expiry.Update(key, h)
 	} else {
-		err = errors.New(fmt.Sprintf("key [%s] not found", key))
+		err = store.KeyNotFound(key)
 	}
 	return err
 }
 
-func (kv *KVSingleLockMap) AddWatch(_ string, _ watch.Operation) (chan watch.Update, func()) {
-	panic("not implemented")
+func (kv *KVSingleLockMap) Txn(txn store.Txn) (store.TxnResult, error) {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	return store.ApplyTxn((*txnView)(kv), txn, kv.options.Revision)
+}
+
+// txnView is used by transactions while the lock is held.
+type txnView KVSingleLockMap
+
+func (v *txnView) Current(key string) (store.Entry, bool) {
+	if h, ok := v.store[key]; ok {
+		return h.Current()
+	}
+	return store.Entry{}, false
+}
+
+func (v *txnView) Put(key string, e store.Entry) store.Entry {
+	h, ok := v.store[key]
+	if !ok {
+		h = v.options.NewHistory()
+		v.store[key] = h
+	}
+	e = h.Put(e)
+	v.expiry.Update(key, h)
+	return e
+}
+
+func (v *txnView) Delete(key string, revision int64) bool {
+	if h, ok := v.store[key]; ok && h.Delete(revision) {
+		v.expiry.Update(key, h)
+		return true
+	}
+	return false
+}
+
+func (v *txnView) Expire(key string, now time.Time, revision int64) bool {
+	if h, ok := v.store[key]; ok && h.Expire(now, revision) {
+		v.expiry.Update(key, h)
+		return true
+	}
+	return false
+}
+
+func (kv *KVSingleLockMap) Expired(now time.Time, limit int) []string {
+	return kv.expiry.Expired(now, limit)
+}
+
+func (kv *KVSingleLockMap) ForEach(f func(key string, entry store.Entry) bool) {
+	kv.m.RLock()
+	defer kv.m.RUnlock()
+	for k, h := range kv.store {
+		if e, ok := h.Current(); ok && !f(k, e) {
+			return
+		}
+	}
+}
+
+func (kv *KVSingleLockMap) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	kv.m.RLock()
+	defer kv.m.RUnlock()
+	var kvs []store.KeyValue
+	for k, h := range kv.store {
+		if e, ok := h.Current(); ok && store.InRange(k, start, end) {
+			kvs = append(kvs, store.KeyValue{Key: k, Value: e.Value})
+		}
+	}
+	return store.SortAndLimit(kvs, limit), nil
+}
+
+func (kv *KVSingleLockMap) Revision() int64 {
+	return kv.options.Revision.Current()
+}
+
+func (kv *KVSingleLockMap) Compact(revision int64) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	err := kv.options.Revision.Compact(revision)
+	if err != nil {
+		return err
+	}
+	for k, h := range kv.store {
+		if h.Compact(revision) {
+			delete(kv.store, k)
+		}
+	}
+	return nil
+}
+
+func (kv *KVSingleLockMap) Undo(keys []string, revision int64) {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	for _, key := range keys {
+		if h, ok := kv.store[key]; ok {
+			if h.Undo(revision) {
+				delete(kv.store, key)
+			}
+			kv.expiry.Update(key, h)
+		}
+	}
+}
+
+func (kv *KVSingleLockMap) Release(revision int64) {
+	kv.options.Revision.Release(revision)
+}
+
+func (kv *KVSingleLockMap) Restore(key string, entry store.Entry) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	h, ok := kv.store[key]
+	if !ok {
+		h = kv.options.NewHistory()
+		kv.store[key] = h
+	}
+	h.Restore(entry)
+	kv.expiry.Update(key, h)
+	kv.options.Revision.Advance(entry.ModRevision)
+	return nil
 }
@@ -0,0 +1,318 @@
+package skiplist
+
+import (
+	"kv/internal/store"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	maxLevel = 32
+
+	// each level links roughly a quarter of the nodes in the level below
+	branching = 4
+)
+
+type node struct {
+	key     string
+	history *store.History
+	next    []*node
+}
+
+// KVSkipList keeps keys in order, so ranges of keys can be read without visiting the whole store.
+type KVSkipList struct {
+	m       sync.RWMutex
+	head    *node
+	level   int
+	options store.Options
+	expiry  store.ExpiryIndex
+}
+
+func New(opts ...store.Option) *KVSkipList {
+	return &KVSkipList{
+		m:       sync.RWMutex{},
+		head:    &node{next: make([]*node, maxLevel)},
+		level:   1,
+		options: store.NewOptions(opts...),
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < maxLevel && rand.IntN(branching) == 0 {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual returns the first node with a key no less than key.  When prev is not nil it's filled with the
+// last node before key on each level.
+func (kv *KVSkipList) findGreaterOrEqual(key string, prev []*node) *node {
+	x := kv.head
+	for i := kv.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// find returns the node for key, or nil.
+func (kv *KVSkipList) find(key string) *node {
+	x := kv.findGreaterOrEqual(key, nil)
+	if x == nil || x.key != key {
+		return nil
+	}
+	return x
+}
+
+// insert returns the node for key, adding it if needed.
+func (kv *KVSkipList) insert(key string) *node {
+	prev := make([]*node, maxLevel)
+	x := kv.findGreaterOrEqual(key, prev)
+	if x != nil && x.key == key {
+		return x
+	}
+
+	level := randomLevel()
+	for i := kv.level; i < level; i++ {
+		prev[i] = kv.head
+	}
+	kv.level = max(kv.level, level)
+
+	x = &node{key: key, history: kv.options.NewHistory(), next: make([]*node, level)}
+	for i := 0; i != level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+	return x
+}
+
+// remove unlinks the node for key.
+func (kv *KVSkipList) remove(key string) {
+	prev := make([]*node, maxLevel)
+	x := kv.findGreaterOrEqual(key, prev)
+	if x == nil || x.key != key {
+		return
+	}
+
+	for i := range x.next {
+		prev[i].next[i] = x.next[i]
+	}
+	for kv.level > 1 && kv.head.next[kv.level-1] == nil {
+		kv.level--
+	}
+}
+
+func (kv *KVSkipList) Put(key string, value interface{}) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	kv.put(key, value)
+	return nil
+}
+
+func (kv *KVSkipList) PutIf(key string, value interface{}, cond store.Condition) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	err := kv.check(key, cond)
+	if err == nil {
+		kv.put(key, value)
+	}
+	return err
+}
+
+func (kv *KVSkipList) put(key string, value interface{}) {
+	x := kv.insert(key)
+	x.history.Put(store.Entry{Value: value, ModRevision: kv.options.Revision.Next()})
+	kv.expiry.Update(key, x.history)
+}
+
+// check tests cond against the current entry for key.  The caller must hold the lock.
+func (kv *KVSkipList) check(key string, cond store.Condition) error {
+	var e store.Entry
+	ok := false
+	if x := kv.find(key); x != nil {
+		e, ok = x.history.Current()
+	}
+	return cond.Check(e, ok)
+}
+
+func (kv *KVSkipList) Get(key string) (interface{}, error) {
+	e, err := kv.GetEntry(key, 0)
+	return e.Value, err
+}
+
+func (kv *KVSkipList) GetEntry(key string, revision int64) (store.Entry, error) {
+	kv.m.RLock()
+	defer kv.m.RUnlock()
+
+	err := kv.options.Revision.Check(revision)
+	if err != nil {
+		return store.Entry{}, err
+	}
+
+	var e store.Entry
+	ok := false
+	if x := kv.find(key); x != nil {
+		e, ok, err = x.history.At(revision)
+	}
+
+	if err == nil && !ok {
+		err = store.KeyNotFound(key)
+	}
+	return e, err
+}
+
+// Delete leaves a tombstone in the list, which is removed when the store is compacted.
+func (kv *KVSkipList) Delete(key string) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	return kv.delete(key)
+}
+
+func (kv *KVSkipList) DeleteIf(key string, cond store.Condition) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	err := kv.check(key, cond)
+	if err == nil {
+		err = kv.delete(key)
+	}
+	return err
+}
+
+func (kv *KVSkipList) delete(key string) error {
+	x := kv.find(key)
+	if x != nil {
+		if _, ok := x.history.Current(); ok {
+			x.history.Delete(kv.options.Revision.Next())
+			kv.expiry.Update(key, x.history)
+			return nil
+		}
+	}
+	return store.KeyNotFound(key)
+}
+
+func (kv *KVSkipList) Txn(txn store.Txn) (store.TxnResult, error) {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	return store.ApplyTxn((*txnView)(kv), txn, kv.options.Revision)
+}
+
+// txnView is used by transactions while the lock is held.
+type txnView KVSkipList
+
+func (v *txnView) Current(key string) (store.Entry, bool) {
+	if x := (*KVSkipList)(v).find(key); x != nil {
+		return x.history.Current()
+	}
+	return store.Entry{}, false
+}
+
+func (v *txnView) Put(key string, e store.Entry) store.Entry {
+	x := (*KVSkipList)(v).insert(key)
+	e = x.history.Put(e)
+	v.expiry.Update(key, x.history)
+	return e
+}
+
+func (v *txnView) Delete(key string, revision int64) bool {
+	if x := (*KVSkipList)(v).find(key); x != nil && x.history.Delete(revision) {
+		v.expiry.Update(key, x.history)
+		return true
+	}
+	return false
+}
+
+func (v *txnView) Expire(key string, now time.Time, revision int64) bool {
+	if x := (*KVSkipList)(v).find(key); x != nil && x.history.Expire(now, revision) {
+		v.expiry.Update(key, x.history)
+		return true
+	}
+	return false
+}
+
+func (kv *KVSkipList) Expired(now time.Time, limit int) []string {
+	return kv.expiry.Expired(now, limit)
+}
+
+// ForEach visits keys in order.
+func (kv *KVSkipList) ForEach(f func(key string, entry store.Entry) bool) {
+	kv.m.RLock()
+	defer kv.m.RUnlock()
+	for x := kv.head.next[0]; x != nil; x = x.next[0] {
+		if e, ok := x.history.Current(); ok && !f(x.key, e) {
+			return
+		}
+	}
+}
+
+func (kv *KVSkipList) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	kv.m.RLock()
+	defer kv.m.RUnlock()
+
+	var kvs []store.KeyValue
+	for x := kv.findGreaterOrEqual(start, nil); x != nil && store.InRange(x.key, start, end); x = x.next[0] {
+		if limit > 0 && len(kvs) == limit {
+			break
+		}
+		if e, ok := x.history.Current(); ok {
+			kvs = append(kvs, store.KeyValue{Key: x.key, Value: e.Value})
+		}
+	}
+	return kvs, nil
+}
+
+func (kv *KVSkipList) Revision() int64 {
+	return kv.options.Revision.Current()
+}
+
+func (kv *KVSkipList) Compact(revision int64) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	err := kv.options.Revision.Compact(revision)
+	if err != nil {
+		return err
+	}
+
+	var empty []string
+	for x := kv.head.next[0]; x != nil; x = x.next[0] {
+		if x.history.Compact(revision) {
+			empty = append(empty, x.key)
+		}
+	}
+	for _, key := range empty {
+		kv.remove(key)
+	}
+	return nil
+}
+
+func (kv *KVSkipList) Undo(keys []string, revision int64) {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	for _, key := range keys {
+		if x := kv.find(key); x != nil {
+			if x.history.Undo(revision) {
+				kv.remove(key)
+			}
+			kv.expiry.Update(key, x.history)
+		}
+	}
+}
+
+func (kv *KVSkipList) Release(revision int64) {
+	kv.options.Revision.Release(revision)
+}
+
+func (kv *KVSkipList) Restore(key string, entry store.Entry) error {
+	kv.m.Lock()
+	defer kv.m.Unlock()
+	x := kv.insert(key)
+	x.history.Restore(entry)
+	kv.expiry.Update(key, x.history)
+	kv.options.Revision.Advance(entry.ModRevision)
+	return nil
+}
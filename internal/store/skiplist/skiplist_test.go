@@ -0,0 +1,108 @@
+package skiplist
+
+import (
+	"fmt"
+	"kv/internal/store"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	kv := New()
+	for _, i := range rand.Perm(1000) {
+		err := kv.Put(fmt.Sprintf("key-%04d", i), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 1000 {
+		v, err := kv.Get(fmt.Sprintf("key-%04d", i))
+		if err != nil {
+			t.Fatal(err)
+		} else if v.(int) != i {
+			t.Errorf("expected [%d], got [%v]", i, v)
+		}
+	}
+
+	kv.Put("key-0001", "replaced")
+	if v, _ := kv.Get("key-0001"); v != "replaced" {
+		t.Errorf("expected [replaced], got [%v]", v)
+	}
+
+	_, err := kv.Get("missing")
+	if err == nil {
+		t.Error("Get should have errored, but did not")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	kv := New()
+	for i := range 100 {
+		kv.Put(fmt.Sprintf("key-%03d", i), i)
+	}
+	for i := 0; i < 100; i += 2 {
+		err := kv.Delete(fmt.Sprintf("key-%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := kv.Delete("key-000")
+	if err == nil {
+		t.Error("deleting a missing key should have errored")
+	}
+
+	count := 0
+	kv.ForEach(func(key string, entry store.Entry) bool {
+		if entry.Value.(int)%2 == 0 {
+			t.Errorf("deleted key [%s] was visited", key)
+		}
+		count++
+		return true
+	})
+	if count != 50 {
+		t.Errorf("expected [50] keys, got [%d]", count)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	kv := New()
+	for _, i := range rand.Perm(500) {
+		kv.Put(fmt.Sprintf("key-%03d", i), i)
+	}
+
+	prev := ""
+	kv.ForEach(func(key string, entry store.Entry) bool {
+		if key <= prev {
+			t.Errorf("key [%s] visited after [%s]", key, prev)
+		}
+		prev = key
+		return true
+	})
+}
+
+func TestRange(t *testing.T) {
+	kv := New()
+	keys := []string{"config/a", "config/serviceA/host", "config/serviceA/port", "config/serviceB/host", "other"}
+	for _, k := range keys {
+		kv.Put(k, k)
+	}
+
+	kvs, err := store.Prefix(kv, "config/serviceA/", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(kvs) != 2 || kvs[0].Key != "config/serviceA/host" || kvs[1].Key != "config/serviceA/port" {
+		t.Errorf("unexpected prefix result %v", kvs)
+	}
+
+	kvs, _ = kv.Range("config/b", "", 0)
+	if len(kvs) != 4 || kvs[3].Key != "other" {
+		t.Errorf("unexpected unbounded range %v", kvs)
+	}
+
+	kvs, _ = kv.Range("", "config/serviceB", 2)
+	if len(kvs) != 2 || kvs[0].Key != "config/a" || kvs[1].Key != "config/serviceA/host" {
+		t.Errorf("unexpected limited range %v", kvs)
+	}
+}
@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"kv/internal/store/wal"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Manager takes snapshots of a store backed by a write ahead log, and removes the log segments and snapshots they
+// make redundant.
+type Manager struct {
+	lock   sync.Mutex
+	dir    string
+	log    *wal.Store
+	retain int
+}
+
+// New returns a Manager which writes snapshots of log to dir, keeping the newest retain snapshots.
+func New(dir string, log *wal.Store, retain int) *Manager {
+	return &Manager{
+		dir:    dir,
+		log:    log,
+		retain: max(retain, 1),
+	}
+}
+
+// Take writes a new snapshot.
+func (m *Manager) Take() (Info, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Only copying the entries holds up writes, and the copy is written out afterward.
+	var entries []keyEntry
+	var revision int64
+	index, err := m.log.Checkpoint(func() {
+		revision = m.log.Revision()
+		entries = collect(m.log)
+	})
+	if err != nil {
+		return Info{}, err
+	}
+
+	info, err := write(m.dir, index, revision, entries)
+	if err != nil {
+		return Info{}, err
+	}
+	slog.Info("snapshot taken", "name", info.Name, "index", index)
+
+	err = m.prune()
+	return info, err
+}
+
+// prune removes old snapshots, and the log segments older than the oldest snapshot kept.  Keeping the log back to the
+// oldest snapshot allows recovery from it if a newer snapshot turns out to be unreadable.
+func (m *Manager) prune() error {
+	snapshots, err := List(m.dir)
+	if err != nil {
+		return err
+	}
+
+	for len(snapshots) > m.retain {
+		oldest := snapshots[len(snapshots)-1]
+		err = os.Remove(filepath.Join(m.dir, oldest.Name))
+		if err != nil {
+			return err
+		}
+		snapshots = snapshots[:len(snapshots)-1]
+	}
+
+	return m.log.Prune(snapshots[len(snapshots)-1].Index)
+}
+
+// List returns the snapshots which have been taken, newest first.
+func (m *Manager) List() ([]Info, error) {
+	return List(m.dir)
+}
+
+// Run takes a snapshot every interval until done is closed.
+func (m *Manager) Run(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_, err := m.Take()
+			if err != nil {
+				slog.Error("snapshot failed", "err", err)
+			}
+		}
+	}
+}
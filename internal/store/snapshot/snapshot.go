@@ -0,0 +1,382 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"hash/crc32"
+	"io"
+	"kv/internal/fsutil"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A snapshot file is laid out as:
+//
+//	| magic | index uint64 | revision uint64 | entries... | 0x00 | crc32c uint32 |
+//
+// where each entry is:
+//
+//	| 0x01 | key length uvarint | key | value length uvarint | value | create revision uvarint |
+//	| mod revision uvarint | version uvarint | expires uvarint | lease uvarint |
+//
+// the value is an anypb.Any produced by anyval.Marshal, and expires is in unix nanoseconds, or zero for a key which
+// doesn't expire.  The checksum covers everything before it.
+const (
+	magic      = "KVSNAP04"
+	headerSize = len(magic) + 16
+	extension  = ".snap"
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrInvalid is returned when a snapshot file is truncated or fails its checksum.
+	ErrInvalid = errors.New("snapshot: invalid snapshot")
+)
+
+// Info describes a snapshot file.  Index is the last log record included in the snapshot, and Revision the store's
+// revision at that point.  Revision is only known once the snapshot has been read.
+type Info struct {
+	Name     string
+	Index    uint64
+	Revision int64
+	Size     int64
+	Created  time.Time
+}
+
+type keyEntry struct {
+	key   string
+	entry store.Entry
+}
+
+func fileName(index uint64) string {
+	return fmt.Sprintf("%016x%s", index, extension)
+}
+
+// List returns the snapshots in dir, newest first.
+func List(dir string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Info
+	for _, e := range entries {
+		name, found := strings.CutSuffix(e.Name(), extension)
+		if !found || e.IsDir() {
+			continue
+		}
+		index, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, Info{
+			Name:    e.Name(),
+			Index:   index,
+			Size:    fi.Size(),
+			Created: fi.ModTime(),
+		})
+	}
+
+	slices.SortFunc(snapshots, func(a, b Info) int {
+		return cmp.Compare(b.Index, a.Index)
+	})
+	return snapshots, nil
+}
+
+// Write saves every key in kv to a snapshot in dir, labelled with the log index it was taken at.  Writes to kv
+// should be paused until Write returns.
+func Write(dir string, index uint64, kv store.KVStore) (Info, error) {
+	return write(dir, index, kv.Revision(), collect(kv))
+}
+
+func collect(kv store.KVStore) []keyEntry {
+	var entries []keyEntry
+	kv.ForEach(func(key string, entry store.Entry) bool {
+		entries = append(entries, keyEntry{key: key, entry: entry})
+		return true
+	})
+	return entries
+}
+
+func write(dir string, index uint64, revision int64, entries []keyEntry) (Info, error) {
+	name := fileName(index)
+	tmp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return Info{}, err
+	}
+	defer func() {
+		// a no-op once the file has been renamed
+		os.Remove(tmp.Name())
+	}()
+
+	err = encode(tmp, index, revision, entries)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Info{}, err
+	}
+
+	path := filepath.Join(dir, name)
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return Info{}, err
+	}
+	err = fsutil.SyncDir(dir)
+	if err != nil {
+		return Info{}, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Name: name, Index: index, Revision: revision, Size: fi.Size(), Created: fi.ModTime()}, nil
+}
+
+func encode(w io.Writer, index uint64, revision int64, entries []keyEntry) error {
+	sum := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, sum))
+
+	buf := append([]byte(magic), binary.LittleEndian.AppendUint64(nil, index)...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(revision))
+	_, err := bw.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	for _, ke := range entries {
+		v, err := anyval.Marshal(ke.entry.Value)
+		if err != nil {
+			return fmt.Errorf("key [%s]: %w", ke.key, err)
+		}
+
+		buf = append(buf[:0], 1)
+		buf = binary.AppendUvarint(buf, uint64(len(ke.key)))
+		buf = append(buf, ke.key...)
+		buf = binary.AppendUvarint(buf, uint64(proto.Size(v)))
+		buf, err = proto.MarshalOptions{}.MarshalAppend(buf, v)
+		if err != nil {
+			return err
+		}
+		buf = binary.AppendUvarint(buf, uint64(ke.entry.CreateRevision))
+		buf = binary.AppendUvarint(buf, uint64(ke.entry.ModRevision))
+		buf = binary.AppendUvarint(buf, uint64(ke.entry.Version))
+		var expires int64
+		if !ke.entry.Expires.IsZero() {
+			expires = ke.entry.Expires.UnixNano()
+		}
+		buf = binary.AppendUvarint(buf, uint64(expires))
+		buf = binary.AppendUvarint(buf, uint64(ke.entry.Lease))
+
+		_, err = bw.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = bw.WriteByte(0)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(binary.LittleEndian.AppendUint32(nil, sum.Sum32()))
+	return err
+}
+
+// Load verifies the snapshot at path and restores its entries into kv.
+func Load(path string, kv store.KVStore) (Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+
+	// check the whole file before changing kv
+	fi, err := verify(f)
+	if err != nil {
+		return Info{}, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return Info{}, err
+	}
+
+	info, err := decode(bufio.NewReader(f), kv)
+	if err != nil {
+		return Info{}, err
+	}
+	info.Name = filepath.Base(path)
+	info.Size = fi.Size()
+	info.Created = fi.ModTime()
+	return info, nil
+}
+
+// WriteTo writes a snapshot of kv to w, in the format of a snapshot file.  Writes to kv should be paused until it
+// returns.
+func WriteTo(w io.Writer, index uint64, kv store.KVStore) error {
+	return encode(w, index, kv.Revision(), collect(kv))
+}
+
+// ReadFrom verifies a snapshot written by WriteTo and restores its entries into kv.
+func ReadFrom(data []byte, kv store.KVStore) (Info, error) {
+	size := len(data) - 4
+	if size < headerSize+1 || string(data[:len(magic)]) != magic ||
+		crc32.Checksum(data[:size], crcTable) != binary.LittleEndian.Uint32(data[size:]) {
+		return Info{}, ErrInvalid
+	}
+	info, err := decode(bufio.NewReader(bytes.NewReader(data)), kv)
+	info.Size = int64(len(data))
+	return info, err
+}
+
+// decode restores the entries of a verified snapshot into kv.
+func decode(r *bufio.Reader, kv store.KVStore) (Info, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Info{}, ErrInvalid
+	}
+	info := Info{
+		Index:    binary.LittleEndian.Uint64(header[len(magic):]),
+		Revision: int64(binary.LittleEndian.Uint64(header[len(magic)+8:])),
+	}
+
+	var buf []byte
+	for {
+		flag, err := r.ReadByte()
+		if err != nil {
+			return Info{}, ErrInvalid
+		} else if flag == 0 {
+			return info, nil
+		}
+
+		buf, err = readField(r, buf)
+		if err != nil {
+			return Info{}, ErrInvalid
+		}
+		key := string(buf)
+
+		buf, err = readField(r, buf)
+		if err != nil {
+			return Info{}, ErrInvalid
+		}
+		v := &anypb.Any{}
+		err = proto.Unmarshal(buf, v)
+		if err != nil {
+			return Info{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+
+		entry := store.Entry{}
+		entry.Value, err = anyval.Unmarshal(v)
+		if err != nil {
+			return Info{}, err
+		}
+		var expires int64
+		fields := []*int64{&entry.CreateRevision, &entry.ModRevision, &entry.Version, &expires, &entry.Lease}
+		for _, field := range fields {
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return Info{}, ErrInvalid
+			}
+			*field = int64(n)
+		}
+		if expires != 0 {
+			entry.Expires = time.Unix(0, expires)
+		}
+
+		err = kv.Restore(key, entry)
+		if err != nil {
+			return Info{}, err
+		}
+	}
+}
+
+func readField(r *bufio.Reader, buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return buf, err
+	}
+	buf = slices.Grow(buf[:0], int(size))[:size]
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+func verify(f *os.File) (os.FileInfo, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size() - 4
+	if size < int64(headerSize+1) {
+		return nil, ErrInvalid
+	}
+
+	sum := crc32.New(crcTable)
+	header := make([]byte, len(magic))
+	_, err = io.ReadFull(f, header)
+	if err != nil || string(header) != magic {
+		return nil, ErrInvalid
+	}
+	sum.Write(header)
+
+	_, err = io.CopyN(sum, f, size-int64(len(magic)))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+
+	trailer := make([]byte, 4)
+	_, err = io.ReadFull(f, trailer)
+	if err != nil || binary.LittleEndian.Uint32(trailer) != sum.Sum32() {
+		return nil, ErrInvalid
+	}
+	return fi, nil
+}
+
+// Restore loads the newest valid snapshot in dir into kv and returns it.  Invalid snapshots are skipped, and an empty
+// Info is returned when there are none.  History before the snapshot isn't kept, so the caller should restore the
+// store's revision with store.Revision.Restore.
+func Restore(dir string, kv store.KVStore) (Info, error) {
+	snapshots, err := List(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return Info{}, nil
+	} else if err != nil {
+		return Info{}, err
+	}
+
+	for _, s := range snapshots {
+		info, err := Load(filepath.Join(dir, s.Name), kv)
+		if errors.Is(err, ErrInvalid) {
+			slog.Warn("skipping invalid snapshot", "name", s.Name)
+			continue
+		}
+		if err == nil {
+			slog.Info("restored snapshot", "name", s.Name, "index", info.Index, "revision", info.Revision)
+		}
+		return info, err
+	}
+	return Info{}, nil
+}
@@ -0,0 +1,163 @@
+package snapshot
+
+import (
+	"errors"
+	"kv/internal/store"
+	"kv/internal/store/singlelock"
+	"kv/internal/store/wal"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var values = map[string]interface{}{
+	"string":  "a value",
+	"int64":   int64(42),
+	"float64": 3.5,
+	"bool":    true,
+	"bytes":   []byte{1, 2, 3},
+	"strings": []string{"a", "b"},
+	"floats":  []float32{1.5, 2.5},
+}
+
+func TestWriteAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	kv := singlelock.New()
+	for k, v := range values {
+		kv.Put(k, v)
+	}
+
+	expires := time.Now().Add(time.Hour).Round(0)
+	kv.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: "session", Value: "token", Expires: expires, Lease: 9}}})
+
+	info, err := Write(dir, 7, kv)
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Index != 7 {
+		t.Errorf("expected index [7], got [%d]", info.Index)
+	}
+
+	restored := singlelock.New()
+	loaded, err := Load(filepath.Join(dir, info.Name), restored)
+	if err != nil {
+		t.Fatal(err)
+	} else if loaded.Index != 7 || loaded.Revision != int64(len(values)+1) {
+		t.Errorf("expected index [7] and revision [%d], got %+v", len(values)+1, loaded)
+	}
+	if e, err := restored.GetEntry("session", 0); err != nil || !e.Expires.Equal(expires) || e.Lease != 9 {
+		t.Errorf("expected expiry [%v] and lease [9], got %+v %v", expires, e, err)
+	}
+
+	for k, expected := range values {
+		actual, err := restored.Get(k)
+		if err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("key [%s]: expected [%v], got [%v]", k, expected, actual)
+		}
+	}
+}
+
+func TestRestoreSkipsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	kv := singlelock.New()
+	kv.Put("foo", "old")
+	_, err := Write(dir, 1, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv.Put("foo", "new")
+	info, err := Write(dir, 2, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the newest snapshot
+	path := filepath.Join(dir, info.Name)
+	data, _ := os.ReadFile(path)
+	data[len(data)-6] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	restored := singlelock.New()
+	loaded, err := Restore(dir, restored)
+	if err != nil {
+		t.Fatal(err)
+	} else if loaded.Index != 1 {
+		t.Errorf("expected index [1], got [%d]", loaded.Index)
+	}
+	if v, _ := restored.Get("foo"); v != "old" {
+		t.Errorf("expected [old], got [%v]", v)
+	}
+}
+
+func TestManagerRecovery(t *testing.T) {
+	dir := t.TempDir()
+	log, err := wal.New(dir, singlelock.New(), wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(dir, log, 1)
+	log.Put("foo", "bar")
+	log.Put("baz", "qux")
+	_, err = m.Take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Put("foo", "updated")
+	log.Delete("baz")
+	_, err = m.Take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Put("after", "snapshot")
+	log.Close()
+
+	snapshots, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(snapshots) != 1 || snapshots[0].Index != 4 {
+		t.Fatalf("expected one snapshot at index [4], got %+v", snapshots)
+	}
+
+	revision := store.NewRevision()
+	kv := singlelock.New(store.WithRevision(revision))
+	restored, err := Restore(dir, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision.Restore(restored.Revision)
+	log, err = wal.New(dir, kv, wal.Options{Applied: restored.Index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	expected := map[string]string{"foo": "updated", "after": "snapshot"}
+	for k, v := range expected {
+		if actual, err := log.Get(k); err != nil || actual != v {
+			t.Errorf("key [%s]: expected [%s], got [%v] %v", k, v, actual, err)
+		}
+	}
+	if _, err := log.Get("baz"); err == nil {
+		t.Error("deleted key [baz] was restored")
+	}
+
+	// revisions carry on from where they were before the restart
+	if log.Revision() != 5 {
+		t.Errorf("expected revision [5], got [%d]", log.Revision())
+	}
+	e, err := log.GetEntry("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if e.CreateRevision != 1 || e.ModRevision != 3 || e.Version != 2 {
+		t.Errorf("unexpected entry for [foo] %+v", e)
+	}
+	_, err = log.GetEntry("foo", 2)
+	if !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("history before the snapshot should be compacted, got %v", err)
+	}
+}
@@ -1,41 +1,268 @@
 package syncmap
 
 import (
-	"errors"
-	"fmt"
-	"kv/pkg/watch"
+	"kv/internal/store"
+	"slices"
 	"sync"
+	"time"
 )
 
+// record guards the history of one key.  A removed record has been compacted away, and must be replaced rather than
+// updated.
+type record struct {
+	sync.Mutex
+	history *store.History
+	removed bool
+}
+
 type KVSyncMap struct {
-	store sync.Map
+	store   sync.Map
+	options store.Options
+	expiry  store.ExpiryIndex
 }
 
-func New() *KVSyncMap {
+func New(opts ...store.Option) *KVSyncMap {
 	return &KVSyncMap{
-		store: sync.Map{},
+		store:   sync.Map{},
+		options: store.NewOptions(opts...),
 	}
 }
 
+// update calls f with the locked record for key, creating one if needed.
+func (kv *KVSyncMap) update(key string, f func(r *record)) {
+	r := kv.lock(key)
+	f(r)
+	r.Unlock()
+}
+
 func (kv *KVSyncMap) Put(key string, value interface{}) error {
-	kv.store.Store(key, value)
+	kv.update(key, func(r *record) {
+		r.history.Put(store.Entry{Value: value, ModRevision: kv.options.Revision.Next()})
+		kv.expiry.Update(key, r.history)
+	})
 	return nil
 }
 
-func (kv *KVSyncMap) Get(key string) (interface{}, error) {
+func (kv *KVSyncMap) PutIf(key string, value interface{}, cond store.Condition) error {
 	var err error
-	value, ok := kv.store.Load(key)
-	if !ok {
-		err = errors.New(fmt.Sprintf("key [%s] not found", key))
+	kv.update(key, func(r *record) {
+		e, ok := r.history.Current()
+		err = cond.Check(e, ok)
+		if err == nil {
+			r.history.Put(store.Entry{Value: value, ModRevision: kv.options.Revision.Next()})
+			kv.expiry.Update(key, r.history)
+		}
+	})
+	return err
+}
+
+func (kv *KVSyncMap) Get(key string) (interface{}, error) {
+	e, err := kv.GetEntry(key, 0)
+	return e.Value, err
+}
+
+func (kv *KVSyncMap) GetEntry(key string, revision int64) (store.Entry, error) {
+	err := kv.options.Revision.Check(revision)
+	if err != nil {
+		return store.Entry{}, err
+	}
+
+	var e store.Entry
+	ok := false
+	if v, exists := kv.store.Load(key); exists {
+		r := v.(*record)
+		r.Lock()
+		e, ok, err = r.history.At(revision)
+		r.Unlock()
+	}
+
+	if err == nil && !ok {
+		err = store.KeyNotFound(key)
 	}
-	return value, err
+	return e, err
 }
 
 func (kv *KVSyncMap) Delete(key string) error {
-	kv.store.Delete(key)
+	v, ok := kv.store.Load(key)
+	if !ok {
+		return store.KeyNotFound(key)
+	}
+
+	r := v.(*record)
+	r.Lock()
+	defer r.Unlock()
+	if _, exists := r.history.Current(); !exists || r.removed {
+		return store.KeyNotFound(key)
+	}
+	r.history.Delete(kv.options.Revision.Next())
+	kv.expiry.Update(key, r.history)
 	return nil
 }
 
-func (kv *KVSyncMap) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
-	panic("watch not implemented")
+func (kv *KVSyncMap) DeleteIf(key string, cond store.Condition) error {
+	v, ok := kv.store.Load(key)
+	if !ok {
+		return cond.Check(store.Entry{}, false)
+	}
+
+	r := v.(*record)
+	r.Lock()
+	defer r.Unlock()
+	e, exists := r.history.Current()
+	exists = exists && !r.removed
+	err := cond.Check(e, exists)
+	if err == nil && exists {
+		r.history.Delete(kv.options.Revision.Next())
+		kv.expiry.Update(key, r.history)
+	}
+	return err
+}
+
+// Txn locks the record of every key it uses, in key order so concurrent transactions can't deadlock.
+func (kv *KVSyncMap) Txn(txn store.Txn) (store.TxnResult, error) {
+	keys := txn.Keys()
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	view := txnView{records: make(map[string]*record, len(keys)), expiry: &kv.expiry}
+	for _, key := range keys {
+		view.records[key] = kv.lock(key)
+	}
+	defer func() {
+		for _, r := range view.records {
+			r.Unlock()
+		}
+	}()
+	return store.ApplyTxn(view, txn, kv.options.Revision)
+}
+
+// lock returns the locked record for key, creating one if needed.
+func (kv *KVSyncMap) lock(key string) *record {
+	for {
+		v, ok := kv.store.Load(key)
+		if !ok {
+			v, _ = kv.store.LoadOrStore(key, &record{history: kv.options.NewHistory()})
+		}
+		r := v.(*record)
+		r.Lock()
+		if !r.removed {
+			return r
+		}
+		r.Unlock()
+	}
+}
+
+// txnView holds the locked records of a transaction's keys.
+type txnView struct {
+	records map[string]*record
+	expiry  *store.ExpiryIndex
+}
+
+func (v txnView) Current(key string) (store.Entry, bool) {
+	return v.records[key].history.Current()
+}
+
+func (v txnView) Put(key string, e store.Entry) store.Entry {
+	h := v.records[key].history
+	e = h.Put(e)
+	v.expiry.Update(key, h)
+	return e
+}
+
+func (v txnView) Expire(key string, now time.Time, revision int64) bool {
+	h := v.records[key].history
+	if !h.Expire(now, revision) {
+		return false
+	}
+	v.expiry.Update(key, h)
+	return true
+}
+
+func (kv *KVSyncMap) Expired(now time.Time, limit int) []string {
+	return kv.expiry.Expired(now, limit)
+}
+
+func (v txnView) Delete(key string, revision int64) bool {
+	h := v.records[key].history
+	if !h.Delete(revision) {
+		return false
+	}
+	v.expiry.Update(key, h)
+	return true
+}
+
+func (kv *KVSyncMap) ForEach(f func(key string, entry store.Entry) bool) {
+	kv.store.Range(func(k, v any) bool {
+		r := v.(*record)
+		r.Lock()
+		e, ok := r.history.Current()
+		r.Unlock()
+		return !ok || f(k.(string), e)
+	})
+}
+
+func (kv *KVSyncMap) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	var kvs []store.KeyValue
+	kv.ForEach(func(key string, e store.Entry) bool {
+		if store.InRange(key, start, end) {
+			kvs = append(kvs, store.KeyValue{Key: key, Value: e.Value})
+		}
+		return true
+	})
+	return store.SortAndLimit(kvs, limit), nil
+}
+
+func (kv *KVSyncMap) Revision() int64 {
+	return kv.options.Revision.Current()
+}
+
+func (kv *KVSyncMap) Compact(revision int64) error {
+	err := kv.options.Revision.Compact(revision)
+	if err != nil {
+		return err
+	}
+
+	kv.store.Range(func(k, v any) bool {
+		r := v.(*record)
+		r.Lock()
+		if r.history.Compact(revision) {
+			r.removed = true
+			kv.store.CompareAndDelete(k, v)
+		}
+		r.Unlock()
+		return true
+	})
+	return nil
+}
+
+func (kv *KVSyncMap) Undo(keys []string, revision int64) {
+	for _, key := range keys {
+		v, ok := kv.store.Load(key)
+		if !ok {
+			continue
+		}
+		r := v.(*record)
+		r.Lock()
+		if !r.removed {
+			if r.history.Undo(revision) {
+				r.removed = true
+				kv.store.CompareAndDelete(key, v)
+			}
+			kv.expiry.Update(key, r.history)
+		}
+		r.Unlock()
+	}
+}
+
+func (kv *KVSyncMap) Release(revision int64) {
+	kv.options.Revision.Release(revision)
+}
+
+func (kv *KVSyncMap) Restore(key string, entry store.Entry) error {
+	kv.update(key, func(r *record) {
+		r.history.Restore(entry)
+		kv.expiry.Update(key, r.history)
+	})
+	kv.options.Revision.Advance(entry.ModRevision)
+	return nil
 }
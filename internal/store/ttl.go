@@ -0,0 +1,63 @@
+package store
+
+import (
+	"log/slog"
+	"time"
+)
+
+// reapBatch is the most keys removed by one transaction.
+const reapBatch = 1000
+
+// PutWithTTL stores a value which expires after ttl.  Expired keys can't be read, and are removed by Reap.
+func PutWithTTL(kv KVStore, key string, value interface{}, ttl time.Duration) error {
+	_, err := kv.Txn(Txn{Then: []Op{{Type: OpPut, Key: key, Value: value, Expires: time.Now().Add(ttl)}}})
+	return err
+}
+
+// Reap removes the keys which had expired by now, and returns how many it removed.  Keys are removed with OpExpire, so
+// watchers can tell them apart from deletes.
+func Reap(kv KVStore, now time.Time) (int, error) {
+	removed := 0
+	for {
+		keys := kv.Expired(now, reapBatch)
+		if len(keys) == 0 {
+			return removed, nil
+		}
+
+		txn := Txn{Then: make([]Op, len(keys))}
+		for i, key := range keys {
+			txn.Then[i] = Op{Type: OpExpire, Key: key, Expires: now}
+		}
+		result, err := kv.Txn(txn)
+		if err != nil {
+			return removed, err
+		}
+		for _, r := range result.Results {
+			if r.Found {
+				removed++
+			}
+		}
+		if len(keys) < reapBatch {
+			return removed, nil
+		}
+	}
+}
+
+// RunReaper removes expired keys every interval until done is closed.
+func RunReaper(kv KVStore, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			n, err := Reap(kv, now)
+			if err != nil {
+				slog.Error("reaping expired keys failed", "err", err)
+			} else if n > 0 {
+				slog.Debug("reaped expired keys", "count", n)
+			}
+		}
+	}
+}
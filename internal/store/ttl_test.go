@@ -0,0 +1,104 @@
+package store_test
+
+import (
+	"kv/internal/store"
+	"kv/internal/store/multilock"
+	"kv/internal/store/singlelock"
+	"kv/internal/store/skiplist"
+	"kv/internal/store/syncmap"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	revision := store.NewRevision()
+	kv := multilock.New(3, func() store.KVStore {
+		return skiplist.New(store.WithRevision(revision))
+	}, multilock.SimpleHashFunc)
+
+	if err := store.PutWithTTL(kv, "session", "token", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "a", Value: "gone", Expires: time.Now().Add(-time.Second)},
+		{Type: store.OpPut, Key: "b", Value: "gone", Expires: time.Now().Add(-time.Second)},
+	}})
+	kv.Put("c", "forever")
+
+	// expired keys can't be read before they're reaped
+	if v, err := kv.Get("session"); err != nil || v != "token" {
+		t.Errorf("expected [token], got [%v] %v", v, err)
+	}
+	if _, err := kv.Get("a"); err == nil {
+		t.Error("expired key [a] was read")
+	}
+	if kvs, _ := kv.Range("", "", 0); len(kvs) != 2 {
+		t.Errorf("expected two unexpired keys, got %v", kvs)
+	}
+	if err := kv.PutIf("b", "new", store.IfAbsent()); err != nil {
+		t.Errorf("an expired key should be absent, got %v", err)
+	}
+
+	now := time.Now()
+	if keys := kv.Expired(now, 0); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("expected [a] to have expired, got %v", keys)
+	}
+	n, err := store.Reap(kv, now)
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("expected to reap one key, got [%d]", n)
+	}
+	if keys := kv.Expired(now.Add(2*time.Hour), 0); len(keys) != 1 || keys[0] != "session" {
+		t.Errorf("expected [session] to expire, got %v", keys)
+	}
+
+	// the value is still in the history
+	e, err := kv.GetEntry("a", 2)
+	if err != nil || e.Value != "gone" {
+		t.Errorf("expected [gone] at revision [2], got %+v %v", e, err)
+	}
+}
+
+// TestExpiredIndex checks each backend keeps its expiry index up to date as keys are written, so Expired finds only
+// the keys which have expired.
+func TestExpiredIndex(t *testing.T) {
+	for name, kv := range map[string]store.KVStore{
+		"skiplist":   skiplist.New(),
+		"singlelock": singlelock.New(),
+		"syncmap":    syncmap.New(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			past := now.Add(-time.Second)
+			kv.Txn(store.Txn{Then: []store.Op{
+				{Type: store.OpPut, Key: "overwritten", Value: "v", Expires: past},
+				{Type: store.OpPut, Key: "deleted", Value: "v", Expires: now.Add(time.Hour)},
+				{Type: store.OpPut, Key: "extended", Value: "v", Expires: past},
+				{Type: store.OpPut, Key: "expired", Value: "v", Expires: past},
+				{Type: store.OpPut, Key: "later", Value: "v", Expires: now.Add(time.Hour)},
+			}})
+			kv.Put("overwritten", "forever")
+			kv.Delete("deleted")
+			kv.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: "extended", Value: "v", Expires: now.Add(time.Minute)}}})
+			kv.Restore("restored", store.Entry{Value: "v", ModRevision: 10, Version: 1, Expires: past})
+
+			keys := kv.Expired(now, 0)
+			slices.Sort(keys)
+			if !slices.Equal(keys, []string{"expired", "restored"}) {
+				t.Errorf("expected [expired restored] to have expired, got %v", keys)
+			}
+			if n, err := store.Reap(kv, now); err != nil || n != 2 {
+				t.Errorf("expected to reap two keys, got %d, %v", n, err)
+			}
+			if keys := kv.Expired(now, 0); len(keys) != 0 {
+				t.Errorf("expected nothing left to expire, got %v", keys)
+			}
+			keys = kv.Expired(now.Add(2*time.Hour), 1)
+			if len(keys) != 1 {
+				t.Errorf("expected the limit to be kept to, got %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"kv/pkg/crdt"
+	"slices"
+	"time"
+)
+
+// ErrInvalidTxn is returned for a transaction with an unknown op, or more than one write to the same key.
+var ErrInvalidTxn = NewError(ErrInvalid, "invalid transaction")
+
+type OpType int
+
+const (
+	OpGet OpType = iota + 1
+	OpPut
+	OpDelete
+
+	// OpExpire deletes a key if it had expired by the op's Expires time.
+	OpExpire
+
+	// OpMerge stores the result of merging the op's Value, which must be a Merger, into the key's current value.
+	OpMerge
+)
+
+// Merger is the value of an OpMerge.  Merge returns the key's new value given its current one, or an error if they
+// can't be merged.  It mustn't change current, and must return the same value whenever it's given the same arguments,
+// so the merge has the same effect when it's replayed.  The merged entry keeps the key's expiry and lease.
+type Merger interface {
+	Merge(current interface{}, found bool) (interface{}, error)
+}
+
+// Op is a single read or write in a transaction.
+type Op struct {
+	Type  OpType
+	Key   string
+	Value interface{}
+
+	// Expires is when a put's value expires, or zero if it doesn't.  For OpExpire it's the time the key's expiry is
+	// checked against, which is recorded so the op has the same effect when it's replayed.
+	Expires time.Time
+
+	// Lease attaches a put's key to a lease, or is zero.
+	Lease int64
+}
+
+// Compare is a condition on one key's current entry.
+type Compare struct {
+	Key       string
+	Condition Condition
+}
+
+// Txn applies Then when every Compare holds, and Else otherwise.  Either way it's atomic, and every write in it is made
+// at the same revision.
+type Txn struct {
+	Compares []Compare
+	Then     []Op
+	Else     []Op
+
+	// Revision is the revision writes are made at.  When zero, a new revision is allocated.  It lets a store made of
+	// several backends sharing a Revision apply one transaction across them.
+	Revision int64
+}
+
+// OpResult is the outcome of an Op.  For a get, Entry is the key's entry and Found reports whether it exists.  For a
+// put or merge, Entry is the new entry.  For a delete or expire, Found reports whether the key was removed.
+type OpResult struct {
+	Entry Entry
+	Found bool
+}
+
+type TxnResult struct {
+	// Succeeded is true when the Then branch was applied.
+	Succeeded bool
+
+	// Results has one entry for each op in the branch that was applied.
+	Results []OpResult
+
+	// Revision is the revision of the transaction's writes, or the current revision if it made none.
+	Revision int64
+}
+
+// Keys returns every key the transaction compares, reads or writes.
+func (t Txn) Keys() []string {
+	var keys []string
+	for _, c := range t.Compares {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range t.Then {
+		keys = append(keys, op.Key)
+	}
+	for _, op := range t.Else {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
+
+// Validate checks the ops in both branches.
+func (t Txn) Validate() error {
+	for _, ops := range [][]Op{t.Then, t.Else} {
+		written := make(map[string]bool)
+		for _, op := range ops {
+			switch op.Type {
+			case OpGet:
+			case OpPut, OpDelete, OpExpire, OpMerge:
+				if op.Type == OpMerge {
+					if _, ok := op.Value.(Merger); !ok {
+						return ErrInvalidTxn
+					}
+				}
+				if written[op.Key] {
+					return ErrInvalidTxn
+				}
+				written[op.Key] = true
+			default:
+				return ErrInvalidTxn
+			}
+		}
+	}
+	return nil
+}
+
+// HasWrites reports whether ops contains a put or delete.
+func HasWrites(ops []Op) bool {
+	for _, op := range ops {
+		if op.Type != OpGet {
+			return true
+		}
+	}
+	return false
+}
+
+// TxnView gives a transaction access to a backend's keys while the backend is locked.
+type TxnView interface {
+	// Current returns the current entry for key, and false if it doesn't exist.
+	Current(key string) (Entry, bool)
+
+	// Put stores a new entry for key, as History.Put does.
+	Put(key string, e Entry) Entry
+
+	// Delete leaves a tombstone at revision, and returns false if the key doesn't exist.
+	Delete(key string, revision int64) bool
+
+	// Expire leaves a tombstone at revision if the key had expired by now, and returns false otherwise.
+	Expire(key string, now time.Time, revision int64) bool
+}
+
+// Undoer is a backend which can take back a transaction's writes, when the transaction was one part of a larger one
+// which failed.
+type Undoer interface {
+	// Undo removes the entries written to keys at revision, leaving no trace of them in the keys' histories.  A key
+	// the transaction created no longer exists.
+	Undo(keys []string, revision int64)
+
+	// Release gives back revision once nothing is left at it, as Revision.Release does.  Backends sharing a Revision
+	// only need one of them to release it.
+	Release(revision int64)
+}
+
+// ApplyTxn runs txn against a locked backend.  A new revision is taken from revision only if the chosen branch writes.
+func ApplyTxn(view TxnView, txn Txn, revision *Revision) (TxnResult, error) {
+	err := txn.Validate()
+	if err != nil {
+		return TxnResult{}, err
+	}
+
+	result := TxnResult{Succeeded: true}
+	for _, c := range txn.Compares {
+		e, ok := view.Current(c.Key)
+		if c.Condition.Check(e, ok) != nil {
+			result.Succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Then
+	if !result.Succeeded {
+		ops = txn.Else
+	}
+
+	// merges are worked out before anything is written, so one which fails leaves the store as it was
+	ops = slices.Clone(ops)
+	for i, op := range ops {
+		if op.Type == OpMerge {
+			e, ok := view.Current(op.Key)
+			if ops[i], err = ResolveMerge(op, e, ok); err != nil {
+				return TxnResult{}, err
+			}
+		}
+	}
+
+	result.Revision = txn.Revision
+	if result.Revision == 0 {
+		if HasWrites(ops) {
+			result.Revision = revision.Next()
+		} else {
+			result.Revision = revision.Current()
+		}
+	}
+
+	result.Results = make([]OpResult, len(ops))
+	for i, op := range ops {
+		r := &result.Results[i]
+		switch op.Type {
+		case OpGet:
+			r.Entry, r.Found = view.Current(op.Key)
+		case OpPut:
+			e := Entry{Value: op.Value, ModRevision: result.Revision, Expires: op.Expires, Lease: op.Lease}
+			r.Entry, r.Found = view.Put(op.Key, e), true
+		case OpDelete:
+			r.Found = view.Delete(op.Key, result.Revision)
+		case OpExpire:
+			r.Found = view.Expire(op.Key, op.Expires, result.Revision)
+		}
+	}
+	return result, nil
+}
+
+// ResolveMerge turns an OpMerge into the OpPut which has the same effect on a key whose current entry is e.  An error
+// from the Merger keeps its kind if it's a store error, and is ErrInvalid otherwise.
+func ResolveMerge(op Op, e Entry, found bool) (Op, error) {
+	value, err := op.Value.(Merger).Merge(e.Value, found)
+	if err != nil {
+		kind := ErrInvalid
+		var storeErr *Error
+		if errors.As(err, &storeErr) {
+			kind = storeErr.Kind
+		} else if errors.Is(err, crdt.ErrMismatch) {
+			kind = ErrTypeMismatch
+		}
+		return Op{}, NewError(kind, fmt.Sprintf("can't merge into [%s]: %v", op.Key, err))
+	}
+	return Op{Type: OpPut, Key: op.Key, Value: value, Expires: e.Expires, Lease: e.Lease}, nil
+}
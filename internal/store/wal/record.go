@@ -0,0 +1,270 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"hash/crc32"
+	"io"
+	"kv/internal/encoding"
+	"kv/internal/gen"
+	"kv/internal/store"
+	"kv/pkg/anyval"
+	"time"
+)
+
+// Each record is framed as | length uint32 | crc32c uint32 | payload |, where the checksum covers the payload.
+const headerSize = 8
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorrupt is returned when a record other than the last one in the log fails validation.
+	ErrCorrupt = errors.New("wal: corrupt record")
+
+	// ErrMissing is returned when records between the store's state and the log have been removed.
+	ErrMissing = errors.New("wal: missing records")
+
+	errTorn = errors.New("wal: torn record")
+)
+
+type opType byte
+
+const (
+	opPut opType = iota + 1
+	opDelete
+
+	// opTxn holds the writes of a transaction, so they're replayed together
+	opTxn
+)
+
+const (
+	// hasExpiry is set in the type of a transaction's put when it's followed by an expiry time.
+	hasExpiry = 0x80
+
+	// hasLease is set in the type of a transaction's put when it's followed by a lease id.
+	hasLease = 0x40
+)
+
+type record struct {
+	index uint64
+	op    opType
+	key   string
+	value interface{}
+	ops   []store.Op
+}
+
+// encode appends the framed record to buf.
+func (r *record) encode(buf []byte) ([]byte, error) {
+	payload := binary.AppendUvarint(nil, r.index)
+	payload = append(payload, byte(r.op))
+	payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+	payload = append(payload, r.key...)
+
+	var err error
+	switch r.op {
+	case opPut:
+		payload, err = appendValue(payload, r.value)
+	case opTxn:
+		payload, err = appendOps(payload, r.ops)
+	}
+	if err != nil {
+		return buf, err
+	}
+
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+	return append(buf, payload...), nil
+}
+
+// appendValue encodes a value with anyval.  A mutation, which anyval doesn't know, is encoded as a gen.Mutation.
+func appendValue(payload []byte, value interface{}) ([]byte, error) {
+	var v *anypb.Any
+	var err error
+	if m, ok := value.(store.Mutation); ok {
+		mutation := &gen.Mutation{Type: gen.MutationType(m.Type)}
+		if m.Operand != nil {
+			mutation.Operand, err = anyval.Marshal(m.Operand)
+		}
+		if err == nil {
+			v, err = anypb.New(mutation)
+		}
+	} else {
+		v, err = anyval.Marshal(value)
+	}
+	if err != nil {
+		return payload, err
+	}
+	return proto.MarshalOptions{}.MarshalAppend(payload, v)
+}
+
+// appendOps encodes each op as | type byte | key length uvarint | key |, followed by | value length uvarint | value |
+// for a put or merge.  A put which expires sets hasExpiry in its type, and expire ops are followed by
+// | unix nanos uvarint |.  A put attached to a lease sets hasLease, and is then followed by | lease uvarint |.
+func appendOps(payload []byte, ops []store.Op) ([]byte, error) {
+	payload = binary.AppendUvarint(payload, uint64(len(ops)))
+	for _, op := range ops {
+		opType := byte(op.Type)
+		if op.Type == store.OpPut && !op.Expires.IsZero() {
+			opType |= hasExpiry
+		}
+		if op.Type == store.OpPut && op.Lease != 0 {
+			opType |= hasLease
+		}
+		payload = append(payload, opType)
+		payload = binary.AppendUvarint(payload, uint64(len(op.Key)))
+		payload = append(payload, op.Key...)
+		if opType&hasExpiry != 0 || op.Type == store.OpExpire {
+			payload = binary.AppendUvarint(payload, uint64(op.Expires.UnixNano()))
+		}
+		if opType&hasLease != 0 {
+			payload = binary.AppendUvarint(payload, uint64(op.Lease))
+		}
+		if op.Type == store.OpPut || op.Type == store.OpMerge {
+			value, err := appendValue(nil, op.Value)
+			if err != nil {
+				return payload, err
+			}
+			payload = binary.AppendUvarint(payload, uint64(len(value)))
+			payload = append(payload, value...)
+		}
+	}
+	return payload, nil
+}
+
+// EncodeOps encodes the ops of a transaction the way the log does, for sending them elsewhere.
+func EncodeOps(ops []store.Op) ([]byte, error) {
+	return appendOps(nil, ops)
+}
+
+// DecodeOps decodes ops encoded by EncodeOps.
+func DecodeOps(payload []byte) ([]store.Op, error) {
+	return decodeOps(payload)
+}
+
+func decodeValue(payload []byte) (interface{}, error) {
+	v := &anypb.Any{}
+	if err := proto.Unmarshal(payload, v); err != nil {
+		return nil, err
+	}
+	mutation := &gen.Mutation{}
+	if !v.MessageIs(mutation) {
+		return anyval.Unmarshal(v)
+	}
+	if err := v.UnmarshalTo(mutation); err != nil {
+		return nil, err
+	}
+	operand, err := anyval.Unmarshal(mutation.Operand)
+	return store.Mutation{Type: store.MutationType(mutation.Type), Operand: operand}, err
+}
+
+func decodeOps(payload []byte) ([]store.Op, error) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, ErrCorrupt
+	}
+	payload = payload[n:]
+
+	ops := make([]store.Op, count)
+	for i := range ops {
+		if len(payload) == 0 {
+			return nil, ErrCorrupt
+		}
+		opType := payload[0]
+		ops[i].Type = store.OpType(opType &^ (hasExpiry | hasLease))
+
+		key, rest, ok := encoding.ReadBytes(payload[1:])
+		if !ok {
+			return nil, ErrCorrupt
+		}
+		ops[i].Key = string(key)
+		payload = rest
+
+		if opType&hasExpiry != 0 || ops[i].Type == store.OpExpire {
+			nanos, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return nil, ErrCorrupt
+			}
+			ops[i].Expires = time.Unix(0, int64(nanos))
+			payload = payload[n:]
+		}
+		if opType&hasLease != 0 {
+			lease, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return nil, ErrCorrupt
+			}
+			ops[i].Lease = int64(lease)
+			payload = payload[n:]
+		}
+
+		switch ops[i].Type {
+		case store.OpPut, store.OpMerge:
+			var value []byte
+			var err error
+			if value, payload, ok = encoding.ReadBytes(payload); !ok {
+				return nil, ErrCorrupt
+			}
+			ops[i].Value, err = decodeValue(value)
+			if err != nil {
+				return nil, err
+			}
+		case store.OpGet, store.OpDelete, store.OpExpire:
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+	return ops, nil
+}
+
+func (r *record) decode(payload []byte) error {
+	index, n := binary.Uvarint(payload)
+	if n <= 0 || len(payload) < n+1 {
+		return ErrCorrupt
+	}
+	r.index = index
+	r.op = opType(payload[n])
+	payload = payload[n+1:]
+
+	key, payload, ok := encoding.ReadBytes(payload)
+	if !ok {
+		return ErrCorrupt
+	}
+	r.key = string(key)
+
+	var err error
+	switch r.op {
+	case opPut:
+		r.value, err = decodeValue(payload)
+	case opDelete:
+	case opTxn:
+		r.ops, err = decodeOps(payload)
+	default:
+		err = ErrCorrupt
+	}
+	return err
+}
+
+// readRecord reads the next framed record from data and returns the size of the frame.  It returns io.EOF when data
+// is empty, and errTorn when the frame is incomplete or fails its checksum.
+func readRecord(data []byte, r *record) (int, error) {
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	if len(data) < headerSize {
+		return len(data), errTorn
+	}
+
+	length := binary.LittleEndian.Uint32(data)
+	sum := binary.LittleEndian.Uint32(data[4:])
+	end := headerSize + int(length)
+	if len(data) < end {
+		return len(data), errTorn
+	}
+
+	payload := data[headerSize:end]
+	if crc32.Checksum(payload, crcTable) != sum {
+		return end, errTorn
+	}
+	return end, r.decode(payload)
+}
@@ -0,0 +1,39 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The log is split into segments named after the index of their first record.
+const segmentExt = ".wal"
+
+func segmentName(start uint64) string {
+	return fmt.Sprintf("%016x%s", start, segmentExt)
+}
+
+// listSegments returns the starting index of every segment in dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		name, found := strings.CutSuffix(e.Name(), segmentExt)
+		if !found || e.IsDir() {
+			continue
+		}
+		start, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, start)
+	}
+	slices.Sort(segments)
+	return segments, nil
+}
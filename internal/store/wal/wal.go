@@ -0,0 +1,583 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"kv/internal/fsutil"
+	"kv/internal/store"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SyncMode controls when the log is flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncAlways flushes the log after every write, before the write is acknowledged.
+	SyncAlways SyncMode = iota + 1
+
+	// SyncBatch acknowledges a write once it is flushed, but concurrent writers share a single flush.
+	SyncBatch
+
+	// SyncInterval flushes the log periodically.  Writes are acknowledged before they are durable.
+	SyncInterval
+)
+
+const defaultInterval = 100 * time.Millisecond
+
+// errReadOnly stops write from logging a transaction which only reads.
+var errReadOnly = errors.New("wal: read only")
+
+// Options configures the write ahead log.
+type Options struct {
+	Sync SyncMode
+
+	// Interval is how often the log is flushed when using SyncInterval.
+	Interval time.Duration
+
+	// Applied is the index of the last record already present in the store, usually restored from a snapshot.
+	// Records up to and including it are skipped during replay.
+	Applied uint64
+}
+
+// Store wraps a KVStore and records every change in an append only log before acknowledging it.
+// The log is replayed into the wrapped store when the Store is created.
+type Store struct {
+	lock    sync.Mutex
+	service store.KVStore
+	options Options
+	dir     string
+	file    *os.File
+	segment uint64
+	size    int64
+	index   uint64
+	buf     []byte
+
+	syncLock sync.Mutex
+	synced   *sync.Cond
+	written  uint64
+	durable  uint64
+	syncing  bool
+	err      error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New opens the log in dir, replays it into service, and returns a Store that logs all further changes.
+func New(dir string, service store.KVStore, options Options) (*Store, error) {
+	if options.Sync == 0 {
+		options.Sync = SyncAlways
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaultInterval
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		service: service,
+		options: options,
+		dir:     dir,
+		index:   options.Applied,
+		done:    make(chan struct{}),
+	}
+	s.synced = sync.NewCond(&s.syncLock)
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, start := range segments {
+		err = s.replay(start, i == len(segments)-1)
+		if err != nil {
+			if s.file != nil {
+				s.file.Close()
+			}
+			return nil, err
+		}
+	}
+
+	if s.file == nil {
+		err = s.createSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.written = s.index
+	s.durable = s.index
+
+	if options.Sync == SyncInterval {
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// replay applies the records in a segment to the wrapped store.  A torn record at the end of the last segment is
+// truncated, and the last segment is left open for writing.
+func (s *Store) replay(start uint64, last bool) error {
+	file, err := os.OpenFile(filepath.Join(s.dir, segmentName(start)), os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	offset, err := s.apply(data)
+	if errors.Is(err, errTorn) && last {
+		slog.Warn("truncating torn wal record", "segment", segmentName(start), "offset", offset, "size", len(data)-offset)
+		err = file.Truncate(int64(offset))
+		if err == nil {
+			err = file.Sync()
+		}
+	} else if errors.Is(err, errTorn) {
+		err = fmt.Errorf("%w in segment %s at offset %d", ErrCorrupt, segmentName(start), offset)
+	}
+
+	if err == nil && last {
+		_, err = file.Seek(int64(offset), io.SeekStart)
+	}
+	if err != nil || !last {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.segment = start
+	s.size = int64(offset)
+	return nil
+}
+
+// apply decodes the records in data and applies the ones the store hasn't seen.  It returns the offset of the first
+// byte it couldn't decode.
+func (s *Store) apply(data []byte) (int, error) {
+	var offset int
+	for {
+		r := record{}
+		n, err := readRecord(data[offset:], &r)
+		if err == io.EOF {
+			return offset, nil
+		} else if errors.Is(err, errTorn) {
+			if offset+n < len(data) {
+				return offset, fmt.Errorf("%w at offset %d", ErrCorrupt, offset)
+			}
+			return offset, err
+		} else if err != nil {
+			return offset, fmt.Errorf("%w at offset %d: %v", ErrCorrupt, offset, err)
+		}
+
+		if r.index > s.index+1 {
+			return offset, fmt.Errorf("%w: expected record %d, found %d", ErrMissing, s.index+1, r.index)
+		}
+
+		if r.index == s.index+1 {
+			switch r.op {
+			case opPut:
+				err = s.service.Put(r.key, r.value)
+			case opDelete:
+				// the key may not have existed when the delete was logged
+				_ = s.service.Delete(r.key)
+			case opTxn:
+				_, err = s.service.Txn(store.Txn{Then: r.ops})
+			}
+			if err != nil {
+				return offset, err
+			}
+			s.index = r.index
+		}
+		offset += n
+	}
+}
+
+// createSegment starts a new segment for the records following the current index.
+func (s *Store) createSegment() error {
+	start := s.index + 1
+	file, err := os.OpenFile(filepath.Join(s.dir, segmentName(start)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = fsutil.SyncDir(s.dir)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.syncLock.Lock()
+	s.file = file
+	s.syncLock.Unlock()
+	s.segment = start
+	s.size = 0
+	return nil
+}
+
+// Rotate flushes the log and starts a new segment.  It returns the index of the last record written before the new
+// segment, and every record up to that index has been applied to the wrapped store.
+func (s *Store) Rotate() (uint64, error) {
+	return s.Checkpoint(nil)
+}
+
+// Checkpoint rotates the log like Rotate, and calls f before any more records are written.  The wrapped store
+// doesn't change while f runs, so f can take a consistent copy of it.
+func (s *Store) Checkpoint(f func()) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f != nil {
+		f()
+	}
+	if s.size == 0 {
+		return s.index, nil
+	}
+
+	err := s.waitDurable(s.index)
+	if err != nil {
+		return 0, err
+	}
+
+	// nothing can be waiting on the old file once everything in it is durable
+	old := s.file
+	err = s.createSegment()
+	if err != nil {
+		return 0, err
+	}
+	return s.index, old.Close()
+}
+
+// Prune removes segments which only contain records up to and including index.
+func (s *Store) Prune(index uint64) error {
+	segments, err := listSegments(s.dir)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	current := s.segment
+	s.lock.Unlock()
+
+	for i := 0; i < len(segments)-1; i++ {
+		// a segment ends where the next one starts
+		if segments[i] >= current || segments[i+1] > index+1 {
+			break
+		}
+		err = os.Remove(filepath.Join(s.dir, segmentName(segments[i])))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Put(key string, value interface{}) error {
+	r := record{op: opPut, key: key, value: value}
+	return s.write(&r, nil, func() error {
+		return s.service.Put(key, value)
+	})
+}
+
+// PutIf checks cond before the write is logged, so only writes which are applied reach the log.
+func (s *Store) PutIf(key string, value interface{}, cond store.Condition) error {
+	r := record{op: opPut, key: key, value: value}
+	return s.write(&r, s.checkFunc(key, cond), func() error {
+		return s.service.Put(key, value)
+	})
+}
+
+func (s *Store) Get(key string) (interface{}, error) {
+	return s.service.Get(key)
+}
+
+func (s *Store) Delete(key string) error {
+	r := record{op: opDelete, key: key}
+	return s.write(&r, nil, func() error {
+		return s.service.Delete(key)
+	})
+}
+
+func (s *Store) DeleteIf(key string, cond store.Condition) error {
+	r := record{op: opDelete, key: key}
+	return s.write(&r, s.checkFunc(key, cond), func() error {
+		return s.service.Delete(key)
+	})
+}
+
+// Txn checks the compares before anything is logged, and logs only the writes of the chosen branch.  The wrapped store
+// then applies the branch as a transaction without compares, which can't change the outcome since every write goes
+// through the log's lock.
+func (s *Store) Txn(txn store.Txn) (store.TxnResult, error) {
+	err := txn.Validate()
+	if err != nil {
+		return store.TxnResult{}, err
+	}
+
+	var result store.TxnResult
+	var ops []store.Op
+	apply := func() error {
+		r, err := s.service.Txn(store.Txn{Then: ops})
+		result.Results, result.Revision = r.Results, r.Revision
+		return err
+	}
+
+	r := record{op: opTxn}
+	check := func() error {
+		result.Succeeded = true
+		for _, c := range txn.Compares {
+			e, err := s.service.GetEntry(c.Key, 0)
+			if c.Condition.Check(e, err == nil) != nil {
+				result.Succeeded = false
+				break
+			}
+		}
+
+		ops = txn.Then
+		if !result.Succeeded {
+			ops = txn.Else
+		}
+		// merges are logged as the puts they resolve to, so one which fails isn't logged, and replaying doesn't merge
+		ops = slices.Clone(ops)
+		for i, op := range ops {
+			if op.Type == store.OpMerge {
+				e, err := s.service.GetEntry(op.Key, 0)
+				if ops[i], err = store.ResolveMerge(op, e, err == nil); err != nil {
+					return err
+				}
+			}
+			if op.Type != store.OpGet {
+				r.ops = append(r.ops, ops[i])
+			}
+		}
+
+		// there's nothing to log, but the reads still happen under the lock
+		if len(r.ops) == 0 {
+			err := apply()
+			if err == nil {
+				err = errReadOnly
+			}
+			return err
+		}
+		return nil
+	}
+
+	err = s.write(&r, check, apply)
+	if errors.Is(err, errReadOnly) {
+		err = nil
+	}
+	return result, err
+}
+
+// checkFunc tests cond against the current entry for key.  Every write goes through the log's lock, so the entry can't
+// change between the check and the write.
+func (s *Store) checkFunc(key string, cond store.Condition) func() error {
+	return func() error {
+		e, err := s.service.GetEntry(key, 0)
+		return cond.Check(e, err == nil)
+	}
+}
+
+func (s *Store) ForEach(f func(key string, entry store.Entry) bool) {
+	s.service.ForEach(f)
+}
+
+func (s *Store) GetEntry(key string, revision int64) (store.Entry, error) {
+	return s.service.GetEntry(key, revision)
+}
+
+func (s *Store) BatchGet(keys []string) ([]store.BatchResult, error) {
+	return store.BatchGet(s.service, keys, false)
+}
+
+func (s *Store) Export(start, end string) ([]store.KeyValue, int64, error) {
+	return store.ExportRange(s.service, start, end)
+}
+
+func (s *Store) Expired(now time.Time, limit int) []string {
+	return s.service.Expired(now, limit)
+}
+
+func (s *Store) Revision() int64 {
+	return s.service.Revision()
+}
+
+func (s *Store) Compact(revision int64) error {
+	return s.service.Compact(revision)
+}
+
+func (s *Store) Restore(key string, entry store.Entry) error {
+	return s.service.Restore(key, entry)
+}
+
+func (s *Store) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.service.Range(start, end, limit)
+}
+
+// write appends r to the log and applies it to the wrapped store.  Both happen under the same lock, so the order of
+// records in the log always matches the order they were applied in.  When check is set, nothing is written unless it
+// returns nil.
+func (s *Store) write(r *record, check func() error, apply func() error) error {
+	s.lock.Lock()
+	err := s.failed()
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	r.index = s.index + 1
+	s.buf, err = r.encode(s.buf[:0])
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	_, err = s.file.Write(s.buf)
+	if err != nil {
+		// don't leave a partial record in front of the next one
+		if terr := s.file.Truncate(s.size); terr != nil {
+			s.fail(terr)
+		}
+		s.lock.Unlock()
+		return err
+	}
+	s.size += int64(len(s.buf))
+	s.index = r.index
+	s.setWritten(r.index)
+
+	err = apply()
+	if s.options.Sync == SyncAlways {
+		if serr := s.sync(); serr != nil {
+			err = serr
+		}
+	}
+	s.lock.Unlock()
+
+	if err == nil && s.options.Sync == SyncBatch {
+		err = s.waitDurable(r.index)
+	}
+	return err
+}
+
+func (s *Store) setWritten(index uint64) {
+	s.syncLock.Lock()
+	s.written = index
+	s.syncLock.Unlock()
+}
+
+// waitDurable blocks until the record at index has been flushed.  The first waiter flushes on behalf of every record
+// written so far, while the others wait for it to finish.
+func (s *Store) waitDurable(index uint64) error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	for s.durable < index && s.err == nil {
+		if s.syncing {
+			s.synced.Wait()
+			continue
+		}
+
+		s.syncing = true
+		target := s.written
+		file := s.file
+		s.syncLock.Unlock()
+		err := file.Sync()
+		s.syncLock.Lock()
+		s.syncing = false
+
+		if err != nil {
+			s.err = err
+		} else if target > s.durable {
+			s.durable = target
+		}
+		s.synced.Broadcast()
+	}
+	return s.err
+}
+
+// sync flushes everything written so far.
+func (s *Store) sync() error {
+	s.syncLock.Lock()
+	target := s.written
+	s.syncLock.Unlock()
+	return s.waitDurable(target)
+}
+
+func (s *Store) syncLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			err := s.sync()
+			if err != nil {
+				slog.Error("wal sync failed", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// fail records an error which leaves the log unusable.
+func (s *Store) fail(err error) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// failed returns an ErrUnavailable error once the log is unusable.
+func (s *Store) failed() error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	if s.err != nil {
+		return store.NewError(store.ErrUnavailable, fmt.Sprintf("wal: log is unusable: %v", s.err))
+	}
+	return nil
+}
+
+// Close flushes and closes the log.
+func (s *Store) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SyncModeFromString parses the names always, batch and interval.
+func SyncModeFromString(name string) (mode SyncMode, err error) {
+	switch name {
+	case "always":
+		mode = SyncAlways
+	case "batch":
+		mode = SyncBatch
+	case "interval":
+		mode = SyncInterval
+	default:
+		err = errors.New("unknown sync mode: " + name)
+	}
+	return
+}
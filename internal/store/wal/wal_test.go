@@ -0,0 +1,381 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"kv/internal/store"
+	"kv/internal/store/singlelock"
+	"kv/pkg/crdt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openStore(t *testing.T, dir string, mode SyncMode) *Store {
+	t.Helper()
+	s, err := New(dir, singlelock.New(), Options{Sync: mode, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestReplay(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(fmt.Sprintf("mode-%d", mode), func(t *testing.T) {
+			dir := t.TempDir()
+			s := openStore(t, dir, mode)
+			if err := s.Put("foo", "bar"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("answer", int64(42)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("list", []string{"a", "b"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("foo"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openStore(t, dir, mode)
+			defer s.Close()
+
+			if _, err := s.Get("foo"); err == nil {
+				t.Error("deleted key [foo] was restored")
+			}
+
+			v, err := s.Get("answer")
+			if err != nil {
+				t.Fatal(err)
+			} else if v.(int64) != 42 {
+				t.Errorf("expected [42], got [%v]", v)
+			}
+
+			v, err = s.Get("list")
+			if err != nil {
+				t.Fatal(err)
+			} else if l := v.([]string); len(l) != 2 || l[1] != "b" {
+				t.Errorf("expected [[a b]], got [%v]", v)
+			}
+		})
+	}
+}
+
+func TestConcurrentBatchWrites(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncBatch)
+
+	wg := sync.WaitGroup{}
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Put(fmt.Sprintf("key-%d", i), i); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	s.Close()
+
+	s = openStore(t, dir, SyncBatch)
+	defer s.Close()
+	for i := range 50 {
+		v, err := s.Get(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		} else if v.(int64) != int64(i) {
+			t.Errorf("expected [%d], got [%v]", i, v)
+		}
+	}
+}
+
+func TestTornRecordTruncated(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Put("foo", "bar")
+	s.Put("baz", "qux")
+	s.Close()
+
+	// chop the last few bytes off the final record
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, info.Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = openStore(t, dir, SyncAlways)
+	if _, err := s.Get("baz"); err == nil {
+		t.Error("torn record [baz] should not have been replayed")
+	}
+	if v, err := s.Get("foo"); err != nil || v != "bar" {
+		t.Errorf("expected [bar], got [%v] %v", v, err)
+	}
+
+	// the log should accept writes after the truncation point
+	if err = s.Put("baz", "again"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openStore(t, dir, SyncAlways)
+	defer s.Close()
+	if v, err := s.Get("baz"); err != nil || v != "again" {
+		t.Errorf("expected [again], got [%v] %v", v, err)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Put("foo", "bar")
+	s.Put("baz", "qux")
+	s.Close()
+
+	// flip a byte in the first record's payload
+	path := filepath.Join(dir, segmentName(1))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[headerSize+2] ^= 0xff
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = New(dir, singlelock.New(), Options{})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestRotateAndPrune(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Put("foo", "bar")
+	s.Put("baz", "qux")
+
+	index, err := s.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	} else if index != 2 {
+		t.Errorf("expected index [2], got [%d]", index)
+	}
+	s.Put("foo", "updated")
+
+	err = s.Prune(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(segments) != 1 || segments[0] != 3 {
+		t.Fatalf("expected only segment [3], got %v", segments)
+	}
+
+	// the remaining records build on state restored from elsewhere
+	kv := singlelock.New()
+	kv.Put("baz", "qux")
+	s, err = New(dir, kv, Options{Applied: index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get("foo"); err != nil || v != "updated" {
+		t.Errorf("expected [updated], got [%v] %v", v, err)
+	}
+}
+
+func TestMissingRecords(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Put("foo", "bar")
+	index, _ := s.Rotate()
+	s.Put("baz", "qux")
+	s.Prune(index)
+	s.Close()
+
+	_, err := New(dir, singlelock.New(), Options{})
+	if !errors.Is(err, ErrMissing) {
+		t.Errorf("expected ErrMissing, got %v", err)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	if err := s.PutIf("foo", "bar", store.IfAbsent()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutIf("foo", "baz", store.IfAbsent()); !errors.Is(err, store.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, got %v", err)
+	}
+	if err := s.DeleteIf("foo", store.IfRevisionEquals(2)); !errors.Is(err, store.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed, got %v", err)
+	}
+	index := s.index
+	s.Close()
+
+	// failed writes never reach the log
+	if index != 1 {
+		t.Errorf("expected one record, got [%d]", index)
+	}
+	s = openStore(t, dir, SyncAlways)
+	defer s.Close()
+	if v, err := s.Get("foo"); err != nil || v != "bar" {
+		t.Errorf("expected [bar], got [%v] %v", v, err)
+	}
+}
+
+func TestTxnReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Put("foo", "bar")
+	txn := store.Txn{
+		Compares: []store.Compare{{Key: "foo", Condition: store.IfValueEquals("bar")}},
+		Then: []store.Op{
+			{Type: store.OpGet, Key: "foo"},
+			{Type: store.OpDelete, Key: "foo"},
+			{Type: store.OpPut, Key: "baz", Value: []string{"a", "b"}},
+		},
+	}
+	result, err := s.Txn(txn)
+	if err != nil {
+		t.Fatal(err)
+	} else if !result.Succeeded || result.Results[0].Entry.Value != "bar" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// a read only transaction isn't logged
+	if _, err = s.Txn(store.Txn{Then: []store.Op{{Type: store.OpGet, Key: "baz"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if s.index != 2 {
+		t.Errorf("expected two records, got [%d]", s.index)
+	}
+	s.Close()
+
+	s = openStore(t, dir, SyncAlways)
+	defer s.Close()
+	if _, err := s.Get("foo"); err == nil {
+		t.Error("deleted key [foo] was restored")
+	}
+	e, err := s.GetEntry("baz", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if e.ModRevision != 2 || len(e.Value.([]string)) != 2 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestMergeReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Put("plain", "v")
+	merge := func(key string) error {
+		_, err := s.Txn(store.Txn{Then: []store.Op{{Type: store.OpMerge, Key: key, Value: crdt.Increment{Node: "a", Delta: 2}}}})
+		return err
+	}
+	if err := merge("count"); err != nil {
+		t.Fatal(err)
+	}
+	if err := merge("count"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a merge which fails isn't logged, so it can't stop the log being replayed
+	if err := merge("plain"); !errors.Is(err, store.ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch, got %v", err)
+	}
+	s.Close()
+
+	s = openStore(t, dir, SyncAlways)
+	defer s.Close()
+	v, err := s.Get("count")
+	if c, ok := v.(crdt.Counter); err != nil || !ok || c.Value() != 4 {
+		t.Errorf("expected a counter of [4], got %v, %v", v, err)
+	}
+}
+
+func TestEncodeMutations(t *testing.T) {
+	// raft sends merges to every replica unresolved, so mutations must survive encoding
+	ops := []store.Op{
+		{Type: store.OpMerge, Key: "n", Value: store.Mutation{Type: store.MutateIncrement, Operand: int64(2)}},
+		{Type: store.OpMerge, Key: "list", Value: store.Mutation{Type: store.MutatePopBack}},
+	}
+	payload, err := EncodeOps(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeOps(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(decoded) != fmt.Sprint(ops) {
+		t.Errorf("expected %v, got %v", ops, decoded)
+	}
+}
+
+func TestExpiryReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	expires := time.Now().Add(time.Hour).Round(0)
+	s.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "foo", Value: "bar", Expires: expires},
+		{Type: store.OpPut, Key: "baz", Value: "qux", Expires: time.Now().Add(-time.Second)},
+	}})
+	if n, err := store.Reap(s, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected to reap one key, got [%d] %v", n, err)
+	}
+	s.Close()
+
+	s = openStore(t, dir, SyncAlways)
+	defer s.Close()
+	e, err := s.GetEntry("foo", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if !e.Expires.Equal(expires) {
+		t.Errorf("expected expiry [%v], got [%v]", expires, e.Expires)
+	}
+	if keys := s.Expired(time.Now(), 0); len(keys) != 0 {
+		t.Errorf("reaped keys were restored %v", keys)
+	}
+	if s.Revision() != 2 {
+		t.Errorf("expected revision [2], got [%d]", s.Revision())
+	}
+}
+
+func TestLeaseReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, SyncAlways)
+	s.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "foo", Value: "bar", Lease: 42},
+		{Type: store.OpPut, Key: "baz", Value: "qux", Lease: 42, Expires: time.Now().Add(time.Hour)},
+	}})
+	s.Close()
+
+	s = openStore(t, dir, SyncAlways)
+	defer s.Close()
+	for _, key := range []string{"foo", "baz"} {
+		e, err := s.GetEntry(key, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if e.Lease != 42 {
+			t.Errorf("expected [%s] to have lease [42], got [%d]", key, e.Lease)
+		}
+	}
+}
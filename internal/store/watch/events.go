@@ -0,0 +1,64 @@
+package watch
+
+import (
+	"kv/internal/store"
+	"kv/pkg/watch"
+	"sync"
+)
+
+// DefaultEventHistory is how many recent updates are kept for watches which start from a past revision.
+const DefaultEventHistory = 10000
+
+// eventLog keeps the most recent updates, so a watch can start from a past revision and replay what it missed.
+type eventLog struct {
+	lock   sync.Mutex
+	size   int
+	events []watch.Update
+
+	// evicted is the newest revision which may be missing from the log.  Updates after it are all kept.
+	evicted int64
+}
+
+func newEventLog(size int, revision int64) *eventLog {
+	// the updates made before the log was created were never kept
+	return &eventLog{size: size, evicted: revision}
+}
+
+// append records the updates made by one write.  The log is trimmed back to its size once it holds twice as many, so
+// the copying is spread over many writes.
+func (l *eventLog) append(updates []watch.Update) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, updates...)
+	if len(l.events) >= 2*l.size {
+		n := len(l.events) - l.size
+		for _, u := range l.events[:n] {
+			l.evicted = max(l.evicted, u.Revision)
+		}
+		l.events = append(l.events[:0:0], l.events[n:]...)
+	}
+}
+
+// since returns the updates matching sub made at revision or later, or store.ErrCompacted if some may be missing.  Each
+// write's updates are kept together, and the sequencer appends writes in revision order, but eviction doesn't rely on
+// it.
+func (l *eventLog) since(revision int64, sub subscription) ([]watch.Update, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if revision <= l.evicted {
+		return nil, store.ErrCompacted
+	}
+
+	var updates []watch.Update
+	for _, u := range l.events {
+		if u.Revision >= revision && sub.matches(u) {
+			updates = append(updates, u)
+		}
+	}
+
+	// mark the last update of each write, as updateWatchers does
+	for i := range updates {
+		updates[i].Last = i == len(updates)-1 || updates[i+1].Revision != updates[i].Revision
+	}
+	return updates, nil
+}
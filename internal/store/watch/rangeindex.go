@@ -0,0 +1,81 @@
+package watch
+
+import (
+	"kv/pkg/watch"
+	"slices"
+	"sort"
+)
+
+type rangeWatcher struct {
+	start string
+	end   string
+	op    watch.Operation
+	sub   *subscriber
+}
+
+// covers reports whether the segment starting at bound is inside the watched range.
+func (r *rangeWatcher) covers(bound string) bool {
+	return r.start <= bound && (len(r.end) == 0 || bound < r.end)
+}
+
+// rangeIndex holds key range subscriptions.  The starts and ends of every range split the key space into segments,
+// and each segment keeps the ranges covering it, so the watchers of a key are found with one binary search.  The index
+// is rebuilt when a range is added or removed, as watches change far less often than keys.
+type rangeIndex struct {
+	watchers []*rangeWatcher
+
+	// bounds are the sorted starts of each segment.  Segment i covers bounds[i] <= key < bounds[i+1], and the last
+	// segment has no upper bound.
+	bounds   []string
+	segments [][]*rangeWatcher
+}
+
+func (ri *rangeIndex) add(start, end string, op watch.Operation, sub *subscriber) {
+	ri.watchers = append(ri.watchers, &rangeWatcher{start: start, end: end, op: op, sub: sub})
+	ri.rebuild()
+}
+
+// remove deletes a watcher, and returns false if it wasn't found.
+func (ri *rangeIndex) remove(sub *subscriber) bool {
+	i := slices.IndexFunc(ri.watchers, func(r *rangeWatcher) bool { return r.sub == sub })
+	if i < 0 {
+		return false
+	}
+	ri.watchers = slices.Delete(ri.watchers, i, i+1)
+	ri.rebuild()
+	return true
+}
+
+func (ri *rangeIndex) rebuild() {
+	ri.bounds = ri.bounds[:0]
+	for _, r := range ri.watchers {
+		ri.bounds = append(ri.bounds, r.start)
+		if len(r.end) != 0 {
+			ri.bounds = append(ri.bounds, r.end)
+		}
+	}
+	slices.Sort(ri.bounds)
+	ri.bounds = slices.Compact(ri.bounds)
+
+	ri.segments = make([][]*rangeWatcher, len(ri.bounds))
+	for i, bound := range ri.bounds {
+		for _, r := range ri.watchers {
+			if r.covers(bound) {
+				ri.segments[i] = append(ri.segments[i], r)
+			}
+		}
+	}
+}
+
+// forEach calls f with every watcher of op whose range contains key.
+func (ri *rangeIndex) forEach(key string, op watch.Operation, f func(sub *subscriber)) {
+	i := sort.Search(len(ri.bounds), func(i int) bool { return ri.bounds[i] > key }) - 1
+	if i < 0 {
+		return
+	}
+	for _, r := range ri.segments[i] {
+		if r.op == op {
+			f(r.sub)
+		}
+	}
+}
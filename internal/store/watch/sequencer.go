@@ -0,0 +1,81 @@
+package watch
+
+import (
+	"cmp"
+	"kv/pkg/watch"
+	"slices"
+	"sync"
+)
+
+// sequencer publishes the updates of concurrent writes in revision order.  A write's revision is handed out part way
+// through it, so two writes to keys in different stripes can finish in the opposite order to their revisions.  The
+// updates of a write are held back until every write still in progress which could be handed an earlier revision,
+// because it started before this write's revision was handed out, has finished.
+type sequencer struct {
+	lock    sync.Mutex
+	publish func([]watch.Update)
+
+	// started counts the writes in progress by the revision the store was at when they started.
+	started map[int64]int
+	pending []*sequenced
+}
+
+// sequenced is a finished write's updates, waiting for the writes before them.
+type sequenced struct {
+	revision int64
+	updates  []watch.Update
+	done     chan struct{}
+}
+
+func newSequencer(publish func([]watch.Update)) *sequencer {
+	return &sequencer{publish: publish, started: make(map[int64]int)}
+}
+
+// begin records a write starting, and returns the revision it started at for end.  Revision is the store's current
+// revision, and must be read before the write is handed one.
+func (q *sequencer) begin(revision func() int64) int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	start := revision()
+	q.started[start]++
+	return start
+}
+
+// end records the write which began at start finishing at revision with updates, and waits until they're published.
+// A write which failed, or didn't change anything, has no updates, but still has to end.
+func (q *sequencer) end(start, revision int64, updates []watch.Update) {
+	q.lock.Lock()
+	if q.started[start]--; q.started[start] == 0 {
+		delete(q.started, start)
+	}
+	var done chan struct{}
+	if len(updates) != 0 {
+		s := &sequenced{revision: revision, updates: updates, done: make(chan struct{})}
+		i, _ := slices.BinarySearchFunc(q.pending, revision, func(p *sequenced, r int64) int {
+			return cmp.Compare(p.revision, r)
+		})
+		q.pending = slices.Insert(q.pending, i, s)
+		done = s.done
+	}
+	q.release()
+	q.lock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// release publishes the pending updates which no write in progress can come before.  The caller must hold the lock.
+func (q *sequencer) release() {
+	for len(q.pending) != 0 {
+		next := q.pending[0]
+		for start := range q.started {
+			if start < next.revision {
+				return
+			}
+		}
+		q.pending = q.pending[1:]
+		q.publish(next.updates)
+		close(next.done)
+	}
+}
@@ -0,0 +1,228 @@
+package watch
+
+import (
+	"errors"
+	"kv/pkg/watch"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultQueueSize is how many updates a watcher can fall behind by before its SlowConsumerPolicy applies.
+const DefaultQueueSize = 1024
+
+// SlowConsumerPolicy decides what happens when a watcher's queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// Disconnect closes the watcher's channel.  It's the default, since clients can resume from the last update they
+	// received without missing any.
+	Disconnect SlowConsumerPolicy = iota + 1
+
+	// DropOldest discards the oldest queued update to make room.
+	DropOldest
+
+	// Coalesce replaces the queued update for the same key with the new one, so the watcher only sees the latest value.
+	// The oldest update is discarded if none is queued for the key.
+	Coalesce
+)
+
+func PolicyFromString(name string) (SlowConsumerPolicy, error) {
+	switch name {
+	case "disconnect":
+		return Disconnect, nil
+	case "drop-oldest":
+		return DropOldest, nil
+	case "coalesce":
+		return Coalesce, nil
+	}
+	return 0, errors.New("unknown slow consumer policy: " + name)
+}
+
+// counters are the totals reported by Metrics.
+type counters struct {
+	dropped      atomic.Uint64
+	coalesced    atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// subscriber queues the updates for one watch, and sends them to its channel from its own goroutine, so a slow watcher
+// never blocks a write or the other watchers.
+type subscriber struct {
+	c        chan watch.Update
+	size     int
+	policy   SlowConsumerPolicy
+	counters *counters
+
+	lock  sync.Mutex
+	queue []watch.Update
+
+	// skip has the revisions of replayed updates, which mustn't be sent again when they're published.
+	skip map[int64]struct{}
+
+	ready   chan struct{}
+	done    chan struct{}
+	stopped bool
+
+	// err is why the watch was stopped, which is sent to the channel before it's closed.  It's nil when the watch was
+	// cancelled, as nothing is reading the channel any more.
+	err       error
+	cancelled chan struct{}
+}
+
+func newSubscriber(size int, policy SlowConsumerPolicy, counters *counters) *subscriber {
+	return &subscriber{
+		c:         make(chan watch.Update),
+		size:      size,
+		policy:    policy,
+		counters:  counters,
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+}
+
+// replay queues updates which were made before the watch started.  They're queued whatever the size of the queue, and
+// not queued again when they're published.
+func (sub *subscriber) replay(updates []watch.Update) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	sub.skip = make(map[int64]struct{})
+	for _, u := range updates {
+		sub.skip[u.Revision] = struct{}{}
+	}
+	sub.queue = append(sub.queue, updates...)
+	sub.signal()
+}
+
+// enqueue adds updates to the queue without blocking, applying the policy when it's full.
+func (sub *subscriber) enqueue(updates []watch.Update) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.stopped {
+		return
+	}
+
+	for _, u := range updates {
+		if _, ok := sub.skip[u.Revision]; ok {
+			continue
+		}
+		if len(sub.queue) >= sub.size && !sub.makeRoom(u) {
+			return
+		}
+		sub.queue = append(sub.queue, u)
+	}
+	sub.signal()
+}
+
+// makeRoom applies the policy to a full queue before u is added, and returns false if the watcher was disconnected.
+// The caller must hold the lock.
+func (sub *subscriber) makeRoom(u watch.Update) bool {
+	switch sub.policy {
+	case Coalesce:
+		for i := len(sub.queue) - 1; i >= 0; i-- {
+			if sub.queue[i].Key == u.Key {
+				sub.queue = append(sub.queue[:i], sub.queue[i+1:]...)
+				sub.counters.coalesced.Add(1)
+				return true
+			}
+		}
+		fallthrough
+	case DropOldest:
+		sub.queue = sub.queue[1:]
+		sub.counters.dropped.Add(1)
+		return true
+	}
+
+	sub.counters.disconnected.Add(1)
+	sub.stopLocked(watch.ErrSlowConsumer)
+	return false
+}
+
+// signal wakes the sending goroutine.  The caller must hold the lock.
+func (sub *subscriber) signal() {
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (sub *subscriber) pop() (watch.Update, bool) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if len(sub.queue) == 0 {
+		return watch.Update{}, false
+	}
+	u := sub.queue[0]
+	sub.queue = sub.queue[1:]
+	return u, true
+}
+
+func (sub *subscriber) depth() int {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return len(sub.queue)
+}
+
+// run sends queued updates to the channel until the subscriber is stopped, then says why and closes it.
+func (sub *subscriber) run() {
+	defer close(sub.c)
+	defer sub.finish()
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-sub.ready:
+		}
+
+		for u, ok := sub.pop(); ok; u, ok = sub.pop() {
+			select {
+			case sub.c <- u:
+			case <-sub.done:
+				return
+			}
+		}
+	}
+}
+
+// finish sends an update with the reason the subscriber was stopped, unless the watch was cancelled.
+func (sub *subscriber) finish() {
+	sub.lock.Lock()
+	err := sub.err
+	sub.lock.Unlock()
+	if err == nil {
+		return
+	}
+	select {
+	case sub.c <- watch.Update{Err: err}:
+	case <-sub.cancelled:
+	}
+}
+
+// stop discards the queue, and closes the channel once the sending goroutine notices.  The last update sent has err,
+// unless the watch is cancelled first.
+func (sub *subscriber) stop(err error) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	sub.stopLocked(err)
+}
+
+func (sub *subscriber) stopLocked(err error) {
+	if !sub.stopped {
+		sub.stopped = true
+		sub.err = err
+		sub.queue = nil
+		close(sub.done)
+	}
+}
+
+// cancel stops the subscriber for a watch which is no longer read.
+func (sub *subscriber) cancel() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	sub.stopLocked(nil)
+	select {
+	case <-sub.cancelled:
+	default:
+		close(sub.cancelled)
+	}
+}
@@ -0,0 +1,79 @@
+package watch
+
+import "kv/pkg/watch"
+
+// trie holds prefix subscriptions, so the watchers of every prefix of a key are found in one walk down the key.
+type trie struct {
+	children map[byte]*trie
+	watchers map[watch.Operation]set
+}
+
+func newTrie() *trie {
+	return &trie{children: make(map[byte]*trie)}
+}
+
+func (t *trie) add(prefix string, op watch.Operation, sub *subscriber) {
+	node := t
+	for i := 0; i < len(prefix); i++ {
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = newTrie()
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+
+	if node.watchers == nil {
+		node.watchers = make(map[watch.Operation]set)
+	}
+	if _, ok := node.watchers[op]; !ok {
+		node.watchers[op] = make(set)
+	}
+	node.watchers[op].put(sub)
+}
+
+// remove deletes a watcher, and prunes the nodes left without watchers or children.  It returns false if the watcher
+// wasn't found.
+func (t *trie) remove(prefix string, op watch.Operation, sub *subscriber) bool {
+	if len(prefix) == 0 {
+		watchers, ok := t.watchers[op]
+		if !ok {
+			return false
+		}
+		if _, ok := watchers[sub]; !ok {
+			return false
+		}
+		watchers.del(sub)
+		if watchers.empty() {
+			delete(t.watchers, op)
+		}
+		return true
+	}
+
+	child, ok := t.children[prefix[0]]
+	if !ok || !child.remove(prefix[1:], op, sub) {
+		return false
+	}
+	if len(child.watchers) == 0 && len(child.children) == 0 {
+		delete(t.children, prefix[0])
+	}
+	return true
+}
+
+// forEach calls f with every watcher of op whose prefix matches key.
+func (t *trie) forEach(key string, op watch.Operation, f func(sub *subscriber)) {
+	node := t
+	for i := 0; ; i++ {
+		if watchers, ok := node.watchers[op]; ok {
+			watchers.forEach(f)
+		}
+		if i == len(key) {
+			return
+		}
+		child, ok := node.children[key[i]]
+		if !ok {
+			return
+		}
+		node = child
+	}
+}
@@ -1,61 +1,144 @@
 package watch
 
 import (
+	"hash/fnv"
 	"kv/internal/store"
 	"kv/pkg/watch"
 	"log/slog"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
-type set map[chan watch.Update]struct{}
+// keyStripes is how many locks keep the updates to each key in order.
+const keyStripes = 64
 
-func (s set) put(c chan watch.Update) {
-	s[c] = struct{}{}
+type set map[*subscriber]struct{}
+
+func (s set) put(sub *subscriber) {
+	s[sub] = struct{}{}
 }
 
-func (s set) del(c chan watch.Update) {
-	delete(s, c)
+func (s set) del(sub *subscriber) {
+	delete(s, sub)
 }
 
 func (s set) empty() bool {
 	return len(s) == 0
 }
 
-func (s set) forEach(f func(c chan watch.Update)) {
+func (s set) forEach(f func(sub *subscriber)) {
 	for k, _ := range s {
 		f(k)
 	}
 }
 
-// KVStoreWatcher wraps a KVStore, and sends changes to channels associated with a specific key and operation.
+// KVStoreWatcher wraps a KVStore, and sends changes to channels associated with an operation and a key, a key prefix
+// or a key range.  Each watcher has a bounded queue, so a slow watcher never holds up writes or the other watchers, and
+// is sent updates in revision order.
 type KVStoreWatcher struct {
 	lock          sync.RWMutex
 	service       store.KVStore
 	subscriptions map[subscription]set
+	prefixes      *trie
+	ranges        rangeIndex
+	events        *eventLog
+	subscribers   map[*subscriber]struct{}
+
+	// keyLocks are held from a write until its updates are queued, so writes to the same key are queued in order.
+	keyLocks [keyStripes]sync.Mutex
+
+	// sequencer publishes the updates of writes to different keys in revision order.
+	sequencer *sequencer
+
+	queueSize int
+	policy    SlowConsumerPolicy
+	counters  counters
 }
 
+type matchType int
+
+const (
+	matchKey matchType = iota
+	matchPrefix
+	matchRange
+)
+
+// subscription is the keys and operation a watcher is sent updates for.  Key is the key, the prefix or the start of
+// the range, and End is the end of the range.
 type subscription struct {
-	Key string
-	Op  watch.Operation
+	Match matchType
+	Key   string
+	End   string
+	Op    watch.Operation
 }
 
-func New(service store.KVStore) store.KVStore {
-	return &KVStoreWatcher{
+// Option configures a KVStoreWatcher.
+type Option func(*KVStoreWatcher)
+
+// WithEventHistory keeps the n most recent updates for watches which start from a past revision, instead of
+// DefaultEventHistory.
+func WithEventHistory(n int) Option {
+	return func(s *KVStoreWatcher) {
+		s.events.size = n
+	}
+}
+
+// WithQueueSize lets each watcher fall behind by n updates, instead of DefaultQueueSize, before its
+// SlowConsumerPolicy applies.
+func WithQueueSize(n int) Option {
+	return func(s *KVStoreWatcher) {
+		s.queueSize = n
+	}
+}
+
+// WithSlowConsumerPolicy sets what happens to a watcher whose queue is full.  The default is Disconnect.
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(s *KVStoreWatcher) {
+		s.policy = policy
+	}
+}
+
+func New(service store.KVStore, opts ...Option) *KVStoreWatcher {
+	s := &KVStoreWatcher{
 		lock:          sync.RWMutex{},
 		service:       service,
 		subscriptions: make(map[subscription]set),
+		prefixes:      newTrie(),
+		events:        newEventLog(DefaultEventHistory, service.Revision()),
+		subscribers:   make(map[*subscriber]struct{}),
+		queueSize:     DefaultQueueSize,
+		policy:        Disconnect,
+	}
+	s.sequencer = newSequencer(s.publish)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Wrap returns kv if it can already watch its keys, otherwise it wraps kv in a KVStoreWatcher with opts.
+func Wrap(kv store.KVStore, opts ...Option) store.WatchableKVStore {
+	if watchable, ok := kv.(store.WatchableKVStore); ok {
+		return watchable
 	}
+	return New(kv, opts...)
 }
 
+// Put, like the other single key writes, is made through Txn, so the update carries the revision it was made at.
 func (s *KVStoreWatcher) Put(key string, value interface{}) error {
-	err := s.service.Put(key, value)
-	if err == nil {
-		update := watch.Update{
-			Key:   key,
-			Op:    watch.Put,
-			Value: value,
-		}
-		go s.updateWatchers(key, update)
+	_, err := s.Txn(store.Txn{Then: []store.Op{{Type: store.OpPut, Key: key, Value: value}}})
+	return err
+}
+
+func (s *KVStoreWatcher) PutIf(key string, value interface{}, cond store.Condition) error {
+	result, err := s.Txn(store.Txn{
+		Compares: []store.Compare{{Key: key, Condition: cond}},
+		Then:     []store.Op{{Type: store.OpPut, Key: key, Value: value}},
+	})
+	if err == nil && !result.Succeeded {
+		err = store.ErrPreconditionFailed
 	}
 	return err
 }
@@ -65,91 +148,305 @@ func (s *KVStoreWatcher) Get(key string) (interface{}, error) {
 }
 
 func (s *KVStoreWatcher) Delete(key string) error {
-	err := s.service.Delete(key)
-	if err == nil {
-		update := watch.Update{
-			Key: key,
-			Op:  watch.Delete,
-		}
-		go s.updateWatchers(key, update)
+	result, err := s.Txn(store.Txn{Then: []store.Op{{Type: store.OpDelete, Key: key}}})
+	if err == nil && !result.Results[0].Found {
+		err = store.KeyNotFound(key)
+	}
+	return err
+}
+
+func (s *KVStoreWatcher) DeleteIf(key string, cond store.Condition) error {
+	result, err := s.Txn(store.Txn{
+		Compares: []store.Compare{{Key: key, Condition: cond}},
+		Then:     []store.Op{{Type: store.OpDelete, Key: key}},
+	})
+	if err == nil && !result.Succeeded {
+		err = store.ErrPreconditionFailed
+	} else if err == nil && !result.Results[0].Found {
+		err = store.KeyNotFound(key)
 	}
 	return err
 }
 
-func (s *KVStoreWatcher) updateWatchers(key string, update watch.Update) {
+// Txn sends the updates made by a transaction together, in the order of its ops, once the whole transaction is applied.
+// Transactions' updates are sent in revision order, and Txn returns once its updates are queued.
+func (s *KVStoreWatcher) Txn(txn store.Txn) (store.TxnResult, error) {
+	unlock := s.lockKeys(txn.Keys())
+	defer unlock()
+	start := s.sequencer.begin(s.service.Revision)
+	result, err := s.service.Txn(txn)
+	if err != nil {
+		s.sequencer.end(start, 0, nil)
+		return result, err
+	}
+
+	ops := txn.Then
+	if !result.Succeeded {
+		ops = txn.Else
+	}
+
+	var updates []watch.Update
+	for i, op := range ops {
+		update := watch.Update{Key: op.Key, Revision: result.Revision}
+		switch {
+		case op.Type == store.OpPut:
+			update.Op, update.Value = watch.Put, op.Value
+		case op.Type == store.OpMerge:
+			update.Op, update.Value = watch.Put, result.Results[i].Entry.Value
+		case op.Type == store.OpDelete && result.Results[i].Found:
+			update.Op = watch.Delete
+		case op.Type == store.OpExpire && result.Results[i].Found:
+			update.Op = watch.Expire
+		default:
+			continue
+		}
+		updates = append(updates, update)
+	}
+
+	s.sequencer.end(start, result.Revision, updates)
+	return result, nil
+}
+
+// publish records the updates made by one write in the event log, then queues them for their watchers.  It doesn't
+// block on the watchers, so it's called while the write's keys are locked, and the sequencer's lock.
+func (s *KVStoreWatcher) publish(updates []watch.Update) {
+	s.events.append(updates)
+	s.updateWatchers(updates)
+}
+
+// lockKeys locks the stripes of keys, in order so concurrent writes can't deadlock, and returns a func which unlocks
+// them.
+func (s *KVStoreWatcher) lockKeys(keys []string) func() {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		stripes = append(stripes, int(h.Sum32()%keyStripes))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, i := range stripes {
+		s.keyLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			s.keyLocks[i].Unlock()
+		}
+	}
+}
+
+func (s *KVStoreWatcher) ForEach(f func(key string, entry store.Entry) bool) {
+	s.service.ForEach(f)
+}
+
+func (s *KVStoreWatcher) GetEntry(key string, revision int64) (store.Entry, error) {
+	return s.service.GetEntry(key, revision)
+}
+
+func (s *KVStoreWatcher) BatchGet(keys []string) ([]store.BatchResult, error) {
+	return store.BatchGet(s.service, keys, false)
+}
+
+func (s *KVStoreWatcher) Export(start, end string) ([]store.KeyValue, int64, error) {
+	return store.ExportRange(s.service, start, end)
+}
+
+func (s *KVStoreWatcher) Expired(now time.Time, limit int) []string {
+	return s.service.Expired(now, limit)
+}
+
+func (s *KVStoreWatcher) Revision() int64 {
+	return s.service.Revision()
+}
+
+func (s *KVStoreWatcher) Compact(revision int64) error {
+	return s.service.Compact(revision)
+}
+
+func (s *KVStoreWatcher) Restore(key string, entry store.Entry) error {
+	return s.service.Restore(key, entry)
+}
+
+func (s *KVStoreWatcher) Range(start, end string, limit int) ([]store.KeyValue, error) {
+	return s.service.Range(start, end, limit)
+}
+
+// updateWatchers queues the updates made by one write for their watchers.  Each watcher is sent its updates together,
+// and the last one is marked, so it can tell when it has them all.
+func (s *KVStoreWatcher) updateWatchers(updates []watch.Update) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	sub := subscription{
-		Key: key,
-		Op:  update.Op,
+	var watchers []*subscriber
+	pending := make(map[*subscriber][]watch.Update)
+	for _, update := range updates {
+		s.forEachWatcher(update, func(sub *subscriber) {
+			if _, ok := pending[sub]; !ok {
+				watchers = append(watchers, sub)
+			}
+			pending[sub] = append(pending[sub], update)
+		})
 	}
 
-	updateFunc := func(c chan watch.Update) {
-		c <- update
+	for _, sub := range watchers {
+		batch := pending[sub]
+		batch[len(batch)-1].Last = true
+		sub.enqueue(batch)
 	}
+}
 
-	if watchers, ok := s.subscriptions[sub]; ok {
-		watchers.forEach(updateFunc)
+// forEachWatcher calls f with each watcher of the update's key and operation.  The caller must hold the lock.
+func (s *KVStoreWatcher) forEachWatcher(update watch.Update, f func(sub *subscriber)) {
+	for _, op := range []watch.Operation{update.Op, watch.All} {
+		if watchers, ok := s.subscriptions[subscription{Key: update.Key, Op: op}]; ok {
+			watchers.forEach(f)
+		}
+		s.prefixes.forEach(update.Key, op, f)
+		s.ranges.forEach(update.Key, op, f)
 	}
 }
 
-func (s *KVStoreWatcher) removeWatcher(sub subscription, c chan watch.Update) {
+func (s *KVStoreWatcher) removeWatcher(sub subscription, subscriber *subscriber) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	slog.Info("removing watch", "sub", sub)
-	if watchers, ok := s.subscriptions[sub]; ok {
-		watchers.del(c)
-		close(c)
-		if watchers.empty() {
-			delete(s.subscriptions, sub)
+
+	switch sub.Match {
+	case matchKey:
+		if watchers, ok := s.subscriptions[sub]; ok {
+			watchers.del(subscriber)
+			if watchers.empty() {
+				delete(s.subscriptions, sub)
+			}
 		}
+	case matchPrefix:
+		s.prefixes.remove(sub.Key, sub.Op, subscriber)
+	case matchRange:
+		s.ranges.remove(subscriber)
 	}
+	delete(s.subscribers, subscriber)
+	subscriber.cancel()
 }
 
 func (s *KVStoreWatcher) AddWatch(key string, op watch.Operation) (chan watch.Update, func()) {
+	c, cancel, _ := s.Watch(watch.WatchRequest{Key: key, WatchType: op})
+	return c, cancel
+}
+
+// Watch adds the watch described by req.  When it starts from a past revision, the updates made since then are sent
+// before live ones, or store.ErrCompacted is returned if they're no longer kept.  The channel is closed when the watch is
+// cancelled.  It's also closed after an update whose Err is watch.ErrSlowConsumer when the watch falls too far behind
+// under the Disconnect policy, or watch.ErrClosed when the store is closed.
+func (s *KVStoreWatcher) Watch(req watch.WatchRequest) (chan watch.Update, func(), error) {
+	err := req.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sub := subscription{Match: matchKey, Key: req.Key, Op: req.WatchType}
+	if req.Prefix {
+		sub.Match = matchPrefix
+	} else if len(req.End) != 0 {
+		sub.Match, sub.End = matchRange, req.End
+	}
+
+	// updates are queued after they're logged, so holding the lock while reading the log and subscribing means an
+	// update is either replayed, queued live, or both, and the subscriber skips the live copy of a replayed update
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	var replayed []watch.Update
+	if req.Revision > 0 {
+		replayed, err = s.events.since(req.Revision, sub)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-	if op != watch.All {
-		return s.watchImpl(key, op)
-	}
-
-	// make two subscriptions, and combine the channels and cancel func
-	updateChan := make(chan watch.Update)
-	done := make(chan struct{})
-	putChan, putCancel := s.watchImpl(key, watch.Put)
-	delChan, delCancel := s.watchImpl(key, watch.Delete)
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			case u := <-putChan:
-				updateChan <- u
-			case u := <-delChan:
-				updateChan <- u
-			}
+	subscriber := s.subscribe(sub)
+	if req.Revision > 0 {
+		subscriber.replay(replayed)
+	}
+	go subscriber.run()
+
+	once := sync.Once{}
+	return subscriber.c, func() { once.Do(func() { s.removeWatcher(sub, subscriber) }) }, nil
+}
+
+// Close ends every watch with watch.ErrClosed, closing their channels.  It's for when the store's contents are replaced all at once, like
+// from a snapshot, which watchers can't follow.  Watches can still be added afterwards.
+func (s *KVStoreWatcher) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for sub := range s.subscribers {
+		sub.stop(watch.ErrClosed)
+	}
+	s.subscriptions = make(map[subscription]set)
+	s.prefixes = newTrie()
+	s.ranges = rangeIndex{}
+	s.subscribers = make(map[*subscriber]struct{})
+}
+
+// subscribe adds a watcher for sub.  The caller must hold the lock.
+func (s *KVStoreWatcher) subscribe(sub subscription) *subscriber {
+	subscriber := newSubscriber(s.queueSize, s.policy, &s.counters)
+	switch sub.Match {
+	case matchKey:
+		if _, ok := s.subscriptions[sub]; !ok {
+			s.subscriptions[sub] = make(set)
 		}
-	}()
+		s.subscriptions[sub].put(subscriber)
+	case matchPrefix:
+		s.prefixes.add(sub.Key, sub.Op, subscriber)
+	case matchRange:
+		s.ranges.add(sub.Key, sub.End, sub.Op, subscriber)
+	}
+	s.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
 
-	cancelFunc := func() {
-		close(done)
-		putCancel()
-		delCancel()
+// matches reports whether the update is for one of the subscription's keys and operations.
+func (s subscription) matches(u watch.Update) bool {
+	if s.Op != watch.All && s.Op != u.Op {
+		return false
+	}
+	switch s.Match {
+	case matchPrefix:
+		return strings.HasPrefix(u.Key, s.Key)
+	case matchRange:
+		return s.Key <= u.Key && (len(s.End) == 0 || u.Key < s.End)
 	}
-	return updateChan, cancelFunc
+	return u.Key == s.Key
 }
 
-func (s *KVStoreWatcher) watchImpl(key string, op watch.Operation) (chan watch.Update, func()) {
-	sub := subscription{
-		Key: key,
-		Op:  op,
+// Metrics describes the watchers' queues.
+type Metrics struct {
+	Watchers int `json:"watchers"`
+
+	// QueueDepth is how many updates are queued across every watcher, and MaxQueueDepth is how many are queued for the
+	// watcher furthest behind.
+	QueueDepth    int `json:"queueDepth"`
+	MaxQueueDepth int `json:"maxQueueDepth"`
+
+	// Dropped, Coalesced and Disconnected count what the slow consumer policy has discarded since the store started.
+	Dropped      uint64 `json:"dropped"`
+	Coalesced    uint64 `json:"coalesced"`
+	Disconnected uint64 `json:"disconnected"`
+}
+
+func (s *KVStoreWatcher) Metrics() Metrics {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	m := Metrics{
+		Watchers:     len(s.subscribers),
+		Dropped:      s.counters.dropped.Load(),
+		Coalesced:    s.counters.coalesced.Load(),
+		Disconnected: s.counters.disconnected.Load(),
 	}
-	updateChan := make(chan watch.Update)
-	if _, ok := s.subscriptions[sub]; !ok {
-		s.subscriptions[sub] = make(set)
+	for sub := range s.subscribers {
+		depth := sub.depth()
+		m.QueueDepth += depth
+		m.MaxQueueDepth = max(m.MaxQueueDepth, depth)
 	}
-	s.subscriptions[sub].put(updateChan)
-	return updateChan, func() { s.removeWatcher(sub, updateChan) }
+	return m
 }
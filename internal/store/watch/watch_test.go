@@ -1,13 +1,16 @@
 package watch
 
 import (
+	"errors"
 	"kv/internal/store"
 	"kv/internal/store/singlelock"
 	"kv/pkg/watch"
+	"slices"
 	"testing"
+	"time"
 )
 
-func makeKVStore() store.KVStore {
+func makeKVStore() store.WatchableKVStore {
 	return New(singlelock.New())
 }
 
@@ -119,3 +122,467 @@ func TestKVStoreWatcher_All(t *testing.T) {
 		t.Errorf("expected value [nil] got [%s]", actual.Value)
 	}
 }
+
+func TestKVStoreWatcher_Txn(t *testing.T) {
+	kv := makeKVStore()
+	kv.Put("bar", "old")
+	putChan, cancelPut := kv.AddWatch("foo", watch.Put)
+	defer cancelPut()
+	delChan, cancelDel := kv.AddWatch("bar", watch.Delete)
+	defer cancelDel()
+
+	_, err := kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "foo", Value: "new"},
+		{Type: store.OpDelete, Key: "bar"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// updates are sent in the order of the ops
+	if u := <-putChan; u.Key != "foo" || u.Value != "new" {
+		t.Errorf("unexpected update %+v", u)
+	}
+	if u := <-delChan; u.Key != "bar" || u.Op != watch.Delete {
+		t.Errorf("unexpected update %+v", u)
+	}
+}
+
+func TestKVStoreWatcher_Expire(t *testing.T) {
+	kv := makeKVStore()
+	updateChan, cancel := kv.AddWatch("foo", watch.All)
+	defer cancel()
+
+	err := store.PutWithTTL(kv, "foo", "bar", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := <-updateChan; u.Op != watch.Put {
+		t.Errorf("expected a put, got %+v", u)
+	}
+
+	if n, err := store.Reap(kv, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected to reap one key, got [%d] %v", n, err)
+	}
+	if u := <-updateChan; u.Op != watch.Expire || u.Key != "foo" {
+		t.Errorf("expected an expiry, got %+v", u)
+	}
+}
+
+func TestKVStoreWatcher_Prefix(t *testing.T) {
+	kv := makeKVStore()
+	configChan, cancelConfig, _ := kv.Watch(watch.WatchRequest{Key: "config/", WatchType: watch.Put, Prefix: true})
+	defer cancelConfig()
+	allChan, cancelAll, _ := kv.Watch(watch.WatchRequest{WatchType: watch.All, Prefix: true})
+	defer cancelAll()
+
+	// each update is sent to both watchers before the next, so they're read together
+	configKeys := collectKeys(configChan, 2)
+	allKeys := collectKeys(allChan, 4)
+
+	_, err := kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "config", Value: 0},
+		{Type: store.OpPut, Key: "config/a", Value: 1},
+		{Type: store.OpPut, Key: "other", Value: 2},
+		{Type: store.OpPut, Key: "config/b/c", Value: 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := <-configKeys; !slices.Equal(keys, []string{"config/a", "config/b/c"}) {
+		t.Errorf("unexpected updates to %v", keys)
+	}
+	if keys := <-allKeys; !slices.Equal(keys, []string{"config", "config/a", "other", "config/b/c"}) {
+		t.Errorf("unexpected updates to %v", keys)
+	}
+}
+
+// collectKeys reads the keys of n updates.
+func collectKeys(c chan watch.Update, n int) chan []string {
+	keys := make(chan []string, 1)
+	go func() {
+		var k []string
+		for i := 0; i < n; i++ {
+			k = append(k, (<-c).Key)
+		}
+		keys <- k
+	}()
+	return keys
+}
+
+func TestKVStoreWatcher_Range(t *testing.T) {
+	kv := makeKVStore()
+	bcChan, cancelBC, _ := kv.Watch(watch.WatchRequest{Key: "b", End: "d", WatchType: watch.Put})
+	defer cancelBC()
+	cChan, cancelC, _ := kv.Watch(watch.WatchRequest{Key: "c", End: "zz", WatchType: watch.Put})
+	bcKeys := collectKeys(bcChan, 2)
+	cKeys := collectKeys(cChan, 3)
+
+	_, err := kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "a", Value: 1},
+		{Type: store.OpPut, Key: "b", Value: 2},
+		{Type: store.OpPut, Key: "cat", Value: 3},
+		{Type: store.OpPut, Key: "d", Value: 4},
+		{Type: store.OpPut, Key: "zebra", Value: 5},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := <-bcKeys; !slices.Equal(keys, []string{"b", "cat"}) {
+		t.Errorf("unexpected updates to %v", keys)
+	}
+	if keys := <-cKeys; !slices.Equal(keys, []string{"cat", "d", "zebra"}) {
+		t.Errorf("unexpected updates to %v", keys)
+	}
+
+	// cancelling one range leaves the other in place
+	cancelC()
+	if _, ok := <-cChan; ok {
+		t.Error("cancelled watch is still open")
+	}
+	kv.Put("c", 6)
+	if u := <-bcChan; u.Key != "c" {
+		t.Errorf("expected an update to [c], got %+v", u)
+	}
+}
+
+func TestTrie(t *testing.T) {
+	root := newTrie()
+	a, ab := &subscriber{}, &subscriber{}
+	root.add("a", watch.Put, a)
+	root.add("ab", watch.Put, ab)
+
+	count := func(key string) int {
+		n := 0
+		root.forEach(key, watch.Put, func(*subscriber) { n++ })
+		return n
+	}
+	if n := count("abc"); n != 2 {
+		t.Errorf("expected [abc] to match two prefixes, got [%d]", n)
+	}
+	if n := count("b"); n != 0 {
+		t.Errorf("expected [b] to match no prefixes, got [%d]", n)
+	}
+
+	if !root.remove("ab", watch.Put, ab) || root.remove("ab", watch.Put, ab) {
+		t.Error("expected to remove [ab] once")
+	}
+	if _, ok := root.children['a'].children['b']; ok {
+		t.Error("empty node wasn't pruned")
+	}
+	if n := count("abc"); n != 1 {
+		t.Errorf("expected [abc] to match one prefix, got [%d]", n)
+	}
+}
+
+func TestKVStoreWatcher_Resume(t *testing.T) {
+	kv := New(singlelock.New(), WithEventHistory(3))
+	kv.Put("foo", 1)
+	kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "foo", Value: 2},
+		{Type: store.OpPut, Key: "bar", Value: 2},
+	}})
+	kv.Delete("foo")
+
+	updateChan, cancel, err := kv.Watch(watch.WatchRequest{Key: "foo", WatchType: watch.All, Revision: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replayed updates come first, then live ones
+	kv.Put("foo", 4)
+	expected := []watch.Update{
+		{Op: watch.Put, Key: "foo", Value: 2, Revision: 2, Last: true},
+		{Op: watch.Delete, Key: "foo", Revision: 3, Last: true},
+		{Op: watch.Put, Key: "foo", Value: 4, Revision: 4, Last: true},
+	}
+	for _, e := range expected {
+		if u := <-updateChan; u != e {
+			t.Errorf("expected %+v, got %+v", e, u)
+		}
+	}
+	cancel()
+
+	// the log is trimmed to three updates once it holds six, which drops revisions 1 and 2
+	kv.Put("foo", 5)
+	if _, _, err := kv.Watch(watch.WatchRequest{Key: "foo", WatchType: watch.Put, Revision: 2}); !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("expected %v, got %v", store.ErrCompacted, err)
+	}
+	if _, cancel, err := kv.Watch(watch.WatchRequest{Key: "foo", WatchType: watch.Put, Revision: 3}); err != nil {
+		t.Error(err)
+	} else {
+		cancel()
+	}
+}
+
+func TestEventLogStartsAtRevision(t *testing.T) {
+	inner := singlelock.New()
+	inner.Put("foo", 1)
+	kv := New(inner)
+
+	// updates made before the watcher wrapped the store were never logged
+	if _, _, err := kv.Watch(watch.WatchRequest{Key: "foo", WatchType: watch.Put, Revision: 1}); !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("expected %v, got %v", store.ErrCompacted, err)
+	}
+}
+
+func TestEventLogEvictsOutOfOrder(t *testing.T) {
+	l := newEventLog(2, 0)
+	for _, revision := range []int64{3, 1, 2, 4} {
+		l.append([]watch.Update{{Op: watch.Put, Key: "foo", Revision: revision, Last: true}})
+	}
+
+	// revisions 3 and 1 are evicted, so a watch from revision 2 would miss revision 3
+	sub := subscription{Key: "foo", Op: watch.All}
+	if _, err := l.since(2, sub); !errors.Is(err, store.ErrCompacted) {
+		t.Errorf("expected %v, got %v", store.ErrCompacted, err)
+	}
+	if updates, err := l.since(4, sub); err != nil || len(updates) != 1 {
+		t.Errorf("expected revision [4], got %+v, %v", updates, err)
+	}
+}
+
+func TestKVStoreWatcher_Last(t *testing.T) {
+	kv := makeKVStore()
+	live, cancel, _ := kv.Watch(watch.WatchRequest{Key: "a/", WatchType: watch.All, Prefix: true})
+	defer cancel()
+	updates := make(chan []watch.Update, 1)
+	go func() {
+		updates <- []watch.Update{<-live, <-live}
+	}()
+
+	kv.Txn(store.Txn{Then: []store.Op{
+		{Type: store.OpPut, Key: "a/1", Value: 1},
+		{Type: store.OpPut, Key: "b", Value: 1},
+		{Type: store.OpPut, Key: "a/2", Value: 1},
+	}})
+
+	replayed, cancelReplay, _ := kv.Watch(watch.WatchRequest{Key: "a/", WatchType: watch.All, Prefix: true, Revision: 1})
+	defer cancelReplay()
+
+	// only the last update the watch is sent for the write is marked, whether it's live or replayed
+	for _, batch := range [][]watch.Update{<-updates, {<-replayed, <-replayed}} {
+		if batch[0].Key != "a/1" || batch[0].Last || batch[1].Key != "a/2" || !batch[1].Last {
+			t.Errorf("unexpected updates %+v", batch)
+		}
+	}
+}
+
+// waitForDepth waits until the watchers have n updates queued.
+func waitForDepth(t *testing.T, kv *KVStoreWatcher, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); kv.Metrics().QueueDepth != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a queue depth of [%d], got %+v", n, kv.Metrics())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receive reads n updates, or fails if they don't arrive.
+func receive(t *testing.T, c chan watch.Update, n int) []watch.Update {
+	t.Helper()
+	var updates []watch.Update
+	for len(updates) < n {
+		select {
+		case u := <-c:
+			updates = append(updates, u)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d updates, got %+v", n, updates)
+		}
+	}
+	return updates
+}
+
+func TestKVStoreWatcher_DropOldest(t *testing.T) {
+	kv := New(singlelock.New(), WithQueueSize(2), WithSlowConsumerPolicy(DropOldest))
+	updateChan, cancel := kv.AddWatch("foo", watch.Put)
+	defer cancel()
+
+	// the first update is waiting to be sent, and the rest are queued
+	kv.Put("foo", 1)
+	waitForDepth(t, kv, 0)
+	for i := 2; i <= 5; i++ {
+		kv.Put("foo", i)
+	}
+	if m := kv.Metrics(); m.QueueDepth != 2 || m.MaxQueueDepth != 2 || m.Dropped != 2 || m.Watchers != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+
+	var values []interface{}
+	for _, u := range receive(t, updateChan, 3) {
+		values = append(values, u.Value)
+	}
+	if !slices.Equal(values, []interface{}{1, 4, 5}) {
+		t.Errorf("expected the oldest updates to be dropped, got %v", values)
+	}
+}
+
+func TestKVStoreWatcher_Coalesce(t *testing.T) {
+	kv := New(singlelock.New(), WithQueueSize(2), WithSlowConsumerPolicy(Coalesce))
+	updateChan, cancel, _ := kv.Watch(watch.WatchRequest{WatchType: watch.Put, Prefix: true})
+	defer cancel()
+
+	kv.Put("a", 1)
+	waitForDepth(t, kv, 0)
+	kv.Put("a", 2)
+	kv.Put("b", 2)
+	kv.Put("a", 3)
+
+	var keys []string
+	var values []interface{}
+	for _, u := range receive(t, updateChan, 3) {
+		keys = append(keys, u.Key)
+		values = append(values, u.Value)
+	}
+	if !slices.Equal(keys, []string{"a", "b", "a"}) || !slices.Equal(values, []interface{}{1, 2, 3}) {
+		t.Errorf("expected the queued update to [a] to be replaced, got %v %v", keys, values)
+	}
+	if m := kv.Metrics(); m.Coalesced != 1 || m.Dropped != 0 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
+
+func TestKVStoreWatcher_Disconnect(t *testing.T) {
+	kv := New(singlelock.New(), WithQueueSize(1))
+	updateChan, cancel := kv.AddWatch("foo", watch.Put)
+	defer cancel()
+	other, cancelOther := kv.AddWatch("bar", watch.Put)
+	defer cancelOther()
+
+	// writes don't wait for the slow watcher
+	kv.Put("foo", 1)
+	waitForDepth(t, kv, 0)
+	kv.Put("foo", 2)
+	kv.Put("foo", 3)
+
+	closed := time.After(time.Second)
+	var last watch.Update
+	for open := true; open; {
+		select {
+		case u, ok := <-updateChan:
+			if open = ok; ok {
+				last = u
+			}
+		case <-closed:
+			t.Fatal("slow watcher wasn't disconnected")
+		}
+	}
+	if !errors.Is(last.Err, watch.ErrSlowConsumer) {
+		t.Errorf("expected the last update to say the watcher was too slow, got %+v", last)
+	}
+	if m := kv.Metrics(); m.Disconnected != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+
+	// the other watchers carry on
+	kv.Put("bar", 1)
+	if u := receive(t, other, 1)[0]; u.Key != "bar" {
+		t.Errorf("expected an update to [bar], got %+v", u)
+	}
+}
+
+func TestKVStoreWatcher_Close(t *testing.T) {
+	kv := New(singlelock.New())
+	updateChan, cancel := kv.AddWatch("foo", watch.Put)
+	defer cancel()
+
+	kv.Close()
+	if u := receive(t, updateChan, 1)[0]; !errors.Is(u.Err, watch.ErrClosed) {
+		t.Errorf("expected the watch to be closed, got %+v", u)
+	}
+	if _, ok := <-updateChan; ok {
+		t.Error("closed watch is still open")
+	}
+
+	// a cancelled watch isn't told why, as nothing is reading it
+	updateChan, cancel = kv.AddWatch("foo", watch.Put)
+	cancel()
+	if u, ok := <-updateChan; ok {
+		t.Errorf("expected the cancelled watch to be closed, got %+v", u)
+	}
+}
+
+func TestKVStoreWatcher_KeyOrder(t *testing.T) {
+	kv := New(singlelock.New())
+	updateChan, cancel, _ := kv.Watch(watch.WatchRequest{WatchType: watch.Put, Prefix: true})
+	defer cancel()
+
+	const writers, writes = 4, 100
+	for w := 0; w < writers; w++ {
+		go func() {
+			for i := 0; i < writes; i++ {
+				kv.Put(string(rune('a'+i%2)), i)
+			}
+		}()
+	}
+
+	// concurrent writes, to the same key or not, are sent in revision order
+	var last int64
+	for _, u := range receive(t, updateChan, writers*writes) {
+		if u.Revision <= last {
+			t.Fatalf("update to [%s] at revision [%d] was sent after revision [%d]", u.Key, u.Revision, last)
+		}
+		last = u.Revision
+	}
+}
+
+func TestWrap(t *testing.T) {
+	kv := Wrap(singlelock.New())
+	if _, ok := kv.(*KVStoreWatcher); !ok {
+		t.Fatalf("expected a store which can't watch to be wrapped, got %T", kv)
+	}
+	if Wrap(kv) != kv {
+		t.Error("expected a store which can watch to be returned as it is")
+	}
+}
+
+// stallingStore holds up transactions on key after they're applied, until release is closed, as if the write were
+// slow to return.
+type stallingStore struct {
+	store.KVStore
+	key     string
+	applied chan struct{}
+	release chan struct{}
+}
+
+func (s *stallingStore) Txn(txn store.Txn) (store.TxnResult, error) {
+	result, err := s.KVStore.Txn(txn)
+	if slices.Contains(txn.Keys(), s.key) {
+		close(s.applied)
+		<-s.release
+	}
+	return result, err
+}
+
+func TestKVStoreWatcher_RevisionOrder(t *testing.T) {
+	backend := &stallingStore{KVStore: singlelock.New(), key: "a"}
+	backend.applied, backend.release = make(chan struct{}), make(chan struct{})
+	kv := New(backend)
+	updateChan, cancel, _ := kv.Watch(watch.WatchRequest{WatchType: watch.Put, Prefix: true})
+	defer cancel()
+
+	// [a] is written at revision 1, but [b] at revision 2 finishes first
+	go kv.Put("a", 1)
+	<-backend.applied
+	written := make(chan struct{})
+	go func() {
+		kv.Put("b", 2)
+		close(written)
+	}()
+	select {
+	case u := <-updateChan:
+		t.Fatalf("expected nothing to be sent before revision [1], got %+v", u)
+	case <-written:
+		t.Fatal("expected the write at revision [2] to wait for revision [1]")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	updates := receive(t, updateChan, 2)
+	if updates[0].Key != "a" || updates[0].Revision != 1 || updates[1].Key != "b" || updates[1].Revision != 2 {
+		t.Errorf("expected [a] at revision [1] then [b] at revision [2], got %+v", updates)
+	}
+}
@@ -1,27 +1,54 @@
 package anyval
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"golang.org/x/exp/constraints"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	"kv/internal/gen"
+	"kv/pkg/crdt"
+	"math"
 	"reflect"
+	"slices"
+	"strings"
 )
 
 // ConvertableType defines all the types the key value store will work with.
 type ConvertableType interface {
 	constraints.Ordered | []string | string |
 		~[]int | ~[]int64 | ~[]int32 | ~[]int16 | ~[]int8 |
-		~[]float32 | ~[]float64
+		~[]float32 | ~[]float64 |
+		map[string]interface{} | []interface{}
 }
 
+// maxExact is the largest integer a document's numbers, which are float64s as in JSON, hold exactly.
+const maxExact = 1 << 53
+
 // Marshal convert interface{} values to an anypb.Any value.
+//
+// Besides scalars, the slices above and CRDTs, it converts documents: maps with string keys, slices of other types
+// and json.RawMessage, which are encoded as a structpb.Struct, ListValue or Value.  They're unmarshalled in the
+// canonical form encoding/json decodes JSON to, so a value reads the same over gRPC and REST: a map[string]interface{},
+// []interface{}, float64, string, bool or nil.  Bytes in a document become base64 strings, and an integer which a
+// float64 can't hold exactly is an error.
 func Marshal(val interface{}) (*anypb.Any, error) {
 	var m proto.Message
 
 	switch v := val.(type) {
+	case nil:
+		m = structpb.NewNullValue()
+	case json.RawMessage:
+		doc, err := decodeJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		return Marshal(doc)
 	case string:
 		m = wrapperspb.String(v)
 	case float32:
@@ -62,11 +89,180 @@ func Marshal(val interface{}) (*anypb.Any, error) {
 		m = &gen.Float32SliceWrapper{Value: v}
 	case []float64:
 		m = &gen.Float64SliceWrapper{Value: v}
+	case crdt.Counter:
+		m = &gen.PNCounter{Increments: counterEntries(v.Increments), Decrements: counterEntries(v.Decrements)}
+	case crdt.Set:
+		m = &gen.ORSet{Elements: setElements(v.Tags), Removed: setElements(v.Removed)}
+	case crdt.Register:
+		value, err := Marshal(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		m = &gen.LWWRegister{Value: value, Timestamp: timestamppb.New(v.Timestamp), Node: v.Node}
+	case crdt.Increment:
+		m = &gen.CounterIncrement{Node: v.Node, Delta: v.Delta}
+	case crdt.SetAdd:
+		m = &gen.ORSetAdd{Tag: v.Tag, Elements: v.Elements}
+	case crdt.SetRemove:
+		m = &gen.ORSetRemove{Elements: v.Elements}
 	default:
-		return nil, errors.New("unrecognized type: " + reflect.TypeOf(val).Name())
+		if isStruct(reflect.ValueOf(val)) {
+			doc, err := viaJSON(val)
+			if err != nil {
+				return nil, err
+			}
+			return Marshal(doc)
+		}
+		var err error
+		m, err = document(reflect.ValueOf(val))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// deterministic, so the same value always has the same bytes, as anti-entropy compares their hashes
+	a := &anypb.Any{}
+	err := anypb.MarshalFrom(a, m, proto.MarshalOptions{Deterministic: true})
+	return a, err
+}
+
+// Canonical returns val in the form the store compares values in, and keeps values written over REST in, so a value
+// equals the same value written over either transport.  Numbers which are whole, and small enough for a float64 to
+// hold exactly, are int64s, and other numbers are float64s, or a uint64 too large for an int64.  Maps with string keys
+// are map[string]interface{}, other slices []interface{}, structs are converted by way of their JSON encoding, and the
+// values inside them are canonical too.  Strings, bytes, bools, nil and CRDTs are left as they are.
+func Canonical(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil, string, bool, []byte:
+		return v
+	case json.RawMessage:
+		if doc, err := decodeJSON(v); err == nil {
+			return Canonical(doc)
+		}
+		return v
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			return rv.Uint()
+		}
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); f == math.Trunc(f) && math.Abs(f) <= maxExact {
+			return int64(f)
+		}
+		return rv.Float()
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return val
+		}
+		m := make(map[string]interface{}, rv.Len())
+		for iter := rv.MapRange(); iter.Next(); {
+			m[iter.Key().String()] = Canonical(iter.Value().Interface())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = Canonical(rv.Index(i).Interface())
+		}
+		return list
+	}
+	if isStruct(rv) && !isCRDT(val) {
+		if doc, err := viaJSON(val); err == nil {
+			return Canonical(doc)
+		}
 	}
+	return val
+}
 
-	return anypb.New(m)
+func isCRDT(val interface{}) bool {
+	switch val.(type) {
+	case crdt.Counter, crdt.Set, crdt.Register, crdt.Increment, crdt.SetAdd, crdt.SetRemove:
+		return true
+	}
+	return false
+}
+
+// document converts a map with string keys to a structpb.Struct, and a slice to a structpb.ListValue.
+func document(v reflect.Value) (proto.Message, error) {
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		fields := make(map[string]*structpb.Value, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			field, err := documentValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			fields[iter.Key().String()] = field
+		}
+		return &structpb.Struct{Fields: fields}, nil
+	case v.Kind() == reflect.Slice, v.Kind() == reflect.Array:
+		values := make([]*structpb.Value, v.Len())
+		for i := range values {
+			var err error
+			if values[i], err = documentValue(v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return &structpb.ListValue{Values: values}, nil
+	case !v.IsValid():
+		return nil, errors.New("unrecognized type: nil")
+	}
+	return nil, errors.New("unrecognized type: " + v.Type().String())
+}
+
+// documentValue converts a value in a document to a structpb.Value.
+func documentValue(v reflect.Value) (*structpb.Value, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return structpb.NewNullValue(), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return structpb.NewStringValue(v.String()), nil
+	case reflect.Bool:
+		return structpb.NewBoolValue(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n > maxExact || n < -maxExact {
+			return nil, fmt.Errorf("%d is too large for a document's number", n)
+		}
+		return structpb.NewNumberValue(float64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > maxExact {
+			return nil, fmt.Errorf("%d is too large for a document's number", v.Uint())
+		}
+		return structpb.NewNumberValue(float64(v.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return structpb.NewNumberValue(v.Float()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return structpb.NewStringValue(base64.StdEncoding.EncodeToString(v.Bytes())), nil
+		}
+	}
+	if isStruct(v) {
+		doc, err := viaJSON(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return documentValue(reflect.ValueOf(doc))
+	}
+
+	m, err := document(v)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := m.(*structpb.Struct); ok {
+		return structpb.NewStructValue(s), nil
+	}
+	return structpb.NewListValue(m.(*structpb.ListValue)), nil
 }
 
 // UnmarshalType converts anypb.Any values to the value requested by the caller.
@@ -168,12 +364,97 @@ func unmarshal(anyVal *anypb.Any) (interface{}, error) {
 	case *gen.Float64SliceWrapper:
 		err = anyVal.UnmarshalTo(m)
 		v = m.GetValue()
+	case *structpb.Struct:
+		v = m.AsMap()
+	case *structpb.ListValue:
+		v = m.AsSlice()
+	case *structpb.Value:
+		v = m.AsInterface()
+	case *gen.PNCounter:
+		v = crdt.Counter{Increments: counterMap(m.GetIncrements()), Decrements: counterMap(m.GetDecrements())}
+	case *gen.ORSet:
+		v = crdt.Set{Tags: setTags(m.GetElements()), Removed: setTags(m.GetRemoved())}
+	case *gen.LWWRegister:
+		var value interface{}
+		value, err = unmarshal(m.GetValue())
+		v = crdt.Register{Value: value, Timestamp: m.GetTimestamp().AsTime(), Node: m.GetNode()}
+	case *gen.CounterIncrement:
+		v = crdt.Increment{Node: m.GetNode(), Delta: m.GetDelta()}
+	case *gen.ORSetAdd:
+		v = crdt.SetAdd{Tag: m.GetTag(), Elements: m.GetElements()}
+	case *gen.ORSetRemove:
+		v = crdt.SetRemove{Elements: m.GetElements()}
 	default:
 		err = errors.New("unrecognized type: " + anyVal.TypeUrl)
 	}
 	return v, err
 }
 
+// counterEntries returns a counter's counts in the order of their nodes.
+func counterEntries(counts map[string]uint64) []*gen.CounterEntry {
+	entries := make([]*gen.CounterEntry, 0, len(counts))
+	for node, count := range counts {
+		entries = append(entries, &gen.CounterEntry{Node: node, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b *gen.CounterEntry) int { return strings.Compare(a.Node, b.Node) })
+	return entries
+}
+
+func counterMap(entries []*gen.CounterEntry) map[string]uint64 {
+	if len(entries) == 0 {
+		return nil
+	}
+	counts := make(map[string]uint64, len(entries))
+	for _, e := range entries {
+		counts[e.GetNode()] = e.GetCount()
+	}
+	return counts
+}
+
+// setElements returns the tags of a set's elements in the order of the elements.
+func setElements(tags map[string][]string) []*gen.ORSetElement {
+	elements := make([]*gen.ORSetElement, 0, len(tags))
+	for element, elementTags := range tags {
+		elements = append(elements, &gen.ORSetElement{Element: element, Tags: elementTags})
+	}
+	slices.SortFunc(elements, func(a, b *gen.ORSetElement) int { return strings.Compare(a.Element, b.Element) })
+	return elements
+}
+
+func setTags(elements []*gen.ORSetElement) map[string][]string {
+	if len(elements) == 0 {
+		return nil
+	}
+	tags := make(map[string][]string, len(elements))
+	for _, e := range elements {
+		tags[e.GetElement()] = e.GetTags()
+	}
+	return tags
+}
+
+// isStruct reports whether v is a struct, or a pointer to one, which is converted by way of its JSON encoding, the same
+// as the REST client sends it.
+func isStruct(v reflect.Value) bool {
+	if v.Kind() == reflect.Pointer {
+		return v.Type().Elem().Kind() == reflect.Struct
+	}
+	return v.Kind() == reflect.Struct
+}
+
+func viaJSON(val interface{}) (interface{}, error) {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(b)
+}
+
+func decodeJSON(b []byte) (interface{}, error) {
+	var doc interface{}
+	err := json.Unmarshal(b, &doc)
+	return doc, err
+}
+
 // Unmarshal converts anypb.Any values to interface{}.
 func Unmarshal(anyVal *anypb.Any) (interface{}, error) {
 	return unmarshal(anyVal)
@@ -1,8 +1,14 @@
 package anyval
 
 import (
+	"bytes"
+	"encoding/json"
+	"google.golang.org/protobuf/types/known/anypb"
+	"kv/pkg/crdt"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMarshalInt(t *testing.T) {
@@ -153,3 +159,104 @@ func TestConvertFloat64Slice(t *testing.T) {
 		t.Fatalf("expected %+v got %+v\n", expected, actual)
 	}
 }
+
+func TestConvertCRDTs(t *testing.T) {
+	now := time.Unix(1700000000, 5).UTC()
+	for _, expected := range []interface{}{
+		crdt.Counter{Increments: map[string]uint64{"a": 3, "b": 1}, Decrements: map[string]uint64{"a": 2}},
+		crdt.Set{Tags: map[string][]string{"x": {"a@1", "b@2"}}, Removed: map[string][]string{"y": {"a@1"}}},
+		crdt.Register{Value: "v", Timestamp: now, Node: "a"},
+		crdt.Increment{Node: "a", Delta: -4},
+		crdt.SetAdd{Tag: "a@1", Elements: []string{"x"}},
+		crdt.SetRemove{Elements: []string{"x"}},
+	} {
+		anyVal, err := Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := Unmarshal(anyVal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v got %+v", expected, actual)
+		}
+	}
+}
+
+func TestConvertDocuments(t *testing.T) {
+	type item struct {
+		Name  string   `json:"name"`
+		Tags  []string `json:"tags,omitempty"`
+		Count int      `json:"count"`
+	}
+	doc := map[string]interface{}{
+		"name":   "a",
+		"count":  float64(2),
+		"nested": map[string]interface{}{"ok": true, "missing": nil},
+		"list":   []interface{}{"x", float64(1), []interface{}{"y"}},
+	}
+	canonical := map[string]interface{}{
+		"name":   "a",
+		"count":  int64(2),
+		"nested": map[string]interface{}{"ok": true, "missing": nil},
+		"list":   []interface{}{"x", int64(1), []interface{}{"y"}},
+	}
+	for _, test := range []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{doc, canonical},
+		{[]interface{}{"x", doc}, []interface{}{"x", canonical}},
+		{map[string][]int{"a": {1, 2}}, map[string]interface{}{"a": []interface{}{int64(1), int64(2)}}},
+		{json.RawMessage(`{"name": "a", "count": 2}`), map[string]interface{}{"name": "a", "count": int64(2)}},
+		{item{Name: "a", Tags: []string{"t"}, Count: 3},
+			map[string]interface{}{"name": "a", "tags": []interface{}{"t"}, "count": int64(3)}},
+		{map[string]interface{}{"item": &item{Name: "b"}, "bytes": []byte("hi")},
+			map[string]interface{}{"item": map[string]interface{}{"name": "b", "count": int64(0)}, "bytes": []byte("hi")}},
+		{float64(1), int64(1)},
+		{int32(1), int64(1)},
+		{uint8(1), int64(1)},
+		{1.5, 1.5},
+		{float64(1 << 60), float64(1 << 60)},
+		{uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"1", "1"},
+		{nil, nil},
+	} {
+		if actual := Canonical(test.value); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("expected %#v got %#v", test.expected, actual)
+		}
+	}
+	// a value is canonical however it was written
+	if read, err := Unmarshal(must(t, canonical)); err != nil || !reflect.DeepEqual(Canonical(read), canonical) {
+		t.Errorf("expected a document to have the same canonical form before and after marshalling, got %v", err)
+	}
+
+	actual, err := UnmarshalType[map[string]interface{}](must(t, doc))
+	if err != nil || !reflect.DeepEqual(actual, doc) {
+		t.Errorf("expected %+v got %+v, %v", doc, actual, err)
+	}
+	// the same document always has the same bytes, whatever order its map is read in
+	first := must(t, doc)
+	for i := 0; i != 10; i++ {
+		if !bytes.Equal(must(t, doc).Value, first.Value) {
+			t.Fatal("expected a document to marshal deterministically")
+		}
+	}
+
+	if _, err := Marshal(map[string]interface{}{"n": int64(1) << 60}); err == nil {
+		t.Error("expected an integer a float64 can't hold to be an error")
+	}
+	if _, err := Marshal(map[int]string{1: "a"}); err == nil {
+		t.Error("expected a map without string keys to be an error")
+	}
+}
+
+func must(t *testing.T, val interface{}) *anypb.Any {
+	t.Helper()
+	a, err := Marshal(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
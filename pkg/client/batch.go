@@ -0,0 +1,44 @@
+package client
+
+import "errors"
+
+// BatchResult is the outcome of one item of a batch.  For a get, Entry is the key's entry, and for a put or delete
+// it has the revisions of the write.  Err is nil when the item succeeded, and can be checked with errors.Is like the
+// errors of single requests.
+type BatchResult struct {
+	Key   string
+	Entry Entry
+	Err   error
+}
+
+type batchOptions struct {
+	atomic bool
+}
+
+// BatchOption configures a BatchGet, BatchPut or BatchDelete.
+type BatchOption func(*batchOptions)
+
+// Atomic applies every item of the batch, or none of them.  Gets are all read at the same revision, and deletes fail
+// with ErrNotFound for the keys which don't exist, and ErrPreconditionFailed for the rest.
+func Atomic() BatchOption {
+	return func(o *batchOptions) {
+		o.atomic = true
+	}
+}
+
+func newBatchOptions(opts []BatchOption) batchOptions {
+	o := batchOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// batchError converts the error of one item to an Error, as fromStatus and fromResponse do for whole requests.
+func batchError(code, message string) error {
+	kind, ok := errorKinds[code]
+	if !ok {
+		return errors.New(message)
+	}
+	return &Error{Kind: kind, Message: message}
+}
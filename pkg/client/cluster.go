@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"kv/internal/gen"
+)
+
+func (c *GPRCClient) Members(ctx context.Context) (ClusterInfo, error) {
+	r, err := c.cc.Members(ctx, &gen.MembersRequest{})
+	if err != nil {
+		return ClusterInfo{}, fromStatus(err)
+	}
+
+	info := ClusterInfo{
+		ID:      r.Id,
+		Leader:  r.Leader,
+		Term:    r.Term,
+		Commit:  r.Commit,
+		Applied: r.Applied,
+	}
+	for _, m := range r.Members {
+		info.Members = append(info.Members, ClusterMember{
+			ID:      m.Id,
+			Address: m.Address,
+			Role:    m.Role,
+			Match:   m.Match,
+			Lag:     m.Lag,
+		})
+	}
+	return info, nil
+}
+
+func (c *GPRCClient) AddMember(ctx context.Context, id, address string) error {
+	_, err := c.cc.AddMember(ctx, &gen.MemberRequest{Id: id, Address: address})
+	return fromStatus(err)
+}
+
+func (c *GPRCClient) RemoveMember(ctx context.Context, id string) error {
+	_, err := c.cc.RemoveMember(ctx, &gen.MemberRequest{Id: id})
+	return fromStatus(err)
+}
+
+func (c *GPRCClient) TransferLeadership(ctx context.Context, id string) error {
+	_, err := c.cc.TransferLeadership(ctx, &gen.MemberRequest{Id: id})
+	return fromStatus(err)
+}
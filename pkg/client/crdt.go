@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/internal/gen"
+	"kv/pkg/anyval"
+	"kv/pkg/crdt"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+// CRDTs defines methods for clients which change the CRDTs of package crdt.  Many clients can change the same key at
+// once without conditional writes, and replicas which accept writes independently merge their changes.  Each method
+// returns the key's new value.  A key holding a different kind of value gives ErrTypeMismatch.
+type CRDTs interface {
+	// IncrementCounter adds delta, which may be negative, to the counter at key, creating it if it doesn't exist.
+	IncrementCounter(ctx context.Context, key string, delta int64) (int64, error)
+
+	// SetAdd adds elements to the set at key, creating it if it doesn't exist.
+	SetAdd(ctx context.Context, key string, elements ...string) ([]string, error)
+
+	// SetRemove removes elements from the set at key.
+	SetRemove(ctx context.Context, key string, elements ...string) ([]string, error)
+
+	// SetRegister sets the last writer wins register at key to value.
+	SetRegister(ctx context.Context, key string, value interface{}) (interface{}, error)
+}
+
+// merger is implemented by the clients which send a change to the server, and return the plain value of the key.
+type merger interface {
+	merge(ctx context.Context, key string, change crdt.Merger) (interface{}, error)
+}
+
+func increment(ctx context.Context, m merger, key string, delta int64) (int64, error) {
+	v, err := m.merge(ctx, key, crdt.Increment{Delta: delta})
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case float64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("unexpected counter value %T", v)
+}
+
+func elements(ctx context.Context, m merger, key string, change crdt.Merger) ([]string, error) {
+	v, err := m.merge(ctx, key, change)
+	if err != nil {
+		return nil, err
+	}
+	switch values := v.(type) {
+	case []string:
+		return values, nil
+	case []interface{}:
+		elements := make([]string, len(values))
+		for i, value := range values {
+			elements[i], _ = value.(string)
+		}
+		return elements, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected set value %T", v)
+}
+
+func (c *GPRCClient) merge(ctx context.Context, key string, change crdt.Merger) (interface{}, error) {
+	v, err := anyval.Marshal(change)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.kvc.Merge(ctx, &gen.MergeRequest{Key: key, Value: v})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	value, err := anyval.Unmarshal(r.Value)
+	return crdt.Plain(value), err
+}
+
+func (c *GPRCClient) IncrementCounter(ctx context.Context, key string, delta int64) (int64, error) {
+	return increment(ctx, c, key, delta)
+}
+
+func (c *GPRCClient) SetAdd(ctx context.Context, key string, elems ...string) ([]string, error) {
+	return elements(ctx, c, key, crdt.SetAdd{Elements: elems})
+}
+
+func (c *GPRCClient) SetRemove(ctx context.Context, key string, elems ...string) ([]string, error) {
+	return elements(ctx, c, key, crdt.SetRemove{Elements: elems})
+}
+
+func (c *GPRCClient) SetRegister(ctx context.Context, key string, value interface{}) (interface{}, error) {
+	return c.merge(ctx, key, crdt.Register{Value: value})
+}
+
+func (kv *RestClient) merge(ctx context.Context, key string, change crdt.Merger) (interface{}, error) {
+	mergeReq := rest.MergeRequest{Key: key}
+	switch c := change.(type) {
+	case crdt.Increment:
+		mergeReq.Op, mergeReq.Delta = "increment", c.Delta
+	case crdt.SetAdd:
+		mergeReq.Op, mergeReq.Elements = "add", c.Elements
+	case crdt.SetRemove:
+		mergeReq.Op, mergeReq.Elements = "remove", c.Elements
+	case crdt.Register:
+		mergeReq.Op, mergeReq.Value = "set", c.Value
+	default:
+		return nil, errors.New(fmt.Sprintf("can't send a %T over REST", change))
+	}
+
+	b, err := json.Marshal(mergeReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", kv.url+"/merge", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := kv.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	doc := rest.MergeResponse{}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	kv.seen.observe(doc.Revision)
+	return doc.Value, nil
+}
+
+func (kv *RestClient) IncrementCounter(ctx context.Context, key string, delta int64) (int64, error) {
+	return increment(ctx, kv, key, delta)
+}
+
+func (kv *RestClient) SetAdd(ctx context.Context, key string, elems ...string) ([]string, error) {
+	return elements(ctx, kv, key, crdt.SetAdd{Elements: elems})
+}
+
+func (kv *RestClient) SetRemove(ctx context.Context, key string, elems ...string) ([]string, error) {
+	return elements(ctx, kv, key, crdt.SetRemove{Elements: elems})
+}
+
+func (kv *RestClient) SetRegister(ctx context.Context, key string, value interface{}) (interface{}, error) {
+	return kv.merge(ctx, key, crdt.Register{Value: value})
+}
+
+// merge sends the change to the shard owning key, which must support CRDTs.
+func (c *ShardedClient) merge(ctx context.Context, key string, change crdt.Merger) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		m, ok := kv.(merger)
+		if !ok {
+			return ErrUnsupported
+		}
+		value, err = m.merge(ctx, key, change)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) IncrementCounter(ctx context.Context, key string, delta int64) (int64, error) {
+	return increment(ctx, c, key, delta)
+}
+
+func (c *ShardedClient) SetAdd(ctx context.Context, key string, elems ...string) ([]string, error) {
+	return elements(ctx, c, key, crdt.SetAdd{Elements: elems})
+}
+
+func (c *ShardedClient) SetRemove(ctx context.Context, key string, elems ...string) ([]string, error) {
+	return elements(ctx, c, key, crdt.SetRemove{Elements: elems})
+}
+
+func (c *ShardedClient) SetRegister(ctx context.Context, key string, value interface{}) (interface{}, error) {
+	return c.merge(ctx, key, crdt.Register{Value: value})
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+// The kinds of error the server returns, along with ErrPreconditionFailed and ErrCompacted.  Errors from the server
+// wrap one of them, so they can be checked with errors.Is on either transport.
+var (
+	// ErrNotFound is returned for a key, or a lease, which doesn't exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrTooLarge is returned for a request which is bigger than the server accepts.
+	ErrTooLarge = errors.New("too large")
+
+	// ErrUnavailable is returned when the server can't be reached, or can't serve requests at the moment.  The request
+	// may succeed if it's retried.
+	ErrUnavailable = errors.New("unavailable")
+
+	// ErrInvalid is returned for a request the server rejected as malformed.
+	ErrInvalid = errors.New("invalid argument")
+
+	// ErrUnsupported is returned for an operation the server's store doesn't support.
+	ErrUnsupported = errors.New("operation not supported")
+
+	// ErrMoved is returned by one shard of a sharded store for a key which belongs to another.  A ShardedClient finds
+	// the right shard itself.
+	ErrMoved = errors.New("moved")
+
+	// ErrReadOnly is returned for a write to a follower, which only serves reads.  The message says where the leader
+	// is.  The REST client is redirected to the leader, so only the gRPC client sees it.
+	ErrReadOnly = errors.New("read only")
+
+	// ErrTypeMismatch is returned for an operation on a key whose value is of a type the operation doesn't apply to,
+	// such as incrementing a string.
+	ErrTypeMismatch = errors.New("type mismatch")
+)
+
+// Error is an error returned by the server.  It wraps one of the kinds of error above, and keeps the server's message.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// errorKinds are the kinds of error for each code the server gives.
+var errorKinds = map[string]error{
+	rest.CodeNotFound:           ErrNotFound,
+	rest.CodePreconditionFailed: ErrPreconditionFailed,
+	rest.CodeTooLarge:           ErrTooLarge,
+	rest.CodeUnavailable:        ErrUnavailable,
+	rest.CodeInvalid:            ErrInvalid,
+	rest.CodeCompacted:          ErrCompacted,
+	rest.CodeUnsupported:        ErrUnsupported,
+	rest.CodeMoved:              ErrMoved,
+	rest.CodeReadOnly:           ErrReadOnly,
+	rest.CodeTypeMismatch:       ErrTypeMismatch,
+}
+
+// fromStatus converts a gRPC error to an Error.  The kind comes from the error's details, or its code when the details
+// are missing.  Errors which aren't from the server, such as a cancelled context, are returned as they are.
+func fromStatus(err error) error {
+	s, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+
+	var kind error
+	switch s.Code() {
+	case codes.NotFound:
+		kind = ErrNotFound
+	case codes.FailedPrecondition:
+		kind = ErrPreconditionFailed
+	case codes.ResourceExhausted:
+		kind = ErrTooLarge
+	case codes.Unavailable:
+		kind = ErrUnavailable
+	case codes.InvalidArgument:
+		kind = ErrInvalid
+	case codes.OutOfRange:
+		kind = ErrCompacted
+	case codes.Unimplemented:
+		kind = ErrUnsupported
+	case codes.Aborted:
+		kind = ErrMoved
+	case codes.PermissionDenied:
+		kind = ErrReadOnly
+	}
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == rest.ErrorDomain {
+			kind = errorKinds[info.Reason]
+		}
+	}
+
+	if kind == nil {
+		return err
+	}
+	return &Error{Kind: kind, Message: s.Message()}
+}
+
+// fromResponse returns nil for a successful response, otherwise it converts the ErrorResponse in the body to an
+// Error.  The kind comes from the status code when the body is missing.
+func fromResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	doc := rest.ErrorResponse{}
+	b, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(b, &doc)
+	}
+	if err != nil || len(doc.Message) == 0 {
+		doc.Message = resp.Status
+	}
+
+	kind, ok := errorKinds[doc.Code]
+	if !ok {
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			kind = ErrNotFound
+		case http.StatusPreconditionFailed:
+			kind = ErrPreconditionFailed
+		case http.StatusRequestEntityTooLarge:
+			kind = ErrTooLarge
+		case http.StatusServiceUnavailable:
+			kind = ErrUnavailable
+		case http.StatusBadRequest:
+			kind = ErrInvalid
+		case http.StatusGone:
+			kind = ErrCompacted
+		case http.StatusNotImplemented:
+			kind = ErrUnsupported
+		case http.StatusMisdirectedRequest:
+			kind = ErrMoved
+		case http.StatusForbidden:
+			kind = ErrReadOnly
+		case http.StatusConflict:
+			kind = ErrTypeMismatch
+		default:
+			return errors.New(doc.Message)
+		}
+	}
+	return &Error{Kind: kind, Message: doc.Message}
+}
@@ -9,61 +9,180 @@ import (
 	"kv/pkg/anyval"
 	"kv/pkg/watch"
 	"log/slog"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type GPRCClient struct {
 	kvc gen.KVClient
+	lc  gen.LeaseClient
+	cc  gen.ClusterClient
+	sc  gen.ShardsClient
+
+	// keepAlives stops the keepalive of each lease granted by the client.
+	lock       sync.Mutex
+	keepAlives map[int64]context.CancelFunc
+
+	seen seenRevision
 }
 
 func NewGRPC(conn *grpc.ClientConn) *GPRCClient {
 	return &GPRCClient{
-		kvc: gen.NewKVClient(conn),
+		kvc:        gen.NewKVClient(conn),
+		lc:         gen.NewLeaseClient(conn),
+		cc:         gen.NewClusterClient(conn),
+		sc:         gen.NewShardsClient(conn),
+		keepAlives: make(map[int64]context.CancelFunc),
 	}
 }
 
-func (c *GPRCClient) Get(ctx context.Context, key string) (interface{}, error) {
+func (c *GPRCClient) Get(ctx context.Context, key string, opts ...ReadOption) (interface{}, error) {
+	o := newReadOptions(opts)
 	req := gen.GetRequest{
-		Key: key,
+		Key:         key,
+		Consistency: gen.Consistency(o.consistency),
+		MinRevision: c.seen.minRevision(o),
 	}
 
 	var remoteVal interface{}
 	r, err := c.kvc.Get(ctx, &req)
 	if err != nil {
-		return nil, err
+		return nil, fromStatus(err)
 	} else {
 		if r.Status != gen.Status_OK {
-			err = errors.New(fmt.Sprintf("key [%s] not found\n", key))
+			err = keyNotFound(key)
 		} else {
 			remoteVal, _ = anyval.Unmarshal(r.GetValue())
+			c.seen.observe(r.Revision)
+			o.setStaleness(r.Staleness.GetEntries(), r.Staleness.GetSinceMillis())
 		}
 	}
 
 	return remoteVal, err
 }
 
-func (c *GPRCClient) Put(ctx context.Context, key string, val interface{}) error {
+func (c *GPRCClient) GetEntry(ctx context.Context, key string, revision int64, opts ...ReadOption) (Entry, error) {
+	o := newReadOptions(opts)
+	req := gen.GetRequest{
+		Key:         key,
+		Revision:    revision,
+		Consistency: gen.Consistency(o.consistency),
+		MinRevision: c.seen.minRevision(o),
+	}
+
+	r, err := c.kvc.Get(ctx, &req)
+	if err != nil {
+		return Entry{}, fromStatus(err)
+	} else if r.Status != gen.Status_OK {
+		return Entry{}, keyNotFound(key)
+	}
+	c.seen.observe(r.Revision)
+	o.setStaleness(r.Staleness.GetEntries(), r.Staleness.GetSinceMillis())
+
+	v, err := anyval.Unmarshal(r.GetValue())
+	return Entry{
+		Value:          v,
+		CreateRevision: r.CreateRevision,
+		ModRevision:    r.ModRevision,
+		Version:        r.Version,
+		Revision:       r.Revision,
+	}, err
+}
+
+func (c *GPRCClient) Put(ctx context.Context, key string, val interface{}, opts ...PutOption) error {
 	anyVal, err := anyval.Marshal(val)
 	if err != nil {
 		return err
 	}
 
+	o := newPutOptions(opts)
 	req := gen.PutRequest{
 		Key:   key,
 		Value: anyVal,
+		Ttl:   ttlSeconds(o.ttl),
+		Lease: o.lease,
 	}
 
 	r, err := c.kvc.Put(ctx, &req)
 	if err != nil {
-		return err
+		return fromStatus(err)
 	}
 
 	if r.Status != gen.Status_OK {
-		err = errors.New(fmt.Sprintf("key [%s] not found", key))
+		err = errors.New(fmt.Sprintf("put of key [%s] failed", key))
 	}
 
 	return err
 }
 
+// ttlSeconds rounds ttl up to whole seconds, so a short ttl doesn't become no ttl.
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+func (c *GPRCClient) PutIfAbsent(ctx context.Context, key string, val interface{}) error {
+	return c.putIf(ctx, key, val, &gen.Condition{Type: gen.ConditionType_IF_ABSENT})
+}
+
+func (c *GPRCClient) PutIfValueEquals(ctx context.Context, key string, val interface{}, prev interface{}) error {
+	anyPrev, err := anyval.Marshal(prev)
+	if err != nil {
+		return err
+	}
+	return c.putIf(ctx, key, val, &gen.Condition{Type: gen.ConditionType_IF_VALUE_EQUALS, Value: anyPrev})
+}
+
+func (c *GPRCClient) PutIfRevisionEquals(ctx context.Context, key string, val interface{}, revision int64) error {
+	return c.putIf(ctx, key, val, &gen.Condition{Type: gen.ConditionType_IF_REVISION_EQUALS, Revision: revision})
+}
+
+func (c *GPRCClient) putIf(ctx context.Context, key string, val interface{}, cond *gen.Condition) error {
+	anyVal, err := anyval.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	req := gen.PutIfRequest{
+		Key:       key,
+		Value:     anyVal,
+		Condition: cond,
+	}
+
+	r, err := c.kvc.PutIf(ctx, &req)
+	if err != nil {
+		return fromStatus(err)
+	}
+	return conditionalError(r.Status, key)
+}
+
+func (c *GPRCClient) DeleteIfRevisionEquals(ctx context.Context, key string, revision int64) error {
+	req := gen.DeleteIfRequest{
+		Key:       key,
+		Condition: &gen.Condition{Type: gen.ConditionType_IF_REVISION_EQUALS, Revision: revision},
+	}
+
+	r, err := c.kvc.DeleteIf(ctx, &req)
+	if err != nil {
+		return fromStatus(err)
+	}
+	return conditionalError(r.Status, key)
+}
+
+func conditionalError(status gen.Status, key string) error {
+	switch status {
+	case gen.Status_OK:
+		return nil
+	case gen.Status_PRECONDITION_FAILED:
+		return ErrPreconditionFailed
+	}
+	return keyNotFound(key)
+}
+
+func keyNotFound(key string) error {
+	return &Error{Kind: ErrNotFound, Message: fmt.Sprintf("key [%s] not found", key)}
+}
+
 func (c *GPRCClient) Delete(ctx context.Context, key string) error {
 	req := gen.DeleteRequest{
 		Key: key,
@@ -71,51 +190,321 @@ func (c *GPRCClient) Delete(ctx context.Context, key string) error {
 
 	r, err := c.kvc.Delete(ctx, &req)
 	if err != nil {
-		return err
+		return fromStatus(err)
 	} else if r.Status != gen.Status_OK {
-		err = errors.New(fmt.Sprintf("key [%s] not found", key))
+		err = keyNotFound(key)
 	}
 
 	return err
 }
 
-func (c *GPRCClient) Watch(ctx context.Context, key string, operation watch.Operation) (chan watch.Update, error) {
-	req := gen.WatchRequest{
-		Key:       key,
-		WatchType: operation.Convert(),
+func (c *GPRCClient) Compact(ctx context.Context, revision int64) error {
+	r, err := c.kvc.Compact(ctx, &gen.CompactRequest{Revision: revision})
+	if err != nil {
+		return fromStatus(err)
+	} else if r.Status != gen.Status_OK {
+		err = errors.New(fmt.Sprintf("compact to revision [%d] failed", revision))
 	}
+	return err
+}
 
-	watchClient, err := c.kvc.Watch(ctx, &req)
+func (c *GPRCClient) Txn(ctx context.Context, compares []Compare, then []Op, els []Op) (TxnResponse, error) {
+	req := gen.TxnRequest{}
+	for _, cmp := range compares {
+		cond := &gen.Condition{Revision: cmp.Revision}
+		switch cmp.Type {
+		case CompareAbsent:
+			cond.Type = gen.ConditionType_IF_ABSENT
+		case CompareValue:
+			cond.Type = gen.ConditionType_IF_VALUE_EQUALS
+			v, err := anyval.Marshal(cmp.Value)
+			if err != nil {
+				return TxnResponse{}, err
+			}
+			cond.Value = v
+		case CompareRevision:
+			cond.Type = gen.ConditionType_IF_REVISION_EQUALS
+		}
+		req.Compares = append(req.Compares, &gen.Compare{Key: cmp.Key, Condition: cond})
+	}
+
+	var err error
+	req.Then, err = convertOps(then)
+	if err == nil {
+		req.Else, err = convertOps(els)
+	}
 	if err != nil {
-		return nil, err
+		return TxnResponse{}, err
 	}
 
-	updateChan := make(chan watch.Update)
+	r, err := c.kvc.Txn(ctx, &req)
+	if err != nil {
+		return TxnResponse{}, fromStatus(err)
+	} else if r.Status != gen.Status_OK {
+		return TxnResponse{}, errors.New("txn failed")
+	}
+	c.seen.observe(r.Revision)
 
-	go func() {
-		response := gen.WatchResponse{}
-		for {
-			err := watchClient.RecvMsg(&response)
+	response := TxnResponse{Succeeded: r.Succeeded, Revision: r.Revision}
+	for _, res := range r.Results {
+		result := OpResult{
+			Found: res.Found,
+			Entry: Entry{
+				CreateRevision: res.CreateRevision,
+				ModRevision:    res.ModRevision,
+				Version:        res.Version,
+				Revision:       r.Revision,
+			},
+		}
+		if res.Value != nil {
+			result.Entry.Value, err = anyval.Unmarshal(res.Value)
 			if err != nil {
-				close(updateChan)
-				break
+				return TxnResponse{}, err
 			}
+		}
+		response.Results = append(response.Results, result)
+	}
+	return response, nil
+}
 
-			v, err := anyval.Unmarshal(response.Value)
+func convertOps(ops []Op) ([]*gen.TxnOp, error) {
+	converted := make([]*gen.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		o := &gen.TxnOp{Key: op.Key}
+		switch op.Type {
+		case OpGet:
+			o.Type = gen.TxnOpType_TXN_GET
+		case OpPut:
+			o.Type = gen.TxnOpType_TXN_PUT
+			v, err := anyval.Marshal(op.Value)
 			if err != nil {
-				slog.Error("unmarshal value failed", "err", err)
-				continue
+				return nil, err
 			}
+			o.Value = v
+		case OpDelete:
+			o.Type = gen.TxnOpType_TXN_DELETE
+		}
+		converted = append(converted, o)
+	}
+	return converted, nil
+}
+
+func (c *GPRCClient) BatchGet(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error) {
+	r, err := c.kvc.BatchGet(ctx, &gen.BatchGetRequest{Keys: keys, Atomic: newBatchOptions(opts).atomic})
+	return convertBatch(r, err)
+}
+
+func (c *GPRCClient) BatchPut(ctx context.Context, kvs []KeyValue, opts ...BatchOption) ([]BatchResult, error) {
+	req := gen.BatchPutRequest{Kvs: make([]*gen.KeyValue, len(kvs)), Atomic: newBatchOptions(opts).atomic}
+	for i, kv := range kvs {
+		v, err := anyval.Marshal(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		req.Kvs[i] = &gen.KeyValue{Key: kv.Key, Value: v}
+	}
+
+	r, err := c.kvc.BatchPut(ctx, &req)
+	return convertBatch(r, err)
+}
+
+func (c *GPRCClient) BatchDelete(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error) {
+	r, err := c.kvc.BatchDelete(ctx, &gen.BatchDeleteRequest{Keys: keys, Atomic: newBatchOptions(opts).atomic})
+	return convertBatch(r, err)
+}
+
+func convertBatch(r *gen.BatchResponse, err error) ([]BatchResult, error) {
+	if err != nil {
+		return nil, fromStatus(err)
+	} else if r.Status != gen.Status_OK {
+		return nil, errors.New("batch failed")
+	}
+
+	results := make([]BatchResult, len(r.Results))
+	for i, res := range r.Results {
+		results[i] = BatchResult{
+			Key: res.Key,
+			Entry: Entry{
+				CreateRevision: res.CreateRevision,
+				ModRevision:    res.ModRevision,
+				Version:        res.Version,
+			},
+		}
+		if res.Error != nil {
+			results[i].Err = batchError(res.Error.Code, res.Error.Message)
+		}
+		if res.Value != nil {
+			results[i].Entry.Value, err = anyval.Unmarshal(res.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
+
+func (c *GPRCClient) Range(ctx context.Context, start, end string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error) {
+	req := gen.RangeRequest{
+		Start:    start,
+		End:      end,
+		Limit:    int32(limit),
+		Continue: token,
+	}
+	return c.rangeImpl(ctx, &req, newReadOptions(opts))
+}
+
+func (c *GPRCClient) Prefix(ctx context.Context, prefix string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error) {
+	req := gen.RangeRequest{
+		Prefix:   prefix,
+		Limit:    int32(limit),
+		Continue: token,
+	}
+	return c.rangeImpl(ctx, &req, newReadOptions(opts))
+}
+
+func (c *GPRCClient) rangeImpl(ctx context.Context, req *gen.RangeRequest, o readOptions) ([]KeyValue, string, error) {
+	req.Consistency = gen.Consistency(o.consistency)
+	req.MinRevision = c.seen.minRevision(o)
+	r, err := c.kvc.Range(ctx, req)
+	if err != nil {
+		return nil, "", fromStatus(err)
+	} else if r.Status != gen.Status_OK {
+		return nil, "", errors.New("range failed")
+	}
+	c.seen.observe(r.Revision)
+	o.setStaleness(r.Staleness.GetEntries(), r.Staleness.GetSinceMillis())
+
+	kvs := make([]KeyValue, 0, len(r.Kvs))
+	for _, kv := range r.Kvs {
+		v, err := anyval.Unmarshal(kv.GetValue())
+		if err != nil {
+			return nil, "", err
+		}
+		kvs = append(kvs, KeyValue{Key: kv.Key, Value: v})
+	}
+	return kvs, r.Continue, nil
+}
+
+// Watch resumes from the last update it received when the stream fails, so no updates are missed.  The channel is
+// closed when ctx is cancelled.  It's also closed if the watch can't continue, after an update whose Err says why:
+// ErrCompacted when the updates needed to resume are no longer kept, or ErrInvalid for an update which can't be
+// decoded.
+func (c *GPRCClient) Watch(ctx context.Context, key string, operation watch.Operation, opts ...WatchOption) (chan watch.Update, error) {
+	watchReq := newWatchRequest(key, operation, opts)
+	err := watchReq.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	watchClient, revision, err := c.openWatch(ctx, watchReq)
+	if err != nil {
+		return nil, err
+	}
+
+	// a live watch resumes after the revision the server had when it started
+	position := newWatchPosition(watchReq.Revision)
+	if watchReq.Revision == 0 {
+		position.revision = revision + 1
+	}
+
+	updateChan := make(chan watch.Update)
 
-			updateChan <- watch.Update{
-				Op:    watch.OperationFrom(response.WatchType),
-				Key:   response.Key,
-				Value: v,
+	go func() {
+		defer close(updateChan)
+		for {
+			err := c.receiveUpdates(ctx, watchClient, position, updateChan)
+			if ctx.Err() != nil {
+				return
+			} else if errors.Is(err, ErrInvalid) {
+				// resuming would be sent the same update again
+				stop(ctx, updateChan, err)
+				return
 			}
+			slog.Warn("watch failed, resuming", "key", key, "revision", position.revision, "err", err)
 
-			response.Reset()
+			delay := minResumeDelay
+			for {
+				if !resumeDelay(ctx, &delay) {
+					return
+				}
+				watchReq.Revision = position.revision
+				watchClient, _, err = c.openWatch(ctx, watchReq)
+				if errors.Is(err, ErrCompacted) {
+					stop(ctx, updateChan, err)
+					return
+				} else if err == nil {
+					break
+				}
+			}
 		}
 	}()
 
 	return updateChan, nil
 }
+
+// openWatch starts a watch, and returns the server's revision when it started.  It waits for the response headers, so
+// a watch which can't start fails here rather than on the first update.
+func (c *GPRCClient) openWatch(ctx context.Context, watchReq watch.WatchRequest) (gen.KV_WatchClient, int64, error) {
+	req := gen.WatchRequest{
+		Key:       watchReq.Key,
+		WatchType: watchReq.WatchType.Convert(),
+		End:       watchReq.End,
+		Prefix:    watchReq.Prefix,
+		Revision:  watchReq.Revision,
+	}
+
+	watchClient, err := c.kvc.Watch(ctx, &req)
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+
+	header, err := watchClient.Header()
+	if err == nil && header == nil {
+		// the stream ended without headers, and its status is returned by the next read
+		err = watchClient.RecvMsg(&gen.WatchResponse{})
+	}
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+
+	var revision int64
+	if values := header.Get(watch.RevisionHeader); len(values) != 0 {
+		revision, _ = strconv.ParseInt(values[0], 10, 64)
+	}
+	return watchClient, revision, nil
+}
+
+// receiveUpdates sends the updates from a watch stream which haven't already been received, until the stream fails or
+// an update can't be decoded.
+func (c *GPRCClient) receiveUpdates(ctx context.Context, watchClient gen.KV_WatchClient, position *watchPosition, updateChan chan watch.Update) error {
+	response := gen.WatchResponse{}
+	for {
+		err := watchClient.RecvMsg(&response)
+		if err != nil {
+			return err
+		}
+
+		v, err := anyval.Unmarshal(response.Value)
+		if err != nil {
+			message := "watch update of [" + response.Key + "] can't be decoded: " + err.Error()
+			return &Error{Kind: ErrInvalid, Message: message}
+		}
+
+		update := watch.Update{
+			Op:       watch.OperationFrom(response.WatchType),
+			Key:      response.Key,
+			Value:    v,
+			Revision: response.Revision,
+			Last:     response.Last,
+		}
+		if position.observe(update) {
+			select {
+			case updateChan <- update:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		response.Reset()
+	}
+}
@@ -2,13 +2,279 @@ package client
 
 import (
 	"context"
+	"errors"
+	"kv/pkg/slot"
 	"kv/pkg/watch"
+	"time"
 )
 
-// KV defines methods for key value client implementations.
+var (
+	// ErrPreconditionFailed is returned when a conditional write isn't applied because its condition doesn't hold.
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrCompacted is returned when a watch starts from a revision whose updates are no longer kept.
+	ErrCompacted = errors.New("revision has been compacted")
+)
+
+// KeyValue is a key and its value, as returned by range reads.
+type KeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is a value along with its revision metadata.
+type Entry struct {
+	Value          interface{}
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+
+	// Revision is the store's revision when the entry was read.
+	Revision int64
+}
+
+type putOptions struct {
+	ttl   time.Duration
+	lease int64
+}
+
+// PutOption configures a Put.
+type PutOption func(*putOptions)
+
+// WithTTL makes the key expire after ttl.  The server counts whole seconds.
+func WithTTL(ttl time.Duration) PutOption {
+	return func(o *putOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithLease attaches the key to a lease, so it's deleted when the lease is revoked or expires.
+func WithLease(id int64) PutOption {
+	return func(o *putOptions) {
+		o.lease = id
+	}
+}
+
+func newPutOptions(opts []PutOption) putOptions {
+	o := putOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+type watchOptions struct {
+	end      string
+	prefix   bool
+	revision int64
+}
+
+// WatchOption configures a Watch.
+type WatchOption func(*watchOptions)
+
+// WithPrefix watches every key beginning with the key.
+func WithPrefix() WatchOption {
+	return func(o *watchOptions) {
+		o.prefix = true
+	}
+}
+
+// WithRange watches every key from the key up to, but not including, end.
+func WithRange(end string) WatchOption {
+	return func(o *watchOptions) {
+		o.end = end
+	}
+}
+
+// FromRevision starts the watch with the updates made at or after revision, rather than from now.
+func FromRevision(revision int64) WatchOption {
+	return func(o *watchOptions) {
+		o.revision = revision
+	}
+}
+
+func newWatchRequest(key string, operation watch.Operation, opts []WatchOption) watch.WatchRequest {
+	o := watchOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return watch.WatchRequest{Key: key, WatchType: operation, End: o.end, Prefix: o.prefix, Revision: o.revision}
+}
+
+// KV defines methods for key value client implementations.  Reads are linearizable unless WithConsistency says
+// otherwise.
 type KV interface {
-	Get(ctx context.Context, key string) (interface{}, error)
-	Put(ctx context.Context, key string, val interface{}) error
+	Get(ctx context.Context, key string, opts ...ReadOption) (interface{}, error)
+	Put(ctx context.Context, key string, val interface{}, opts ...PutOption) error
 	Delete(ctx context.Context, key string) error
-	Watch(ctx context.Context, key string, operation watch.Operation) (chan watch.Update, error)
+
+	// PutIfAbsent stores val only when key doesn't exist.
+	PutIfAbsent(ctx context.Context, key string, val interface{}) error
+
+	// PutIfValueEquals stores val only when the current value of key is equal to prev.
+	PutIfValueEquals(ctx context.Context, key string, val interface{}, prev interface{}) error
+
+	// PutIfRevisionEquals stores val only when key was last changed at revision, as reported by GetEntry.
+	PutIfRevisionEquals(ctx context.Context, key string, val interface{}, revision int64) error
+
+	// DeleteIfRevisionEquals deletes key only when it was last changed at revision.
+	DeleteIfRevisionEquals(ctx context.Context, key string, revision int64) error
+
+	// Txn applies the then ops atomically when every compare holds, and the else ops otherwise.
+	Txn(ctx context.Context, compares []Compare, then []Op, els []Op) (TxnResponse, error)
+
+	// GetEntry reads key as of revision, or the latest value when revision is zero.
+	GetEntry(ctx context.Context, key string, revision int64, opts ...ReadOption) (Entry, error)
+
+	// Compact discards the history older than revision.
+	Compact(ctx context.Context, revision int64) error
+
+	// Range reads a page of keys where start <= key < end, in key order.  Pass the returned token back in to read
+	// the next page.  The token is empty when there are no more keys.
+	Range(ctx context.Context, start, end string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error)
+
+	// Prefix reads a page of keys beginning with prefix, like Range.
+	Prefix(ctx context.Context, prefix string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error)
+
+	// BatchGet reads every key in one request.  Each key has its own result, in the order of keys.
+	BatchGet(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error)
+
+	// BatchPut stores every value in one request, at the same revision.  A key can only appear once.
+	BatchPut(ctx context.Context, kvs []KeyValue, opts ...BatchOption) ([]BatchResult, error)
+
+	// BatchDelete deletes every key in one request.  Each key has its own result, in the order of keys.
+	BatchDelete(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error)
+
+	// Increment adds delta, a number which is 1 when it's nil, to the number at key, and returns the new value.  A key
+	// which doesn't exist starts from zero, and one which isn't a number gives ErrTypeMismatch.
+	Increment(ctx context.Context, key string, delta interface{}) (interface{}, error)
+
+	// Decrement subtracts delta from the number at key, like Increment.
+	Decrement(ctx context.Context, key string, delta interface{}) (interface{}, error)
+
+	// Append appends val to the string, bytes or slice at key, and returns the new value.  A slice can be appended
+	// either a slice or a single element.  A key which doesn't exist is set to val, which must be a string, bytes or a
+	// slice.
+	Append(ctx context.Context, key string, val interface{}) (interface{}, error)
+
+	// PushFront adds val to the front of the slice at key, and returns the new slice.  A key which doesn't exist
+	// becomes a slice of one.
+	PushFront(ctx context.Context, key string, val interface{}) (interface{}, error)
+
+	// PushBack adds val to the back of the slice at key, like PushFront.
+	PushBack(ctx context.Context, key string, val interface{}) (interface{}, error)
+
+	// Pop removes the first element of the slice at key when front is true, and the last otherwise, and returns it.
+	// An empty slice, or a key which doesn't exist, gives ErrNotFound.
+	Pop(ctx context.Context, key string, front bool) (interface{}, error)
+
+	// Watch sends updates to key, or the keys selected by WithPrefix or WithRange, until ctx is cancelled.  It
+	// returns ErrCompacted if it starts from a revision whose updates are no longer kept.  A watch which can't continue
+	// later sends an update whose Err says why before its channel is closed.
+	Watch(ctx context.Context, key string, operation watch.Operation, opts ...WatchOption) (chan watch.Update, error)
+}
+
+// ErrLeaseNotFound is returned for a lease which doesn't exist, or has expired.  It's an ErrNotFound error.
+var ErrLeaseNotFound error = &Error{Kind: ErrNotFound, Message: "lease not found"}
+
+// LeaseInfo describes a lease.
+type LeaseInfo struct {
+	ID        int64
+	TTL       time.Duration
+	Remaining time.Duration
+	Keys      []string
+}
+
+// Leases defines methods for clients which grant leases.  Attach keys to a lease with WithLease.
+type Leases interface {
+	// LeaseGrant creates a lease which expires after ttl.  The client keeps it alive until it's revoked.
+	LeaseGrant(ctx context.Context, ttl time.Duration) (int64, error)
+
+	// LeaseRevoke removes a lease and deletes the keys attached to it.
+	LeaseRevoke(ctx context.Context, id int64) error
+
+	LeaseTimeToLive(ctx context.Context, id int64) (LeaseInfo, error)
+}
+
+// Transfers defines methods for clients which stream whole datasets in and out of the store.  Use package dump to keep
+// them in files.
+type Transfers interface {
+	// Export reads every key beginning with prefix at a single revision, calling f for each in key order, and returns
+	// the revision they were read at.  It stops at the first error from f.
+	Export(ctx context.Context, prefix string, f func(KeyValue) error) (int64, error)
+
+	// Import stores every key returned by next, until it returns io.EOF, and returns how many were stored.  Keys are
+	// sent in batches, and next isn't called faster than the server stores them.
+	Import(ctx context.Context, next func() (KeyValue, error)) (int64, error)
+}
+
+// ClusterMember is a member of a replicated cluster.  Match, the last entry known to be in the member's log, and Lag,
+// how many entries it's behind the leader's log, are only known when the leader answers.
+type ClusterMember struct {
+	ID      string
+	Address string
+	Role    string
+	Match   uint64
+	Lag     uint64
+}
+
+// ClusterInfo is a replicated cluster as seen by the node ID which answered.
+type ClusterInfo struct {
+	ID      string
+	Leader  string
+	Term    uint64
+	Commit  uint64
+	Applied uint64
+	Members []ClusterMember
+}
+
+// Cluster defines methods for clients which manage the members of a replicated cluster.  Any member can be asked, and
+// changes are passed on to the leader.
+type Cluster interface {
+	Members(ctx context.Context) (ClusterInfo, error)
+
+	// AddMember adds a node, which has been started to join the cluster, at its gRPC address.
+	AddMember(ctx context.Context, id, address string) error
+
+	RemoveMember(ctx context.Context, id string) error
+
+	// TransferLeadership makes the member id the leader, returning once it has taken over.
+	TransferLeadership(ctx context.Context, id string) error
+}
+
+// ShardInfo is one server of a sharded store, owning the hash slots where Start <= slot < End.  Address is its gRPC
+// address, and HTTPAddress its REST address.
+type ShardInfo struct {
+	ID          string
+	Address     string
+	HTTPAddress string
+	Start       int
+	End         int
+}
+
+// ShardMap assigns every hash slot of a sharded store to a shard.  Version increases whenever the slots are assigned
+// differently.
+type ShardMap struct {
+	Version int64
+	Slots   int
+	Shards  []ShardInfo
+}
+
+// Owner returns the shard owning key.  Ok is false when the map has no shards.
+func (m ShardMap) Owner(key string) (owner ShardInfo, ok bool) {
+	if len(m.Shards) == 0 {
+		return ShardInfo{}, false
+	}
+	n := slot.Of(key)
+	for _, s := range m.Shards {
+		if n < s.End {
+			return s, true
+		}
+	}
+	return m.Shards[len(m.Shards)-1], true
+}
+
+// Shards defines methods for clients of a sharded store.  Any shard can be asked.
+type Shards interface {
+	ShardMap(ctx context.Context) (ShardMap, error)
 }
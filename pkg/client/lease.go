@@ -0,0 +1,124 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"kv/internal/gen"
+	"log/slog"
+	"time"
+)
+
+// minKeepAliveInterval stops short leases from being kept alive in a busy loop.
+const minKeepAliveInterval = 100 * time.Millisecond
+
+func (c *GPRCClient) LeaseGrant(ctx context.Context, ttl time.Duration) (int64, error) {
+	r, err := c.lc.LeaseGrant(ctx, &gen.LeaseGrantRequest{Ttl: ttlSeconds(ttl)})
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+
+	// the keepalive outlives ctx, which is only for the grant
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	c.lock.Lock()
+	c.keepAlives[r.Id] = cancel
+	c.lock.Unlock()
+
+	go c.keepAlive(keepAliveCtx, r.Id, time.Duration(r.Ttl)*time.Second)
+	return r.Id, nil
+}
+
+func (c *GPRCClient) LeaseRevoke(ctx context.Context, id int64) error {
+	c.stopKeepAlive(id)
+	r, err := c.lc.LeaseRevoke(ctx, &gen.LeaseRevokeRequest{Id: id})
+	if err != nil {
+		return leaseError(err)
+	} else if r.Status != gen.Status_OK {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (c *GPRCClient) LeaseTimeToLive(ctx context.Context, id int64) (LeaseInfo, error) {
+	r, err := c.lc.LeaseTimeToLive(ctx, &gen.LeaseTimeToLiveRequest{Id: id})
+	if err != nil {
+		return LeaseInfo{}, leaseError(err)
+	} else if r.Status != gen.Status_OK {
+		return LeaseInfo{}, ErrLeaseNotFound
+	}
+	return LeaseInfo{
+		ID:        r.Id,
+		TTL:       time.Duration(r.Ttl) * time.Second,
+		Remaining: time.Duration(r.Remaining) * time.Second,
+		Keys:      r.Keys,
+	}, nil
+}
+
+// leaseError converts a gRPC error, returning ErrLeaseNotFound for a lease which doesn't exist.
+func leaseError(err error) error {
+	err = fromStatus(err)
+	if errors.Is(err, ErrNotFound) {
+		return ErrLeaseNotFound
+	}
+	return err
+}
+
+// Close stops keeping the client's leases alive.  The leases expire on the server once their ttl passes.
+func (c *GPRCClient) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, cancel := range c.keepAlives {
+		cancel()
+		delete(c.keepAlives, id)
+	}
+}
+
+func (c *GPRCClient) stopKeepAlive(id int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cancel, ok := c.keepAlives[id]; ok {
+		cancel()
+		delete(c.keepAlives, id)
+	}
+}
+
+// keepAlive renews a lease three times per ttl, so one lost keepalive doesn't let it expire.  A broken stream is opened
+// again on the next renewal.  It stops when ctx is cancelled, or the server reports the lease is gone.
+func (c *GPRCClient) keepAlive(ctx context.Context, id int64, ttl time.Duration) {
+	defer c.stopKeepAlive(id)
+	ticker := time.NewTicker(max(ttl/3, minKeepAliveInterval))
+	defer ticker.Stop()
+
+	var stream gen.Lease_LeaseKeepAliveClient
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if stream == nil {
+			stream, err = c.lc.LeaseKeepAlive(ctx)
+			if err != nil {
+				slog.Debug("lease keepalive stream failed", "id", id, "err", err)
+				continue
+			}
+		}
+
+		var r *gen.LeaseKeepAliveResponse
+		err = stream.Send(&gen.LeaseKeepAliveRequest{Id: id})
+		if err == nil {
+			r, err = stream.Recv()
+		}
+		if err != nil {
+			slog.Debug("lease keepalive failed", "id", id, "err", err)
+			stream = nil
+			continue
+		}
+
+		if r.Ttl == 0 {
+			slog.Warn("lease expired before it was kept alive", "id", id)
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"kv/internal/gen"
+	"kv/pkg/anyval"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+// ops names the mutations in the REST API.
+var ops = map[gen.MutationType]string{
+	gen.MutationType_MUTATE_INCREMENT:  "increment",
+	gen.MutationType_MUTATE_DECREMENT:  "decrement",
+	gen.MutationType_MUTATE_APPEND:     "append",
+	gen.MutationType_MUTATE_PUSH_FRONT: "pushFront",
+	gen.MutationType_MUTATE_PUSH_BACK:  "pushBack",
+	gen.MutationType_MUTATE_POP_FRONT:  "popFront",
+	gen.MutationType_MUTATE_POP_BACK:   "popBack",
+}
+
+func popType(front bool) gen.MutationType {
+	if front {
+		return gen.MutationType_MUTATE_POP_FRONT
+	}
+	return gen.MutationType_MUTATE_POP_BACK
+}
+
+func (c *GPRCClient) mutate(ctx context.Context, key string, t gen.MutationType, operand interface{}) (value, popped interface{}, err error) {
+	m := &gen.Mutation{Type: t}
+	if operand != nil {
+		if m.Operand, err = anyval.Marshal(operand); err != nil {
+			return nil, nil, err
+		}
+	}
+	r, err := c.kvc.Mutate(ctx, &gen.MutateRequest{Key: key, Mutation: m})
+	if err != nil {
+		return nil, nil, fromStatus(err)
+	}
+	c.seen.observe(r.Revision)
+	if value, err = anyval.Unmarshal(r.Value); err != nil {
+		return nil, nil, err
+	}
+	popped, err = anyval.Unmarshal(r.Popped)
+	return value, popped, err
+}
+
+func (c *GPRCClient) Increment(ctx context.Context, key string, delta interface{}) (interface{}, error) {
+	value, _, err := c.mutate(ctx, key, gen.MutationType_MUTATE_INCREMENT, delta)
+	return value, err
+}
+
+func (c *GPRCClient) Decrement(ctx context.Context, key string, delta interface{}) (interface{}, error) {
+	value, _, err := c.mutate(ctx, key, gen.MutationType_MUTATE_DECREMENT, delta)
+	return value, err
+}
+
+func (c *GPRCClient) Append(ctx context.Context, key string, val interface{}) (interface{}, error) {
+	value, _, err := c.mutate(ctx, key, gen.MutationType_MUTATE_APPEND, val)
+	return value, err
+}
+
+func (c *GPRCClient) PushFront(ctx context.Context, key string, val interface{}) (interface{}, error) {
+	value, _, err := c.mutate(ctx, key, gen.MutationType_MUTATE_PUSH_FRONT, val)
+	return value, err
+}
+
+func (c *GPRCClient) PushBack(ctx context.Context, key string, val interface{}) (interface{}, error) {
+	value, _, err := c.mutate(ctx, key, gen.MutationType_MUTATE_PUSH_BACK, val)
+	return value, err
+}
+
+func (c *GPRCClient) Pop(ctx context.Context, key string, front bool) (interface{}, error) {
+	_, popped, err := c.mutate(ctx, key, popType(front), nil)
+	return popped, err
+}
+
+func (kv *RestClient) mutate(ctx context.Context, key string, t gen.MutationType, operand interface{}) (value, popped interface{}, err error) {
+	b, err := json.Marshal(rest.MutateRequest{Key: key, Op: ops[t], Operand: operand})
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", kv.url+"/mutate", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := kv.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return nil, nil, err
+	}
+
+	b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc := rest.MutateResponse{}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return nil, nil, err
+	}
+	kv.seen.observe(doc.Revision)
+	return doc.Value, doc.Popped, nil
+}
+
+func (kv *RestClient) Increment(ctx context.Context, key string, delta interface{}) (interface{}, error) {
+	value, _, err := kv.mutate(ctx, key, gen.MutationType_MUTATE_INCREMENT, delta)
+	return value, err
+}
+
+func (kv *RestClient) Decrement(ctx context.Context, key string, delta interface{}) (interface{}, error) {
+	value, _, err := kv.mutate(ctx, key, gen.MutationType_MUTATE_DECREMENT, delta)
+	return value, err
+}
+
+func (kv *RestClient) Append(ctx context.Context, key string, val interface{}) (interface{}, error) {
+	value, _, err := kv.mutate(ctx, key, gen.MutationType_MUTATE_APPEND, val)
+	return value, err
+}
+
+func (kv *RestClient) PushFront(ctx context.Context, key string, val interface{}) (interface{}, error) {
+	value, _, err := kv.mutate(ctx, key, gen.MutationType_MUTATE_PUSH_FRONT, val)
+	return value, err
+}
+
+func (kv *RestClient) PushBack(ctx context.Context, key string, val interface{}) (interface{}, error) {
+	value, _, err := kv.mutate(ctx, key, gen.MutationType_MUTATE_PUSH_BACK, val)
+	return value, err
+}
+
+func (kv *RestClient) Pop(ctx context.Context, key string, front bool) (interface{}, error) {
+	_, popped, err := kv.mutate(ctx, key, popType(front), nil)
+	return popped, err
+}
+
+func (c *ShardedClient) Increment(ctx context.Context, key string, delta interface{}) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		value, err = kv.Increment(ctx, key, delta)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) Decrement(ctx context.Context, key string, delta interface{}) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		value, err = kv.Decrement(ctx, key, delta)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) Append(ctx context.Context, key string, val interface{}) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		value, err = kv.Append(ctx, key, val)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) PushFront(ctx context.Context, key string, val interface{}) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		value, err = kv.PushFront(ctx, key, val)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) PushBack(ctx context.Context, key string, val interface{}) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		value, err = kv.PushBack(ctx, key, val)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) Pop(ctx context.Context, key string, front bool) (popped interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		popped, err = kv.Pop(ctx, key, front)
+		return err
+	})
+	return popped, err
+}
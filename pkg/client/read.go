@@ -0,0 +1,114 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Consistency is how up to date a read must be when the server is one node of a cluster.
+type Consistency int
+
+const (
+	// Linearizable reads see every write which completed before they started.  It's the default.
+	Linearizable Consistency = iota
+
+	// Sequential reads are served by the node the client is connected to, once it has caught up with the highest
+	// revision the client has seen, so the client never sees an older state than it already has.
+	Sequential
+
+	// Stale reads are served by the node the client is connected to straight away.
+	Stale
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case Linearizable:
+		return "linearizable"
+	case Sequential:
+		return "sequential"
+	case Stale:
+		return "stale"
+	}
+	return strconv.Itoa(int(c))
+}
+
+// ConsistencyFromString parses a Consistency by name, with an empty name being Linearizable.
+func ConsistencyFromString(name string) (Consistency, error) {
+	switch name {
+	case "", "linearizable":
+		return Linearizable, nil
+	case "sequential":
+		return Sequential, nil
+	case "stale":
+		return Stale, nil
+	}
+	return 0, errors.New("unknown consistency: " + name)
+}
+
+// Staleness is how far behind a sequential or stale read may be.  Entries is how many writes the node knew were
+// committed but hadn't applied yet, and Since how long it had been since it last heard from the cluster's leader.
+type Staleness struct {
+	Entries uint64
+	Since   time.Duration
+}
+
+type readOptions struct {
+	consistency Consistency
+	staleness   *Staleness
+}
+
+// ReadOption configures a Get, GetEntry, Range or Prefix.
+type ReadOption func(*readOptions)
+
+// WithConsistency reads with consistency c, rather than Linearizable.
+func WithConsistency(c Consistency) ReadOption {
+	return func(o *readOptions) {
+		o.consistency = c
+	}
+}
+
+// WithStaleness sets s to how far behind a sequential or stale read may be.  It's left at zero for linearizable
+// reads.
+func WithStaleness(s *Staleness) ReadOption {
+	return func(o *readOptions) {
+		o.staleness = s
+	}
+}
+
+func newReadOptions(opts []ReadOption) readOptions {
+	o := readOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o readOptions) setStaleness(entries uint64, sinceMillis int64) {
+	if o.staleness != nil {
+		*o.staleness = Staleness{Entries: entries, Since: time.Duration(sinceMillis) * time.Millisecond}
+	}
+}
+
+// seenRevision is the highest revision a client has read, which its sequential reads wait for.
+type seenRevision struct {
+	revision atomic.Int64
+}
+
+func (s *seenRevision) observe(revision int64) {
+	for {
+		seen := s.revision.Load()
+		if revision <= seen || s.revision.CompareAndSwap(seen, revision) {
+			return
+		}
+	}
+}
+
+// minRevision is the revision a read with o waits for.
+func (s *seenRevision) minRevision(o readOptions) int64 {
+	if o.consistency != Sequential {
+		return 0
+	}
+	return s.revision.Load()
+}
@@ -12,11 +12,13 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 )
 
 type RestClient struct {
 	url    string
 	client http.Client
+	seen   seenRevision
 }
 
 func NewRest(host string) KV {
@@ -26,72 +28,365 @@ func NewRest(host string) KV {
 	}
 }
 
-func (kv *RestClient) Get(ctx context.Context, key string) (interface{}, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", makeKeyUrl(kv.url, key), nil)
+func (kv *RestClient) Get(ctx context.Context, key string, opts ...ReadOption) (interface{}, error) {
+	e, err := kv.GetEntry(ctx, key, 0, opts...)
+	return e.Value, err
+}
+
+func (kv *RestClient) GetEntry(ctx context.Context, key string, revision int64, opts ...ReadOption) (Entry, error) {
+	o := newReadOptions(opts)
+	query := kv.readQuery(o)
+	if revision > 0 {
+		query.Set("revision", strconv.FormatInt(revision, 10))
+	}
+	u := makeKeyUrl(kv.url, key)
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
-		return nil, err
+		return Entry{}, err
 	}
 
-	resp, err := kv.client.Do(req)
+	resp, err := kv.do(req)
 	if err != nil {
-		return nil, err
-	} else if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+		return Entry{}, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return Entry{}, err
 	}
 
 	respBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return Entry{}, err
 	}
-	update := rest.GetResponse{}
-	err = json.Unmarshal(respBytes, &update)
-	return update.Value, err
+	doc := rest.GetResponse{}
+	err = json.Unmarshal(respBytes, &doc)
+	kv.observe(o, doc.Revision, doc.Staleness)
+	return Entry{
+		Value:          doc.Value,
+		CreateRevision: doc.CreateRevision,
+		ModRevision:    doc.ModRevision,
+		Version:        doc.Version,
+		Revision:       doc.Revision,
+	}, err
+}
+
+func (kv *RestClient) Put(ctx context.Context, key string, val interface{}, opts ...PutOption) error {
+	o := newPutOptions(opts)
+	put := rest.PutRequest{Key: key, Value: val, TTL: ttlSeconds(o.ttl), Lease: o.lease}
+	return kv.put(ctx, put, nil)
+}
+
+func (kv *RestClient) PutIfAbsent(ctx context.Context, key string, val interface{}) error {
+	return kv.put(ctx, rest.PutRequest{Key: key, Value: val}, http.Header{"If-None-Match": {"*"}})
+}
+
+func (kv *RestClient) PutIfValueEquals(ctx context.Context, key string, val interface{}, prev interface{}) error {
+	return kv.put(ctx, rest.PutRequest{Key: key, Value: val, PrevValue: prev}, nil)
 }
 
-func (kv *RestClient) Put(ctx context.Context, key string, val interface{}) error {
-	b, err := json.Marshal(rest.PutRequest{Key: key, Value: val})
+func (kv *RestClient) PutIfRevisionEquals(ctx context.Context, key string, val interface{}, revision int64) error {
+	return kv.put(ctx, rest.PutRequest{Key: key, Value: val}, ifMatch(revision))
+}
+
+func (kv *RestClient) put(ctx context.Context, put rest.PutRequest, header http.Header) error {
+	b, err := json.Marshal(put)
 	if err != nil {
 		return err
 	}
 
 	body := bytes.NewBuffer(b)
 
-	req, err := http.NewRequestWithContext(ctx, "POST", makeKeyUrl(kv.url, key), body)
+	req, err := http.NewRequestWithContext(ctx, "POST", makeKeyUrl(kv.url, put.Key), body)
 	if err != nil {
 		return err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
-	resp, err := kv.client.Do(req)
+	resp, err := kv.do(req)
 	if err != nil {
 		return err
-	} else if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
 	}
-	return nil
+	defer resp.Body.Close()
+	return fromResponse(resp)
 }
 
 func (kv *RestClient) Delete(ctx context.Context, key string) error {
+	return kv.delete(ctx, key, nil)
+}
+
+func (kv *RestClient) DeleteIfRevisionEquals(ctx context.Context, key string, revision int64) error {
+	return kv.delete(ctx, key, ifMatch(revision))
+}
+
+func (kv *RestClient) delete(ctx context.Context, key string, header http.Header) error {
 	req, err := http.NewRequestWithContext(ctx, "DELETE", makeKeyUrl(kv.url, key), nil)
 	if err != nil {
 		return err
 	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := kv.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return fromResponse(resp)
+}
+
+// ifMatch makes an If-Match header for the entity tag the server gives a revision.
+func ifMatch(revision int64) http.Header {
+	return http.Header{"If-Match": {strconv.Quote(strconv.FormatInt(revision, 10))}}
+}
 
+// do sends req, and returns an ErrUnavailable error if the server can't be reached.
+func (kv *RestClient) do(req *http.Request) (*http.Response, error) {
 	resp, err := kv.client.Do(req)
+	if err != nil && req.Context().Err() == nil {
+		return nil, &Error{Kind: ErrUnavailable, Message: err.Error()}
+	}
+	return resp, err
+}
+
+func (kv *RestClient) Compact(ctx context.Context, revision int64) error {
+	b, err := json.Marshal(rest.CompactRequest{Revision: revision})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", kv.url+"/compact", bytes.NewBuffer(b))
 	if err != nil {
 		return err
-	} else if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
 	}
-	return nil
+
+	resp, err := kv.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return fromResponse(resp)
 }
 
-func (kv *RestClient) Watch(ctx context.Context, key string, operation watch.Operation) (chan watch.Update, error) {
-	watchReq := watch.WatchRequest{
-		Key:       key,
-		WatchType: operation,
+func (kv *RestClient) Txn(ctx context.Context, compares []Compare, then []Op, els []Op) (TxnResponse, error) {
+	txnReq := rest.TxnRequest{
+		Then: convertRestOps(then),
+		Else: convertRestOps(els),
+	}
+	for _, cmp := range compares {
+		c := rest.Compare{Key: cmp.Key, Value: cmp.Value, Revision: cmp.Revision}
+		switch cmp.Type {
+		case CompareAbsent:
+			c.Type = "absent"
+		case CompareValue:
+			c.Type = "value"
+		case CompareRevision:
+			c.Type = "revision"
+		}
+		txnReq.Compares = append(txnReq.Compares, c)
 	}
 
-	b, err := json.Marshal(watchReq)
+	b, err := json.Marshal(txnReq)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", kv.url+"/txn", bytes.NewBuffer(b))
+	if err != nil {
+		return TxnResponse{}, err
+	}
+
+	resp, err := kv.do(req)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return TxnResponse{}, err
+	}
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+	doc := rest.TxnResponse{}
+	err = json.Unmarshal(respBytes, &doc)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+
+	kv.seen.observe(doc.Revision)
+	response := TxnResponse{Succeeded: doc.Succeeded, Revision: doc.Revision}
+	for _, res := range doc.Results {
+		response.Results = append(response.Results, OpResult{
+			Found: res.Found,
+			Entry: Entry{
+				Value:          res.Value,
+				CreateRevision: res.CreateRevision,
+				ModRevision:    res.ModRevision,
+				Version:        res.Version,
+				Revision:       doc.Revision,
+			},
+		})
+	}
+	return response, nil
+}
+
+func convertRestOps(ops []Op) []rest.TxnOp {
+	converted := make([]rest.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		o := rest.TxnOp{Key: op.Key, Value: op.Value}
+		switch op.Type {
+		case OpGet:
+			o.Op = "get"
+		case OpPut:
+			o.Op = "put"
+		case OpDelete:
+			o.Op = "delete"
+		}
+		converted = append(converted, o)
+	}
+	return converted
+}
+
+func (kv *RestClient) BatchGet(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error) {
+	return kv.bulk(ctx, "get", keyItems(keys), opts)
+}
+
+func (kv *RestClient) BatchPut(ctx context.Context, kvs []KeyValue, opts ...BatchOption) ([]BatchResult, error) {
+	items := make([]rest.KeyValue, len(kvs))
+	for i, item := range kvs {
+		items[i] = rest.KeyValue{Key: item.Key, Value: item.Value}
+	}
+	return kv.bulk(ctx, "put", items, opts)
+}
+
+func (kv *RestClient) BatchDelete(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error) {
+	return kv.bulk(ctx, "delete", keyItems(keys), opts)
+}
+
+func keyItems(keys []string) []rest.KeyValue {
+	items := make([]rest.KeyValue, len(keys))
+	for i, key := range keys {
+		items[i] = rest.KeyValue{Key: key}
+	}
+	return items
+}
+
+func (kv *RestClient) bulk(ctx context.Context, op string, items []rest.KeyValue, opts []BatchOption) ([]BatchResult, error) {
+	b, err := json.Marshal(rest.BulkRequest{Op: op, Atomic: newBatchOptions(opts).atomic, Items: items})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", kv.url+"/kv/_bulk", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := kv.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return nil, err
+	}
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	doc := rest.BulkResponse{}
+	err = json.Unmarshal(respBytes, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(doc.Results))
+	for i, res := range doc.Results {
+		results[i] = BatchResult{
+			Key: res.Key,
+			Entry: Entry{
+				Value:          res.Value,
+				CreateRevision: res.CreateRevision,
+				ModRevision:    res.ModRevision,
+				Version:        res.Version,
+			},
+		}
+		if res.Error != nil {
+			results[i].Err = batchError(res.Error.Code, res.Error.Message)
+		}
+	}
+	return results, nil
+}
+
+func (kv *RestClient) Range(ctx context.Context, start, end string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error) {
+	o := newReadOptions(opts)
+	query := kv.readQuery(o)
+	query.Set("start", start)
+	query.Set("end", end)
+	return kv.rangeImpl(ctx, query, limit, token, o)
+}
+
+func (kv *RestClient) Prefix(ctx context.Context, prefix string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error) {
+	o := newReadOptions(opts)
+	query := kv.readQuery(o)
+	query.Set("prefix", prefix)
+	return kv.rangeImpl(ctx, query, limit, token, o)
+}
+
+func (kv *RestClient) rangeImpl(ctx context.Context, query url.Values, limit int, token string, o readOptions) ([]KeyValue, string, error) {
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if len(token) != 0 {
+		query.Set("continue", token)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", makeRangeUrl(kv.url, query), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := kv.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return nil, "", err
+	}
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	doc := rest.RangeResponse{}
+	err = json.Unmarshal(respBytes, &doc)
+	if err != nil {
+		return nil, "", err
+	}
+	kv.observe(o, doc.Revision, doc.Staleness)
+
+	kvs := make([]KeyValue, 0, len(doc.KVs))
+	for _, kv := range doc.KVs {
+		kvs = append(kvs, KeyValue{Key: kv.Key, Value: kv.Value})
+	}
+	return kvs, doc.Continue, nil
+}
+
+// Watch long polls for one update at a time, starting each poll from the last update received, so no updates are
+// missed between polls.  Failed polls are retried.  The channel is closed when ctx is cancelled, or after an update
+// whose Err is ErrCompacted when the updates needed to resume are no longer kept.
+func (kv *RestClient) Watch(ctx context.Context, key string, operation watch.Operation, opts ...WatchOption) (chan watch.Update, error) {
+	watchReq := newWatchRequest(key, operation, opts)
+	err := watchReq.Validate()
 	if err != nil {
 		return nil, err
 	}
@@ -104,45 +399,97 @@ func (kv *RestClient) Watch(ctx context.Context, key string, operation watch.Ope
 
 	go func() {
 		defer close(watchChan)
+		position := newWatchPosition(watchReq.Revision)
+		delay := minResumeDelay
 		for {
-			bytesBuff := bytes.NewBuffer(b)
-			req, err := http.NewRequestWithContext(ctx, "POST", makeWatchUrl(kv.url), bytesBuff)
-			if err != nil {
-				break
+			if position.revision > 0 {
+				watchReq.Revision = position.revision
 			}
-
-			resp, err := watchClient.Do(req)
-			if err != nil {
-				log.Printf("watch request failed: %+v\n", err)
+			update, err := kv.poll(ctx, &watchClient, watchReq)
+			if ctx.Err() != nil {
 				return
-			} else if resp.StatusCode != 200 {
-				log.Printf("watch request failed: %s\n", resp.Status)
+			} else if errors.Is(err, ErrCompacted) {
+				stop(ctx, watchChan, err)
 				return
+			} else if err != nil {
+				log.Printf("watch request failed: %+v\n", err)
+				if !resumeDelay(ctx, &delay) {
+					return
+				}
+				continue
 			}
 
-			respBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				break
-			}
-			resp.Body.Close()
-
-			update := watch.Update{}
-			err = json.Unmarshal(respBytes, &update)
-			if err != nil {
-				log.Printf("decoding json failed: %+v\n", err)
-				break
+			delay = minResumeDelay
+			if position.observe(update) {
+				select {
+				case watchChan <- update:
+				case <-ctx.Done():
+					return
+				}
 			}
-			watchChan <- update
 		}
 	}()
 
 	return watchChan, nil
 }
 
+// poll waits for the next update.
+func (kv *RestClient) poll(ctx context.Context, watchClient *http.Client, watchReq watch.WatchRequest) (watch.Update, error) {
+	update := watch.Update{}
+	b, err := json.Marshal(watchReq)
+	if err != nil {
+		return update, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", makeWatchUrl(kv.url), bytes.NewBuffer(b))
+	if err != nil {
+		return update, err
+	}
+
+	resp, err := watchClient.Do(req)
+	if err != nil {
+		return update, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return update, err
+	}
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(respBytes, &update)
+	}
+	return update, err
+}
+
+// readQuery returns the query parameters for a read with o.
+func (kv *RestClient) readQuery(o readOptions) url.Values {
+	query := url.Values{}
+	if o.consistency != Linearizable {
+		query.Set("consistency", o.consistency.String())
+	}
+	if revision := kv.seen.minRevision(o); revision > 0 {
+		query.Set("minRevision", strconv.FormatInt(revision, 10))
+	}
+	return query
+}
+
+// observe records what a read with o returned.
+func (kv *RestClient) observe(o readOptions, revision int64, staleness *rest.Staleness) {
+	kv.seen.observe(revision)
+	if staleness != nil {
+		o.setStaleness(staleness.Entries, staleness.SinceMillis)
+	}
+}
+
 func makeKeyUrl(requestUrl, key string) string {
 	return requestUrl + "/kv/" + url.PathEscape(key)
 }
 
+func makeRangeUrl(requestUrl string, query url.Values) string {
+	return requestUrl + "/kv?" + query.Encode()
+}
+
 func makeWatchUrl(requestUrl string) string {
 	return requestUrl + "/watch"
 }
@@ -0,0 +1,417 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"kv/pkg/slot"
+	"kv/pkg/watch"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxRedirects is how many times a ShardedClient refreshes its shard map for one request before giving up.
+	maxRedirects = 3
+
+	// defaultPageSize is the number of keys a page of a range has when no limit is given, as on the server.
+	defaultPageSize = 100
+)
+
+// ShardedClient talks to a sharded store, sending each request straight to the shard which owns its keys.  It caches
+// the shard map, and fetches it again when a shard says a key has moved.
+//
+// A transaction's keys must all belong to one shard, which keys sharing a hash tag, a part between { and }, always do.
+// Batches are split between shards, so only a batch on a single shard can be atomic.  Ranges and watches of a range
+// are read from every shard and merged.  Each shard has its own revisions, so revisions from different shards can't
+// be compared.  Leases are held by a single shard, so ShardedClient doesn't grant them.
+type ShardedClient struct {
+	seed Shards
+	dial func(ShardInfo) (KV, error)
+
+	lock    sync.Mutex
+	m       ShardMap
+	clients map[string]KV
+}
+
+// NewSharded fetches the shard map from seed, which can be a client of any shard, and calls dial for a client of each
+// shard as it's first needed.  dial is responsible for the connections it makes.
+func NewSharded(ctx context.Context, seed Shards, dial func(ShardInfo) (KV, error)) (*ShardedClient, error) {
+	c := &ShardedClient{
+		seed:    seed,
+		dial:    dial,
+		clients: make(map[string]KV),
+	}
+	return c, c.Refresh(ctx)
+}
+
+// ShardMap returns the cached shard map.
+func (c *ShardedClient) ShardMap(_ context.Context) (ShardMap, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.m, nil
+}
+
+// Refresh fetches the shard map again.  It's asked for from the seed, or from any shard if the seed can't answer.
+func (c *ShardedClient) Refresh(ctx context.Context) error {
+	m, err := c.seed.ShardMap(ctx)
+	if err != nil {
+		c.lock.Lock()
+		clients := make([]KV, 0, len(c.clients))
+		for _, kv := range c.clients {
+			clients = append(clients, kv)
+		}
+		c.lock.Unlock()
+		for _, kv := range clients {
+			if shards, ok := kv.(Shards); ok {
+				if m, err = shards.ShardMap(ctx); err == nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	} else if len(m.Shards) == 0 || m.Slots != slot.Count {
+		return &Error{Kind: ErrInvalid, Message: fmt.Sprintf("unusable shard map with %d shards and %d slots",
+			len(m.Shards), m.Slots)}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if m.Version >= c.m.Version {
+		c.m = m
+	}
+	return nil
+}
+
+// client returns the client of shard s, dialling it if needed.
+func (c *ShardedClient) client(s ShardInfo) (KV, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if kv, ok := c.clients[s.ID]; ok {
+		return kv, nil
+	}
+	kv, err := c.dial(s)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[s.ID] = kv
+	return kv, nil
+}
+
+func (c *ShardedClient) owner(key string) (ShardInfo, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.m.Owner(key)
+	if !ok {
+		return ShardInfo{}, &Error{Kind: ErrUnavailable, Message: "the shard map has no shards"}
+	}
+	return s, nil
+}
+
+func (c *ShardedClient) shards() []ShardInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return slices.Clone(c.m.Shards)
+}
+
+// do calls f with the client of key's shard.  When the shard says the key has moved, the shard map is fetched again
+// and f is retried.
+func (c *ShardedClient) do(ctx context.Context, key string, f func(KV) error) error {
+	for attempt := 0; ; attempt++ {
+		s, err := c.owner(key)
+		var kv KV
+		if err == nil {
+			kv, err = c.client(s)
+		}
+		if err == nil {
+			err = f(kv)
+		}
+		if !errors.Is(err, ErrMoved) || attempt == maxRedirects {
+			return err
+		}
+		if rerr := c.Refresh(ctx); rerr != nil {
+			return err
+		}
+	}
+}
+
+func (c *ShardedClient) Get(ctx context.Context, key string, opts ...ReadOption) (value interface{}, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		value, err = kv.Get(ctx, key, opts...)
+		return err
+	})
+	return value, err
+}
+
+func (c *ShardedClient) GetEntry(ctx context.Context, key string, revision int64, opts ...ReadOption) (e Entry, err error) {
+	err = c.do(ctx, key, func(kv KV) error {
+		e, err = kv.GetEntry(ctx, key, revision, opts...)
+		return err
+	})
+	return e, err
+}
+
+func (c *ShardedClient) Put(ctx context.Context, key string, val interface{}, opts ...PutOption) error {
+	return c.do(ctx, key, func(kv KV) error {
+		return kv.Put(ctx, key, val, opts...)
+	})
+}
+
+func (c *ShardedClient) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, key, func(kv KV) error {
+		return kv.Delete(ctx, key)
+	})
+}
+
+func (c *ShardedClient) PutIfAbsent(ctx context.Context, key string, val interface{}) error {
+	return c.do(ctx, key, func(kv KV) error {
+		return kv.PutIfAbsent(ctx, key, val)
+	})
+}
+
+func (c *ShardedClient) PutIfValueEquals(ctx context.Context, key string, val interface{}, prev interface{}) error {
+	return c.do(ctx, key, func(kv KV) error {
+		return kv.PutIfValueEquals(ctx, key, val, prev)
+	})
+}
+
+func (c *ShardedClient) PutIfRevisionEquals(ctx context.Context, key string, val interface{}, revision int64) error {
+	return c.do(ctx, key, func(kv KV) error {
+		return kv.PutIfRevisionEquals(ctx, key, val, revision)
+	})
+}
+
+func (c *ShardedClient) DeleteIfRevisionEquals(ctx context.Context, key string, revision int64) error {
+	return c.do(ctx, key, func(kv KV) error {
+		return kv.DeleteIfRevisionEquals(ctx, key, revision)
+	})
+}
+
+// Txn is sent to the shard of its first key.  The shard rejects it with ErrInvalid if its keys belong to more than one
+// shard.
+func (c *ShardedClient) Txn(ctx context.Context, compares []Compare, then []Op, els []Op) (r TxnResponse, err error) {
+	key := ""
+	if len(compares) != 0 {
+		key = compares[0].Key
+	} else if len(then) != 0 {
+		key = then[0].Key
+	} else if len(els) != 0 {
+		key = els[0].Key
+	}
+	err = c.do(ctx, key, func(kv KV) error {
+		r, err = kv.Txn(ctx, compares, then, els)
+		return err
+	})
+	return r, err
+}
+
+// Compact compacts every shard to revision.  Since each shard has its own revisions, that discards a different amount
+// of history from each.
+func (c *ShardedClient) Compact(ctx context.Context, revision int64) error {
+	for _, s := range c.shards() {
+		kv, err := c.client(s)
+		if err == nil {
+			err = kv.Compact(ctx, revision)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Range reads a page from every shard and merges them.
+func (c *ShardedClient) Range(ctx context.Context, start, end string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error) {
+	return c.rangeImpl(limit, func(kv KV) ([]KeyValue, string, error) {
+		return kv.Range(ctx, start, end, limit, token, opts...)
+	})
+}
+
+func (c *ShardedClient) Prefix(ctx context.Context, prefix string, limit int, token string, opts ...ReadOption) ([]KeyValue, string, error) {
+	return c.rangeImpl(limit, func(kv KV) ([]KeyValue, string, error) {
+		return kv.Prefix(ctx, prefix, limit, token, opts...)
+	})
+}
+
+// rangeImpl merges a page from each shard.  A shard's page holds the first keys it has after the token, so the first
+// limit keys of the merged pages are the first limit keys of the whole store, and the next page starts after the last
+// of them.
+func (c *ShardedClient) rangeImpl(limit int, read func(KV) ([]KeyValue, string, error)) ([]KeyValue, string, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	var kvs []KeyValue
+	more := false
+	for _, s := range c.shards() {
+		kv, err := c.client(s)
+		if err != nil {
+			return nil, "", err
+		}
+		page, token, err := read(kv)
+		if err != nil {
+			return nil, "", err
+		}
+		kvs = append(kvs, page...)
+		more = more || token != ""
+	}
+
+	slices.SortFunc(kvs, func(a, b KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	if len(kvs) > limit {
+		kvs, more = kvs[:limit], true
+	}
+	if !more || len(kvs) == 0 {
+		return kvs, "", nil
+	}
+	return kvs, base64.RawURLEncoding.EncodeToString([]byte(kvs[len(kvs)-1].Key + "\x00")), nil
+}
+
+// batch splits keys between their shards, and calls f with each shard's client and the indexes of its keys.  The keys
+// a shard says have moved are split again with a fresh shard map.
+func (c *ShardedClient) batch(ctx context.Context, keys []string, atomic bool, f func(KV, []int) ([]BatchResult, error)) ([]BatchResult, error) {
+	results := make([]BatchResult, len(keys))
+	pending := make([]int, len(keys))
+	for i := range keys {
+		pending[i] = i
+	}
+
+	for attempt := 0; ; attempt++ {
+		groups := make(map[string][]int)
+		owners := make(map[string]ShardInfo)
+		for _, i := range pending {
+			s, err := c.owner(keys[i])
+			if err != nil {
+				return nil, err
+			}
+			groups[s.ID] = append(groups[s.ID], i)
+			owners[s.ID] = s
+		}
+		if atomic && len(groups) > 1 {
+			return nil, &Error{Kind: ErrInvalid, Message: "an atomic batch's keys must all belong to one shard"}
+		}
+
+		var moved []int
+		var err error
+		for id, group := range groups {
+			var kv KV
+			kv, err = c.client(owners[id])
+			if err != nil {
+				return nil, err
+			}
+			var groupResults []BatchResult
+			groupResults, err = f(kv, group)
+			if errors.Is(err, ErrMoved) {
+				moved = append(moved, group...)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			for j, i := range group {
+				results[i] = groupResults[j]
+			}
+		}
+
+		if len(moved) == 0 {
+			return results, nil
+		} else if attempt == maxRedirects {
+			return nil, err
+		} else if rerr := c.Refresh(ctx); rerr != nil {
+			return nil, err
+		}
+		pending = moved
+	}
+}
+
+func (c *ShardedClient) BatchGet(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error) {
+	return c.batch(ctx, keys, newBatchOptions(opts).atomic, func(kv KV, group []int) ([]BatchResult, error) {
+		groupKeys := make([]string, len(group))
+		for j, i := range group {
+			groupKeys[j] = keys[i]
+		}
+		return kv.BatchGet(ctx, groupKeys, opts...)
+	})
+}
+
+func (c *ShardedClient) BatchPut(ctx context.Context, kvs []KeyValue, opts ...BatchOption) ([]BatchResult, error) {
+	keys := make([]string, len(kvs))
+	for i, item := range kvs {
+		keys[i] = item.Key
+	}
+	return c.batch(ctx, keys, newBatchOptions(opts).atomic, func(kv KV, group []int) ([]BatchResult, error) {
+		groupKVs := make([]KeyValue, len(group))
+		for j, i := range group {
+			groupKVs[j] = kvs[i]
+		}
+		return kv.BatchPut(ctx, groupKVs, opts...)
+	})
+}
+
+func (c *ShardedClient) BatchDelete(ctx context.Context, keys []string, opts ...BatchOption) ([]BatchResult, error) {
+	return c.batch(ctx, keys, newBatchOptions(opts).atomic, func(kv KV, group []int) ([]BatchResult, error) {
+		groupKeys := make([]string, len(group))
+		for j, i := range group {
+			groupKeys[j] = keys[i]
+		}
+		return kv.BatchDelete(ctx, groupKeys, opts...)
+	})
+}
+
+// Watch of a single key is sent to its shard.  A watch of a prefix or range is sent to every shard, and their updates
+// are merged into one channel, which is closed once every shard's is.
+func (c *ShardedClient) Watch(ctx context.Context, key string, operation watch.Operation, opts ...WatchOption) (chan watch.Update, error) {
+	req := newWatchRequest(key, operation, opts)
+	if !req.Prefix && req.End == "" {
+		var updates chan watch.Update
+		err := c.do(ctx, key, func(kv KV) (err error) {
+			updates, err = kv.Watch(ctx, key, operation, opts...)
+			return err
+		})
+		return updates, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var shardUpdates []chan watch.Update
+	for _, s := range c.shards() {
+		kv, err := c.client(s)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		updates, err := kv.Watch(ctx, key, operation, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		shardUpdates = append(shardUpdates, updates)
+	}
+
+	merged := make(chan watch.Update)
+	var wg sync.WaitGroup
+	for _, updates := range shardUpdates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range updates {
+				select {
+				case merged <- u:
+				case <-ctx.Done():
+					return
+				}
+			}
+			// one shard's watch ending ends them all, as the caller would otherwise miss its updates unknowingly
+			cancel()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(merged)
+	}()
+	return merged, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"kv/internal/gen"
+	"kv/pkg/rest"
+	"net/http"
+)
+
+func (c *GPRCClient) ShardMap(ctx context.Context) (ShardMap, error) {
+	r, err := c.sc.ShardMap(ctx, &gen.ShardMapRequest{})
+	if err != nil {
+		return ShardMap{}, fromStatus(err)
+	}
+
+	m := ShardMap{Version: r.Version, Slots: int(r.Slots)}
+	for _, s := range r.Shards {
+		m.Shards = append(m.Shards, ShardInfo{
+			ID:          s.Id,
+			Address:     s.Address,
+			HTTPAddress: s.HttpAddress,
+			Start:       int(s.Start),
+			End:         int(s.End),
+		})
+	}
+	return m, nil
+}
+
+func (kv *RestClient) ShardMap(ctx context.Context) (ShardMap, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", kv.url+"/admin/shards", nil)
+	if err != nil {
+		return ShardMap{}, err
+	}
+	resp, err := kv.do(req)
+	if err != nil {
+		return ShardMap{}, err
+	}
+	defer resp.Body.Close()
+	if err := fromResponse(resp); err != nil {
+		return ShardMap{}, err
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ShardMap{}, err
+	}
+	doc := rest.ShardMapResponse{}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return ShardMap{}, err
+	}
+
+	m := ShardMap{Version: doc.Version, Slots: doc.Slots}
+	for _, s := range doc.Shards {
+		m.Shards = append(m.Shards, ShardInfo(s))
+	}
+	return m, nil
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"kv/internal/gen"
+	"kv/pkg/anyval"
+)
+
+const (
+	// importChunkSize is roughly how many bytes of keys and values are sent in each chunk of an import.
+	importChunkSize = 1 << 20
+
+	// importChunkKeys is the most keys sent in each chunk of an import.
+	importChunkKeys = 1000
+)
+
+func (c *GPRCClient) Export(ctx context.Context, prefix string, f func(KeyValue) error) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.kvc.Export(ctx, &gen.ExportRequest{Prefix: prefix})
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+
+	var revision int64
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return revision, nil
+		} else if err != nil {
+			return 0, fromStatus(err)
+		}
+
+		revision = r.Revision
+		for _, kv := range r.Kvs {
+			value, err := anyval.Unmarshal(kv.Value)
+			if err != nil {
+				return 0, err
+			}
+			err = f(KeyValue{Key: kv.Key, Value: value})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func (c *GPRCClient) Import(ctx context.Context, next func() (KeyValue, error)) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.kvc.Import(ctx)
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+
+	chunk := &gen.ImportRequest{}
+	keys := make(map[string]struct{})
+	size := 0
+	send := func() error {
+		err := stream.Send(chunk)
+		chunk = &gen.ImportRequest{}
+		clear(keys)
+		size = 0
+		return err
+	}
+
+	for {
+		kv, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		// a batch can't write a key twice, so a repeated key starts a new chunk
+		if _, ok := keys[kv.Key]; ok && send() != nil {
+			break
+		}
+
+		v, err := anyval.Marshal(kv.Value)
+		if err != nil {
+			return 0, err
+		}
+		item := &gen.KeyValue{Key: kv.Key, Value: v}
+		chunk.Kvs = append(chunk.Kvs, item)
+		keys[kv.Key] = struct{}{}
+		size += proto.Size(item)
+
+		if (size >= importChunkSize || len(chunk.Kvs) == importChunkKeys) && send() != nil {
+			break
+		}
+	}
+
+	// a failed send is reported by CloseAndRecv, with the server's reason
+	if len(chunk.Kvs) > 0 {
+		send()
+	}
+	r, err := stream.CloseAndRecv()
+	if err != nil {
+		return 0, fromStatus(err)
+	} else if r.Status != gen.Status_OK {
+		return 0, errors.New("import failed")
+	}
+	return r.Count, nil
+}
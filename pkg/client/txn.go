@@ -0,0 +1,72 @@
+package client
+
+type CompareType int
+
+const (
+	CompareAbsent CompareType = iota + 1
+	CompareValue
+	CompareRevision
+)
+
+// Compare is a condition on a key which decides which branch of a transaction is applied.
+type Compare struct {
+	Type     CompareType
+	Key      string
+	Value    interface{}
+	Revision int64
+}
+
+// IfAbsent holds when key doesn't exist.
+func IfAbsent(key string) Compare {
+	return Compare{Type: CompareAbsent, Key: key}
+}
+
+// IfValueEquals holds when the value of key is equal to value.
+func IfValueEquals(key string, value interface{}) Compare {
+	return Compare{Type: CompareValue, Key: key, Value: value}
+}
+
+// IfRevisionEquals holds when key was last changed at revision.
+func IfRevisionEquals(key string, revision int64) Compare {
+	return Compare{Type: CompareRevision, Key: key, Revision: revision}
+}
+
+type OpType int
+
+const (
+	OpGet OpType = iota + 1
+	OpPut
+	OpDelete
+)
+
+// Op is a read or write in a transaction.
+type Op struct {
+	Type  OpType
+	Key   string
+	Value interface{}
+}
+
+func GetOp(key string) Op {
+	return Op{Type: OpGet, Key: key}
+}
+
+func PutOp(key string, value interface{}) Op {
+	return Op{Type: OpPut, Key: key, Value: value}
+}
+
+func DeleteOp(key string) Op {
+	return Op{Type: OpDelete, Key: key}
+}
+
+// OpResult is the entry read or written by an op.  For a delete, Found reports whether the key existed.
+type OpResult struct {
+	Found bool
+	Entry Entry
+}
+
+type TxnResponse struct {
+	// Succeeded is true when every compare held, and the then ops were applied.
+	Succeeded bool
+	Results   []OpResult
+	Revision  int64
+}
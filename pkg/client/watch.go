@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"kv/pkg/watch"
+	"time"
+)
+
+const (
+	minResumeDelay = 100 * time.Millisecond
+	maxResumeDelay = 5 * time.Second
+)
+
+// watchPosition is how far a watch has got, so it can resume without missing or repeating updates.  It's the lowest
+// revision the watch doesn't have every update of, which the server relies on sending updates in revision order to
+// find.  Once it has every update of a write, it resumes from the next revision.  If it was cut off part way through a
+// write which updated several keys, it resumes from that write, and skips the keys it already has.
+type watchPosition struct {
+	revision int64
+	seen     map[string]struct{}
+}
+
+func newWatchPosition(revision int64) *watchPosition {
+	return &watchPosition{revision: revision, seen: make(map[string]struct{})}
+}
+
+// observe records an update, and returns false if it was already received.
+func (p *watchPosition) observe(u watch.Update) bool {
+	switch {
+	case u.Revision < p.revision:
+		// a write made before a live watch started, but sent after.  A resumed watch is only sent later revisions, so
+		// it's never a repeat, and the position stays where it is.
+		return true
+	case u.Revision > p.revision:
+		p.revision = u.Revision
+		clear(p.seen)
+	}
+
+	if _, ok := p.seen[u.Key]; ok {
+		return false
+	}
+	p.seen[u.Key] = struct{}{}
+	if u.Last {
+		p.revision = u.Revision + 1
+		clear(p.seen)
+	}
+	return true
+}
+
+// stop sends the last update of a watch which can't continue, saying why.
+func stop(ctx context.Context, updates chan watch.Update, err error) {
+	select {
+	case updates <- watch.Update{Err: err}:
+	case <-ctx.Done():
+	}
+}
+
+// resumeDelay waits before the next attempt to resume a watch, doubling the delay each time.  It returns false if ctx
+// is cancelled first.
+func resumeDelay(ctx context.Context, delay *time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(*delay):
+	}
+	*delay = min(*delay*2, maxResumeDelay)
+	return true
+}
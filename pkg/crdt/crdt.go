@@ -0,0 +1,292 @@
+// Package crdt has values which many clients can change at once without compare-and-swap loops.  A change is sent to
+// the server as a merge, which combines it with the key's current value while the key is locked.  Two copies of a
+// value which were changed separately merge into one with the changes of both, in any order and any number of times,
+// so replicas which accept writes independently converge on the same value.
+//
+// Counter, Set and Register are the values.  Increment, SetAdd and SetRemove are changes to them, and a value merged
+// into another is joined with it.
+package crdt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// adds numbers the adds stamped by this process, so two in the same instant still get different tags.
+var adds atomic.Uint64
+
+// ErrMismatch is returned for a merge into a key holding a different kind of value.
+var ErrMismatch = errors.New("value is a different kind")
+
+// Merger is a value, or a change to one, which merges into a key's current value.  Merge returns the new value, and
+// must not change current, which may still be read.
+type Merger interface {
+	Merge(current interface{}, found bool) (interface{}, error)
+}
+
+func mismatch(current interface{}, want string) error {
+	return fmt.Errorf("%w: the key holds a %T, not a %s", ErrMismatch, current, want)
+}
+
+// Counter is a PN-counter, which counts the increments and decrements made by each node separately.  Its value is the
+// difference of their sums.
+type Counter struct {
+	Increments map[string]uint64 `json:"increments,omitempty"`
+	Decrements map[string]uint64 `json:"decrements,omitempty"`
+}
+
+// Value returns the count.
+func (c Counter) Value() int64 {
+	var v int64
+	for _, n := range c.Increments {
+		v += int64(n)
+	}
+	for _, n := range c.Decrements {
+		v -= int64(n)
+	}
+	return v
+}
+
+// Merge joins c with the current counter, keeping each node's largest counts.
+func (c Counter) Merge(current interface{}, found bool) (interface{}, error) {
+	if !found {
+		return c, nil
+	}
+	other, ok := current.(Counter)
+	if !ok {
+		return nil, mismatch(current, "counter")
+	}
+	return Counter{Increments: joinCounts(c.Increments, other.Increments),
+		Decrements: joinCounts(c.Decrements, other.Decrements)}, nil
+}
+
+func joinCounts(a, b map[string]uint64) map[string]uint64 {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	joined := maps.Clone(a)
+	if joined == nil {
+		joined = make(map[string]uint64)
+	}
+	for node, n := range b {
+		joined[node] = max(joined[node], n)
+	}
+	return joined
+}
+
+// Increment adds Delta, which may be negative, to a counter, creating it if the key doesn't exist.  The change is
+// counted against Node, which should be the server applying it.
+type Increment struct {
+	Node  string
+	Delta int64
+}
+
+func (i Increment) Merge(current interface{}, found bool) (interface{}, error) {
+	var c Counter
+	if found {
+		var ok bool
+		if c, ok = current.(Counter); !ok {
+			return nil, mismatch(current, "counter")
+		}
+	}
+	if i.Delta >= 0 {
+		c.Increments = maps.Clone(c.Increments)
+		if c.Increments == nil {
+			c.Increments = make(map[string]uint64)
+		}
+		c.Increments[i.Node] += uint64(i.Delta)
+	} else {
+		c.Decrements = maps.Clone(c.Decrements)
+		if c.Decrements == nil {
+			c.Decrements = make(map[string]uint64)
+		}
+		c.Decrements[i.Node] += uint64(-i.Delta)
+	}
+	return c, nil
+}
+
+// Set is an observed-remove set of strings.  Every add of an element is given a unique tag, and a remove only removes
+// the tags it has seen, so an add made at the same time as a remove, on another replica, wins.
+type Set struct {
+	// Tags are the live tags of each element.
+	Tags map[string][]string `json:"tags,omitempty"`
+
+	// Removed are the tags of each element which have been removed.
+	Removed map[string][]string `json:"removed,omitempty"`
+}
+
+// Values returns the elements, in order.
+func (s Set) Values() []string {
+	return sortedKeys(s.Tags)
+}
+
+// Contains reports whether element is in the set.
+func (s Set) Contains(element string) bool {
+	_, found := s.Tags[element]
+	return found
+}
+
+// Merge joins s with the current set.  An element is in the result if either has a tag for it which neither has
+// removed.
+func (s Set) Merge(current interface{}, found bool) (interface{}, error) {
+	if !found {
+		return s, nil
+	}
+	other, ok := current.(Set)
+	if !ok {
+		return nil, mismatch(current, "set")
+	}
+
+	removed := unionTags(nil, s.Removed, other.Removed)
+	return Set{Tags: unionTags(removed, s.Tags, other.Tags), Removed: removed}, nil
+}
+
+// unionTags returns the tags of each element in any of sets, leaving out those in removed.
+func unionTags(removed map[string][]string, sets ...map[string][]string) map[string][]string {
+	union := make(map[string][]string)
+	for _, tags := range sets {
+		for element, elementTags := range tags {
+			for _, tag := range elementTags {
+				if !slices.Contains(removed[element], tag) && !slices.Contains(union[element], tag) {
+					union[element] = append(union[element], tag)
+				}
+			}
+		}
+	}
+	if len(union) == 0 {
+		return nil
+	}
+	for _, tags := range union {
+		slices.Sort(tags)
+	}
+	return union
+}
+
+// SetAdd adds Elements to a set, creating it if the key doesn't exist.  Tag must be unique to this add, and is given by
+// Stamp.
+type SetAdd struct {
+	Tag      string
+	Elements []string
+}
+
+func (a SetAdd) Merge(current interface{}, found bool) (interface{}, error) {
+	var s Set
+	if found {
+		var ok bool
+		if s, ok = current.(Set); !ok {
+			return nil, mismatch(current, "set")
+		}
+	}
+	added := make(map[string][]string)
+	for _, element := range a.Elements {
+		added[element] = []string{a.Tag}
+	}
+	return Set{Tags: unionTags(nil, s.Tags, added), Removed: s.Removed}, nil
+}
+
+// SetRemove removes Elements from a set, by removing every tag they have.  It's a no-op for a key which doesn't exist.
+type SetRemove struct {
+	Elements []string
+}
+
+func (r SetRemove) Merge(current interface{}, found bool) (interface{}, error) {
+	if !found {
+		return Set{}, nil
+	}
+	s, ok := current.(Set)
+	if !ok {
+		return nil, mismatch(current, "set")
+	}
+	removed := make(map[string][]string)
+	for _, element := range r.Elements {
+		removed[element] = s.Tags[element]
+	}
+	removed = unionTags(nil, s.Removed, removed)
+	return Set{Tags: unionTags(removed, s.Tags), Removed: removed}, nil
+}
+
+// Register is a last writer wins register.  Of two writes, the one with the later Timestamp wins, with ties broken by
+// Node.
+type Register struct {
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+	Node      string      `json:"node"`
+}
+
+// Merge keeps whichever of r and the current register was written last.
+func (r Register) Merge(current interface{}, found bool) (interface{}, error) {
+	if !found {
+		return r, nil
+	}
+	other, ok := current.(Register)
+	if !ok {
+		return nil, mismatch(current, "register")
+	}
+	if other.Timestamp.After(r.Timestamp) || other.Timestamp.Equal(r.Timestamp) && other.Node > r.Node {
+		return other, nil
+	}
+	return r, nil
+}
+
+// Stamp fills in the parts of a change which the server applying it decides: the node of an Increment, the tag of a
+// SetAdd, and the timestamp and node of a Register.  It leaves any which are already set.
+func Stamp(m Merger, node string, now time.Time) Merger {
+	switch v := m.(type) {
+	case Increment:
+		if v.Node == "" {
+			v.Node = node
+		}
+		return v
+	case SetAdd:
+		if v.Tag == "" {
+			v.Tag = node + "@" + strconv.FormatInt(now.UnixNano(), 36) + "." + strconv.FormatUint(adds.Add(1), 36)
+		}
+		return v
+	case Register:
+		if v.Timestamp.IsZero() {
+			v.Timestamp, v.Node = now, node
+		}
+		return v
+	}
+	return m
+}
+
+// Plain returns the plain value of a CRDT: a counter's count, a set's elements, or a register's value.  Anything else
+// is returned as it is.
+func Plain(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Counter:
+		return v.Value()
+	case Set:
+		return v.Values()
+	case Register:
+		return v.Value
+	}
+	return value
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// NewNode returns a random node name, for a server which isn't given one.
+func NewNode() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,109 @@
+package crdt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// apply merges each change into the value in turn.
+func apply(t *testing.T, value interface{}, changes ...Merger) interface{} {
+	t.Helper()
+	found := value != nil
+	for _, c := range changes {
+		var err error
+		value, err = c.Merge(value, found)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = true
+	}
+	return value
+}
+
+func TestCounter(t *testing.T) {
+	a := apply(t, nil, Increment{Node: "a", Delta: 5}, Increment{Node: "a", Delta: -2}).(Counter)
+	b := apply(t, nil, Increment{Node: "b", Delta: 10}).(Counter)
+	if a.Value() != 3 || b.Value() != 10 {
+		t.Fatalf("expected [3] and [10], got [%d] and [%d]", a.Value(), b.Value())
+	}
+
+	// joining is commutative and idempotent, so replicas converge whichever way they sync
+	ab, ba := apply(t, a, b).(Counter), apply(t, b, a).(Counter)
+	if ab.Value() != 13 || !reflect.DeepEqual(ab, ba) {
+		t.Errorf("expected both joins to be [13], got %+v and %+v", ab, ba)
+	}
+	if again := apply(t, ab, a).(Counter); !reflect.DeepEqual(again, ab) {
+		t.Errorf("expected joining again to change nothing, got %+v", again)
+	}
+	if a.Value() != 3 {
+		t.Errorf("expected the merge not to change its input, got [%d]", a.Value())
+	}
+}
+
+func TestSetAddWins(t *testing.T) {
+	s := apply(t, nil, SetAdd{Tag: "a@1", Elements: []string{"x", "y"}}).(Set)
+
+	// one replica removes x while another adds it again, so the add it hadn't seen survives
+	removed := apply(t, s, SetRemove{Elements: []string{"x"}}).(Set)
+	added := apply(t, s, SetAdd{Tag: "b@1", Elements: []string{"x", "z"}}).(Set)
+	if removed.Contains("x") || !added.Contains("x") {
+		t.Fatalf("unexpected sets %v and %v", removed.Values(), added.Values())
+	}
+	one, other := apply(t, removed, added).(Set), apply(t, added, removed).(Set)
+	if !reflect.DeepEqual(one, other) {
+		t.Errorf("expected the joins to match, got %+v and %+v", one, other)
+	}
+	if got := one.Values(); !reflect.DeepEqual(got, []string{"x", "y", "z"}) {
+		t.Errorf("expected [x y z], got %v", got)
+	}
+
+	// removing it after seeing both adds removes it everywhere
+	gone := apply(t, one, SetRemove{Elements: []string{"x"}}).(Set)
+	if joined := apply(t, gone, added).(Set); joined.Contains("x") {
+		t.Errorf("expected x to stay removed, got %v", joined.Values())
+	}
+}
+
+func TestRegister(t *testing.T) {
+	now := time.Now()
+	early := Register{Value: "early", Timestamp: now, Node: "a"}
+	late := Register{Value: "late", Timestamp: now.Add(time.Second), Node: "a"}
+	tie := Register{Value: "tie", Timestamp: now, Node: "b"}
+	for _, r := range []interface{}{apply(t, early, late), apply(t, late, early)} {
+		if r.(Register).Value != "late" {
+			t.Errorf("expected the later write to win, got %v", r)
+		}
+	}
+	for _, r := range []interface{}{apply(t, early, tie), apply(t, tie, early)} {
+		if r.(Register).Value != "tie" {
+			t.Errorf("expected a tie to go to the greater node, got %v", r)
+		}
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	for _, m := range []Merger{Increment{Delta: 1}, SetAdd{Elements: []string{"x"}}, SetRemove{}, Counter{}, Register{}} {
+		if _, err := m.Merge("plain", true); !errors.Is(err, ErrMismatch) {
+			t.Errorf("%T: expected ErrMismatch, got %v", m, err)
+		}
+	}
+}
+
+func TestStamp(t *testing.T) {
+	now := time.Now()
+	if i := Stamp(Increment{Delta: 1}, "n", now).(Increment); i.Node != "n" {
+		t.Errorf("expected the increment to be counted against [n], got %+v", i)
+	}
+	a, b := Stamp(SetAdd{}, "n", now).(SetAdd), Stamp(SetAdd{}, "n", now).(SetAdd)
+	if a.Tag == "" || a.Tag == b.Tag {
+		t.Errorf("expected unique tags, got [%s] and [%s]", a.Tag, b.Tag)
+	}
+	if r := Stamp(Register{Value: 1}, "n", now).(Register); !r.Timestamp.Equal(now) || r.Node != "n" {
+		t.Errorf("expected the register to be stamped, got %+v", r)
+	}
+	if Plain(Counter{Increments: map[string]uint64{"a": 2}}) != int64(2) || Plain("v") != "v" {
+		t.Error("unexpected plain values")
+	}
+}
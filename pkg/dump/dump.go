@@ -0,0 +1,232 @@
+// Package dump reads and writes exports of a store, in a format which is stable across versions of the server.
+package dump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"hash"
+	"hash/crc32"
+	"io"
+	"kv/pkg/anyval"
+	"slices"
+)
+
+// A dump is laid out as:
+//
+//	| magic | records... | 0x00 | revision uint64 | count uint64 | crc32c uint32 |
+//
+// where each record is:
+//
+//	| 0x01 | key length uvarint | key | value length uvarint | value |
+//
+// the value is an anypb.Any produced by anyval.Marshal, and revision is the store's revision when it was exported.  The
+// trailer comes last so a dump can be written while an export is streamed.  The checksum covers everything before it.
+const (
+	magic       = "KVDUMP01"
+	trailerSize = 16
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrInvalid is returned when a dump is truncated, or fails its checksum.
+	ErrInvalid = errors.New("dump: invalid dump")
+)
+
+// Writer writes a dump.  Call Finish once every key has been written.
+type Writer struct {
+	w     io.Writer
+	bw    *bufio.Writer
+	sum   hash.Hash32
+	count int64
+	buf   []byte
+}
+
+// NewWriter writes the header of a dump to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	sum := crc32.New(crcTable)
+	dw := &Writer{w: w, bw: bufio.NewWriter(io.MultiWriter(w, sum)), sum: sum}
+	_, err := dw.bw.WriteString(magic)
+	if err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+// Write adds a key and its value.
+func (w *Writer) Write(key string, value interface{}) error {
+	v, err := anyval.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("key [%s]: %w", key, err)
+	}
+
+	w.buf = append(w.buf[:0], 1)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(key)))
+	w.buf = append(w.buf, key...)
+	w.buf = binary.AppendUvarint(w.buf, uint64(proto.Size(v)))
+	w.buf, err = proto.MarshalOptions{}.MarshalAppend(w.buf, v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.bw.Write(w.buf)
+	if err == nil {
+		w.count++
+	}
+	return err
+}
+
+// Count returns the number of keys written so far.
+func (w *Writer) Count() int64 {
+	return w.count
+}
+
+// Finish writes the trailer, with the revision the keys were exported at, and flushes the dump.  It doesn't close the
+// underlying writer.
+func (w *Writer) Finish(revision int64) error {
+	buf := append(w.buf[:0], 0)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(revision))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(w.count))
+	_, err := w.bw.Write(buf)
+	if err == nil {
+		err = w.bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(binary.LittleEndian.AppendUint32(nil, w.sum.Sum32()))
+	return err
+}
+
+// Reader reads a dump.  The trailer is only checked once Next has returned every key, so use Verify to check a whole
+// dump before acting on it.
+type Reader struct {
+	r        *bufio.Reader
+	sum      hash.Hash32
+	count    int64
+	revision int64
+	buf      []byte
+}
+
+// NewReader reads the header of a dump from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	dr := &Reader{r: bufio.NewReader(r), sum: crc32.New(crcTable)}
+	header := make([]byte, len(magic))
+	_, err := io.ReadFull(dr, header)
+	if err != nil || string(header) != magic {
+		return nil, ErrInvalid
+	}
+	return dr, nil
+}
+
+// Next returns the next key and its value.  Once every key has been read and the trailer checked, it returns io.EOF.
+func (r *Reader) Next() (string, interface{}, error) {
+	flag, err := r.ReadByte()
+	if err != nil {
+		return "", nil, ErrInvalid
+	} else if flag == 0 {
+		return "", nil, r.finish()
+	} else if flag != 1 {
+		return "", nil, ErrInvalid
+	}
+
+	r.buf, err = r.readField(r.buf)
+	if err != nil {
+		return "", nil, ErrInvalid
+	}
+	key := string(r.buf)
+
+	r.buf, err = r.readField(r.buf)
+	if err != nil {
+		return "", nil, ErrInvalid
+	}
+	v := &anypb.Any{}
+	err = proto.Unmarshal(r.buf, v)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	value, err := anyval.Unmarshal(v)
+	if err != nil {
+		return "", nil, err
+	}
+
+	r.count++
+	return key, value, nil
+}
+
+// Revision returns the revision the dump was exported at.  It's only known once Next has returned io.EOF.
+func (r *Reader) Revision() int64 {
+	return r.revision
+}
+
+// Count returns the number of keys read so far.
+func (r *Reader) Count() int64 {
+	return r.count
+}
+
+func (r *Reader) finish() error {
+	trailer := make([]byte, trailerSize)
+	_, err := io.ReadFull(r, trailer)
+	if err != nil {
+		return ErrInvalid
+	}
+	expected := r.sum.Sum32()
+
+	// the checksum is read past the hash, since it isn't part of what it covers
+	sum := make([]byte, 4)
+	_, err = io.ReadFull(r.r, sum)
+	if err != nil || binary.LittleEndian.Uint32(sum) != expected {
+		return ErrInvalid
+	}
+	if int64(binary.LittleEndian.Uint64(trailer[8:])) != r.count {
+		return ErrInvalid
+	}
+	r.revision = int64(binary.LittleEndian.Uint64(trailer))
+	return io.EOF
+}
+
+// Read and ReadByte add what they read to the checksum.  The bufio.Reader reads ahead, so the hash can't simply be
+// fed everything read from the underlying reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.sum.Write(p[:n])
+	return n, err
+}
+
+func (r *Reader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.sum.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *Reader) readField(buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return buf, err
+	}
+	buf = slices.Grow(buf[:0], int(size))[:size]
+	_, err = io.ReadFull(r, buf)
+	return buf, err
+}
+
+// Verify reads the whole of a dump, and returns the revision it was exported at and the number of keys in it.
+func Verify(r io.Reader) (int64, int64, error) {
+	dr, err := NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	for {
+		_, _, err = dr.Next()
+		if err == io.EOF {
+			return dr.Revision(), dr.Count(), nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+	}
+}
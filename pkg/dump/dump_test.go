@@ -0,0 +1,81 @@
+package dump
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var values = map[string]interface{}{
+	"string":  "a value",
+	"int64":   int64(42),
+	"float64": 3.5,
+	"bool":    true,
+	"bytes":   []byte{1, 2, 3},
+	"strings": []string{"a", "b"},
+}
+
+func TestRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		err = w.Write(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Finish(17)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revision, count, err := Verify(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	} else if revision != 17 || count != int64(len(values)) {
+		t.Errorf("expected revision [17] and [%d] keys, got [%d] and [%d]", len(values), revision, count)
+	}
+
+	r, err := NewReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(map[string]interface{})
+	for {
+		key, value, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		read[key] = value
+	}
+	if !reflect.DeepEqual(values, read) {
+		t.Errorf("expected %v, got %v", values, read)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	var b bytes.Buffer
+	w, _ := NewWriter(&b)
+	w.Write("key", "value")
+	w.Finish(1)
+	dump := b.Bytes()
+
+	corrupt := bytes.Clone(dump)
+	corrupt[len(magic)+3] ^= 0xff
+	for name, d := range map[string][]byte{
+		"truncated": dump[:len(dump)-1],
+		"corrupt":   corrupt,
+		"empty":     nil,
+	} {
+		if _, _, err := Verify(bytes.NewReader(d)); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected %v, got %v", name, ErrInvalid, err)
+		}
+	}
+}
@@ -1,15 +1,46 @@
 package rest
 
+import "time"
+
+// PutRequest stores value at key.  When PrevValue is set, the value is only stored if the current value is equal to it.
+// When TTL is set, the key expires after that many seconds.  When Lease is set, the key is deleted along with the lease.
 type PutRequest struct {
-	Key   string      `json:"key"`
-	Value interface{} `json:"value"`
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	PrevValue interface{} `json:"prevValue,omitempty"`
+	TTL       int64       `json:"ttl,omitempty"`
+	Lease     int64       `json:"lease,omitempty"`
 }
 
 type GetResponse struct {
+	Key            string      `json:"key"`
+	Value          interface{} `json:"value"`
+	CreateRevision int64       `json:"createRevision"`
+	ModRevision    int64       `json:"modRevision"`
+	Version        int64       `json:"version"`
+	Revision       int64       `json:"revision"`
+	Staleness      *Staleness  `json:"staleness,omitempty"`
+}
+
+// Staleness is how far behind a sequential or stale read may be.  Entries is how many writes the node knew were
+// committed but hadn't applied, and SinceMillis how long ago it last heard from the leader.
+type Staleness struct {
+	Entries     uint64 `json:"entries"`
+	SinceMillis int64  `json:"sinceMillis"`
+}
+
+type KeyValue struct {
 	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
 }
 
+type RangeResponse struct {
+	KVs       []KeyValue `json:"kvs"`
+	Continue  string     `json:"continue,omitempty"`
+	Revision  int64      `json:"revision"`
+	Staleness *Staleness `json:"staleness,omitempty"`
+}
+
 type GetRequest struct {
 	Key string `json:"key"`
 }
@@ -17,3 +48,219 @@ type GetRequest struct {
 type DeleteRequest struct {
 	Key string `json:"key"`
 }
+
+// Compare is a condition of a transaction.  Type is "absent", "value" or "revision", which compare against Value and
+// Revision respectively.
+type Compare struct {
+	Key      string      `json:"key"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value,omitempty"`
+	Revision int64       `json:"revision,omitempty"`
+}
+
+// TxnOp is an op in a transaction.  Op is "get", "put" or "delete".
+type TxnOp struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type TxnRequest struct {
+	Compares []Compare `json:"compares"`
+	Then     []TxnOp   `json:"then"`
+	Else     []TxnOp   `json:"else"`
+}
+
+type TxnOpResult struct {
+	Found          bool        `json:"found"`
+	Value          interface{} `json:"value,omitempty"`
+	CreateRevision int64       `json:"createRevision,omitempty"`
+	ModRevision    int64       `json:"modRevision,omitempty"`
+	Version        int64       `json:"version,omitempty"`
+}
+
+type TxnResponse struct {
+	Succeeded bool          `json:"succeeded"`
+	Results   []TxnOpResult `json:"results"`
+	Revision  int64         `json:"revision"`
+}
+
+// BulkRequest applies Op, which is "get", "put" or "delete", to every item.  Gets and deletes only use the items' keys.
+// When Atomic is set, either every item is applied, or none are.
+type BulkRequest struct {
+	Op     string     `json:"op"`
+	Atomic bool       `json:"atomic,omitempty"`
+	Items  []KeyValue `json:"items"`
+}
+
+// BulkResult is the outcome of one item, in the order of the request.  Status is the HTTP status the item would have
+// had on its own, and Error is set when it failed.  Otherwise, a get has the key's entry, and a put has the new entry
+// without its value.
+type BulkResult struct {
+	Key            string         `json:"key"`
+	Status         int            `json:"status"`
+	Error          *ErrorResponse `json:"error,omitempty"`
+	Value          interface{}    `json:"value,omitempty"`
+	CreateRevision int64          `json:"createRevision,omitempty"`
+	ModRevision    int64          `json:"modRevision,omitempty"`
+	Version        int64          `json:"version,omitempty"`
+}
+
+type BulkResponse struct {
+	Results []BulkResult `json:"results"`
+}
+
+// MergeRequest changes the CRDT at Key.  Op is "increment", which adds Delta to a counter, "add" or "remove", which add
+// or remove Elements of a set, or "set", which sets a last writer wins register to Value.
+type MergeRequest struct {
+	Key      string      `json:"key"`
+	Op       string      `json:"op"`
+	Delta    int64       `json:"delta,omitempty"`
+	Elements []string    `json:"elements,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// MergeResponse has the key's value after the change: a counter's count, a set's elements, or a register's value.
+type MergeResponse struct {
+	Value    interface{} `json:"value"`
+	Revision int64       `json:"revision"`
+}
+
+// MutateRequest changes the value at Key atomically.  Op is "increment" or "decrement", which add or subtract
+// Operand, a number which is 1 when it's missing, "append", which appends Operand to a string or a list, "pushFront" or
+// "pushBack", which add Operand to either end of a list, or "popFront" or "popBack", which remove an element.
+type MutateRequest struct {
+	Key     string      `json:"key"`
+	Op      string      `json:"op"`
+	Operand interface{} `json:"operand,omitempty"`
+}
+
+// MutateResponse has the key's value after the change, and the element removed by a pop.
+type MutateResponse struct {
+	Value    interface{} `json:"value"`
+	Popped   interface{} `json:"popped,omitempty"`
+	Revision int64       `json:"revision"`
+}
+
+type CompactRequest struct {
+	Revision int64 `json:"revision"`
+}
+
+// LeaseGrantRequest creates a lease which expires after TTL seconds unless it's kept alive.
+type LeaseGrantRequest struct {
+	TTL int64 `json:"ttl"`
+}
+
+type LeaseResponse struct {
+	ID  int64 `json:"id"`
+	TTL int64 `json:"ttl"`
+}
+
+type LeaseTimeToLiveResponse struct {
+	ID        int64    `json:"id"`
+	TTL       int64    `json:"ttl"`
+	Remaining int64    `json:"remaining"`
+	Keys      []string `json:"keys"`
+}
+
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Index   uint64    `json:"index"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type ListSnapshotsResponse struct {
+	Snapshots []SnapshotInfo `json:"snapshots"`
+}
+
+// ClusterMember is a member of a replicated cluster.  Match and Lag are only known when the leader answers.
+type ClusterMember struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Role    string `json:"role"`
+	Match   uint64 `json:"match"`
+	Lag     uint64 `json:"lag"`
+}
+
+// ClusterResponse is the cluster as seen by the node ID which answered.
+type ClusterResponse struct {
+	ID      string          `json:"id"`
+	Leader  string          `json:"leader"`
+	Term    uint64          `json:"term"`
+	Commit  uint64          `json:"commit"`
+	Applied uint64          `json:"applied"`
+	Members []ClusterMember `json:"members"`
+}
+
+// MemberRequest names a member to add, or to transfer leadership to.  Only an added member needs its Address, which is
+// its gRPC address.
+type MemberRequest struct {
+	ID      string `json:"id"`
+	Address string `json:"address,omitempty"`
+}
+
+// BucketStats describes one of a server's buckets.
+type BucketStats struct {
+	Keys int    `json:"keys"`
+	Ops  uint64 `json:"ops"`
+}
+
+// BucketsResponse describes how a server's keys are spread across its buckets.  Skew is the most keys in any bucket
+// divided by the mean.  While Resizing, keys are moving to Target buckets.
+type BucketsResponse struct {
+	Buckets  []BucketStats `json:"buckets"`
+	Skew     float64       `json:"skew"`
+	Resizing bool          `json:"resizing"`
+	Target   int           `json:"target"`
+}
+
+// ResizeRequest sets the number of buckets a server divides its keys between.
+type ResizeRequest struct {
+	Buckets int `json:"buckets"`
+}
+
+// Shard is one server of a sharded store, owning the hash slots where Start <= slot < End.  Address is its gRPC
+// address, and HTTPAddress its REST address.
+type Shard struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`
+	HTTPAddress string `json:"httpAddress,omitempty"`
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+}
+
+// ShardMapResponse assigns every hash slot of a sharded store to a shard.
+type ShardMapResponse struct {
+	Version int64   `json:"version"`
+	Slots   int     `json:"slots"`
+	Shards  []Shard `json:"shards"`
+}
+
+// The codes of an ErrorResponse.  They're also the reason given in the ErrorInfo details of gRPC errors, in
+// ErrorDomain.
+const (
+	CodeNotFound           = "not_found"
+	CodePreconditionFailed = "precondition_failed"
+	CodeTooLarge           = "too_large"
+	CodeUnavailable        = "unavailable"
+	CodeInvalid            = "invalid"
+	CodeCompacted          = "compacted"
+	CodeUnsupported        = "unsupported"
+	CodeMoved              = "moved"
+	CodeReadOnly           = "read_only"
+	CodeTypeMismatch       = "type_mismatch"
+	CodeInternal           = "internal"
+)
+
+// ErrorDomain is the domain of the ErrorInfo details of gRPC errors.
+const ErrorDomain = "kv"
+
+// ErrorResponse is the body of every response with an error status.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// Owner is the shard a key belongs to, when the code is CodeMoved.
+	Owner *Shard `json:"owner,omitempty"`
+}
@@ -0,0 +1,22 @@
+// Package slot hashes keys to the slots the keyspace of a sharded store is divided into.  Servers and clients share it,
+// so a client sends each key to the shard which owns it.
+package slot
+
+import (
+	"hash/crc32"
+	"strings"
+)
+
+// Count is the number of hash slots the keyspace is divided into.
+const Count = 1024
+
+// Of returns the slot key hashes to.  When key contains a hash tag, a non-empty part between the first { and the next
+// }, only the tag is hashed, so keys sharing a tag are kept together and can be used in one transaction.
+func Of(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc32.ChecksumIEEE([]byte(key)) % Count)
+}
@@ -0,0 +1,17 @@
+package slot
+
+import "testing"
+
+func TestHashTag(t *testing.T) {
+	if Of("{user1}.name") != Of("{user1}.email") || Of("{user1}.name") != Of("user1") {
+		t.Error("expected keys sharing a hash tag to share a slot")
+	}
+	if Of("{}.name") == Of("") {
+		t.Error("expected an empty hash tag to be ignored")
+	}
+	for _, key := range []string{"", "a", "{a", "a}", "{user1}.name"} {
+		if s := Of(key); s < 0 || s >= Count {
+			t.Errorf("expected [%s] to hash to a slot below %d, got %d", key, Count, s)
+		}
+	}
+}
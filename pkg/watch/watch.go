@@ -5,18 +5,35 @@ import (
 	"kv/internal/gen"
 )
 
+// RevisionHeader is the gRPC header with the store's revision when a watch started.
+const RevisionHeader = "kv-revision"
+
 type Operation int
 
 const (
 	All Operation = iota + 1
 	Put
 	Delete
+
+	// Expire is sent when a key is removed because its TTL elapsed.
+	Expire
 )
 
 type Update struct {
 	Op    Operation   `json:"op"`
 	Key   string      `json:"key"`
 	Value interface{} `json:"value,omitempty"`
+
+	// Revision is the revision of the write which made the update.
+	Revision int64 `json:"revision"`
+
+	// Last is set on the last update a watch is sent for a write.  A write can update several watched keys.
+	Last bool `json:"last,omitempty"`
+
+	// Err is set on the last update sent before the channel of a watch which can't continue is closed, saying why, such
+	// as ErrSlowConsumer, or ErrCompacted from a client whose updates needed to resume are no longer kept.  None of the
+	// other fields are set with it.
+	Err error `json:"-"`
 }
 
 func OperationFromString(name string) (op Operation, err error) {
@@ -25,6 +42,8 @@ func OperationFromString(name string) (op Operation, err error) {
 		op = Put
 	case "delete":
 		op = Delete
+	case "expire":
+		op = Expire
 	case "all":
 		op = All
 	default:
@@ -40,6 +59,8 @@ func OperationFrom(optype gen.OpType) Operation {
 		o = Put
 	case gen.OpType_DELETE:
 		o = Delete
+	case gen.OpType_EXPIRE:
+		o = Expire
 	default:
 		panic("unknown gen.OpType type")
 	}
@@ -53,6 +74,8 @@ func (o Operation) Convert() gen.OpType {
 		optype = gen.OpType_PUT
 	case Delete:
 		optype = gen.OpType_DELETE
+	case Expire:
+		optype = gen.OpType_EXPIRE
 	case All:
 		optype = gen.OpType_ALL
 	default:
@@ -61,7 +84,30 @@ func (o Operation) Convert() gen.OpType {
 	return optype
 }
 
+// ErrInvalidRequest is returned for a watch with both a prefix and an end, an end which isn't after its key, or a
+// negative revision.
+var ErrInvalidRequest = errors.New("invalid watch request")
+
+// ErrSlowConsumer is returned when a watch is disconnected because it fell too far behind.  It can resume from the
+// last update it received.
+var ErrSlowConsumer = errors.New("watch disconnected, too far behind")
+
+// ErrClosed is returned when a watch is ended because the store's contents were replaced, like from a snapshot.
+var ErrClosed = errors.New("watch closed, the store's contents were replaced")
+
+// WatchRequest watches Key, or every key beginning with Key when Prefix is set, or every key where Key <= k < End when
+// End is set.  When Revision is set, the updates made at or after it are sent first, then live updates.
 type WatchRequest struct {
 	Key       string    `json:"key"`
 	WatchType Operation `json:"watchType"`
+	End       string    `json:"end,omitempty"`
+	Prefix    bool      `json:"prefix,omitempty"`
+	Revision  int64     `json:"revision,omitempty"`
+}
+
+func (r WatchRequest) Validate() error {
+	if r.Revision < 0 || len(r.End) != 0 && (r.Prefix || r.End <= r.Key) {
+		return ErrInvalidRequest
+	}
+	return nil
 }